@@ -0,0 +1,276 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maxOutboxItems is how many activities the outbox keeps, newest first.
+const maxOutboxItems = 100
+
+// maxSummary is how long the text of a post in the outbox may be.
+const maxSummary = 500
+
+const (
+	activityStreams = "https://www.w3.org/ns/activitystreams"
+	securityContext = "https://w3id.org/security/v1"
+	publicAudience  = activityStreams + "#Public"
+)
+
+// reMarkdownImage matches an image in Markdown, which the summary of a
+// post leaves out.
+var reMarkdownImage = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+
+// apObject is a post as ActivityPub sees it.
+type apObject struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	Name         string   `json:"name,omitempty"`
+	Content      string   `json:"content"`
+	URL          string   `json:"url"`
+	AttributedTo string   `json:"attributedTo"`
+	Published    string   `json:"published"`
+	To           []string `json:"to"`
+}
+
+// apActivity is the Create activity that announces a post.
+type apActivity struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Actor     string   `json:"actor"`
+	Published string   `json:"published"`
+	To        []string `json:"to"`
+	Object    apObject `json:"object"`
+}
+
+// apOutbox is the outbox document.
+type apOutbox struct {
+	Context      string       `json:"@context"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	TotalItems   int          `json:"totalItems"`
+	OrderedItems []apActivity `json:"orderedItems"`
+}
+
+// Federate adds the posts written by a run to the ActivityPub outbox in
+// ActivityPubDir and writes the actor document next to it, so a static
+// site can be followed when a simple ActivityPub server or bridge serves
+// the files and delivers the activities. A post that is written again
+// replaces its old activity. Nothing is done unless ActivityPubDir is set.
+func (m *Mailpost) Federate(posts []Post) {
+	if m.config.ActivityPubDir == "" || len(posts) == 0 {
+		return
+	}
+	if err := os.MkdirAll(m.config.ActivityPubDir, 0755); err != nil {
+		log.Printf("Couldn't make ActivityPubDir: %s", err)
+		return
+	}
+
+	actor := m.apURL("actor.json")
+	outbox := apOutbox{Context: activityStreams, ID: m.apURL("outbox.json"), Type: "OrderedCollection"}
+	outboxPath := filepath.Join(m.config.ActivityPubDir, "outbox.json")
+	if data, err := ioutil.ReadFile(outboxPath); err == nil {
+		if err := json.Unmarshal(data, &outbox); err != nil {
+			log.Printf("Couldn't read the ActivityPub outbox, starting a new one: %s", err)
+		}
+	}
+
+	var items []apActivity
+	replaced := make(map[string]bool)
+	for i := len(posts) - 1; i >= 0; i-- {
+		activity := m.apActivity(posts[i], actor)
+		items = append(items, activity)
+		replaced[activity.ID] = true
+	}
+	for _, item := range outbox.OrderedItems {
+		if !replaced[item.ID] {
+			items = append(items, item)
+		}
+	}
+	if len(items) > maxOutboxItems {
+		items = items[:maxOutboxItems]
+	}
+	outbox.OrderedItems = items
+	outbox.TotalItems = len(items)
+
+	if err := writeJSON(outboxPath, outbox); err != nil {
+		log.Printf("Couldn't write the ActivityPub outbox: %s", err)
+		return
+	}
+	if err := m.writeActor(actor); err != nil {
+		log.Printf("Couldn't write the ActivityPub actor: %s", err)
+	}
+	log.Printf("   |-- Added %d posts to the ActivityPub outbox", len(posts))
+}
+
+// apURL returns the address of a file in ActivityPubDir.
+func (m *Mailpost) apURL(name string) string {
+	base := m.config.ActivityPubURL
+	if base == "" {
+		base = m.config.BaseURL
+	}
+	return strings.TrimRight(base, "/") + "/" + name
+}
+
+// apActivity makes the Create activity for a post: an Article with its
+// title, or a Note if it has none, with the start of its text.
+func (m *Mailpost) apActivity(postInfo Post, actor string) apActivity {
+	postURL := m.PostURL(postInfo)
+	published := time.Now()
+	if t, ok := ParsePostDate(postInfo.Date, m.siteTime); ok {
+		published = t
+	}
+	date := published.UTC().Format(time.RFC3339)
+
+	object := apObject{
+		ID:           postURL,
+		Type:         "Note",
+		URL:          postURL,
+		AttributedTo: actor,
+		Published:    date,
+		To:           []string{publicAudience},
+	}
+	summary := postSummary(postInfo.Data)
+	if postInfo.Title != "" {
+		object.Type = "Article"
+		object.Name = postInfo.Title
+	}
+	object.Content = fmt.Sprintf(`<p>%s</p><p><a href="%s">%s</a></p>`,
+		html.EscapeString(summary), html.EscapeString(postURL), html.EscapeString(postURL))
+
+	return apActivity{
+		ID:        postURL + "#create",
+		Type:      "Create",
+		Actor:     actor,
+		Published: date,
+		To:        []string{publicAudience},
+		Object:    object,
+	}
+}
+
+// postSummary returns the summary or description in a post's frontmatter,
+// or else the first paragraph of its text, without images.
+func postSummary(post string) string {
+	frontmatter, body, _ := SplitFrontmatter(post)
+	var fields struct {
+		Summary     string `yaml:"summary"`
+		Description string `yaml:"description"`
+	}
+	yaml.Unmarshal([]byte(frontmatter), &fields)
+
+	summary := fields.Summary
+	if summary == "" {
+		summary = fields.Description
+	}
+	if summary == "" {
+		for _, paragraph := range strings.Split(strings.Replace(body, "\r\n", "\n", -1), "\n\n") {
+			paragraph = strings.TrimSpace(reMarkdownImage.ReplaceAllString(paragraph, ""))
+			if paragraph != "" {
+				summary = paragraph
+				break
+			}
+		}
+	}
+	summary = strings.Join(strings.Fields(summary), " ")
+	if runes := []rune(summary); len(runes) > maxSummary {
+		summary = string(runes[:maxSummary-1]) + "…"
+	}
+	return summary
+}
+
+// writeActor writes the actor document, and the WebFinger document that
+// points at it, which the site has to serve at
+// /.well-known/webfinger?resource=acct:user@host.
+func (m *Mailpost) writeActor(actor string) error {
+	user := m.config.ActivityPubUser
+	if user == "" {
+		user = "blog"
+	}
+	doc := map[string]interface{}{
+		"@context":          []string{activityStreams, securityContext},
+		"id":                actor,
+		"type":              "Person",
+		"preferredUsername": user,
+		"name":              m.config.ActivityPubName,
+		"summary":           m.config.ActivityPubSummary,
+		"url":               m.config.BaseURL,
+		"outbox":            m.apURL("outbox.json"),
+	}
+	if m.config.ActivityPubInbox != "" {
+		doc["inbox"] = m.config.ActivityPubInbox
+	}
+	if m.config.ActivityPubKeyFile != "" {
+		pem, err := ioutil.ReadFile(m.config.ActivityPubKeyFile)
+		if err != nil {
+			return err
+		}
+		doc["publicKey"] = map[string]string{
+			"id":           actor + "#main-key",
+			"owner":        actor,
+			"publicKeyPem": string(pem),
+		}
+	}
+	if err := writeJSON(filepath.Join(m.config.ActivityPubDir, "actor.json"), doc); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(m.config.BaseURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	webfinger := map[string]interface{}{
+		"subject": "acct:" + user + "@" + u.Hostname(),
+		"links": []map[string]string{
+			{"rel": "self", "type": "application/activity+json", "href": actor},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": m.config.BaseURL},
+		},
+	}
+	return writeJSON(filepath.Join(m.config.ActivityPubDir, "webfinger.json"), webfinger)
+}
+
+// writeJSON writes v to path as indented JSON.
+func writeJSON(path string, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return replaceFile(path, buf.Bytes())
+}
+
+// replaceFile writes data to path through a temporary file, so a server
+// never sees half of it.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
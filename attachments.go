@@ -0,0 +1,142 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// An Attachment is a file attached to a message that isn't an image but
+// is of one of the AttachmentTypes, such as a PDF or an MP3. It is saved
+// as it is under AttachmentDir and linked from the post.
+type Attachment struct {
+	OrigName    string
+	Name        string
+	Path        string
+	URL         string
+	Data        []byte
+	ContentType string
+	Msg         int
+}
+
+// AttachmentAllowed reports whether an attachment that isn't an image
+// should be kept.
+func (m *Mailpost) AttachmentAllowed(contentType string) bool {
+	return len(m.config.AttachmentTypes) > 0 && m.TypeAllowed(m.config.AttachmentTypes, contentType)
+}
+
+// AttachmentDirs returns the path template attachments are saved under,
+// and the URL path they are found at: AttachmentDir and AttachmentPath,
+// or ImageDir and ImagePath if they aren't set.
+func (c *Config) AttachmentDirs() (dir string, urlPath string) {
+	dir, urlPath = c.AttachmentDir, c.AttachmentPath
+	if dir == "" {
+		dir, urlPath = c.ImageDir, c.ImagePath
+	}
+	return dir, urlPath
+}
+
+// AddAttachment adds a file attached to message msg to the attachments to
+// save.
+func (m *Mailpost) AddAttachment(msg int, a Attachment) {
+	a.Msg = msg
+	a.Name = m.SanitizeFilename(a.OrigName)
+	m.SaveArtifact(msg, "attachments/"+a.Name, a.Data)
+	log.Printf("|-- Attachment: %s (%s)", a.OrigName, a.ContentType)
+	m.attachments = append(m.attachments, a)
+}
+
+// LinkAttachments saves the attachments of a post's message and links
+// them from the post. Links the author made to an attachment by its file
+// name, like [the slides](slides.pdf), are pointed at the saved file; the
+// attachments the post doesn't mention are listed at its end.
+func (m *Mailpost) LinkAttachments(postInfo Post, data string) string {
+	site := m.config.ForPost(postInfo)
+	dir, urlPath := site.AttachmentDirs()
+	var pathData PathParts
+	pathData.Date = m.MakeDatePathPart(postInfo.Date)
+	pathData.Fields = postInfo.Fields
+	attachDir := m.MakePathFromTemplate(dir, pathData)
+	if m.config.PageBundles {
+		attachDir = postInfo.Path
+	}
+
+	var unlinked, texts []string
+	for i := range m.attachments {
+		a := &m.attachments[i]
+		if a.Msg != postInfo.Msg {
+			continue
+		}
+		a.Path = filepath.Join(attachDir, a.Name)
+		a.URL = filepath.Join(site.BaseURL, FillFields(urlPath, pathData.Fields), pathData.Date, a.Name)
+		if m.config.PageBundles {
+			a.URL = a.Name
+		}
+		if err := os.MkdirAll(attachDir, 0755); err != nil {
+			m.Fail(postInfo, "Couldn't make attachment path: %s", err)
+			continue
+		}
+		m.files.Acquire()
+		err := ioutil.WriteFile(a.Path, a.Data, 0644)
+		m.files.Release()
+		if err != nil {
+			m.Fail(postInfo, "Failed to write attachment %s: %s", a.Path, err)
+			continue
+		}
+		log.Printf("   |-- Saved attachment: %s", a.Path)
+		if m.config.AttachmentText != "" {
+			if text, ok := m.ExtractAttachmentText(*a); ok {
+				texts = append(texts, text)
+				if m.config.AttachmentText == textInSidecar {
+					m.saveSidecar(postInfo, a.Path+".txt", text)
+				}
+			}
+		}
+
+		reLink := regexp.MustCompile(`((?:^|[^!])\[[^\]]*\]\(\s*)` + regexp.QuoteMeta(a.OrigName) + `(\s*(?:"[^"]*")?\s*\))`)
+		if reLink.MatchString(data) {
+			data = reLink.ReplaceAllString(data, "${1}"+strings.Replace(a.URL, "$", "$$", -1)+"${2}")
+			continue
+		}
+		unlinked = append(unlinked, "["+a.OrigName+"]("+a.URL+")")
+	}
+
+	if len(unlinked) > 0 {
+		data = strings.TrimRight(data, "\n") + "\n\n" + strings.Join(unlinked, "\n") + "\n"
+	}
+	if len(texts) > 0 && m.config.AttachmentText == textInFrontmatter {
+		data = MergeFrontmatter(data, yaml.MapSlice{{Key: "attachment_text", Value: strings.Join(texts, "\n\n")}})
+	}
+	return data
+}
+
+// saveSidecar writes the text of an attachment next to it, where the
+// site's search indexer can find it.
+func (m *Mailpost) saveSidecar(postInfo Post, path string, text string) {
+	m.files.Acquire()
+	err := ioutil.WriteFile(path, []byte(text+"\n"), 0644)
+	m.files.Release()
+	if err != nil {
+		m.Fail(postInfo, "Failed to write attachment text %s: %s", path, err)
+		return
+	}
+	log.Printf("   |-- Saved attachment text: %s", path)
+}
@@ -0,0 +1,95 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// signatureHeader is the header an author's HMAC can be sent in.
+const signatureHeader = "X-Mailpost-Signature"
+
+// reSignatureLine matches a line of a post that gives the author's HMAC.
+var reSignatureLine = regexp.MustCompile(`(?im)^[ \t]*signature:[ \t]*([0-9a-f]{64})[ \t]*(\r?\n|$)`)
+
+// PostHMAC returns the HMAC-SHA256 of a post with an author's Secret, in
+// hex. The post is taken without its signature line, with CRLF line ends
+// made LF and without the whitespace around it, so that mail clients and
+// scripts come to the same result.
+func PostHMAC(secret, post string) string {
+	post = strings.TrimSpace(strings.Replace(post, "\r\n", "\n", -1))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(post))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckAuthorSignature checks the HMAC of a post from a sender who has a
+// Secret. It is given in an X-Mailpost-Signature header or on a line of
+// its own, "signature: <hex>", which is removed from the post. Posts from
+// senders without a Secret pass as they are.
+func (m *Mailpost) CheckAuthorSignature(post string, fromAddr string) (string, bool) {
+	sender, ok := m.config.Sender(fromAddr)
+	if !ok || sender.Secret == "" {
+		return post, true
+	}
+
+	given := ""
+	if match := reSignatureLine.FindStringSubmatch(post); match != nil {
+		given = match[1]
+		post = reSignatureLine.ReplaceAllString(post, "")
+	} else if m.msgHeader != nil {
+		given = strings.TrimSpace(m.msgHeader.Get(signatureHeader))
+	}
+	if given == "" {
+		log.Printf("No signature from %s, who has a Secret", fromAddr)
+		return post, false
+	}
+
+	want := PostHMAC(sender.Secret, post)
+	if !hmac.Equal([]byte(strings.ToLower(given)), []byte(want)) {
+		log.Printf("Signature from %s doesn't match the post", fromAddr)
+		return post, false
+	}
+	return post, true
+}
+
+// Sign prints the signature line for a post read from stdin, for scripts
+// and mail client macros to add to it.
+func (m *Mailpost) Sign(args []string) int {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	from := flags.String("from", "", "Sign with the Secret of this sender.")
+	flags.Parse(args)
+
+	sender, ok := m.config.Sender(*from)
+	if !ok || sender.Secret == "" {
+		log.Printf("Sender %q has no Secret", *from)
+		return 1
+	}
+	post, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Printf("Couldn't read the post: %s", err)
+		return 1
+	}
+	fmt.Printf("signature: %s\n", PostHMAC(sender.Secret, string(post)))
+	return 0
+}
@@ -0,0 +1,118 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultPostType is the type of posts made with AutoFrontmatter when
+// neither DefaultType nor the sender's Type says otherwise.
+const defaultPostType = "post"
+
+// SynthesizeFrontmatter gives a post without frontmatter some made from
+// its message, when AutoFrontmatter is set: the title from the subject,
+// the author from the From header and the type from DefaultType. The
+// date is added later, from the Date header, as it is for any post
+// without one. Posts that start with frontmatter, even a broken one, and
+// the notes that forwarded posts come with are left alone.
+func (m *Mailpost) SynthesizeFrontmatter(post string) string {
+	if !m.config.AutoFrontmatter || m.msgHeader == nil || m.msgForwards {
+		return post
+	}
+	if _, _, ok := SplitFrontmatter(post); ok || strings.HasPrefix(strings.TrimSpace(post), "---") {
+		return post
+	}
+
+	sender, _ := m.config.Sender(m.msgFrom)
+	var fields yaml.MapSlice
+	if title, _ := ParseSubject(DecodeHeader(m.msgHeader.Get("Subject"))); title != "" {
+		fields = append(fields, yaml.MapItem{Key: "title", Value: title})
+	}
+	author := sender.Author
+	if author == "" {
+		author = m.fromName()
+	}
+	if author != "" {
+		fields = append(fields, yaml.MapItem{Key: "author", Value: author})
+	}
+	postType := sender.Type
+	if postType == "" {
+		postType = m.config.DefaultType
+	}
+	if postType == "" {
+		postType = defaultPostType
+	}
+	fields = append(fields, yaml.MapItem{Key: "type", Value: postType})
+
+	frontmatter, err := MarshalFrontmatter(fields)
+	if err != nil {
+		log.Printf("Couldn't make frontmatter: %s", err)
+		return post
+	}
+	log.Printf("|-- No frontmatter, made it from the message")
+	return JoinFrontmatter(frontmatter, strings.TrimLeft(post, "\r\n"))
+}
+
+// fromName returns the display name in the message's From header, or the
+// address if there is none.
+func (m *Mailpost) fromName() string {
+	parser := mail.AddressParser{WordDecoder: headerDecoder}
+	addr, err := parser.Parse(m.msgHeader.Get("From"))
+	if err != nil {
+		return m.msgFrom
+	}
+	if addr.Name != "" {
+		return addr.Name
+	}
+	return addr.Address
+}
+
+// HasForwarded reports whether a message body has another message
+// attached to it, somewhere among its parts.
+func (m *Mailpost) HasForwarded(header mail.Header, body []byte) bool {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if m.HasMessage(contentType) {
+		return true
+	}
+	if !m.HasMultipart(contentType) {
+		return false
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return false
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return false
+		}
+		if m.HasForwarded(mail.Header(p.Header), data) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+var reAutoSubject = regexp.MustCompile(`(?i)^\s*(auto(matic)?[ -]?(reply|response|antwort)|auto:|out of (the )?office|vacation|away from|abwesenheit|r[ée]ponse automatique|undeliverable|delivery status notification|mail delivery (failed|failure))`)
+
+var reAutoSender = regexp.MustCompile(`(?i)^(mailer-daemon|postmaster|no-?reply|do-?not-?reply)@`)
+
+// autoReplyHeaders are set by common vacation and auto-responder programs.
+var autoReplyHeaders = []string{
+	"X-Autoreply", "X-Autorespond", "X-Autoresponder", "X-Auto-Reply",
+}
+
+// IsAutomated reports whether a message was sent by a program rather than
+// a person: auto-replies, out of office notices, bounces and bulk mail.
+// Such messages are never posted, and nothing may ever be sent in reply to
+// them, since that is how mail loops with auto-responders start. The
+// reason is returned for logging.
+func (m *Mailpost) IsAutomated(msg *mail.Message, fromAddr string) (bool, string) {
+	header := msg.Header
+
+	// RFC 3834
+	if auto := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); auto != "" && auto != "no" {
+		return true, "Auto-Submitted: " + auto
+	}
+
+	switch precedence := strings.ToLower(strings.TrimSpace(header.Get("Precedence"))); precedence {
+	case "bulk", "junk", "list", "auto_reply":
+		return true, "Precedence: " + precedence
+	}
+
+	for _, name := range autoReplyHeaders {
+		if header.Get(name) != "" {
+			return true, name
+		}
+	}
+
+	// RFC 6522 reports: bounces (delivery status notifications), read
+	// receipts (disposition notifications) and the like
+	if contentType, params, _ := mime.ParseMediaType(header.Get("Content-Type")); m.IsReport(contentType) {
+		if reportType := params["report-type"]; reportType != "" {
+			return true, contentType + "; report-type=" + reportType
+		}
+		return true, contentType
+	}
+
+	// bounces are sent with a null return path
+	if strings.TrimSpace(header.Get("Return-Path")) == "<>" {
+		return true, "null Return-Path"
+	}
+
+	if reAutoSender.MatchString(fromAddr) {
+		return true, "sender " + fromAddr
+	}
+
+	if subject := m.DecodeSubject(msg); reAutoSubject.MatchString(subject) {
+		return true, "subject " + subject
+	}
+
+	return false, ""
+}
+
+// IsReport reports whether a message or part is a delivery or read report
+// rather than something a person wrote.
+func (m *Mailpost) IsReport(contentType string) bool {
+	switch contentType {
+	case "multipart/report", "message/delivery-status", "message/global-delivery-status",
+		"message/disposition-notification", "message/global-disposition-notification":
+		return true
+	}
+	return false
+}
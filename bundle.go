@@ -0,0 +1,45 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// bundleIndex is the name of a page bundle's post, without its extension.
+const bundleIndex = "index"
+
+// BundlePath turns the directory and file name of a post into those of a
+// Hugo leaf bundle: a directory named after the post, with the post in it
+// as index.md, so content/posts/my-post.md becomes
+// content/posts/my-post/index.md.
+func BundlePath(dir, file string) (string, string) {
+	ext := filepath.Ext(file)
+	return filepath.Join(dir, strings.TrimSuffix(file, ext)), bundleIndex + ext
+}
+
+// InBundle reports whether a post is the index.md of a page bundle.
+func InBundle(postInfo Post) bool {
+	return strings.TrimSuffix(postInfo.File, filepath.Ext(postInfo.File)) == bundleIndex
+}
+
+// PostSlug returns the name a post is published under: the name of its
+// file without the extension, or of its bundle's directory.
+func PostSlug(postInfo Post) string {
+	if InBundle(postInfo) {
+		return filepath.Base(postInfo.Path)
+	}
+	return strings.TrimSuffix(postInfo.File, filepath.Ext(postInfo.File))
+}
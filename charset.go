@@ -0,0 +1,61 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func init() {
+	headerDecoder.CharsetReader = CharsetReader
+}
+
+// CharsetReader returns a reader that converts text in charset read from r
+// to UTF-8. Charset names are looked up the way browsers do, so the common
+// mislabellings of mail clients, like ISO-8859-1 text containing Windows
+// quotes, come out right.
+func CharsetReader(charset string, r io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(r), nil
+}
+
+// ToUTF8 converts the text of a part in charset to UTF-8. Text that is
+// already UTF-8 or ASCII is returned as it is, and so is text in a charset
+// that isn't known, after logging it.
+func ToUTF8(text, charset string) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return text
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		log.Printf("Unknown charset %q, leaving the text as it is", charset)
+		return text
+	}
+	converted, err := enc.NewDecoder().String(text)
+	if err != nil {
+		log.Printf("Couldn't convert text from %s: %s", charset, err)
+		return text
+	}
+	return converted
+}
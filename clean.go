@@ -0,0 +1,91 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// reReplyMarker matches the line mail clients put above the message being
+// replied to. Everything from it on is the earlier conversation.
+var reReplyMarker = regexp.MustCompile(`(?i)^\s*(on\b.{4,200}\bwrote:|-{2,}\s*original message\s*-{2,}|_{10,})\s*$`)
+
+// reMobileFooter matches the lines phones and webmail add to the end of
+// every message.
+var reMobileFooter = regexp.MustCompile(`(?i)^\s*(sent from my \w+.*|sent from (yahoo mail|mail for windows|outlook|aol mobile mail|proton ?mail).*|sent (with|via) (proton ?mail|blackberry|superhuman).*|get outlook for (ios|android).*)\s*$`)
+
+// ParseStripPatterns compiles the StripPatterns config values.
+func (m *Mailpost) ParseStripPatterns() error {
+	for _, pattern := range m.config.StripPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid StripPatterns entry %q: %s", pattern, err)
+		}
+		m.stripRes = append(m.stripRes, re)
+	}
+	return nil
+}
+
+// CleanBody removes what mail clients add to a message but shouldn't be
+// published from the body of a post. With CleanBody set, that is the
+// signature (from a "-- " line on), the quoted message being replied to
+// (from an "On ... wrote:" or "Original Message" line on) and footers
+// such as "Sent from my iPhone" at the end. Then whatever matches
+// StripPatterns is removed. Code blocks are left alone.
+func (m *Mailpost) CleanBody(post string) string {
+	if !m.config.CleanBody && len(m.stripRes) == 0 {
+		return post
+	}
+	frontmatter, body, hasFrontmatter := SplitFrontmatter(post)
+	body, unmask := MaskCode(body)
+
+	if m.config.CleanBody {
+		body = stripReplyAndSignature(body)
+	}
+	for _, re := range m.stripRes {
+		body = re.ReplaceAllString(body, "")
+	}
+
+	body = unmask(body)
+	if !hasFrontmatter {
+		return body
+	}
+	return JoinFrontmatter(frontmatter, body)
+}
+
+// stripReplyAndSignature cuts a body off at its signature or the message
+// it replies to, whichever comes first, and drops the footers left at the
+// end.
+func stripReplyAndSignature(body string) string {
+	lines := strings.SplitAfter(body, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t\r\n")
+		if trimmed == "--" || reReplyMarker.MatchString(trimmed) {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	end := len(lines)
+	for end > 0 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !reMobileFooter.MatchString(line) {
+			break
+		}
+		end--
+	}
+	return strings.Join(lines[:end], "")
+}
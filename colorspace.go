@@ -0,0 +1,42 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// toRGB8 converts the images scanners like to send, CMYK JPEGs and PNGs
+// with 16 bits per channel, to 8-bit RGB (or gray) before they are
+// resized and encoded. The resizer keeps 16-bit images 16-bit and goes
+// through every pixel of CMYK ones the slow way, and both come out of
+// it less predictably than plain 8-bit images. Other images are returned
+// as they are.
+func toRGB8(img image.Image) image.Image {
+	bounds := img.Bounds()
+	var dst draw.Image
+	switch img.(type) {
+	case *image.CMYK, *image.RGBA64:
+		dst = image.NewRGBA(bounds)
+	case *image.NRGBA64:
+		dst = image.NewNRGBA(bounds)
+	case *image.Gray16:
+		dst = image.NewGray(bounds)
+	default:
+		return img
+	}
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	return dst
+}
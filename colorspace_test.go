@@ -0,0 +1,153 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestToRGB8(t *testing.T) {
+	bounds := image.Rect(2, 3, 4, 5)
+
+	cmyk := image.NewCMYK(bounds)
+	cmyk.SetCMYK(2, 3, color.CMYK{200, 120, 0, 20})
+	cmyk.SetCMYK(3, 3, color.CMYK{0, 0, 0, 0})
+	cmyk.SetCMYK(2, 4, color.CMYK{0, 0, 0, 255})
+	cmyk.SetCMYK(3, 4, color.CMYK{0, 255, 255, 0})
+
+	rgba64 := image.NewRGBA64(bounds)
+	rgba64.SetRGBA64(2, 3, color.RGBA64{0x40ff, 0x8000, 0xc0c0, 0xffff})
+	rgba64.SetRGBA64(3, 3, color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+	rgba64.SetRGBA64(2, 4, color.RGBA64{0x8080, 0, 0, 0x8080})
+
+	nrgba64 := image.NewNRGBA64(bounds)
+	nrgba64.SetNRGBA64(2, 3, color.NRGBA64{0xffff, 0x8080, 0, 0x8080})
+	nrgba64.SetNRGBA64(3, 3, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xffff})
+
+	gray16 := image.NewGray16(bounds)
+	gray16.SetGray16(2, 3, color.Gray16{0x8080})
+	gray16.SetGray16(3, 3, color.Gray16{0xffff})
+
+	tests := []struct {
+		name   string
+		img    image.Image
+		pixels map[image.Point]color.Color
+	}{
+		{"cmyk", cmyk, map[image.Point]color.Color{
+			{2, 3}: color.RGBA{50, 124, 235, 0xff},
+			{3, 3}: color.RGBA{0xff, 0xff, 0xff, 0xff},
+			{2, 4}: color.RGBA{0, 0, 0, 0xff},
+			{3, 4}: color.RGBA{0xff, 0, 0, 0xff},
+		}},
+		{"rgba64", rgba64, map[image.Point]color.Color{
+			{2, 3}: color.RGBA{0x40, 0x80, 0xc0, 0xff},
+			{3, 3}: color.RGBA{0xff, 0xff, 0xff, 0xff},
+			{2, 4}: color.RGBA{0x80, 0, 0, 0x80},
+			{3, 4}: color.RGBA{0, 0, 0, 0},
+		}},
+		{"nrgba64", nrgba64, map[image.Point]color.Color{
+			{2, 3}: color.NRGBA{0xff, 0x80, 0, 0x80},
+			{3, 3}: color.NRGBA{0x12, 0x56, 0x9a, 0xff},
+		}},
+		{"gray16", gray16, map[image.Point]color.Color{
+			{2, 3}: color.Gray{0x80},
+			{3, 3}: color.Gray{0xff},
+			{2, 4}: color.Gray{0},
+		}},
+	}
+
+	for _, test := range tests {
+		out := toRGB8(test.img)
+		if out.Bounds() != bounds {
+			t.Errorf("%s: bounds are %v, want %v", test.name, out.Bounds(), bounds)
+		}
+		for p, want := range test.pixels {
+			got := out.ColorModel().Convert(out.At(p.X, p.Y))
+			if got != want {
+				t.Errorf("%s: pixel %v is %#v, want %#v", test.name, p, got, want)
+			}
+		}
+		// nothing 16-bit or CMYK is left for the resizer
+		switch out.(type) {
+		case *image.RGBA, *image.NRGBA, *image.Gray:
+		default:
+			t.Errorf("%s: converted to %T", test.name, out)
+		}
+	}
+}
+
+func TestToRGB8LeavesOthers(t *testing.T) {
+	for _, img := range []image.Image{
+		image.NewRGBA(image.Rect(0, 0, 1, 1)),
+		image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+		image.NewGray(image.Rect(0, 0, 1, 1)),
+		image.NewYCbCr(image.Rect(0, 0, 1, 1), image.YCbCrSubsampleRatio420),
+		image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}),
+	} {
+		if out := toRGB8(img); out != img {
+			t.Errorf("%T was converted to %T", img, out)
+		}
+	}
+}
+
+func TestToRGB8Decoded(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		want   color.Color
+	}{
+		{"cmyk.jpg", cmykJPEGFixture(16, 8), "jpeg", color.RGBA{50, 124, 235, 0xff}},
+		{"deep.png", deepPNGFixture(6, 6), "png", color.RGBA{0x40, 0x80, 0xc0, 0xff}},
+		{"gray16.png", gray16PNG(0x4000), "png", color.Gray{0x40}},
+	}
+	for _, test := range tests {
+		img, format, err := image.Decode(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("%s: decoded as %s, want %s", test.name, format, test.format)
+		}
+		out := toRGB8(img)
+		bounds := out.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if got := out.At(x, y); !similarColor(got, test.want) {
+					t.Fatalf("%s: pixel (%d, %d) is %v, want %v", test.name, x, y, got, test.want)
+				}
+			}
+		}
+	}
+}
+
+// gray16PNG makes a 2x2 PNG with 16-bit gray pixels of one value.
+func gray16PNG(value uint16) []byte {
+	img := image.NewGray16(image.Rect(0, 0, 2, 2))
+	for p := range img.Pix {
+		if p%2 == 0 {
+			img.Pix[p] = uint8(value >> 8)
+		} else {
+			img.Pix[p] = uint8(value)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
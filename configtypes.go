@@ -0,0 +1,138 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a length of time in the config, written like "90s", "5m" or
+// "1h30m". A Duration that isn't in the config at all is unset, which is
+// different from "0s".
+type Duration struct {
+	d   time.Duration
+	set bool
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, use something like \"30s\", \"5m\" or \"1h\"", text)
+	}
+	if v < 0 {
+		return fmt.Errorf("invalid duration %q, it can't be negative", text)
+	}
+	*d = Duration{v, true}
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.d.String()), nil
+}
+
+// Or returns the duration, or def if it isn't set.
+func (d Duration) Or(def time.Duration) time.Duration {
+	if !d.set {
+		return def
+	}
+	return d.d
+}
+
+// Size is a number of bytes in the config, written as a plain number or
+// with a unit: "512KB", "25MB" or "1.5GB". Units count in 1024s, and KiB,
+// MiB and GiB are accepted too.
+type Size uint
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	value := strings.ToUpper(strings.TrimSpace(string(text)))
+	unit := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			unit = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, use something like 1048576, \"512KB\" or \"25MB\"", text)
+	}
+	*s = Size(n * unit)
+	return nil
+}
+
+// Validate checks the settings that can't be checked while decoding them,
+// and returns an error naming the first one that is wrong.
+func (c *Config) Validate() error {
+	positive := []struct {
+		name  string
+		value Duration
+	}{
+		{"Interval", c.Interval},
+		{"RetryDelay", c.RetryDelay},
+		{"RetryMaxDelay", c.RetryMaxDelay},
+		{"MessageTimeout", c.MessageTimeout},
+		{"DigestInterval", c.DigestInterval},
+	}
+	for _, setting := range positive {
+		if setting.value.set && setting.value.d <= 0 {
+			return fmt.Errorf("invalid %s: it must be longer than 0s", setting.name)
+		}
+	}
+	if err := c.checkSignaturePolicy(); err != nil {
+		return err
+	}
+	if err := c.checkDomains(); err != nil {
+		return err
+	}
+	if err := c.checkAttachmentText(); err != nil {
+		return err
+	}
+	if err := c.checkFrontmatterFormat(); err != nil {
+		return err
+	}
+	if err := c.checkProvenance(); err != nil {
+		return err
+	}
+	if err := c.checkSiteGenerator(); err != nil {
+		return err
+	}
+	if err := c.checkExifFrontmatter(); err != nil {
+		return err
+	}
+	if err := c.checkKeepMetadata(); err != nil {
+		return err
+	}
+	if err := c.checkImageFormats(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(c.SearchQuery, "\r\n") {
+		return fmt.Errorf("SearchQuery can't contain line breaks")
+	}
+	return c.checkNotifiers()
+}
@@ -0,0 +1,300 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How serious a doctor finding is. Lower is more urgent.
+const (
+	doctorError = iota
+	doctorWarning
+	doctorInfo
+)
+
+var doctorLevels = []string{"ERROR", "WARN", "INFO"}
+
+const (
+	// staleAfter is how old a lock or a workspace has to be before
+	// doctor says it was left behind.
+	staleAfter = 24 * time.Hour
+	// lowDiskFraction is the share of a disk that has to be free.
+	lowDiskFraction = 0.05
+)
+
+// A doctorFinding is something doctor found, and how to fix it.
+type doctorFinding struct {
+	level   int
+	problem string
+	fix     string
+}
+
+// Doctor runs every check mailpost has on its setup and prints what it
+// found, the most urgent first, each with how to fix it. On top of the
+// startup checks it looks at the state database, free disk space, locks
+// and workspaces left behind and the external tools the config needs. It
+// returns the exit status: 1 if anything needs fixing.
+func (m *Mailpost) Doctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	offline := flags.Bool("offline", false, "Don't connect to the mail source.")
+	flags.Parse(args)
+
+	var findings []doctorFinding
+	add := func(level int, fix string, format string, v ...interface{}) {
+		findings = append(findings, doctorFinding{level, fmt.Sprintf(format, v...), fix})
+	}
+
+	m.doctorConfig(add)
+	if !*offline {
+		m.source = m.NewSource()
+		for _, problem := range m.Preflight(context.Background()) {
+			add(doctorError, "Fix the setting or the directory's permissions, then run doctor again.", "%s", problem)
+		}
+	}
+	m.doctorState(add)
+	m.doctorDisk(add)
+	m.doctorLocks(add)
+	m.doctorWorkspaces(add)
+	m.doctorTools(add)
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].level < findings[j].level })
+	status := 0
+	for i, f := range findings {
+		fmt.Printf("%2d. [%s] %s\n", i+1, doctorLevels[f.level], f.problem)
+		if f.fix != "" {
+			fmt.Printf("    fix: %s\n", f.fix)
+		}
+		if f.level != doctorInfo {
+			status = 1
+		}
+	}
+	if status == 0 {
+		fmt.Println("No problems found.")
+	}
+	return status
+}
+
+type doctorReport func(level int, fix string, format string, v ...interface{})
+
+// doctorConfig looks for settings that are valid but probably not meant.
+func (m *Mailpost) doctorConfig(add doctorReport) {
+	if !m.config.RestrictsSenders() {
+		add(doctorWarning, "Set PostFrom, or AllowedSenders, to the addresses you post from.",
+			"Neither PostFrom nor AllowedSenders is set, so anyone who knows the posting address can publish")
+	}
+	if m.config.PostDir == "" {
+		add(doctorError, "Set PostDir to the content directory of the site.", "PostDir isn't set")
+	}
+	if m.config.BaseURL == "" {
+		add(doctorWarning, "Set BaseURL to the address of the site.", "BaseURL isn't set, so image links are relative")
+	}
+	if m.config.VerifiesSignatures() && m.config.SMIMECAFile == "" {
+		add(doctorInfo, "Set SMIMECAFile to a PEM file of trusted certificates to accept S/MIME signatures.",
+			"SMIMECAFile isn't set, so only PGP signatures are accepted")
+	} else if m.config.VerifiesSignatures() {
+		if _, err := os.Stat(m.config.SMIMECAFile); err != nil {
+			add(doctorError, "Point SMIMECAFile at a PEM file of trusted certificates.", "SMIMECAFile can't be read: %s", err)
+		}
+	}
+	if m.config.Decrypt {
+		for _, file := range []struct{ name, path string }{
+			{"SMIMEKeyFile", m.config.SMIMEKeyFile},
+			{"SMIMECertFile", m.config.SMIMECertFile},
+		} {
+			if file.path == "" {
+				continue
+			}
+			if _, err := os.Stat(file.path); err != nil {
+				add(doctorError, "Fix the path, or remove it if you don't use S/MIME.", "%s can't be read: %s", file.name, err)
+			}
+		}
+	}
+}
+
+// doctorState checks that the state database is intact and that no held
+// post was forgotten.
+func (m *Mailpost) doctorState(add doctorReport) {
+	if err := m.state.Check(); err != nil {
+		add(doctorError, "Restore "+m.state.path+" from a backup, or move it away to start over; mailpost will read unseen mail again.",
+			"The state database is damaged: %s", err)
+		return
+	}
+
+	now := time.Now()
+	err := m.state.View(func(state *State) {
+		for server, h := range state.IMAPHealth {
+			add(doctorInfo, "", "%s: %s", server, h.Summary())
+			if h.Throttled > 0 {
+				add(doctorWarning, "Check more rarely (Interval), or ask the provider about its limits.",
+					"%s has throttled the account %d times since %s", server, h.Throttled, h.Since.Format("Jan 2, 2006"))
+			}
+			if h.Connects > 0 && h.ConnectFailures*4 > h.Connects {
+				add(doctorWarning, "Check the server's status and the network, or set RetryAttempts higher.",
+					"%d of %d connections to %s failed", h.ConnectFailures, h.Connects+h.ConnectFailures, server)
+			}
+			if n := len(h.CapChanges); n > 0 {
+				add(doctorWarning, "Settings like Idle and Compress stop working if the server drops what they need.",
+					"%s capabilities changed, last at %s", server, h.CapChanges[n-1])
+			}
+		}
+		for _, scheduled := range state.Schedule {
+			if now.Sub(scheduled.Publish) > staleAfter {
+				add(doctorWarning, "Run mailpost once to publish it.",
+					"Held post %s was due %s", scheduled.Path, scheduled.Publish.Format(time.RFC1123))
+			}
+		}
+	})
+	if err != nil {
+		add(doctorError, "", "Couldn't read the state: %s", err)
+	}
+}
+
+// doctorDisk checks that the disks mailpost writes to aren't full.
+func (m *Mailpost) doctorDisk(add doctorReport) {
+	dirs := []string{m.WorkDir(), m.StateDir()}
+	for _, name := range m.config.SiteNames() {
+		site := m.config.ForSite(name)
+		dirs = append(dirs, TemplateRoot(site.PostDir), TemplateRoot(site.ImageDir))
+	}
+
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		dir = existingParent(dir)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		free, total, err := diskSpace(dir)
+		if err != nil || total == 0 {
+			continue
+		}
+		if float64(free) < lowDiskFraction*float64(total) {
+			add(doctorWarning, "Free up space, or run mailpost gc to remove images no post uses.",
+				"Only %d MB of %d MB is free on the disk holding %s", free>>20, total>>20, dir)
+		}
+	}
+}
+
+// existingParent returns dir, or the nearest directory above it that
+// exists.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// doctorLocks looks for git locks left by a commit that was cut short,
+// which make every later commit fail.
+func (m *Mailpost) doctorLocks(add doctorReport) {
+	if !m.config.GitCommit {
+		return
+	}
+	for _, name := range m.config.SiteNames() {
+		lock := filepath.Join(TemplateRoot(m.config.ForSite(name).PostDir), ".git", "index.lock")
+		info, err := os.Stat(lock)
+		if err != nil {
+			continue
+		}
+		level := doctorInfo
+		if time.Since(info.ModTime()) > time.Hour {
+			level = doctorError
+		}
+		add(level, "If no git command is running in the repository, remove "+lock+".",
+			"%s is from %s", lock, info.ModTime().Format(time.RFC1123))
+	}
+}
+
+// doctorWorkspaces looks for workspaces left under WorkDir. Those of
+// failed messages are kept on purpose, but they pile up.
+func (m *Mailpost) doctorWorkspaces(add doctorReport) {
+	entries, err := ioutil.ReadDir(m.WorkDir())
+	if err != nil {
+		return
+	}
+	old := 0
+	var size int64
+	for _, entry := range entries {
+		if !entry.IsDir() || time.Since(entry.ModTime()) < staleAfter {
+			continue
+		}
+		old++
+		size += m.diskUsage(filepath.Join(m.WorkDir(), entry.Name()))
+	}
+	if old > 0 {
+		add(doctorWarning, "Look at the failed messages' workspaces, then remove them.",
+			"%d workspaces older than a day are left in %s (%d KB)", old, m.WorkDir(), size>>10)
+	}
+}
+
+// doctorTools checks that the commands the config needs are installed and
+// reports their versions.
+func (m *Mailpost) doctorTools(add doctorReport) {
+	tools := []struct {
+		name    string
+		args    []string
+		needed  bool
+		setting string
+		// what fails without it, if it isn't needed but is worth having
+		without string
+	}{
+		{"git", []string{"--version"}, m.config.GitCommit, "GitCommit", ""},
+		{"gpg", []string{"--version"}, m.config.VerifiesSignatures() || m.config.Decrypt, "SignaturePolicy or Decrypt", ""},
+		{"openssl", []string{"version"}, m.config.VerifiesSignatures() || m.config.Decrypt, "SignaturePolicy or Decrypt", ""},
+		{"hugo", []string{"version"}, false, "", ""},
+		{"heif-convert", []string{"--version"}, false, "", "messages with HEIC photos, as iPhones send, fail"},
+		{"cwebp", []string{"-version"}, m.config.encodes(formatWebP), "ImageFormat or ExtraImageFormats", ""},
+		{"avifenc", []string{"--version"}, m.config.encodes(formatAVIF), "ImageFormat or ExtraImageFormats", ""},
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool.name); err != nil {
+			if tool.needed {
+				add(doctorError, "Install "+tool.name+" or turn off "+tool.setting+".",
+					"%s isn't installed, but %s needs it", tool.name, tool.setting)
+			} else if tool.without != "" {
+				add(doctorWarning, "Install "+tool.name+".", "%s isn't installed, so %s", tool.name, tool.without)
+			}
+			continue
+		}
+		out, err := exec.Command(tool.name, tool.args...).Output()
+		if err != nil {
+			add(doctorWarning, "Check the "+tool.name+" installation.", "%s doesn't run: %s", tool.name, err)
+			continue
+		}
+		version := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+		add(doctorInfo, "", "%s", version)
+	}
+	if m.config.GitCommit {
+		repo := TemplateRoot(m.config.PostDir)
+		if err := m.git(repo, nil, "rev-parse", "--git-dir"); err != nil {
+			add(doctorError, "Run git init in "+repo+", or turn off GitCommit.", "PostDir %s isn't in a git repository", repo)
+		}
+	}
+}
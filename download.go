@@ -0,0 +1,209 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultUserAgent is sent with image downloads unless UserAgent is set.
+// Some hosts turn away Go's own.
+const defaultUserAgent = "mailpost (+https://github.com/delputnam/mailpost)"
+
+// ImageHost holds the settings for downloading images from the hosts
+// matching a pattern, configured in an [ImageHosts."pattern"] table.
+// Private hosts can be signed in to with User and Password (basic auth),
+// Token (a bearer token), or S3AccessKey and S3SecretKey, which turn each
+// link into a pre-signed S3 URL.
+type ImageHost struct {
+	Headers     map[string]string
+	User        string
+	Password    string
+	Token       string
+	S3AccessKey string
+	S3SecretKey string
+	S3Region    string
+}
+
+// ImageHost returns the settings for host. Patterns are matched with
+// path.Match, so "*.example.com" matches every subdomain. An exact match
+// wins over a pattern, and a longer pattern over a shorter one.
+func (c *Config) ImageHost(host string) (ImageHost, bool) {
+	host = strings.ToLower(host)
+	best := ""
+	found := false
+	for pattern := range c.ImageHosts {
+		if strings.ToLower(pattern) == host {
+			return c.ImageHosts[pattern], true
+		}
+		if matchHost(pattern, host) && len(pattern) > len(best) {
+			best = pattern
+			found = true
+		}
+	}
+	return c.ImageHosts[best], found
+}
+
+// matchHost reports whether host matches a host name or glob pattern.
+func matchHost(pattern string, host string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return ok
+}
+
+// ImageSourceAllowed reports whether images may be downloaded from host.
+// ImageDenyHosts always wins; if ImageAllowHosts is set, only the hosts
+// matching it are allowed.
+func (c *Config) ImageSourceAllowed(host string) bool {
+	for _, pattern := range c.ImageDenyHosts {
+		if matchHost(pattern, host) {
+			return false
+		}
+	}
+	if len(c.ImageAllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range c.ImageAllowHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckImageHeaders checks what a server says about an image against
+// MaxImageDownload and ImageTypes. Servers that don't give a length, or
+// only say application/octet-stream, get the benefit of the doubt; the
+// download itself is checked again.
+func (c *Config) CheckImageHeaders(header http.Header, length int64) error {
+	if c.MaxImageDownload > 0 && length > int64(c.MaxImageDownload) {
+		return fmt.Errorf("%d bytes is over MaxImageDownload", length)
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" || len(c.ImageTypes) == 0 {
+		return nil
+	}
+	return c.CheckImageType(contentType)
+}
+
+// CheckImageType checks a media type against ImageTypes. Any type is
+// allowed when ImageTypes isn't set.
+func (c *Config) CheckImageType(contentType string) error {
+	if len(c.ImageTypes) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid type %q", contentType)
+	}
+	if mediaType == "application/octet-stream" {
+		return nil
+	}
+	for _, t := range c.ImageTypes {
+		if strings.EqualFold(t, mediaType) {
+			return nil
+		}
+	}
+	return fmt.Errorf("type %s isn't allowed", mediaType)
+}
+
+// PreflightImage decides whether an image should be downloaded at all. The
+// host is checked against ImageAllowHosts and ImageDenyHosts, and then the
+// server is asked about the image with a HEAD request, so one that is too
+// big or of the wrong type is never downloaded. Servers that don't answer
+// HEAD are let through to the download. Every decision is logged.
+func (m *Mailpost) PreflightImage(ctx context.Context, link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return true
+	}
+	if !m.config.ImageSourceAllowed(u.Hostname()) {
+		log.Printf("   |-- Skipping image %s: host not allowed", link)
+		return false
+	}
+	if m.config.MaxImageDownload == 0 && len(m.config.ImageTypes) == 0 {
+		return true
+	}
+
+	req, err := m.NewImageRequest(ctx, link)
+	if err != nil {
+		return true
+	}
+	req.Method = "HEAD"
+	resp, err := m.web.Do(req)
+	if err != nil {
+		log.Printf("   |-- HEAD %s failed, downloading anyway: %s", link, err)
+		return true
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("   |-- HEAD %s answered %s, downloading anyway", link, resp.Status)
+		return true
+	}
+
+	if err := m.config.CheckImageHeaders(resp.Header, resp.ContentLength); err != nil {
+		log.Printf("   |-- Skipping image %s: %s", link, err)
+		return false
+	}
+	log.Printf("   |-- Image %s passed preflight (%s, %d bytes)", link, resp.Header.Get("Content-Type"), resp.ContentLength)
+	return true
+}
+
+// NewImageRequest builds the request for downloading an image, with
+// UserAgent, ImageHeaders and the headers and credentials of the
+// ImageHosts entry for the image's host, which win over the others.
+func (m *Mailpost) NewImageRequest(ctx context.Context, link string) (*http.Request, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	host, hostOK := m.config.ImageHost(u.Hostname())
+	if hostOK && host.S3AccessKey != "" {
+		u = presignS3(u, host, time.Now())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := m.config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, value := range m.config.ImageHeaders {
+		req.Header.Set(name, value)
+	}
+	if !hostOK {
+		return req, nil
+	}
+	switch {
+	case host.Token != "":
+		req.Header.Set("Authorization", "Bearer "+host.Token)
+	case host.User != "":
+		req.SetBasicAuth(host.User, host.Password)
+	}
+	for name, value := range host.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
@@ -0,0 +1,99 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ApplyDraftDefault makes a post a draft when DraftByDefault is set,
+// unless its author said to publish it: with [publish] in the subject,
+// "publish: true" in the frontmatter, or the draft field set to false.
+// "publish" is taken out of the frontmatter whether DraftByDefault is set
+// or not, since site generators don't know it. Jekyll sites get
+// "published: false" instead of "draft: true", and take "published: true"
+// to publish.
+func (m *Mailpost) ApplyDraftDefault(post string) string {
+	frontmatter, body, ok := SplitFrontmatter(post)
+	if !ok {
+		return post
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(frontmatter), &fields); err != nil {
+		return post
+	}
+
+	publish, decided := false, false
+	var kept yaml.MapSlice
+	for _, field := range fields {
+		key, _ := field.Key.(string)
+		value, isBool := field.Value.(bool)
+		switch strings.ToLower(key) {
+		case "publish":
+			publish, decided = isBool && value, true
+			continue
+		case "draft":
+			if isBool {
+				publish, decided = !value, true
+			}
+		case "published":
+			if isBool {
+				publish, decided = value, true
+			}
+		}
+		kept = append(kept, field)
+	}
+	switch {
+	case len(kept) == len(fields) && (decided || !m.config.DraftByDefault):
+		// the post says itself whether it is a draft
+		return post
+	case !m.config.DraftByDefault:
+		return withFields(post, kept, body)
+	}
+
+	draftKey, draftValue := "draft", !publish
+	if strings.ToLower(m.config.SiteGenerator) == generatorJekyll {
+		draftKey, draftValue = "published", publish
+	}
+	kept = setField(kept, draftKey, draftValue)
+	if !publish {
+		log.Printf("|-- Writing as a draft, DraftByDefault is set")
+	}
+	return withFields(post, kept, body)
+}
+
+// withFields puts new frontmatter on a post's body, or returns the post
+// as it was if the frontmatter can't be written.
+func withFields(post string, fields yaml.MapSlice, body string) string {
+	out, err := MarshalFrontmatter(fields)
+	if err != nil {
+		return post
+	}
+	return JoinFrontmatter(out, body)
+}
+
+// setField sets a field in frontmatter, replacing its value if it has
+// one.
+func setField(fields yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, yaml.MapItem{Key: key, Value: value})
+}
@@ -0,0 +1,182 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The formats Go can't encode, which are made by external commands.
+const (
+	formatWebP = "webp"
+	formatAVIF = "avif"
+)
+
+// imageEncoders are the commands that encode WebP and AVIF.
+var imageEncoders = map[string]string{
+	formatWebP: "cwebp",
+	formatAVIF: "avifenc",
+}
+
+// defaultQualities are the qualities WebP and AVIF are encoded to when
+// WebPQuality or AVIFQuality aren't set, which make files about the size
+// of a JPEG that looks the same.
+var defaultQualities = map[string]uint{
+	formatWebP: 80,
+	formatAVIF: 60,
+}
+
+// checkImageFormats makes sure ImageFormat and ExtraImageFormats name
+// formats mailpost can publish, and the qualities are percentages.
+func (c *Config) checkImageFormats() error {
+	switch strings.ToLower(c.ImageFormat) {
+	case "", formatJPEG, formatWebP, formatAVIF:
+	default:
+		return fmt.Errorf("invalid ImageFormat %q: it must be %q, %q or %q", c.ImageFormat, formatJPEG, formatWebP, formatAVIF)
+	}
+	for _, format := range c.ExtraImageFormats {
+		if _, ok := imageEncoders[strings.ToLower(format)]; !ok {
+			return fmt.Errorf("invalid ExtraImageFormats %q: it must be %q or %q", format, formatWebP, formatAVIF)
+		}
+	}
+	for _, quality := range []struct {
+		name  string
+		value uint
+	}{
+		{"WebPQuality", c.WebPQuality},
+		{"AVIFQuality", c.AVIFQuality},
+	} {
+		if quality.value > 100 {
+			return fmt.Errorf("invalid %s: it must be between 1 and 100", quality.name)
+		}
+	}
+	return nil
+}
+
+// EncodedFormats returns the formats the config needs an external
+// encoder for.
+func (c *Config) EncodedFormats() []string {
+	var formats []string
+	seen := make(map[string]bool)
+	for _, format := range append([]string{c.ImageFormat}, c.ExtraImageFormats...) {
+		format = strings.ToLower(format)
+		if _, ok := imageEncoders[format]; ok && !seen[format] {
+			formats = append(formats, format)
+			seen[format] = true
+		}
+	}
+	return formats
+}
+
+// encodes reports whether the config needs an external encoder for
+// format.
+func (c *Config) encodes(format string) bool {
+	for _, encoded := range c.EncodedFormats() {
+		if encoded == format {
+			return true
+		}
+	}
+	return false
+}
+
+// imageQuality returns the quality images are encoded to in format.
+func (c *Config) imageQuality(format string) uint {
+	quality := c.WebPQuality
+	if format == formatAVIF {
+		quality = c.AVIFQuality
+	}
+	if quality == 0 {
+		return defaultQualities[format]
+	}
+	return quality
+}
+
+// extraFormats returns the formats an image published in format is also
+// written in, next to it. GIFs are only ever GIFs, to keep their
+// animation.
+func (m *Mailpost) extraFormats(format string) []string {
+	if format == formatGIF {
+		return nil
+	}
+	var extras []string
+	for _, extra := range m.config.ExtraImageFormats {
+		if extra = strings.ToLower(extra); extra != format {
+			extras = append(extras, extra)
+		}
+	}
+	return extras
+}
+
+// writePublishedImage writes img to path in format, see encodeImage, and
+// next to it, under the same name with another extension, in each of the
+// ExtraImageFormats. WebP and AVIF are made by cwebp and avifenc from a
+// lossless PNG of the image, kept next to path while they run, so their
+// transparency survives and there is no metadata to carry over.
+func (m *Mailpost) writePublishedImage(path string, img image.Image, alpha bool, format string, data, meta []byte) error {
+	_, encoded := imageEncoders[format]
+	if !encoded {
+		if err := writeImageFile(path, img, alpha, format, data, meta); err != nil {
+			return err
+		}
+	}
+	extras := m.extraFormats(format)
+	if !encoded && len(extras) == 0 {
+		return nil
+	}
+
+	source := path + ".source.png"
+	if err := writeImageFile(source, img, alpha, formatPNG, data, nil); err != nil {
+		return err
+	}
+	defer os.Remove(source)
+	if encoded {
+		if err := m.encodeImageWith(format, source, path); err != nil {
+			return err
+		}
+	}
+	for _, extra := range extras {
+		if err := m.encodeImageWith(extra, source, strings.TrimSuffix(path, filepath.Ext(path))+imageExts[extra]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeImageWith runs the encoder for format on the image at source,
+// writing it to target.
+func (m *Mailpost) encodeImageWith(format, source, target string) error {
+	quality := strconv.Itoa(int(m.config.imageQuality(format)))
+	var args []string
+	switch format {
+	case formatWebP:
+		args = []string{"-quiet", "-q", quality, source, "-o", target}
+	case formatAVIF:
+		args = []string{"-q", quality, source, target}
+	}
+	cmd := exec.Command(imageEncoders[format], args...)
+	out, err := cmd.CombinedOutput()
+	switch {
+	case err == nil:
+		return nil
+	case strings.TrimSpace(string(out)) == "":
+		return fmt.Errorf("%s: %s", imageEncoders[format], err)
+	}
+	return fmt.Errorf("%s: %s: %s", imageEncoders[format], err, firstOutputLine(string(out)))
+}
@@ -0,0 +1,427 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The values accepted in ExifFrontmatter, each naming a group of fields
+// copied from a photo's EXIF into its post.
+const (
+	exifDate     = "date"
+	exifLocation = "location"
+	exifCamera   = "camera"
+	exifExposure = "exposure"
+)
+
+// exifKey is the frontmatter field the EXIF fields are written under.
+const exifKey = "exif"
+
+// EXIF tags mailpost reads.
+const (
+	tagMake         = 0x010f
+	tagModel        = 0x0110
+	tagOrientation  = 0x0112
+	tagExifIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagExposureTime = 0x829a
+	tagFNumber      = 0x829d
+	tagISO          = 0x8827
+	tagTaken        = 0x9003
+	tagTakenOffset  = 0x9011
+	tagFocalLength  = 0x920a
+	tagLatitudeRef  = 0x0001
+	tagLatitude     = 0x0002
+	tagLongitudeRef = 0x0003
+	tagLongitude    = 0x0004
+)
+
+// Exif is what mailpost reads from a photo's EXIF. Fields the photo
+// doesn't have are left empty.
+type Exif struct {
+	Orientation int
+	Make        string
+	Model       string
+	Taken       string
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+	// the exposure time as a fraction of a second, like "1/250", or in
+	// seconds
+	Exposure    string
+	FNumber     float64
+	ISO         uint32
+	FocalLength float64
+}
+
+// checkExifFrontmatter makes sure ExifFrontmatter only names groups of
+// fields mailpost knows.
+func (c *Config) checkExifFrontmatter() error {
+	for _, group := range c.ExifFrontmatter {
+		switch strings.ToLower(group) {
+		case exifDate, exifLocation, exifCamera, exifExposure:
+			continue
+		}
+		return fmt.Errorf("invalid ExifFrontmatter %q: it must be %q, %q, %q or %q", group, exifDate, exifLocation, exifCamera, exifExposure)
+	}
+	return nil
+}
+
+// ApplyExifFrontmatter adds what the first photo of a message with EXIF
+// says about how it was taken to the frontmatter of the message's posts,
+// in an exif field, for photoblog themes that show it. ExifFrontmatter
+// picks what is added: the date it was taken, where, the camera, and the
+// exposure, aperture, ISO and focal length. Nothing is added for a sender
+// with StripMetadata, and no location for one with StripGPS. Fields the
+// author set win.
+func (m *Mailpost) ApplyExifFrontmatter(msg int) {
+	if len(m.config.ExifFrontmatter) == 0 {
+		return
+	}
+	var info Exif
+	found := false
+	for _, imageInfo := range m.images {
+		if imageInfo.Msg != msg {
+			continue
+		}
+		if info, found = ReadExif(imageInfo.Data); found {
+			break
+		}
+	}
+	if !found {
+		return
+	}
+
+	for p := range m.posts {
+		if m.posts[p].Msg != msg {
+			continue
+		}
+		// StripMetadata for the site is about the image files, but a
+		// sender's keeps their EXIF off the site altogether
+		sender, _ := m.config.Sender(m.posts[p].From)
+		if sender.StripMetadata {
+			continue
+		}
+		fields := info.Fields(m.config.ExifFrontmatter, !sender.StripGPS)
+		if len(fields) == 0 {
+			continue
+		}
+		log.Printf("|-- Adding EXIF to %s", m.posts[p].File)
+		m.posts[p].Data = MergeFrontmatter(m.posts[p].Data, yaml.MapSlice{{Key: exifKey, Value: fields}})
+		m.posts[p].Fields = ParseFields(m.posts[p].Data)
+	}
+}
+
+// Fields returns the frontmatter fields for the groups named, leaving out
+// the location unless withLocation is set.
+func (e Exif) Fields(groups []string, withLocation bool) yaml.MapSlice {
+	var fields yaml.MapSlice
+	add := func(key string, value interface{}, ok bool) {
+		if ok {
+			fields = append(fields, yaml.MapItem{Key: key, Value: value})
+		}
+	}
+	for _, group := range groups {
+		switch strings.ToLower(group) {
+		case exifDate:
+			add("taken", e.Taken, e.Taken != "")
+		case exifLocation:
+			add("latitude", e.Latitude, e.HasLocation && withLocation)
+			add("longitude", e.Longitude, e.HasLocation && withLocation)
+		case exifCamera:
+			add("camera", e.Camera(), e.Camera() != "")
+		case exifExposure:
+			add("exposure", e.Exposure, e.Exposure != "")
+			add("aperture", e.FNumber, e.FNumber != 0)
+			add("iso", e.ISO, e.ISO != 0)
+			add("focal_length", e.FocalLength, e.FocalLength != 0)
+		}
+	}
+	return fields
+}
+
+// Camera returns the camera's make and model, without the make twice
+// when the model already starts with it, as many do.
+func (e Exif) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// ReadExif reads the EXIF of a JPEG. It reports false if the image has
+// none or it can't be read.
+func ReadExif(data []byte) (Exif, bool) {
+	var info Exif
+	r, ifd0, ok := readTIFF(data)
+	if !ok {
+		return info, false
+	}
+	info.Make = ifd0[tagMake].text()
+	info.Model = ifd0[tagModel].text()
+	if orientation, ok := r.uint(ifd0[tagOrientation]); ok {
+		info.Orientation = int(orientation)
+	}
+
+	if offset, ok := r.uint(ifd0[tagExifIFD]); ok {
+		sub := r.ifd(offset)
+		if taken, err := time.Parse("2006:01:02 15:04:05", sub[tagTaken].text()); err == nil {
+			info.Taken = taken.Format("2006-01-02T15:04:05")
+			if zone := sub[tagTakenOffset].text(); zone != "" {
+				if t, err := time.Parse("2006:01:02 15:04:05-07:00", sub[tagTaken].text()+zone); err == nil {
+					info.Taken = t.Format(time.RFC3339)
+				}
+			}
+		}
+		if num, den, ok := r.rational(sub[tagExposureTime], 0); ok && num != 0 && den != 0 {
+			if num < den {
+				info.Exposure = fmt.Sprintf("1/%d", uint32(math.Round(float64(den)/float64(num))))
+			} else {
+				info.Exposure = fmt.Sprintf("%g", round(float64(num)/float64(den), 1))
+			}
+		}
+		if num, den, ok := r.rational(sub[tagFNumber], 0); ok && den != 0 {
+			info.FNumber = round(float64(num)/float64(den), 1)
+		}
+		if num, den, ok := r.rational(sub[tagFocalLength], 0); ok && den != 0 {
+			info.FocalLength = round(float64(num)/float64(den), 1)
+		}
+		if iso, ok := r.uint(sub[tagISO]); ok {
+			info.ISO = iso
+		}
+	}
+
+	if offset, ok := r.uint(ifd0[tagGPSIFD]); ok {
+		gps := r.ifd(offset)
+		lat, latOK := r.degrees(gps[tagLatitude])
+		lon, lonOK := r.degrees(gps[tagLongitude])
+		if latOK && lonOK {
+			if strings.HasPrefix(gps[tagLatitudeRef].text(), "S") {
+				lat = -lat
+			}
+			if strings.HasPrefix(gps[tagLongitudeRef].text(), "W") {
+				lon = -lon
+			}
+			info.HasLocation = true
+			info.Latitude = round(lat, 6)
+			info.Longitude = round(lon, 6)
+		}
+	}
+	return info, true
+}
+
+// orient turns img the way an EXIF orientation says it should be shown,
+// flipping or rotating it as needed, so it is upright without the tag.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		// these turn it on its side
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			i, j := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+	return dst
+}
+
+// readTIFF finds the EXIF of a JPEG and reads its first IFD.
+func readTIFF(data []byte) (tiffReader, map[uint16]tiffEntry, bool) {
+	tiff := exifSegment(data)
+	if len(tiff) < 8 {
+		return tiffReader{}, nil, false
+	}
+	r := tiffReader{data: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return r, nil, false
+	}
+	ifd0 := r.ifd(r.order.Uint32(tiff[4:]))
+	return r, ifd0, ifd0 != nil
+}
+
+// round rounds x to places decimal places.
+func round(x float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(x*scale) / scale
+}
+
+// exifSegment returns the TIFF data in a JPEG's EXIF segment, or nil if
+// it has none.
+func exifSegment(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// the EXIF comes before the image data
+			return nil
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			i += 2
+			continue
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + size
+	}
+	return nil
+}
+
+// tiffReader reads the IFDs of the TIFF structure EXIF is stored in.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is one field of an IFD.
+type tiffEntry struct {
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+// tiffSizes are the sizes of the TIFF field types mailpost reads.
+var tiffSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd reads the IFD at offset, returning nil if it is out of bounds.
+// Entries that are out of bounds are left out.
+func (r tiffReader) ifd(offset uint32) map[uint16]tiffEntry {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return nil
+	}
+	count := uint64(r.order.Uint16(r.data[offset:]))
+	if uint64(offset)+2+count*12 > uint64(len(r.data)) {
+		return nil
+	}
+
+	entries := make(map[uint16]tiffEntry)
+	for i := uint64(0); i < count; i++ {
+		raw := r.data[uint64(offset)+2+i*12:]
+		entry := tiffEntry{kind: r.order.Uint16(raw[2:]), count: r.order.Uint32(raw[4:])}
+		size, ok := tiffSizes[entry.kind]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			start := uint64(r.order.Uint32(raw[8:]))
+			if start+length > uint64(len(r.data)) {
+				continue
+			}
+			entry.value = r.data[start : start+length]
+		}
+		entries[r.order.Uint16(raw)] = entry
+	}
+	return entries
+}
+
+// text returns an ASCII field's value.
+func (e tiffEntry) text() string {
+	if e.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// uint returns the first value of a SHORT or LONG field.
+func (r tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch {
+	case e.kind == 3 && len(e.value) >= 2:
+		return uint32(r.order.Uint16(e.value)), true
+	case e.kind == 4 && len(e.value) >= 4:
+		return r.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rational returns the i'th value of a RATIONAL field.
+func (r tiffReader) rational(e tiffEntry, i int) (uint32, uint32, bool) {
+	if e.kind != 5 || len(e.value) < (i+1)*8 {
+		return 0, 0, false
+	}
+	return r.order.Uint32(e.value[i*8:]), r.order.Uint32(e.value[i*8+4:]), true
+}
+
+// degrees returns a GPS coordinate, stored as degrees, minutes and
+// seconds, in degrees.
+func (r tiffReader) degrees(e tiffEntry) (float64, bool) {
+	var degrees float64
+	for i, scale := range []float64{1, 60, 3600} {
+		num, den, ok := r.rational(e, i)
+		if !ok || den == 0 {
+			return 0, false
+		}
+		degrees += float64(num) / float64(den) / scale
+	}
+	return degrees, true
+}
@@ -0,0 +1,267 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// The formats of frontmatter, as Hugo knows them: YAML between --- lines,
+// TOML between +++ lines and a JSON object.
+const (
+	formatYAML = "yaml"
+	formatTOML = "toml"
+	formatJSON = "json"
+)
+
+// reJSONFrontmatter matches the start of JSON frontmatter, but not a post
+// that starts with a shortcode like {{< figure >}}.
+var reJSONFrontmatter = regexp.MustCompile(`^\{\s*["}]`)
+
+// tomlDates are the fields written as TOML dates instead of strings.
+var tomlDates = map[string]bool{"date": true, "lastmod": true, "publishdate": true, "expirydate": true}
+
+// checkFrontmatterFormat checks the FrontmatterFormat config value.
+func (c *Config) checkFrontmatterFormat() error {
+	switch strings.ToLower(c.FrontmatterFormat) {
+	case "", formatYAML, formatTOML, formatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid FrontmatterFormat %q: it must be %q, %q or %q", c.FrontmatterFormat, formatYAML, formatTOML, formatJSON)
+}
+
+// NormalizeFrontmatter turns TOML or JSON frontmatter into YAML, which is
+// what mailpost works with until the post is written. Posts with YAML
+// frontmatter, or none, are returned as they are.
+func NormalizeFrontmatter(post string) (string, error) {
+	trimmed := strings.TrimLeft(post, " \t\r\n")
+	var fields yaml.MapSlice
+	var body string
+	switch {
+	case strings.HasPrefix(trimmed, "+++"):
+		lines := strings.SplitAfter(trimmed, "\n")
+		end := 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "+++" {
+			end++
+		}
+		if end == len(lines) {
+			return post, fmt.Errorf("TOML frontmatter has no closing +++")
+		}
+		var data map[string]interface{}
+		md, err := toml.Decode(strings.Join(lines[1:end], ""), &data)
+		if err != nil {
+			return post, fmt.Errorf("invalid TOML frontmatter: %s", err)
+		}
+		for _, key := range md.Keys() {
+			if len(key) == 1 {
+				fields = append(fields, yaml.MapItem{Key: key[0], Value: yamlValue(data[key[0]])})
+			}
+		}
+		body = strings.Join(lines[end+1:], "")
+
+	case reJSONFrontmatter.MatchString(trimmed):
+		dec := json.NewDecoder(strings.NewReader(trimmed))
+		if _, err := dec.Token(); err != nil {
+			return post, fmt.Errorf("invalid JSON frontmatter: %s", err)
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return post, fmt.Errorf("invalid JSON frontmatter: %s", err)
+			}
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				return post, fmt.Errorf("invalid JSON frontmatter: %s", err)
+			}
+			fields = append(fields, yaml.MapItem{Key: key, Value: yamlValue(value)})
+		}
+		if _, err := dec.Token(); err != nil {
+			return post, fmt.Errorf("invalid JSON frontmatter: %s", err)
+		}
+		body = strings.TrimPrefix(strings.TrimPrefix(trimmed[dec.InputOffset():], "\r"), "\n")
+
+	default:
+		return post, nil
+	}
+
+	out, err := yaml.Marshal(fields)
+	if err != nil {
+		return post, err
+	}
+	return JoinFrontmatter(string(out), body), nil
+}
+
+// yamlValue makes a decoded TOML or JSON value one YAML writes the same
+// way, with times as RFC 3339 strings so they read back as they were.
+func yamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case map[string]interface{}:
+		var fields yaml.MapSlice
+		for _, key := range sortedKeys(v) {
+			fields = append(fields, yaml.MapItem{Key: key, Value: yamlValue(v[key])})
+		}
+		return fields
+	case []map[string]interface{}:
+		var list []interface{}
+		for _, item := range v {
+			list = append(list, yamlValue(item))
+		}
+		return list
+	case []interface{}:
+		var list []interface{}
+		for _, item := range v {
+			list = append(list, yamlValue(item))
+		}
+		return list
+	}
+	return value
+}
+
+// FormatFrontmatter writes the YAML frontmatter of a post in
+// FrontmatterFormat. A post it can't convert is logged and kept in YAML.
+func (m *Mailpost) FormatFrontmatter(post string) string {
+	format := strings.ToLower(m.config.FrontmatterFormat)
+	if format == "" || format == formatYAML {
+		return post
+	}
+	frontmatter, body, ok := SplitFrontmatter(post)
+	if !ok {
+		return post
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(frontmatter), &fields); err != nil {
+		log.Printf("Couldn't convert frontmatter to %s: %s", format, err)
+		return post
+	}
+
+	var out string
+	var err error
+	if format == formatTOML {
+		out, err = tomlFrontmatter(fields)
+	} else {
+		out, err = jsonFrontmatter(fields)
+	}
+	if err != nil {
+		log.Printf("Couldn't convert frontmatter to %s: %s", format, err)
+		return post
+	}
+	return out + body
+}
+
+// tomlFrontmatter writes fields as TOML frontmatter, in order, except
+// that tables have to come after the plain values.
+func tomlFrontmatter(fields yaml.MapSlice) (string, error) {
+	var values, tables bytes.Buffer
+	for _, field := range fields {
+		key := fmt.Sprint(field.Key)
+		value := plainValue(field.Value)
+		if s, ok := value.(string); ok && tomlDates[strings.ToLower(key)] {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				value = t
+			}
+		}
+		w := &values
+		if isTable(value) {
+			w = &tables
+		}
+		if err := toml.NewEncoder(w).Encode(map[string]interface{}{key: value}); err != nil {
+			return "", fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return "+++\n" + values.String() + tables.String() + "+++\n", nil
+}
+
+// isTable reports whether TOML writes a value as a table of its own.
+func isTable(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.(map[string]interface{}); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonFrontmatter writes fields as a JSON object, in order.
+func jsonFrontmatter(fields yaml.MapSlice) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for i, field := range fields {
+		key, _ := json.Marshal(fmt.Sprint(field.Key))
+		value, err := json.MarshalIndent(plainValue(field.Value), "  ", "  ")
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", field.Key, err)
+		}
+		fmt.Fprintf(&buf, "  %s: %s", key, value)
+		if i < len(fields)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	return buf.String(), nil
+}
+
+// plainValue turns the maps YAML decodes into, which TOML and JSON can't
+// encode, into maps with string keys.
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{})
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = plainValue(item.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, item := range v {
+			m[fmt.Sprint(key)] = plainValue(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = plainValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+// sortedKeys returns the keys of a map in order, so conversions always
+// come out the same.
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
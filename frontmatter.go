@@ -0,0 +1,343 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SplitFrontmatter separates the YAML frontmatter at the top of a post
+// from the rest of it. The frontmatter is returned without its --- lines.
+func SplitFrontmatter(post string) (frontmatter string, body string, ok bool) {
+	lines := strings.SplitAfter(post, "\n")
+
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+	if start == len(lines) || strings.TrimSpace(lines[start]) != "---" {
+		return "", post, false
+	}
+
+	for end := start + 1; end < len(lines); end++ {
+		if line := strings.TrimSpace(lines[end]); line == "---" || line == "..." {
+			frontmatter = strings.Join(lines[start+1:end], "")
+			body = strings.Join(lines[end+1:], "")
+			return frontmatter, body, true
+		}
+	}
+	return "", post, false
+}
+
+// JoinFrontmatter puts a post back together from its frontmatter and body.
+func JoinFrontmatter(frontmatter string, body string) string {
+	if frontmatter != "" && !strings.HasSuffix(frontmatter, "\n") {
+		frontmatter += "\n"
+	}
+	return "---\n" + frontmatter + "---\n" + body
+}
+
+// MergeFrontmatter adds the fields of extra that the post's frontmatter
+// doesn't already have. Fields set by the author always win, and the
+// author's frontmatter is kept exactly as written.
+func MergeFrontmatter(post string, extra yaml.MapSlice) string {
+	frontmatter, body, ok := SplitFrontmatter(post)
+
+	var existing map[string]interface{}
+	if ok {
+		if err := yaml.Unmarshal([]byte(frontmatter), &existing); err != nil {
+			return post
+		}
+	}
+
+	var missing yaml.MapSlice
+	for _, field := range extra {
+		if _, found := existing[field.Key.(string)]; !found {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return post
+	}
+
+	out, err := MarshalFrontmatter(missing)
+	if err != nil {
+		return post
+	}
+	if frontmatter != "" && !strings.HasSuffix(frontmatter, "\n") {
+		frontmatter += "\n"
+	}
+	return JoinFrontmatter(frontmatter+string(out), body)
+}
+
+// A ValueSanitizer cleans up a value before mailpost writes it into
+// frontmatter. Sanitizers are applied in order, to every field.
+type ValueSanitizer func(key string, value interface{}) interface{}
+
+// ValueSanitizers are applied by MarshalFrontmatter.
+var ValueSanitizers = []ValueSanitizer{TrimValue, SingleLineTitle}
+
+// TrimValue removes leading and trailing whitespace from strings.
+func TrimValue(key string, value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		return strings.TrimSpace(s)
+	}
+	return value
+}
+
+// SingleLineTitle joins the lines of a title, which themes expect to be
+// on one line.
+func SingleLineTitle(key string, value interface{}) interface{} {
+	if s, ok := value.(string); ok && key == "title" {
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return value
+}
+
+// MarshalFrontmatter turns fields into YAML frontmatter, without the ---
+// lines. Values are run through ValueSanitizers and then quoted and
+// escaped as YAML needs, so titles with colons, quotes, emoji or line
+// breaks come out as valid YAML that reads back the same.
+func MarshalFrontmatter(fields yaml.MapSlice) (string, error) {
+	clean := make(yaml.MapSlice, len(fields))
+	for i, field := range fields {
+		key, _ := field.Key.(string)
+		value := field.Value
+		for _, sanitize := range ValueSanitizers {
+			value = sanitize(key, value)
+		}
+		clean[i] = yaml.MapItem{Key: field.Key, Value: value}
+	}
+
+	out, err := yaml.Marshal(clean)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+var reFrontmatterField = regexp.MustCompile(`^([A-Za-z0-9_-]+):[ \t]+(.*?)[ \t]*$`)
+
+// RepairFrontmatter fixes frontmatter that isn't valid YAML because of a
+// plain value that needed quoting, like "title: Re: my trip" or
+// "title: "Quoted" words". Each top level field whose value doesn't parse
+// on its own is rewritten with the value quoted. Frontmatter that already
+// parses, or can't be fixed this way, is left as it is.
+func RepairFrontmatter(post string) string {
+	frontmatter, body, ok := SplitFrontmatter(post)
+	if !ok {
+		return post
+	}
+	var parsed map[string]interface{}
+	if yaml.Unmarshal([]byte(frontmatter), &parsed) == nil {
+		return post
+	}
+
+	lines := strings.SplitAfter(frontmatter, "\n")
+	for i, line := range lines {
+		match := reFrontmatterField.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if match == nil || match[2] == "" {
+			continue
+		}
+		var field map[string]interface{}
+		if yaml.Unmarshal([]byte(match[0]), &field) == nil {
+			continue
+		}
+
+		out, err := MarshalFrontmatter(yaml.MapSlice{{Key: match[1], Value: match[2]}})
+		if err != nil {
+			continue
+		}
+		lines[i] = out
+	}
+
+	repaired := strings.Join(lines, "")
+	if yaml.Unmarshal([]byte(repaired), &parsed) != nil {
+		return post
+	}
+	log.Printf("Quoted frontmatter values that weren't valid YAML")
+	return JoinFrontmatter(repaired, body)
+}
+
+// MergeSenderFrontmatter merges the sender's FrontmatterFile, if they have
+// one, and their Author and Type into a post. The file is read for every
+// post, so changes to it take effect without restarting mailpost.
+func (m *Mailpost) MergeSenderFrontmatter(post string, fromAddr string) string {
+	sender, ok := m.config.Sender(fromAddr)
+	if !ok {
+		return post
+	}
+
+	var extra yaml.MapSlice
+	if sender.FrontmatterFile != "" {
+		data, err := ioutil.ReadFile(sender.FrontmatterFile)
+		if err != nil {
+			log.Printf("Couldn't read frontmatter template for %s: %s", fromAddr, err)
+			return post
+		}
+		if err := yaml.Unmarshal(data, &extra); err != nil {
+			log.Printf("Invalid frontmatter template %s: %s", sender.FrontmatterFile, err)
+			return post
+		}
+		for _, field := range extra {
+			if _, ok := field.Key.(string); !ok {
+				log.Printf("Invalid frontmatter template %s: keys must be strings", sender.FrontmatterFile)
+				return post
+			}
+		}
+	}
+
+	// the file wins over the sender's settings
+	has := make(map[string]bool)
+	for _, field := range extra {
+		has[field.Key.(string)] = true
+	}
+	for _, field := range []yaml.MapItem{{Key: "author", Value: sender.Author}, {Key: "type", Value: sender.Type}} {
+		if field.Value != "" && !has[field.Key.(string)] {
+			extra = append(extra, field)
+		}
+	}
+	if len(extra) == 0 {
+		return post
+	}
+
+	return MergeFrontmatter(post, extra)
+}
+
+// rePlaceholder matches a placeholder in a path template, like <slug>.
+var rePlaceholder = regexp.MustCompile(`<([A-Za-z_][\w-]*)>`)
+
+// ParseFields returns the complete frontmatter of a post, or nil if it
+// has none that parses.
+func ParseFields(post string) map[string]interface{} {
+	frontmatter, _, ok := SplitFrontmatter(post)
+	if !ok {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal([]byte(frontmatter), &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// FillFields replaces the placeholders in a path template with the
+// frontmatter fields they name, so PostDir can be "content/<categories>"
+// or ImagePath "images/<slug>". A list gives its first item, and a field
+// the post doesn't have gives nothing. Values are made into slugs, so they
+// can't reach outside the directory. Without fields, nothing is replaced.
+func FillFields(pathTemplate string, fields map[string]interface{}) string {
+	if fields == nil {
+		return pathTemplate
+	}
+	filled := rePlaceholder.ReplaceAllStringFunc(pathTemplate, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		for name, value := range fields {
+			if strings.EqualFold(name, key) {
+				return Slugify(fieldText(value))
+			}
+		}
+		return ""
+	})
+	if filled == pathTemplate {
+		return pathTemplate
+	}
+	// a missing field leaves an empty directory name behind
+	return strings.Replace(filled, string(filepath.Separator)+string(filepath.Separator), string(filepath.Separator), -1)
+}
+
+// fieldText returns a frontmatter value as text, the first item of a
+// list and nothing for a map.
+func fieldText(value interface{}) string {
+	switch v := value.(type) {
+	case nil, map[interface{}]interface{}:
+		return ""
+	case []interface{}:
+		if len(v) == 0 {
+			return ""
+		}
+		return fieldText(v[0])
+	}
+	return fmt.Sprint(value)
+}
+
+// OverrideFrontmatter sets fields in a post's frontmatter, replacing the
+// values the post has for them. The rest of the frontmatter is kept, in
+// order.
+func OverrideFrontmatter(post string, override yaml.MapSlice) string {
+	frontmatter, body, ok := SplitFrontmatter(post)
+	var fields yaml.MapSlice
+	if ok {
+		if err := yaml.Unmarshal([]byte(frontmatter), &fields); err != nil {
+			return post
+		}
+	}
+	for _, item := range override {
+		found := false
+		for i := range fields {
+			if fields[i].Key == item.Key {
+				fields[i].Value = item.Value
+				found = true
+			}
+		}
+		if !found {
+			fields = append(fields, item)
+		}
+	}
+	out, err := MarshalFrontmatter(fields)
+	if err != nil {
+		return post
+	}
+	return JoinFrontmatter(out, body)
+}
+
+// ApplyConfigFrontmatter adds the Frontmatter of the post's type and of
+// the config to a post where the post doesn't set the field itself, and
+// sets the fields of FrontmatterOverride whatever the post says.
+func (m *Mailpost) ApplyConfigFrontmatter(post string) string {
+	if postType, ok := ParseFields(post)["type"].(string); ok {
+		if t, ok := m.config.PostType(postType); ok && len(t.Frontmatter) > 0 {
+			post = MergeFrontmatter(post, configFields(t.Frontmatter))
+		}
+	}
+	if len(m.config.Frontmatter) > 0 {
+		post = MergeFrontmatter(post, configFields(m.config.Frontmatter))
+	}
+	if len(m.config.FrontmatterOverride) > 0 {
+		post = OverrideFrontmatter(post, configFields(m.config.FrontmatterOverride))
+	}
+	return post
+}
+
+// configFields returns fields from the config in name order.
+func configFields(fields map[string]interface{}) yaml.MapSlice {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var slice yaml.MapSlice
+	for _, name := range names {
+		slice = append(slice, yaml.MapItem{Key: name, Value: fields[name]})
+	}
+	return slice
+}
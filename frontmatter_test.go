@@ -0,0 +1,135 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// frontmatterTitles are titles that need quoting or escaping, and what
+// they read back as.
+var frontmatterTitles = []struct {
+	name  string
+	title string
+	want  string
+}{
+	{"plain", "A day out", "A day out"},
+	{"colon", "Re: my trip", "Re: my trip"},
+	{"colon at the end", "Packing list:", "Packing list:"},
+	{"colon and space at the start", ": leading", ": leading"},
+	{"double quotes", `"Quoted" words`, `"Quoted" words`},
+	{"single quotes", "It's 'fine'", "It's 'fine'"},
+	{"both quotes", `She said "it's here"`, `She said "it's here"`},
+	{"backslash", `C:\photos\new`, `C:\photos\new`},
+	{"emoji", "Sunset 🌅 at the beach 🏖️", "Sunset 🌅 at the beach 🏖️"},
+	{"emoji and colon", "🎉: party", "🎉: party"},
+	{"hash", "Day #3 # of 5", "Day #3 # of 5"},
+	{"yaml indicators", "- [not] {a} list & *ref | > !tag %", "- [not] {a} list & *ref | > !tag %"},
+	{"looks like a bool", "yes", "yes"},
+	{"looks like a number", "1984", "1984"},
+	{"looks like a date", "2020-01-02", "2020-01-02"},
+	{"frontmatter delimiter", "---", "---"},
+	{"newline", "First line\nsecond line", "First line second line"},
+	{"crlf and spaces", "  Windows\r\n  title  ", "Windows title"},
+	{"toml delimiter", "+++ and \"\"\"", "+++ and \"\"\""},
+}
+
+func TestMergeFrontmatterTitles(t *testing.T) {
+	for _, test := range frontmatterTitles {
+		post := MergeFrontmatter("---\ndraft: true\n---\nBody\n", yaml.MapSlice{{Key: "title", Value: test.title}})
+		fields := ParseFields(post)
+		if fields == nil {
+			t.Errorf("%s: frontmatter isn't valid YAML:\n%s", test.name, post)
+			continue
+		}
+		if got, _ := fields["title"].(string); got != test.want {
+			t.Errorf("%s: title read back as %q, want %q", test.name, fields["title"], test.want)
+		}
+		if fields["draft"] != true {
+			t.Errorf("%s: the author's draft field was lost:\n%s", test.name, post)
+		}
+	}
+}
+
+func TestMarshalFrontmatterKeepsNewlines(t *testing.T) {
+	// only titles are put on one line
+	summary := "First: one\n\"Second\" 🌅\n"
+	out, err := MarshalFrontmatter(yaml.MapSlice{{Key: "summary", Value: summary}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := yaml.Unmarshal([]byte(out), &fields); err != nil {
+		t.Fatalf("%s:\n%s", err, out)
+	}
+	if want := "First: one\n\"Second\" 🌅"; fields["summary"] != want {
+		t.Errorf("summary read back as %q, want %q", fields["summary"], want)
+	}
+}
+
+func TestFrontmatterFormatTitles(t *testing.T) {
+	for _, format := range []string{formatTOML, formatJSON} {
+		m := &Mailpost{config: Config{FrontmatterFormat: format}}
+		for _, test := range frontmatterTitles {
+			post := MergeFrontmatter("Body\n", yaml.MapSlice{{Key: "title", Value: test.title}})
+			written := m.FormatFrontmatter(post)
+			if written == post {
+				t.Errorf("%s %s: frontmatter wasn't converted:\n%s", format, test.name, post)
+				continue
+			}
+
+			read, err := NormalizeFrontmatter(written)
+			if err != nil {
+				t.Errorf("%s %s: %s:\n%s", format, test.name, err, written)
+				continue
+			}
+			fields := ParseFields(read)
+			if got, _ := fields["title"].(string); got != test.want {
+				t.Errorf("%s %s: title read back as %q, want %q", format, test.name, fields["title"], test.want)
+			}
+			if _, body, _ := SplitFrontmatter(read); body != "Body\n" {
+				t.Errorf("%s %s: body read back as %q", format, test.name, body)
+			}
+		}
+	}
+}
+
+func TestRepairFrontmatter(t *testing.T) {
+	tests := []struct {
+		name  string
+		post  string
+		title string
+	}{
+		{"valid", "---\ntitle: Fine\n---\n", "Fine"},
+		{"colon", "---\ntitle: Re: my trip\ndraft: true\n---\n", "Re: my trip"},
+		{"leading quote", "---\ntitle: \"Quoted\" words\n---\n", `"Quoted" words`},
+		{"colon and quotes", "---\ntitle: Re: \"this\" and 'that'\n---\n", `Re: "this" and 'that'`},
+		{"emoji and colon", "---\ntitle: 🌅: sunset\n---\n", "🌅: sunset"},
+		{"crlf", "---\r\ntitle: Re: crlf\r\n---\r\n", "Re: crlf"},
+	}
+	for _, test := range tests {
+		fields := ParseFields(RepairFrontmatter(test.post))
+		if got, _ := fields["title"].(string); got != test.title {
+			t.Errorf("%s: title repaired to %q, want %q", test.name, fields["title"], test.title)
+		}
+	}
+
+	// what can't be repaired is left alone
+	broken := "---\ntitle: [unclosed\n  - nested: {\n---\nBody\n"
+	if got := RepairFrontmatter(broken); got != broken {
+		t.Errorf("RepairFrontmatter changed frontmatter it couldn't fix:\n%s", got)
+	}
+}
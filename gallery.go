@@ -0,0 +1,95 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// Gallery is the data passed to the Gallery template: the images of a
+// message its post didn't refer to, in the order they were attached.
+type Gallery struct {
+	Images []ImageRef
+}
+
+// galleryStyles are the built-in values accepted for Gallery. Any other
+// value is parsed as a text/template.
+var galleryStyles = map[string]string{
+	"gallery": `{{if gt (len .Images) 1}}{{"{{<"}} gallery {{">}}"}}
+{{end}}{{range .Images}}{{"{{<"}} figure src="{{.URL}}"{{if .Alt}} alt="{{html .Alt}}"{{end}}{{if .Caption}} caption="{{html .Caption}}"{{end}} {{">}}"}}
+{{end}}{{if gt (len .Images) 1}}{{"{{<"}} /gallery {{">}}"}}
+{{end}}`,
+	"figures": `{{range .Images}}<figure><img src="{{.URL}}" alt="{{html .Alt}}">{{if .Caption}}<figcaption>{{html .Caption}}</figcaption>{{end}}</figure>
+{{end}}`,
+}
+
+// ParseGallery compiles the Gallery config value. An empty value leaves
+// images the post doesn't refer to out of it.
+func (m *Mailpost) ParseGallery() error {
+	style := m.config.Gallery
+	if style == "" {
+		return nil
+	}
+	if preset, ok := galleryStyles[strings.ToLower(style)]; ok {
+		style = preset
+	}
+
+	tmpl, err := template.New("gallery").Parse(style)
+	if err != nil {
+		return fmt.Errorf("invalid Gallery: %s", err)
+	}
+	m.galleryTmpl = tmpl
+	return nil
+}
+
+// AddGallery saves the images of a post's message that no post of it
+// referred to and adds a gallery of them to the end of the post, when
+// Gallery is set, so a sender can attach photos without naming each one
+// in the text. It is done for the last post of a message, once the others
+// have had their images.
+func (m *Mailpost) AddGallery(p int) string {
+	postInfo := m.posts[p]
+	if m.galleryTmpl == nil || (p+1 < len(m.posts) && m.posts[p+1].Msg == postInfo.Msg) {
+		return postInfo.Data
+	}
+
+	var gallery Gallery
+	for i := range m.images {
+		if m.images[i].Msg != postInfo.Msg || m.images[i].URL != "" {
+			continue
+		}
+		m.images[i].SaveImage(m, postInfo)
+		gallery.Images = append(gallery.Images, ImageRef{
+			URL:     m.images[i].URL,
+			Alt:     m.images[i].Description,
+			Caption: m.images[i].Description,
+			Name:    m.images[i].Name,
+		})
+	}
+	if len(gallery.Images) == 0 {
+		return postInfo.Data
+	}
+
+	buf := new(bytes.Buffer)
+	if err := m.galleryTmpl.Execute(buf, gallery); err != nil {
+		log.Printf("Failed to render gallery for %s: %s", postInfo.File, err)
+		return postInfo.Data
+	}
+	log.Printf("|-- Adding a gallery of %d images to %s", len(gallery.Images), postInfo.File)
+	return strings.TrimRight(postInfo.Data, "\r\n") + "\n\n" + buf.String()
+}
@@ -0,0 +1,209 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GC finds images under ImageDir that no post under PostDir refers to any
+// more, e.g. because the post was deleted or renamed, and removes them.
+// With PageBundles, so are the images in a bundle its post doesn't refer
+// to. With -dry-run they are only listed.
+func (m *Mailpost) GC(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only list orphaned images, don't remove them.")
+	siteName := flags.String("site", "", "Check the posts and images of this site from Sites instead of the main one.")
+	flags.Parse(args)
+
+	if !m.config.HasSite(*siteName) {
+		log.Fatalf("Unknown site: %s", *siteName)
+	}
+	m.config = *m.config.ForSite(*siteName)
+
+	postRoot := TemplateRoot(m.config.PostDir)
+	imageRoot := m.ImageRoot()
+
+	// every post's text, so an image counts as used if any of them mention
+	// it, and with PageBundles the images in each bundle, which only its
+	// own posts refer to, by name
+	exts := m.config.PostExts()
+	var index strings.Builder
+	posts := 0
+	bundles := make(map[string]string)
+	var bundled []string
+	err := filepath.Walk(postRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == imageRoot {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !exts[filepath.Ext(path)] {
+			if m.config.PageBundles && isImageFile(path) {
+				bundled = append(bundled, path)
+			}
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		index.Write(data)
+		index.WriteByte('\n')
+		bundles[filepath.Dir(path)] += string(data) + "\n"
+		posts++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Couldn't read posts in %s: %s", postRoot, err)
+	}
+	// held posts aren't written yet, but their images are
+	err = m.state.View(func(state *State) {
+		for _, scheduled := range state.Schedule {
+			index.WriteString(scheduled.Data)
+			index.WriteByte('\n')
+			bundles[filepath.Dir(scheduled.Path)] += scheduled.Data + "\n"
+		}
+	})
+	if err != nil {
+		log.Fatalf("Couldn't read held posts: %s", err)
+	}
+	used := index.String()
+
+	var orphans []string
+	var freed int64
+	err = filepath.Walk(imageRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		// posts link to images by URL, which ends with the same date
+		// directories and name as the file under ImageDir
+		rel, err := filepath.Rel(imageRoot, path)
+		if err != nil {
+			return err
+		}
+		if !mentionsImage(used, filepath.ToSlash(rel)) {
+			orphans = append(orphans, path)
+			freed += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Couldn't read images in %s: %s", imageRoot, err)
+	}
+	for _, path := range bundled {
+		// an image in a directory without a post isn't in a bundle
+		text, ok := bundles[filepath.Dir(path)]
+		if !ok || mentionsImage(text, filepath.Base(path)) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			orphans = append(orphans, path)
+			freed += info.Size()
+		}
+	}
+	sort.Strings(orphans)
+
+	log.Printf("Checked %d posts in %s against images in %s", posts, postRoot, imageRoot)
+	for _, path := range orphans {
+		if *dryRun {
+			log.Printf("   |-- Orphaned image: %s", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Couldn't remove %s: %s", path, err)
+			continue
+		}
+		log.Printf("   |-- Removed orphaned image: %s", path)
+		removeEmptyDirs(filepath.Dir(path), imageRoot)
+	}
+
+	if *dryRun {
+		log.Printf("%d orphaned images, %s could be freed", len(orphans), formatBytes(freed))
+	} else {
+		log.Printf("Removed %d orphaned images, %s freed", len(orphans), formatBytes(freed))
+	}
+}
+
+// mentionsImage reports whether text refers to the image name, or, for a
+// WebP or AVIF, to the image of the same name it was written next to as
+// one of the ExtraImageFormats, which posts don't link to themselves.
+func mentionsImage(text, name string) bool {
+	if strings.Contains(text, name) {
+		return true
+	}
+	ext := filepath.Ext(name)
+	if !strings.EqualFold(ext, imageExts[formatWebP]) && !strings.EqualFold(ext, imageExts[formatAVIF]) {
+		return false
+	}
+	base := strings.TrimSuffix(name, ext)
+	for _, primary := range imageExts {
+		if primary != strings.ToLower(ext) && strings.Contains(text, base+primary) {
+			return true
+		}
+	}
+	return false
+}
+
+// PostExts returns the extensions of post files: .md, and those the
+// FilenameTemplate of the site and of the Types end with.
+func (c *Config) PostExts() map[string]bool {
+	exts := map[string]bool{".md": true}
+	templates := []string{c.FilenameTemplate}
+	for _, postType := range c.Types {
+		templates = append(templates, postType.FilenameTemplate)
+	}
+	for _, tmpl := range templates {
+		if ext := filepath.Ext(tmpl); ext != "" && !strings.ContainsAny(ext, "{}") {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
+
+// isImageFile reports whether path has the extension of an image format
+// mailpost publishes.
+func isImageFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, imageExt := range imageExts {
+		if ext == imageExt {
+			return true
+		}
+	}
+	return ext == ".jpeg"
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including,
+// root for as long as they are empty.
+func removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) > 0 {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The site generators SiteGenerator can lay posts out for. Hugo is what
+// mailpost does without one.
+const (
+	generatorHugo   = "hugo"
+	generatorJekyll = "jekyll"
+)
+
+// jekyllDefaults are the settings of the Jekyll profile, used where the
+// config leaves them out. Jekyll wants every post in _posts, named with
+// its date, and static files under assets, and by default publishes a post
+// at /category/year/month/day/slug.html.
+var jekyllDefaults = struct {
+	PostDir, ImageDir, ImagePath, DatePathFmt, FilenameTemplate, PostURL string
+}{
+	PostDir:          "_posts",
+	ImageDir:         "assets/images/<date>",
+	ImagePath:        "/assets/images",
+	DatePathFmt:      "2006/01/02",
+	FilenameTemplate: "{{ .Date }}-{{ .Slug }}.md",
+	PostURL:          "<categories>/<date>/<title>.html",
+}
+
+// checkSiteGenerator checks the SiteGenerator config value.
+func (c *Config) checkSiteGenerator() error {
+	switch strings.ToLower(c.SiteGenerator) {
+	case "", generatorHugo, generatorJekyll:
+		return nil
+	}
+	return fmt.Errorf("invalid SiteGenerator %q: it must be %q or %q", c.SiteGenerator, generatorHugo, generatorJekyll)
+}
+
+// ApplySiteGenerator fills in the settings SiteGenerator implies that the
+// config doesn't set itself.
+func (c *Config) ApplySiteGenerator() {
+	if strings.ToLower(c.SiteGenerator) != generatorJekyll {
+		return
+	}
+	for _, s := range []struct {
+		value   string
+		setting *string
+	}{
+		{jekyllDefaults.PostDir, &c.PostDir},
+		{jekyllDefaults.ImageDir, &c.ImageDir},
+		{jekyllDefaults.ImagePath, &c.ImagePath},
+		{jekyllDefaults.DatePathFmt, &c.DatePathFmt},
+		{jekyllDefaults.FilenameTemplate, &c.FilenameTemplate},
+		{jekyllDefaults.PostURL, &c.PostURL},
+	} {
+		if *s.setting == "" {
+			*s.setting = s.value
+		}
+	}
+}
+
+// ApplyGeneratorFrontmatter adds the frontmatter SiteGenerator's themes
+// expect and the post doesn't have. For Jekyll that is layout "post" and,
+// unless it has a category, the post's type as its category.
+func (m *Mailpost) ApplyGeneratorFrontmatter(post string) string {
+	if strings.ToLower(m.config.SiteGenerator) != generatorJekyll {
+		return post
+	}
+	existing := ParseFields(post)
+	fields := yaml.MapSlice{{Key: "layout", Value: "post"}}
+	if postType, ok := existing["type"].(string); ok && postType != "" && existing["category"] == nil {
+		fields = append(fields, yaml.MapItem{Key: "categories", Value: []string{strings.ToLower(postType)}})
+	}
+	return MergeFrontmatter(post, fields)
+}
@@ -0,0 +1,137 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// defaultCommitMessage is the GitCommitMessage used when none is set: a
+// summary line and the title and slug of every post.
+const defaultCommitMessage = `{{if eq (len .Posts) 1}}Post "{{(index .Posts 0).Title}}"{{else}}Post {{len .Posts}} posts{{end}}
+
+{{range .Posts}}- {{.Title}} ({{.Slug}})
+{{end}}`
+
+// CommitPost is what a commit message template knows about a post.
+type CommitPost struct {
+	Title string
+	Slug  string
+	Type  string
+	Date  string
+	Path  string
+}
+
+// CommitInfo is the data passed to the GitCommitMessage template: the
+// posts written in the run, in the order they were read.
+type CommitInfo struct {
+	Posts []CommitPost
+}
+
+// ParseCommitMessage compiles the GitCommitMessage config value.
+func (m *Mailpost) ParseCommitMessage() error {
+	if !m.config.GitCommit {
+		return nil
+	}
+	text := m.config.GitCommitMessage
+	if text == "" {
+		text = defaultCommitMessage
+	}
+	tmpl, err := template.New("commit").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid GitCommitMessage: %s", err)
+	}
+	m.commitTmpl = tmpl
+	return nil
+}
+
+// CommitPosts commits the posts and images written in a run to the git
+// repository PostDir is in, with a message from GitCommitMessage, if
+// GitCommit is set. ImageDir has to be in the same repository. Posts that
+// went to other Sites are committed to their own repositories, one commit
+// each. With GitSigningKey the commit is signed, with GPG or, if
+// GitSigningFormat is "ssh", with an SSH key. A run that changed nothing
+// makes no commit, and a failed commit is only logged: the posts are
+// written either way.
+func (m *Mailpost) CommitPosts(posts []Post) {
+	if !m.config.GitCommit || len(posts) == 0 {
+		return
+	}
+	bySite := make(map[string][]Post)
+	for _, postInfo := range posts {
+		bySite[postInfo.Site] = append(bySite[postInfo.Site], postInfo)
+	}
+	for _, name := range m.config.SiteNames() {
+		if len(bySite[name]) > 0 {
+			m.commitSite(m.config.ForSite(name), bySite[name])
+		}
+	}
+}
+
+// commitSite makes the commit for the posts that went to one site.
+func (m *Mailpost) commitSite(site *Config, posts []Post) {
+	var info CommitInfo
+	for _, postInfo := range posts {
+		info.Posts = append(info.Posts, CommitPost{
+			Title: postInfo.Title,
+			Slug:  PostSlug(postInfo),
+			Type:  postInfo.Type,
+			Date:  postInfo.Date,
+			Path:  filepath.Join(postInfo.Path, postInfo.File),
+		})
+	}
+	message := new(bytes.Buffer)
+	if err := m.commitTmpl.Execute(message, info); err != nil {
+		log.Printf("Couldn't render GitCommitMessage: %s", err)
+		return
+	}
+
+	repo := TemplateRoot(site.PostDir)
+	err := m.git(repo, nil, "add", "-A", "--", repo, TemplateRoot(site.ImageDir))
+	if err != nil {
+		log.Printf("Couldn't add posts to git: %s", err)
+		return
+	}
+
+	args := []string{"commit", "-q", "-F", "-"}
+	if m.config.GitSigningKey != "" {
+		args = []string{"-c", "user.signingkey=" + m.config.GitSigningKey, "commit", "-q", "-S", "-F", "-"}
+		if m.config.GitSigningFormat != "" {
+			args = append([]string{"-c", "gpg.format=" + m.config.GitSigningFormat}, args...)
+		}
+	}
+	if err := m.git(repo, message, args...); err != nil {
+		log.Printf("Couldn't commit posts: %s", err)
+		return
+	}
+	log.Printf("Committed %d posts to git in %s", len(posts), repo)
+}
+
+// git runs a git command in dir, with stdin as its input if it isn't nil.
+func (m *Mailpost) git(dir string, stdin *bytes.Buffer, args ...string) error {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gmailAPI = "https://gmail.googleapis.com/gmail/v1/users/me"
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// GmailSource reads messages through the Gmail REST API, for accounts
+// where IMAP or password logins aren't allowed. Mailbox names are Gmail
+// labels. Processed messages are marked read and given GmailProcessedLabel
+// if it is set, moved to the ArchiveMailbox label, or moved to the trash
+// when DeleteProcessed is set.
+type GmailSource struct {
+	config  *Config
+	client  *http.Client
+	token   string
+	labels  map[string]string
+	pending []gmailPending
+}
+
+type gmailPending struct {
+	id      string
+	labelID string
+}
+
+func (s *GmailSource) Connect(ctx context.Context) error {
+	log.Print("Connecting to Gmail..\n")
+	client, err := s.config.HTTPClient()
+	if err != nil {
+		return err
+	}
+	s.client = client
+
+	form := url.Values{
+		"client_id":     {s.config.GmailClientID},
+		"client_secret": {s.config.GmailClientSecret},
+		"refresh_token": {s.config.GmailRefreshToken},
+		"grant_type":    {"refresh_token"},
+	}
+	resp, err := postForm(ctx, s.client, googleTokenURL, form)
+	if err != nil {
+		return fmt.Errorf("connection to server failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&token)
+	if token.AccessToken == "" {
+		return fmt.Errorf("couldn't get Gmail access token: %s %s", resp.Status, token.Error)
+	}
+	s.token = token.AccessToken
+
+	var labels struct {
+		Labels []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"labels"`
+	}
+	if err := s.call(ctx, "GET", "/labels", nil, &labels); err != nil {
+		return err
+	}
+
+	s.labels = make(map[string]string)
+	for _, label := range labels.Labels {
+		s.labels[label.Name] = label.ID
+	}
+	return nil
+}
+
+// labelID returns the ID of a label, creating the label if asked to.
+func (s *GmailSource) labelID(ctx context.Context, name string, create bool) (string, error) {
+	if id, ok := s.labels[name]; ok {
+		return id, nil
+	}
+	if !create {
+		return "", fmt.Errorf("couldn't find label %s", name)
+	}
+
+	var label struct {
+		ID string `json:"id"`
+	}
+	if err := s.call(ctx, "POST", "/labels", map[string]string{"name": name}, &label); err != nil {
+		return "", err
+	}
+	s.labels[name] = label.ID
+	return label.ID, nil
+}
+
+// query returns the Gmail search used to find new messages.
+func (s *GmailSource) query() string {
+	if s.config.GmailQuery != "" {
+		return s.config.GmailQuery
+	}
+	if s.config.GmailProcessedLabel != "" {
+		// Gmail searches write spaces and slashes in label names as dashes
+		label := strings.NewReplacer(" ", "-", "/", "-").Replace(s.config.GmailProcessedLabel)
+		return "-label:" + label
+	}
+	return "is:unread"
+}
+
+func (s *GmailSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.pending = nil
+
+	for _, mbox := range s.config.MailboxNames() {
+		log.Printf("Fetching new messages in %s..\n", mbox)
+		labelID, err := s.labelID(ctx, mbox, false)
+		if err != nil {
+			return err
+		}
+
+		var ids []string
+		pageToken := ""
+		for {
+			params := url.Values{"labelIds": {labelID}, "q": {s.query()}}
+			if pageToken != "" {
+				params.Set("pageToken", pageToken)
+			}
+
+			var list struct {
+				Messages []struct {
+					ID string `json:"id"`
+				} `json:"messages"`
+				NextPageToken string `json:"nextPageToken"`
+			}
+			if err := s.call(ctx, "GET", "/messages?"+params.Encode(), nil, &list); err != nil {
+				return err
+			}
+
+			for _, msg := range list.Messages {
+				ids = append(ids, msg.ID)
+			}
+			if pageToken = list.NextPageToken; pageToken == "" {
+				break
+			}
+		}
+
+		if len(ids) == 0 {
+			log.Print("No unread messages found.")
+			continue
+		}
+
+		// the list is newest first
+		for i := len(ids) - 1; i >= 0; i-- {
+			var msg struct {
+				Raw string `json:"raw"`
+			}
+			msgCtx, cancel := context.WithTimeout(ctx, s.config.PerMessageTimeout())
+			err := s.call(msgCtx, "GET", "/messages/"+ids[i]+"?format=raw", nil, &msg)
+			timedOut := msgCtx.Err() != nil && ctx.Err() == nil
+			cancel()
+			if timedOut {
+				log.Printf("Message %s took longer than MessageTimeout, leaving it for later.", ids[i])
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			body, err := base64.URLEncoding.DecodeString(msg.Raw)
+			if err != nil {
+				body, err = base64.RawURLEncoding.DecodeString(msg.Raw)
+			}
+			if err != nil {
+				log.Printf("Couldn't decode message %s: %s", ids[i], err)
+				continue
+			}
+			process(body)
+			s.pending = append(s.pending, gmailPending{ids[i], labelID})
+		}
+	}
+	return nil
+}
+
+func (s *GmailSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	defer func() { s.pending = nil }()
+
+	var processedID, archiveID string
+	var err error
+	if s.config.GmailProcessedLabel != "" {
+		if processedID, err = s.labelID(ctx, s.config.GmailProcessedLabel, true); err != nil {
+			return err
+		}
+	}
+	if s.config.ArchiveMailbox != "" {
+		if archiveID, err = s.labelID(ctx, s.config.ArchiveMailbox, true); err != nil {
+			return err
+		}
+	}
+
+	log.Print("Marking messages processed..\n")
+	for i, msg := range s.pending {
+		if archiveID == "" && s.config.Removable(status, i) {
+			if err := s.call(ctx, "POST", "/messages/"+msg.id+"/trash", nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		add := []string{}
+		remove := []string{"UNREAD"}
+		if processedID != "" {
+			add = append(add, processedID)
+		}
+		if archiveID != "" && Posted(status, i) {
+			add = append(add, archiveID)
+			remove = append(remove, msg.labelID)
+		}
+		err := s.call(ctx, "POST", "/messages/"+msg.id+"/modify",
+			map[string][]string{"addLabelIds": add, "removeLabelIds": remove}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GmailSource) Close() {}
+
+// call makes a Gmail API request, sending body as JSON if it isn't nil
+// and decoding the response into v if it isn't nil.
+func (s *GmailSource) call(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, method, gmailAPI+path, reader)
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Gmail request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		buf := new(strings.Builder)
+		io.Copy(buf, io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Gmail error: %s %s", resp.Status, buf.String())
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("Gmail request failed: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const graphAPI = "https://graph.microsoft.com/v1.0"
+const microsoftLogin = "https://login.microsoftonline.com/"
+
+// folders Graph lets us address by name instead of ID
+var graphWellKnownFolders = map[string]bool{
+	"inbox": true, "archive": true, "drafts": true, "sentitems": true,
+	"deleteditems": true, "junkemail": true,
+}
+
+// GraphSource reads messages from Office 365 through the Microsoft Graph
+// API, for tenants that have IMAP turned off. Mailbox names are folder
+// paths such as "Inbox/Blog".
+//
+// With GraphClientSecret set, mailpost signs in as the app registration
+// itself and reads GraphUser's mailbox. Without it, mailpost signs in as
+// a user with the device code flow the first time it runs and keeps the
+// refresh token in StateDir.
+type GraphSource struct {
+	config  *Config
+	state   string
+	client  *http.Client
+	token   string
+	folders map[string]string
+	pending []string
+}
+
+type graphToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (s *GraphSource) Connect(ctx context.Context) error {
+	log.Print("Connecting to Microsoft Graph..\n")
+	client, err := s.config.HTTPClient()
+	if err != nil {
+		return err
+	}
+	s.client = client
+	s.folders = make(map[string]string)
+
+	if s.config.GraphClientSecret != "" {
+		token, err := s.requestToken(ctx, url.Values{
+			"client_id":     {s.config.GraphClientID},
+			"client_secret": {s.config.GraphClientSecret},
+			"scope":         {"https://graph.microsoft.com/.default"},
+			"grant_type":    {"client_credentials"},
+		})
+		if err != nil {
+			return err
+		}
+		if token.AccessToken == "" {
+			return fmt.Errorf("couldn't get Graph access token: %s", token.Description)
+		}
+		s.token = token.AccessToken
+		return nil
+	}
+
+	if refresh, err := ioutil.ReadFile(s.tokenFile()); err == nil {
+		token, err := s.requestToken(ctx, url.Values{
+			"client_id":     {s.config.GraphClientID},
+			"refresh_token": {strings.TrimSpace(string(refresh))},
+			"grant_type":    {"refresh_token"},
+		})
+		if err != nil {
+			return err
+		}
+		if token.AccessToken != "" {
+			s.useToken(token)
+			return nil
+		}
+		log.Printf("Stored Graph sign-in no longer works: %s", token.Description)
+	}
+
+	token, err := s.deviceCode(ctx)
+	if err != nil {
+		return err
+	}
+	s.useToken(token)
+	return nil
+}
+
+// deviceCode signs in a user by having them enter a code in a browser.
+func (s *GraphSource) deviceCode(ctx context.Context) (graphToken, error) {
+	form := url.Values{
+		"client_id": {s.config.GraphClientID},
+		"scope":     {"offline_access Mail.ReadWrite"},
+	}
+	resp, err := postForm(ctx, s.client, s.loginURL("devicecode"), form)
+	if err != nil {
+		return graphToken{}, fmt.Errorf("connection to server failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var code struct {
+		DeviceCode string `json:"device_code"`
+		Message    string `json:"message"`
+		Interval   int    `json:"interval"`
+		ExpiresIn  int    `json:"expires_in"`
+	}
+	json.NewDecoder(resp.Body).Decode(&code)
+	if code.DeviceCode == "" {
+		return graphToken{}, fmt.Errorf("couldn't start Graph sign-in: %s", resp.Status)
+	}
+	log.Print(code.Message)
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		token, err := s.requestToken(ctx, url.Values{
+			"client_id":   {s.config.GraphClientID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		})
+		if err != nil {
+			return graphToken{}, err
+		}
+		switch token.Error {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return graphToken{}, fmt.Errorf("Graph sign-in failed: %s", token.Description)
+		}
+	}
+	return graphToken{}, fmt.Errorf("Graph sign-in timed out")
+}
+
+func (s *GraphSource) useToken(token graphToken) {
+	s.token = token.AccessToken
+	if token.RefreshToken == "" {
+		return
+	}
+	os.MkdirAll(filepath.Dir(s.tokenFile()), 0755)
+	if err := ioutil.WriteFile(s.tokenFile(), []byte(token.RefreshToken), 0600); err != nil {
+		log.Printf("Couldn't save Graph sign-in: %s", err)
+	}
+}
+
+func (s *GraphSource) tokenFile() string {
+	return filepath.Join(s.state, "graph-token")
+}
+
+func (s *GraphSource) loginURL(endpoint string) string {
+	tenant := s.config.GraphTenantID
+	if tenant == "" {
+		tenant = "organizations"
+	}
+	return microsoftLogin + url.PathEscape(tenant) + "/oauth2/v2.0/" + endpoint
+}
+
+func (s *GraphSource) requestToken(ctx context.Context, form url.Values) (graphToken, error) {
+	var token graphToken
+	resp, err := postForm(ctx, s.client, s.loginURL("token"), form)
+	if err != nil {
+		return token, fmt.Errorf("connection to server failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	json.NewDecoder(resp.Body).Decode(&token)
+	return token, nil
+}
+
+// mailbox is the path of the mailbox being read.
+func (s *GraphSource) mailbox() string {
+	if s.config.GraphClientSecret != "" {
+		return "/users/" + url.PathEscape(s.config.GraphUser)
+	}
+	return "/me"
+}
+
+// folderID finds a folder by its path, creating it if asked to.
+func (s *GraphSource) folderID(ctx context.Context, path string, create bool) (string, error) {
+	if id, ok := s.folders[path]; ok {
+		return id, nil
+	}
+
+	id := ""
+	for i, name := range strings.Split(path, "/") {
+		if i == 0 && graphWellKnownFolders[strings.ToLower(name)] {
+			id = strings.ToLower(name)
+			continue
+		}
+
+		parent := s.mailbox() + "/mailFolders"
+		if id != "" {
+			parent += "/" + id + "/childFolders"
+		}
+		filter := "displayName eq '" + strings.Replace(name, "'", "''", -1) + "'"
+
+		var list struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+		}
+		if err := s.call(ctx, "GET", parent+"?"+url.Values{"$filter": {filter}}.Encode(), nil, &list); err != nil {
+			return "", err
+		}
+
+		switch {
+		case len(list.Value) > 0:
+			id = list.Value[0].ID
+		case create:
+			var folder struct {
+				ID string `json:"id"`
+			}
+			if err := s.call(ctx, "POST", parent, map[string]string{"displayName": name}, &folder); err != nil {
+				return "", err
+			}
+			id = folder.ID
+		default:
+			return "", fmt.Errorf("couldn't find folder %s", path)
+		}
+	}
+	s.folders[path] = id
+	return id, nil
+}
+
+func (s *GraphSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.pending = nil
+
+	for _, mbox := range s.config.MailboxNames() {
+		log.Printf("Fetching new messages in %s..\n", mbox)
+		folder, err := s.folderID(ctx, mbox, false)
+		if err != nil {
+			return err
+		}
+
+		params := url.Values{
+			// Graph wants anything in $orderby to be in $filter first
+			"$filter":  {"receivedDateTime ge 1900-01-01T00:00:00Z and isRead eq false"},
+			"$orderby": {"receivedDateTime asc"},
+			"$select":  {"id"},
+		}
+		next := s.mailbox() + "/mailFolders/" + folder + "/messages?" + params.Encode()
+
+		var ids []string
+		for next != "" {
+			var list struct {
+				Value []struct {
+					ID string `json:"id"`
+				} `json:"value"`
+				NextLink string `json:"@odata.nextLink"`
+			}
+			if err := s.call(ctx, "GET", next, nil, &list); err != nil {
+				return err
+			}
+
+			for _, msg := range list.Value {
+				ids = append(ids, msg.ID)
+			}
+			next = list.NextLink
+		}
+
+		if len(ids) == 0 {
+			log.Print("No unread messages found.")
+			continue
+		}
+
+		for _, id := range ids {
+			msgCtx, cancel := context.WithTimeout(ctx, s.config.PerMessageTimeout())
+			resp, err := s.do(msgCtx, "GET", s.mailbox()+"/messages/"+id+"/$value", nil)
+			if err != nil {
+				timedOut := msgCtx.Err() != nil && ctx.Err() == nil
+				cancel()
+				if timedOut {
+					log.Printf("Message %s took longer than MessageTimeout, leaving it for later.", id)
+					continue
+				}
+				return err
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			cancel()
+			if err != nil {
+				log.Printf("Couldn't read message %s: %s", id, err)
+				continue
+			}
+			process(body)
+			s.pending = append(s.pending, id)
+		}
+	}
+	return nil
+}
+
+func (s *GraphSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	defer func() { s.pending = nil }()
+
+	var archiveID string
+	if s.config.ArchiveMailbox != "" {
+		var err error
+		if archiveID, err = s.folderID(ctx, s.config.ArchiveMailbox, true); err != nil {
+			return err
+		}
+	}
+
+	log.Print("Marking messages processed..\n")
+	for i, id := range s.pending {
+		path := s.mailbox() + "/messages/" + id
+		if err := s.call(ctx, "PATCH", path, map[string]bool{"isRead": true}, nil); err != nil {
+			return err
+		}
+
+		var err error
+		switch {
+		case archiveID != "" && Posted(status, i):
+			err = s.call(ctx, "POST", path+"/move", map[string]string{"destinationId": archiveID}, nil)
+		case archiveID == "" && s.config.Removable(status, i):
+			err = s.call(ctx, "POST", path+"/move", map[string]string{"destinationId": "deleteditems"}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GraphSource) Close() {}
+
+// call makes a Graph request, sending body as JSON if it isn't nil and
+// decoding the response into v if it isn't nil.
+func (s *GraphSource) call(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	resp, err := s.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("Graph request failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// do makes a Graph request and checks that it succeeded. path may also be
+// a full URL, as Graph gives for the next page of a list.
+func (s *GraphSource) do(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+
+	if !strings.HasPrefix(path, "https://") {
+		path = graphAPI + path
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Graph request failed: %s", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf := new(strings.Builder)
+		io.Copy(buf, io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Graph error: %s %s", resp.Status, buf.String())
+	}
+	return resp, nil
+}
@@ -0,0 +1,59 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// headerDecoder decodes RFC 2047 encoded words, both the Base64
+// ("=?UTF-8?B?...?=") and the quoted-printable ("=?UTF-8?Q?...?=") kind.
+var headerDecoder = &mime.WordDecoder{}
+
+// DecodeHeader returns a header value with its encoded words decoded. A
+// value that can't be decoded is returned as it is.
+func DecodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// DecodeFrom returns the From header of msg for display, with an encoded
+// display name decoded.
+func DecodeFrom(msg *mail.Message) string {
+	parser := mail.AddressParser{WordDecoder: headerDecoder}
+	addr, err := parser.Parse(msg.Header.Get("From"))
+	if err != nil {
+		return DecodeHeader(msg.Header.Get("From"))
+	}
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.Name + " <" + addr.Address + ">"
+}
+
+// DecodeFileName returns the decoded file name of an attachment. Names
+// split or encoded as RFC 2231 parameters are already decoded by the mime
+// package, but many mail clients put RFC 2047 encoded words in the plain
+// filename parameter instead.
+func DecodeFileName(name string) string {
+	if !strings.Contains(name, "=?") {
+		return name
+	}
+	return DecodeHeader(name)
+}
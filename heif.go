@@ -0,0 +1,62 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// heifConverter is the command HEIC and HEIF images are converted with,
+// from libheif.
+const heifConverter = "heif-convert"
+
+// heifQuality is the quality of the JPEG a HEIC image is converted to,
+// high enough that it loses next to nothing before it is scaled down.
+const heifQuality = "92"
+
+// IsHEIF reports whether contentType is a HEIC or HEIF image, as iPhones
+// attach.
+func IsHEIF(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/heic") || strings.HasPrefix(contentType, "image/heif")
+}
+
+// ConvertHEIF converts a HEIC or HEIF image to a JPEG, which Go can
+// decode, with heif-convert. The JPEG keeps the photo's EXIF, and is
+// already turned the way the photo is shown, with its orientation tag
+// reset to match.
+func (m *Mailpost) ConvertHEIF(data []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "mailpost-heif")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	source, target := filepath.Join(dir, "image.heic"), filepath.Join(dir, "image.jpg")
+	if err := ioutil.WriteFile(source, data, 0600); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(heifConverter, "-q", heifQuality, source, target).CombinedOutput()
+	if err != nil {
+		if strings.TrimSpace(string(out)) == "" {
+			return nil, fmt.Errorf("%s: %s", heifConverter, err)
+		}
+		return nil, fmt.Errorf("%s: %s: %s", heifConverter, err, firstOutputLine(string(out)))
+	}
+	return ioutil.ReadFile(target)
+}
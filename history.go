@@ -0,0 +1,164 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryEntry records what happened to one message that was processed.
+type HistoryEntry struct {
+	Processed time.Time
+	Source    string
+	MessageID string
+	Sender    string
+	Subject   string
+	Status    string
+	Posts     []string
+	Error     string `json:",omitempty"`
+}
+
+func (s MessageStatus) String() string {
+	switch s {
+	case MessagePosted:
+		return "posted"
+	case MessageFailed:
+		return "failed"
+	}
+	return "ignored"
+}
+
+// AddHistory saves entries to the history.
+func (s *StateStore) AddHistory(entries []HistoryEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		_, err := tx.Exec(`INSERT INTO history
+			(processed, source, message_id, sender, subject, status, posts, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Processed.UTC(), e.Source, e.MessageID, e.Sender, e.Subject,
+			e.Status, strings.Join(e.Posts, "\n"), e.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// History returns the messages processed since the given time, oldest
+// first, limited to one sender if sender isn't empty.
+func (s *StateStore) History(sender string, since time.Time) ([]HistoryEntry, error) {
+	query := `SELECT processed, source, message_id, sender, subject, status, posts, error
+		FROM history WHERE processed >= ?`
+	args := []interface{}{since.UTC()}
+	if sender != "" {
+		query += ` AND sender = ?`
+		args = append(args, strings.ToLower(sender))
+	}
+	query += ` ORDER BY processed, id`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		var posts string
+		err := rows.Scan(&e.Processed, &e.Source, &e.MessageID, &e.Sender,
+			&e.Subject, &e.Status, &posts, &e.Error)
+		if err != nil {
+			return nil, err
+		}
+		if posts != "" {
+			e.Posts = strings.Split(posts, "\n")
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RecordHistory saves the messages of the current run to the history. It
+// must be called before the run's status is reset.
+func (m *Mailpost) RecordHistory() {
+	if len(m.history) == 0 {
+		return
+	}
+	for i := range m.history {
+		if i < len(m.status) {
+			m.history[i].Status = m.status[i].String()
+		}
+	}
+	if err := m.state.AddHistory(m.history); err != nil {
+		log.Printf("Couldn't save history: %s", err)
+	}
+	m.history = nil
+}
+
+// HistoryCommand prints the history of processed messages.
+func (m *Mailpost) HistoryCommand(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	sender := flags.String("sender", "", "Only show messages from this address.")
+	since := flags.String("since", "", "Only show messages processed on or after this date (2006-01-02).")
+	asJSON := flags.Bool("json", false, "Print the history as JSON.")
+	flags.Parse(args)
+
+	var from time.Time
+	if *since != "" {
+		var err error
+		if from, err = time.ParseInLocation("2006-01-02", *since, time.Local); err != nil {
+			log.Fatalf("Invalid -since date: %s", err)
+		}
+	}
+
+	entries, err := m.state.History(*sender, from)
+	if err != nil {
+		log.Fatalf("Couldn't read history: %s", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []HistoryEntry{}
+		}
+		enc.Encode(entries)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROCESSED\tSTATUS\tSENDER\tSUBJECT\tPOSTS")
+	for _, e := range entries {
+		detail := strings.Join(e.Posts, ", ")
+		if e.Error != "" {
+			detail = e.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Processed.Local().Format("2006-01-02 15:04"),
+			e.Status, e.Sender, e.Subject, detail)
+	}
+	w.Flush()
+}
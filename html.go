@@ -0,0 +1,302 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToMarkdown converts the HTML part of a message to Markdown. It keeps
+// headings, paragraphs and line breaks, emphasis, code, lists, links,
+// images and block quotes, and drops everything else but the text. Text
+// isn't escaped, so frontmatter and Markdown typed into a rich text editor
+// come through as they were written. Images attached to the message are
+// referenced as cid: links, which ReplaceImageRefs resolves.
+func HTMLToMarkdown(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return src
+	}
+
+	w := &mdWriter{atLineStart: true}
+	w.node(doc)
+
+	lines := strings.Split(w.out.String(), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
+
+// mdWriter writes Markdown as the HTML tree is walked. Block elements ask
+// for a number of line breaks before their content; the breaks are only
+// written when more content follows, so blocks don't pile up blank lines.
+type mdWriter struct {
+	out         strings.Builder
+	prefix      []string // what each line starts with inside quotes and lists
+	marker      string   // list marker for the next line written
+	lists       []int    // item counters of the open lists, -1 for unordered
+	breaks      int      // line breaks wanted before the next content
+	newlines    int      // line breaks at the end of out
+	atLineStart bool
+	space       bool // whitespace is pending between inline content
+	pre         int
+}
+
+// block asks for at least n line breaks before the next content.
+func (w *mdWriter) block(n int) {
+	if w.out.Len() > 0 && w.breaks < n {
+		w.breaks = n
+	}
+	w.space = false
+}
+
+func (w *mdWriter) lineBreak() {
+	w.flushBreaks()
+	if w.atLineStart {
+		w.out.WriteString(strings.TrimRight(strings.Join(w.prefix, ""), " "))
+	}
+	w.out.WriteString("\n")
+	w.atLineStart = true
+	w.newlines++
+	w.space = false
+}
+
+func (w *mdWriter) flushBreaks() {
+	for w.newlines < w.breaks {
+		if w.newlines > 0 {
+			w.out.WriteString(strings.TrimRight(strings.Join(w.prefix, ""), " "))
+		}
+		w.out.WriteString("\n")
+		w.newlines++
+		w.atLineStart = true
+	}
+	w.breaks = 0
+}
+
+// inline writes s as content, after any pending line breaks and
+// whitespace.
+func (w *mdWriter) inline(s string) {
+	w.flushBreaks()
+	if w.atLineStart {
+		if w.marker != "" {
+			w.out.WriteString(strings.Join(w.prefix[:len(w.prefix)-1], "") + w.marker)
+			w.marker = ""
+		} else {
+			w.out.WriteString(strings.Join(w.prefix, ""))
+		}
+		w.atLineStart = false
+	} else if w.space {
+		w.out.WriteString(" ")
+	}
+	w.out.WriteString(s)
+	w.space = false
+	w.newlines = 0
+}
+
+// closing writes the end of an inline span, like the ** after bold text,
+// directly after it and before any pending whitespace.
+func (w *mdWriter) closing(s string) {
+	space := w.space
+	w.space = false
+	w.out.WriteString(s)
+	w.space = space
+}
+
+func (w *mdWriter) text(s string) {
+	if w.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.lineBreak()
+			}
+			if line != "" {
+				w.inline(line)
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" && !w.atLineStart {
+			w.space = true
+		}
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		w.space = !w.atLineStart
+	}
+	w.inline(strings.Join(words, " "))
+	last := s[len(s)-1]
+	w.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+func (w *mdWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *mdWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title:
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block(2)
+		w.inline(strings.Repeat("#", int(n.Data[1]-'0')))
+		w.space = true
+		w.children(n)
+		w.block(2)
+
+	case atom.P:
+		w.block(2)
+		w.children(n)
+		w.block(2)
+
+	case atom.Br:
+		w.lineBreak()
+
+	case atom.Hr:
+		// not ---, which would look like the end of the frontmatter
+		w.block(2)
+		w.inline("* * *")
+		w.block(2)
+
+	case atom.Blockquote:
+		w.block(2)
+		w.flushBreaks()
+		w.prefix = append(w.prefix, "> ")
+		w.children(n)
+		w.prefix = w.prefix[:len(w.prefix)-1]
+		w.block(2)
+
+	case atom.Ul, atom.Ol:
+		if len(w.lists) > 0 {
+			w.block(1)
+		} else {
+			w.block(2)
+		}
+		counter := -1
+		if n.DataAtom == atom.Ol {
+			counter = 1
+			if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+				counter = start
+			}
+		}
+		w.lists = append(w.lists, counter)
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.block(2)
+
+	case atom.Li:
+		w.block(1)
+		marker := "- "
+		if len(w.lists) > 0 && w.lists[len(w.lists)-1] >= 0 {
+			marker = strconv.Itoa(w.lists[len(w.lists)-1]) + ". "
+			w.lists[len(w.lists)-1]++
+		}
+		w.prefix = append(w.prefix, strings.Repeat(" ", len(marker)))
+		w.marker = marker
+		w.children(n)
+		w.marker = ""
+		w.prefix = w.prefix[:len(w.prefix)-1]
+		w.block(1)
+
+	case atom.Pre:
+		w.block(2)
+		w.inline("```")
+		w.lineBreak()
+		w.pre++
+		w.children(n)
+		w.pre--
+		if !w.atLineStart {
+			w.lineBreak()
+		}
+		w.inline("```")
+		w.block(2)
+
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		if w.pre > 0 {
+			w.children(n)
+			break
+		}
+		w.inline("`")
+		w.children(n)
+		w.closing("`")
+
+	case atom.B, atom.Strong:
+		w.inline("**")
+		w.children(n)
+		w.closing("**")
+
+	case atom.I, atom.Em:
+		w.inline("*")
+		w.children(n)
+		w.closing("*")
+
+	case atom.A:
+		href := attr(n, "href")
+		if href == "" || strings.HasPrefix(href, "#") {
+			w.children(n)
+			break
+		}
+		w.inline("[")
+		w.children(n)
+		w.closing("](" + href + ")")
+
+	case atom.Img:
+		src := attr(n, "src")
+		if src != "" {
+			w.inline("![" + attr(n, "alt") + "](" + src + ")")
+		}
+
+	case atom.Div, atom.Table, atom.Tr, atom.Section, atom.Article,
+		atom.Header, atom.Footer, atom.Center, atom.Dl, atom.Dt, atom.Dd:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+
+	case atom.Td, atom.Th:
+		w.children(n)
+		w.space = !w.atLineStart
+
+	default:
+		w.children(n)
+	}
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
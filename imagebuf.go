@@ -0,0 +1,136 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"sync"
+)
+
+// Big photos are expensive to handle, so the buffers for them are kept
+// and reused from one image to the next instead of being allocated anew.
+var (
+	encodeBuffers  = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	compositeCache = sync.Pool{}
+)
+
+// opaque reports whether img has no transparent pixels. Types that can't
+// be transparent, like the YCbCr images JPEGs decode to, answer without
+// looking at the pixels.
+func opaque(img image.Image) bool {
+	o, ok := img.(interface{ Opaque() bool })
+	return ok && o.Opaque()
+}
+
+// hasAlpha reports whether a freshly decoded image has transparency that
+// has to be flattened away before it is saved as a JPEG. JPEGs never do,
+// whatever they decode to; other formats such as PNG are checked. It should
+// be asked before resizing, which can turn the image into a type whose
+// opacity is only known by going through every pixel.
+func hasAlpha(format string, img image.Image) bool {
+	if format == "jpeg" {
+		return false
+	}
+	return !opaque(img)
+}
+
+// flatten returns img as it should be encoded as a JPEG: as it is if it
+// has no alpha, otherwise drawn over a white background so transparent
+// areas don't turn black. The returned function gives the background's
+// memory back for the next image once the caller is done with it.
+func flatten(img image.Image, alpha bool) (image.Image, func()) {
+	if !alpha {
+		return img, func() {}
+	}
+
+	bounds := img.Bounds()
+	size := 4 * bounds.Dx() * bounds.Dy()
+	var finalImg *image.RGBA
+	if cached, ok := compositeCache.Get().(*image.RGBA); ok && cap(cached.Pix) >= size {
+		finalImg = &image.RGBA{Pix: cached.Pix[:size], Stride: 4 * bounds.Dx(), Rect: bounds}
+	} else {
+		finalImg = image.NewRGBA(bounds)
+	}
+
+	backgroundColor := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	draw.Draw(finalImg, bounds, image.NewUniform(backgroundColor), image.Point{}, draw.Src)
+	draw.Draw(finalImg, bounds, img, bounds.Min, draw.Over)
+	return finalImg, func() { compositeCache.Put(finalImg) }
+}
+
+// encodeJPEG writes img to w as a JPEG, flattening it first if alpha is
+// set, with the metadata segment meta, if there is one, from
+// KeptMetadata.
+func encodeJPEG(w io.Writer, img image.Image, alpha bool, meta []byte) error {
+	flat, release := flatten(img, alpha)
+	defer release()
+	if meta != nil {
+		w = &segmentWriter{w: w, segment: meta}
+	}
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: jpeg.DefaultQuality})
+}
+
+// encodeImageBuffer encodes img into a buffer from the pool, see
+// encodeImage. The buffer goes back with releaseBuffer.
+func encodeImageBuffer(img image.Image, alpha bool, format string, data, meta []byte) (*bytes.Buffer, error) {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := encodeImage(buf, img, alpha, format, data, meta); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	encodeBuffers.Put(buf)
+}
+
+// writeImageFile encodes img straight into the file at path, without
+// holding the whole image in memory first, see encodeImage.
+func writeImageFile(path string, img image.Image, alpha bool, format string, data, meta []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 64<<10)
+	err = encodeImage(w, img, alpha, format, data, meta)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFile writes the contents of buf to the file at path.
+func writeFile(path string, buf *bytes.Buffer) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
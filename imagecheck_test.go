@@ -0,0 +1,432 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// An imageFixture is a tiny image of a kind phones and mail clients send,
+// built the same way every time, along with what the image pipeline
+// should make of it.
+type imageFixture struct {
+	name        string
+	contentType string
+	data        []byte
+	want        imageWant
+	// what it should come out as with KeepImageFormat, if that differs
+	kept *imageWant
+}
+
+// imageWant is what a fixture should come out of the pipeline as. A
+// skipped image is one mailpost doesn't handle and leaves alone.
+type imageWant struct {
+	skipped bool
+	format  string
+	width   int
+	height  int
+	// corner is the colour the top left pixel should have, if set
+	corner color.Color
+	// frames is how many frames an animation should have, if set
+	frames int
+}
+
+// imageFixtures returns the fixtures the image pipeline is checked with.
+func imageFixtures() []imageFixture {
+	return []imageFixture{
+		{
+			// a transparent PNG has to come out on white, not black
+			name:        "alpha.png",
+			contentType: "image/png",
+			data:        alphaPNGFixture(32, 32),
+			want:        imageWant{format: "jpeg", width: 32, height: 32, corner: color.White},
+			kept:        &imageWant{format: "png", width: 32, height: 32, corner: color.Transparent},
+		},
+		{
+			// phones store photos sideways and say so in the EXIF
+			// orientation; mailpost turns them upright
+			name:        "rotated.jpg",
+			contentType: "image/jpeg",
+			data:        orientedJPEGFixture(8, 4, 6),
+			want:        imageWant{format: "jpeg", width: 4, height: 8},
+		},
+		{
+			name:        "cmyk.jpg",
+			contentType: "image/jpeg",
+			data:        cmykJPEGFixture(16, 8),
+			want:        imageWant{format: "jpeg", width: 16, height: 8, corner: color.RGBA{51, 124, 235, 0xff}},
+		},
+		{
+			// scanners write 16 bits per channel
+			name:        "deep.png",
+			contentType: "image/png",
+			data:        deepPNGFixture(6, 6),
+			want:        imageWant{format: "jpeg", width: 6, height: 6, corner: color.RGBA{0x40, 0x80, 0xc0, 0xff}},
+			kept:        &imageWant{format: "png", width: 6, height: 6, corner: color.RGBA{0x40, 0x80, 0xc0, 0xff}},
+		},
+		{
+			name:        "animated.gif",
+			contentType: "image/gif",
+			data:        animatedGIFFixture(4, 4, 2),
+			want:        imageWant{skipped: true},
+			kept:        &imageWant{format: "gif", width: 4, height: 4, frames: 2},
+		},
+	}
+}
+
+// CheckImage runs a fixture through the image pipeline the way an
+// attachment goes through it and returns what doesn't match what it
+// should come out as.
+func (m *Mailpost) CheckImage(f imageFixture) error {
+	want := f.want
+	if m.config.KeepImageFormat && f.kept != nil {
+		want = *f.kept
+	}
+	if !m.HasImage(f.contentType) {
+		if want.skipped {
+			return nil
+		}
+		return fmt.Errorf("%s isn't handled as an image", f.contentType)
+	}
+	if want.skipped {
+		return fmt.Errorf("%s should be skipped but is handled as an image", f.contentType)
+	}
+
+	img, alpha, err := m.DecodeImage(f.data, Post{})
+	if err != nil {
+		return fmt.Errorf("decoding: %s", err)
+	}
+	buf, err := encodeImageBuffer(img, alpha, m.PublishedFormat(f.contentType), f.data, nil)
+	if err != nil {
+		return fmt.Errorf("encoding: %s", err)
+	}
+	defer releaseBuffer(buf)
+
+	out, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("decoding the output: %s", err)
+	}
+	if format != want.format {
+		return fmt.Errorf("output is %s, want %s", format, want.format)
+	}
+	bounds := out.Bounds()
+	if bounds.Dx() != want.width || bounds.Dy() != want.height {
+		return fmt.Errorf("output is %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), want.width, want.height)
+	}
+	if want.corner != nil && !similarColor(out.At(bounds.Min.X, bounds.Min.Y), want.corner) {
+		return fmt.Errorf("top left pixel is %v, want %v", out.At(bounds.Min.X, bounds.Min.Y), want.corner)
+	}
+	if want.frames > 0 {
+		anim, err := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return fmt.Errorf("decoding the output's frames: %s", err)
+		}
+		if len(anim.Image) != want.frames {
+			return fmt.Errorf("output has %d frames, want %d", len(anim.Image), want.frames)
+		}
+	}
+	return nil
+}
+
+// similarColor reports whether two colours are the same give or take what
+// JPEG compression changes.
+func similarColor(a, b color.Color) bool {
+	const tolerance = 0x0800
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	near := func(x, y uint32) bool {
+		return x+tolerance >= y && y+tolerance >= x
+	}
+	return near(ar, br) && near(ag, bg) && near(ab, bb) && near(aa, ba)
+}
+
+func TestImagePipeline(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		m := &Mailpost{config: Config{KeepImageFormat: keep}}
+		for _, f := range imageFixtures() {
+			if err := m.CheckImage(f); err != nil {
+				t.Errorf("%s with KeepImageFormat %v: %s", f.name, keep, err)
+			}
+		}
+	}
+}
+
+func TestAnimatedGIFScaled(t *testing.T) {
+	// the second frame only covers the right half, as GIF encoders write
+	// frames that change part of the picture
+	palette := color.Palette{color.Black, color.White, color.Transparent}
+	first := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+	second := image.NewPaletted(image.Rect(20, 0, 40, 20), palette)
+	for p := range second.Pix {
+		second.Pix[p] = 1
+	}
+	// with a transparent top left corner
+	for y := 0; y < 10; y++ {
+		for x := 20; x < 30; x++ {
+			second.SetColorIndex(x, y, 2)
+		}
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{10, 10}})
+	data := buf.Bytes()
+
+	tests := []struct {
+		name   string
+		config Config
+		from   string
+		width  int
+		height int
+		// where the second frame should end up
+		frame image.Rectangle
+	}{
+		{"no limit", Config{}, "", 40, 20, image.Rect(20, 0, 40, 20)},
+		{"MaxImgWidth", Config{MaxImgWidth: 10}, "", 10, 5, image.Rect(5, 0, 10, 5)},
+		{"sender's MaxImgHeight", Config{Senders: map[string]Sender{"a@example.com": {MaxImgHeight: 4}}}, "a@example.com", 8, 4, image.Rect(4, 0, 8, 4)},
+		{"wider than MaxImgWidth", Config{MaxImgWidth: 80}, "", 40, 20, image.Rect(20, 0, 40, 20)},
+	}
+	for _, test := range tests {
+		test.config.KeepImageFormat = true
+		m := &Mailpost{config: test.config}
+		img, alpha, err := m.DecodeImage(data, Post{From: test.from})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		out, err := encodeImageBuffer(img, alpha, m.PublishedFormat("image/gif"), data, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+		releaseBuffer(out)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if anim.Config.Width != test.width || anim.Config.Height != test.height {
+			t.Errorf("%s: GIF is %dx%d, want %dx%d", test.name, anim.Config.Width, anim.Config.Height, test.width, test.height)
+		}
+		if len(anim.Image) != 2 {
+			t.Errorf("%s: GIF has %d frames, want 2", test.name, len(anim.Image))
+			continue
+		}
+		if got := anim.Image[0].Bounds(); got != image.Rect(0, 0, test.width, test.height) {
+			t.Errorf("%s: first frame is %v", test.name, got)
+		}
+		frame := anim.Image[1]
+		if frame.Bounds() != test.frame {
+			t.Errorf("%s: second frame is %v, want %v", test.name, frame.Bounds(), test.frame)
+		}
+		// the transparent corner scales down with the rest of the frame
+		b := frame.Bounds()
+		if _, _, _, a := frame.At(b.Min.X, b.Min.Y).RGBA(); a != 0 {
+			t.Errorf("%s: second frame's top left pixel isn't transparent", test.name)
+		}
+		if got := frame.At(b.Max.X-1, b.Max.Y-1); !similarColor(got, color.White) {
+			t.Errorf("%s: second frame's bottom right pixel is %v, want white", test.name, got)
+		}
+	}
+}
+
+// alphaPNGFixture makes a PNG that is transparent but for a red square
+// in the bottom right quarter, far enough from the top left corner for
+// JPEG compression not to smear it there.
+func alphaPNGFixture(width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := height / 2; y < height; y++ {
+		for x := width / 2; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// deepPNGFixture makes an opaque PNG with 16 bits per channel in one
+// flat colour.
+func deepPNGFixture(width, height int) []byte {
+	img := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{0x4040, 0x8080, 0xc0c0, 0xffff})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// orientedJPEGFixture makes a JPEG with an EXIF orientation tag, as a
+// phone held on its side writes.
+func orientedJPEGFixture(width, height int, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// dark on the left, light on the right, so a rotation shows
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 255 / width), 0x80, 0x80, 0xff})
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 90})
+
+	// a big endian TIFF header and an IFD with the one tag
+	var exif bytes.Buffer
+	exif.WriteString("Exif\x00\x00")
+	exif.WriteString("MM\x00\x2a")
+	binary.Write(&exif, binary.BigEndian, uint32(8))
+	binary.Write(&exif, binary.BigEndian, uint16(1))
+	binary.Write(&exif, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&exif, binary.BigEndian, uint32(1))
+	binary.Write(&exif, binary.BigEndian, []uint16{orientation, 0})
+	binary.Write(&exif, binary.BigEndian, uint32(0))
+
+	// APP1 goes right after SOI
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(exif.Len()+2))
+	out.Write(exif.Bytes())
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+// animatedGIFFixture makes a GIF with a few frames of alternating colour.
+func animatedGIFFixture(width, height, frames int) []byte {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % 2)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, anim)
+	return buf.Bytes()
+}
+
+// cmykJPEGFixture makes a CMYK JPEG in one flat colour, as print shops
+// and some scanners send. The standard library can't write those, so it
+// is put together by hand: every 8x8 block has only its DC coefficient
+// and the Adobe marker says the components are unconverted CMYK.
+func cmykJPEGFixture(width, height int) []byte {
+	// stored inverted, as Adobe writes them; this is a mid blue
+	cmyk := [4]int{255 - 200, 255 - 120, 255 - 0, 255 - 20}
+
+	var out bytes.Buffer
+	segment := func(marker byte, payload []byte) {
+		out.Write([]byte{0xff, marker})
+		binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+		out.Write(payload)
+	}
+
+	out.Write([]byte{0xff, 0xd8})
+	segment(0xee, []byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0})
+
+	// every quantization step is 1, so the DC coefficient is exact
+	dqt := append([]byte{0}, bytes.Repeat([]byte{1}, 64)...)
+	segment(0xdb, dqt)
+
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 4}
+	for c := byte(1); c <= 4; c++ {
+		sof = append(sof, c, 0x11, 0)
+	}
+	segment(0xc0, sof)
+
+	// DC categories 0-11 all get 4 bit codes; the only AC code is EOB
+	dcCounts := make([]byte, 16)
+	dcCounts[3] = 12
+	dht := append([]byte{0x00}, dcCounts...)
+	dht = append(dht, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	acCounts := make([]byte, 16)
+	acCounts[0] = 1
+	dht = append(dht, 0x10)
+	dht = append(dht, acCounts...)
+	dht = append(dht, 0x00)
+	segment(0xc4, dht)
+
+	sos := []byte{4}
+	for c := byte(1); c <= 4; c++ {
+		sos = append(sos, c, 0x00)
+	}
+	sos = append(sos, 0, 63, 0)
+	segment(0xda, sos)
+
+	var bits bitWriter
+	blocks := ((width + 7) / 8) * ((height + 7) / 8)
+	var prev [4]int
+	for b := 0; b < blocks; b++ {
+		for c := 0; c < 4; c++ {
+			dc := 8 * (cmyk[c] - 128)
+			diff := dc - prev[c]
+			prev[c] = dc
+
+			size := 0
+			for v := diff; v != 0; v /= 2 {
+				size++
+			}
+			bits.Write(uint32(size), 4)
+			if diff < 0 {
+				diff += 1<<uint(size) - 1
+			}
+			bits.Write(uint32(diff), size)
+			bits.Write(0, 1)
+		}
+	}
+	out.Write(bits.Bytes())
+	out.Write([]byte{0xff, 0xd9})
+	return out.Bytes()
+}
+
+// bitWriter collects the bits of JPEG entropy coded data.
+type bitWriter struct {
+	buf   []byte
+	acc   uint32
+	nbits int
+}
+
+func (w *bitWriter) Write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.acc = w.acc<<1 | (v>>uint(i))&1
+		w.nbits++
+		if w.nbits == 8 {
+			w.flush()
+		}
+	}
+}
+
+func (w *bitWriter) flush() {
+	b := byte(w.acc)
+	w.buf = append(w.buf, b)
+	if b == 0xff {
+		w.buf = append(w.buf, 0)
+	}
+	w.acc, w.nbits = 0, 0
+}
+
+// Bytes pads the last byte with ones and returns the data.
+func (w *bitWriter) Bytes() []byte {
+	for w.nbits != 0 {
+		w.Write(1, 1)
+	}
+	return w.buf
+}
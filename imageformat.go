@@ -0,0 +1,122 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// The formats images are published in.
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+	formatGIF  = "gif"
+)
+
+// imageExts are the extensions images are saved with, by format.
+var imageExts = map[string]string{
+	formatJPEG: ".jpg",
+	formatPNG:  ".png",
+	formatGIF:  ".gif",
+	formatWebP: ".webp",
+	formatAVIF: ".avif",
+}
+
+// PublishedFormat returns the format an image of contentType is published
+// in: ImageFormat, or JPEG if it isn't set, unless KeepImageFormat is set
+// and it is a PNG, such as a screenshot, or a GIF, which keep theirs.
+func (m *Mailpost) PublishedFormat(contentType string) string {
+	if m.config.KeepImageFormat {
+		switch {
+		case strings.HasPrefix(contentType, "image/png"):
+			return formatPNG
+		case strings.HasPrefix(contentType, "image/gif"):
+			return formatGIF
+		}
+	}
+	if format := strings.ToLower(m.config.ImageFormat); format != "" {
+		return format
+	}
+	return formatJPEG
+}
+
+// encodeImage writes img to w in format, or as a JPEG if it is a format
+// only an external encoder can write. Only a JPEG is flattened onto
+// white, and only a JPEG gets the metadata segment meta, if there is one;
+// a PNG keeps its transparency. A GIF is made again from data, the image
+// as it was sent, since img is only its first frame, with every frame
+// scaled down as much as img was.
+func encodeImage(w io.Writer, img image.Image, alpha bool, format string, data, meta []byte) error {
+	switch format {
+	case formatPNG:
+		return png.Encode(w, img)
+	case formatGIF:
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if first := anim.Image[0].Bounds().Dx(); img.Bounds().Dx() < first {
+			scaleGIF(anim, float64(img.Bounds().Dx())/float64(first))
+		}
+		// without the comments and application data it was sent with
+		return gif.EncodeAll(w, anim)
+	}
+	return encodeJPEG(w, img, alpha, meta)
+}
+
+// scaleGIF scales every frame of anim, and the screen they are drawn on,
+// by factor. Each pixel is a pixel of the original frame, so it keeps its
+// palette and transparency, and the frames still line up.
+func scaleGIF(anim *gif.GIF, factor float64) {
+	scale := func(v int) int {
+		return int(float64(v)*factor + 0.5)
+	}
+	width, height := scale(anim.Config.Width), scale(anim.Config.Height)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	for i, frame := range anim.Image {
+		b := frame.Bounds()
+		r := image.Rect(scale(b.Min.X), scale(b.Min.Y), scale(b.Max.X), scale(b.Max.Y))
+		// a frame too small to scale is kept as one pixel on the screen
+		if r.Dx() < 1 {
+			r.Max.X = r.Min.X + 1
+			if r.Max.X > width {
+				r = r.Add(image.Pt(width-r.Max.X, 0))
+			}
+		}
+		if r.Dy() < 1 {
+			r.Max.Y = r.Min.Y + 1
+			if r.Max.Y > height {
+				r = r.Add(image.Pt(0, height-r.Max.Y))
+			}
+		}
+		scaled := resize.Resize(uint(r.Dx()), uint(r.Dy()), frame, resize.NearestNeighbor)
+		out := image.NewPaletted(r, frame.Palette)
+		draw.Draw(out, r, scaled, scaled.Bounds().Min, draw.Src)
+		anim.Image[i] = out
+	}
+	anim.Config.Width, anim.Config.Height = width, height
+}
@@ -0,0 +1,120 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ImageRef holds what is known about a single image reference in a post.
+// It is the data passed to the ImageRefStyle template. Caption is the
+// caption the reference gave, or else its alt text, or else the
+// attachment's Content-Description.
+type ImageRef struct {
+	URL     string
+	Alt     string
+	Title   string
+	Caption string
+	Name    string
+}
+
+// imageRefStyles are the built-in values accepted for ImageRefStyle. Any
+// other value is parsed as a text/template.
+var imageRefStyles = map[string]string{
+	"markdown": `![{{.Alt}}]({{.URL}}{{if .Title}} "{{.Title}}"{{end}})`,
+	"figure":   `{{"{{<"}} figure src="{{.URL}}"{{if .Alt}} alt="{{html .Alt}}"{{end}}{{if .Title}} title="{{html .Title}}"{{end}}{{if .Caption}} caption="{{html .Caption}}"{{end}} {{">}}"}}`,
+	"img":      `<img src="{{.URL}}" alt="{{html .Alt}}"{{if .Title}} title="{{html .Title}}"{{end}}>`,
+}
+
+var reRefMarkdown = regexp.MustCompile(`^!\[(.*)\]\(\s*\S+?(?:\s+"(.*?)")?\s*\)$`)
+var reRefAttr = regexp.MustCompile(`(\w+)="(.*?)"`)
+
+// ParseImageRefStyle compiles the ImageRefStyle config value. An empty
+// style leaves references in the syntax the author used.
+func (m *Mailpost) ParseImageRefStyle() error {
+	style := m.config.ImageRefStyle
+	if style == "" {
+		return nil
+	}
+	if preset, ok := imageRefStyles[strings.ToLower(style)]; ok {
+		style = preset
+	}
+
+	tmpl, err := template.New("imageref").Parse(style)
+	if err != nil {
+		return fmt.Errorf("invalid ImageRefStyle: %s", err)
+	}
+	m.refTmpl = tmpl
+	return nil
+}
+
+// ParseImageRef pulls the alt text and title out of a Markdown image,
+// figure/img shortcode or HTML img reference.
+func (m *Mailpost) ParseImageRef(ref string) ImageRef {
+	var info ImageRef
+
+	if matches := reRefMarkdown.FindStringSubmatch(ref); matches != nil {
+		info.Alt = matches[1]
+		info.Title = matches[2]
+		return info
+	}
+
+	for _, attr := range reRefAttr.FindAllStringSubmatch(ref, -1) {
+		switch strings.ToLower(attr[1]) {
+		case "alt":
+			info.Alt = html.UnescapeString(attr[2])
+		case "title":
+			info.Title = html.UnescapeString(attr[2])
+		case "caption":
+			info.Caption = html.UnescapeString(attr[2])
+		}
+	}
+	return info
+}
+
+// RewriteImageRef replaces a matched image reference in a post with one
+// pointing at the saved image. ref is the complete reference, old is the
+// portion of it that names the image and replacement is what old becomes
+// when no ImageRefStyle is configured.
+func (m *Mailpost) RewriteImageRef(data, ref, old, replacement string, imageInfo Image) string {
+	if m.refTmpl == nil {
+		return strings.Replace(data, old, replacement, 1)
+	}
+
+	info := m.ParseImageRef(ref)
+	info.URL = imageInfo.URL
+	info.Name = imageInfo.Name
+	if info.Caption == "" {
+		info.Caption = info.Alt
+	}
+	if info.Caption == "" {
+		info.Caption = imageInfo.Description
+	}
+	if info.Alt == "" {
+		info.Alt = imageInfo.Description
+	}
+
+	buf := new(bytes.Buffer)
+	if err := m.refTmpl.Execute(buf, info); err != nil {
+		log.Printf("Failed to render image reference for %s: %s", imageInfo.Name, err)
+		return strings.Replace(data, old, replacement, 1)
+	}
+	return strings.Replace(data, ref, buf.String(), 1)
+}
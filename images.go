@@ -0,0 +1,196 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// originalExt is the extension an original is archived with when its
+// name doesn't have one.
+const originalExt = ".orig"
+
+// SaveOriginal keeps the image as it was sent under OriginalsDir, at the
+// same place as the published image is under ImageDir, so "images
+// rebuild" can make it again later. Only the extension differs. A HEIC
+// image is kept as the JPEG it was converted to. Images saved in a page
+// bundle aren't under ImageDir, and aren't kept.
+func (m *Mailpost) SaveOriginal(site *Config, imageInfo Image) {
+	if site.OriginalsDir == "" {
+		return
+	}
+	rel, err := filepath.Rel(TemplateRoot(site.ImageDir), imageInfo.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(m.SanitizeFilename(imageInfo.OrigName)))
+	if ext == "" {
+		ext = originalExt
+	}
+	if ext == ".heic" || ext == ".heif" {
+		// what is kept is the JPEG it was converted to
+		ext = imageExts[formatJPEG]
+	}
+	path := filepath.Join(site.OriginalsDir, strings.TrimSuffix(rel, filepath.Ext(rel))+ext)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Couldn't keep original of %s: %s", imageInfo.Path, err)
+		return
+	}
+	m.files.Acquire()
+	err = ioutil.WriteFile(path, imageInfo.Data, 0644)
+	m.files.Release()
+	if err != nil {
+		log.Printf("Couldn't keep original of %s: %s", imageInfo.Path, err)
+	}
+}
+
+// Images runs the images commands. "images rebuild" makes the published
+// images again from the originals kept under OriginalsDir, e.g. after
+// MaxImgWidth was changed. -width overrides MaxImgWidth. Posts are
+// pointed at the new file if its name changed.
+func (m *Mailpost) Images(args []string) int {
+	if len(args) == 0 || args[0] != "rebuild" {
+		log.Printf("Usage: mailpost images rebuild [-width N] [-site name] [-dry-run]")
+		return 2
+	}
+	flags := flag.NewFlagSet("images rebuild", flag.ExitOnError)
+	width := flags.Uint("width", 0, "Scale images down to this width instead of MaxImgWidth.")
+	siteName := flags.String("site", "", "Rebuild the images of this site from Sites instead of the main one.")
+	dryRun := flags.Bool("dry-run", false, "Only list the images that would be rebuilt.")
+	flags.Parse(args[1:])
+
+	if !m.config.HasSite(*siteName) {
+		log.Fatalf("Unknown site: %s", *siteName)
+	}
+	m.config = *m.config.ForSite(*siteName)
+	if m.config.OriginalsDir == "" {
+		log.Printf("OriginalsDir isn't set, so there are no originals to rebuild from")
+		return 1
+	}
+	if m.config.PageBundles {
+		// bundle images aren't under ImageDir, so SaveOriginal keeps none
+		log.Printf("PageBundles is set, so images are saved in each post's bundle and no originals are kept to rebuild them from")
+		return 1
+	}
+	if *width > 0 {
+		m.config.MaxImgWidth = *width
+	}
+
+	imageRoot := m.ImageRoot()
+	status, rebuilt := 0, 0
+	renamed := make(map[string]string)
+	err := filepath.Walk(m.config.OriginalsDir, func(original string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(m.config.OriginalsDir, original)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(imageRoot, filepath.Dir(rel))
+		base := strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel))
+		published := findPublished(dir, base)
+		format := m.PublishedFormat(mime.TypeByExtension(strings.ToLower(filepath.Ext(rel))))
+		target := filepath.Join(dir, base+imageExts[format])
+
+		if *dryRun {
+			log.Printf("   |-- Would rebuild %s from %s", target, original)
+			return nil
+		}
+		data, err := ioutil.ReadFile(original)
+		if err != nil {
+			return err
+		}
+		img, alpha, err := m.DecodeImage(data, Post{})
+		if err != nil {
+			log.Printf("Couldn't decode %s: %s", original, err)
+			status = 1
+			return nil
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := m.writePublishedImage(target, img, alpha, format, data, m.KeptMetadata(data, Post{})); err != nil {
+			return err
+		}
+		log.Printf("   |-- Rebuilt %s", target)
+		rebuilt++
+
+		if published != "" && published != target {
+			os.Remove(published)
+			old, _ := filepath.Rel(imageRoot, published)
+			renamed[filepath.ToSlash(old)] = filepath.ToSlash(filepath.Join(filepath.Dir(rel), base+imageExts[format]))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't rebuild images from %s: %s", m.config.OriginalsDir, err)
+		return 1
+	}
+
+	if len(renamed) > 0 {
+		m.RenameImageRefs(renamed)
+	}
+	if !*dryRun {
+		log.Printf("Rebuilt %d images in %s", rebuilt, imageRoot)
+	}
+	return status
+}
+
+// findPublished returns the image in dir named base, whatever its
+// extension, or "" if there is none.
+func findPublished(dir, base string) string {
+	matches, _ := filepath.Glob(filepath.Join(dir, base+".*"))
+	for _, match := range matches {
+		if strings.TrimSuffix(filepath.Base(match), filepath.Ext(match)) == base {
+			return match
+		}
+	}
+	return ""
+}
+
+// RenameImageRefs points the posts under PostDir at renamed images.
+// renamed maps the old path of an image under ImageDir to its new one,
+// which is how its URL ends too.
+func (m *Mailpost) RenameImageRefs(renamed map[string]string) {
+	postRoot := TemplateRoot(m.config.PostDir)
+	err := filepath.Walk(postRoot, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		post := string(data)
+		for from, to := range renamed {
+			post = strings.Replace(post, path.Join(m.config.ImagePath, from), path.Join(m.config.ImagePath, to), -1)
+		}
+		if post == string(data) {
+			return nil
+		}
+		log.Printf("   |-- Updated image links in %s", file)
+		return ioutil.WriteFile(file, []byte(post), info.Mode())
+	})
+	if err != nil {
+		log.Printf("Couldn't update image links in %s: %s", postRoot, err)
+	}
+}
@@ -0,0 +1,697 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// IMAPSource reads new messages from one or more mailboxes on an IMAP
+// server. Processed messages are flagged Seen and, if ArchiveMailbox is
+// set, moved to the archive mailbox or, if DeleteProcessed is set,
+// deleted.
+//
+// The highest UID processed in each mailbox is kept in the state, and
+// only messages after it are read, whether they are flagged Seen or not.
+// The first time a mailbox is read, or when its UIDVALIDITY changes and
+// the old UIDs mean nothing, unseen messages are read instead. If
+// SearchQuery is set, only messages matching it are ever read.
+//
+// Every message in DraftsMailbox is a submission, read or not, so authors
+// can save a draft there instead of sending mail. Posted drafts are always
+// archived or deleted; the others are flagged $MailpostSkipped and left
+// for the author to fix.
+//
+// Messages are downloaded FetchBatchSize at a time, each one streamed
+// from the connection to a file under WorkDir, and only read back, one at
+// a time, once its batch is in. Messages larger than MaxMessageSize are
+// left on the server without being downloaded.
+type IMAPSource struct {
+	config  *Config
+	state   *StateStore
+	spool   string
+	client  *imap.Client
+	pending []pendingMessage
+	uids    map[string]MailboxState
+
+	// the structure of the messages being fetched, with FetchParts
+	structures map[uint32]*bodyPart
+}
+
+type pendingMessage struct {
+	mbox string
+	uid  uint32
+}
+
+// skippedDraft flags drafts that weren't posted, so they are only looked
+// at again once the author saves a new version.
+const skippedDraft = "$MailpostSkipped"
+
+// mailboxes returns the mailboxes to read, including DraftsMailbox.
+func (s *IMAPSource) mailboxes() []string {
+	mboxes := s.config.MailboxNames()
+	if s.config.DraftsMailbox == "" {
+		return mboxes
+	}
+	for _, mbox := range mboxes {
+		if mbox == s.config.DraftsMailbox {
+			return mboxes
+		}
+	}
+	return append(append([]string{}, mboxes...), s.config.DraftsMailbox)
+}
+
+// draftsDelay is how long a draft must have been left alone before it is
+// posted, so one that is still being written and autosaved isn't.
+func (s *IMAPSource) draftsDelay() time.Duration {
+	return s.config.DraftsDelay.Or(2 * time.Minute)
+}
+
+func (s *IMAPSource) Connect(ctx context.Context) error {
+	var err error
+	log.Print("Connecting to server..\n")
+	s.client, err = s.dial(ctx)
+
+	if err != nil {
+		s.recordFailure(err, false)
+		return fmt.Errorf("connection to server failed: %s", err)
+	}
+
+	if s.client.State() == imap.Login {
+		log.Print("Logging in..\n")
+		if _, err := imap.Wait(s.client.Login(s.config.User, s.config.Password)); err != nil {
+			s.client.Logout(1 * time.Second)
+			s.recordFailure(err, false)
+			return fmt.Errorf("login failed: %s", err)
+		}
+	}
+
+	if s.config.Compress && s.client.Caps["COMPRESS=DEFLATE"] {
+		if _, err := s.client.CompressDeflate(-1); err != nil {
+			log.Printf("Couldn't turn on compression: %s", err)
+		}
+	}
+	s.recordConnect()
+	return nil
+}
+
+// dial opens the TLS connection to Server, through Proxy if one is set.
+func (s *IMAPSource) dial(ctx context.Context) (*imap.Client, error) {
+	addr := s.config.Server
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, "993")
+	}
+	conn, err := s.config.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := s.config.TLSConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	client, err := imap.NewClient(tls.Client(conn, config), host, 60*time.Second)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s *IMAPSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.pending = nil
+	s.uids = make(map[string]MailboxState)
+	for _, mbox := range s.mailboxes() {
+		if err := s.fetchMailbox(ctx, mbox, process); err != nil {
+			s.recordFailure(err, true)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *IMAPSource) fetchMailbox(ctx context.Context, mbox string, process func(body []byte)) error {
+	log.Printf("Opening %s..\n", mbox)
+	if _, err := s.client.Select(mbox, false); err != nil {
+		return fmt.Errorf("couldn't open mailbox %s: %s", mbox, err)
+	}
+
+	drafts := mbox == s.config.DraftsMailbox
+	criteria := s.searchCriteria()
+	search := "1:* " + criteria
+	if drafts {
+		search = "1:* NOT DELETED NOT KEYWORD " + skippedDraft
+	}
+
+	// drafts are removed or flagged once processed, so they don't need UIDs
+	var known MailboxState
+	byUID := false
+	if !drafts {
+		if err := s.state.View(func(state *State) { known = state.UIDs[s.stateKey(mbox)] }); err != nil {
+			return fmt.Errorf("couldn't read state: %s", err)
+		}
+
+		current := MailboxState{UIDValidity: s.client.Mailbox.UIDValidity}
+		switch {
+		case known.LastUID > 0 && known.UIDValidity == current.UIDValidity:
+			search = fmt.Sprintf("UID %d:*", known.LastUID+1)
+			if s.config.SearchQuery != "" {
+				search += " " + criteria
+			}
+			current.LastUID = known.LastUID
+			byUID = true
+		case known.LastUID > 0:
+			log.Printf("UIDVALIDITY of %s changed, reading unseen messages.", mbox)
+			fallthrough
+		default:
+			// from now on, only mail that arrives after this is read
+			if next := s.client.Mailbox.UIDNext; next > 0 {
+				current.LastUID = next - 1
+			}
+		}
+		s.uids[mbox] = current
+	}
+
+	log.Print("Fetching unread UIDs..\n")
+	cmd, err := imap.Wait(s.client.UIDSearch(search))
+	if err != nil {
+		return fmt.Errorf("UIDSearch failed: %s", err)
+	}
+
+	var uids []uint32
+	if len(cmd.Data) > 0 {
+		uids = cmd.Data[0].SearchResults()
+	}
+
+	// "n:*" always matches the last message, even if its UID is below n
+	if byUID {
+		var newer []uint32
+		for _, uid := range uids {
+			if uid > known.LastUID {
+				newer = append(newer, uid)
+			}
+		}
+		uids = newer
+	}
+	if len(uids) == 0 {
+		log.Print("No unread messages found.")
+		return nil
+	}
+
+	uids, err = s.checkMessages(ctx, mbox, uids, drafts)
+	if err != nil {
+		return err
+	}
+
+	batch := s.config.FetchBatchSize
+	if batch <= 0 {
+		batch = 20
+	}
+	for start := 0; start < len(uids); start += batch {
+		end := start + batch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		log.Printf("Fetching mail bodies %d-%d of %d..\n", start+1, end, len(uids))
+
+		// the whole batch gets MessageTimeout for each of its messages
+		batchCtx, cancel := context.WithTimeout(ctx, s.config.PerMessageTimeout()*time.Duration(end-start))
+		files, err := s.spoolBodies(batchCtx, uids[start:end])
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids[start:end] {
+			file, ok := files[uid]
+			if !ok {
+				continue
+			}
+			body, err := ioutil.ReadFile(file)
+			os.Remove(file)
+			if err != nil {
+				log.Printf("Couldn't read message %d: %s", uid, err)
+				continue
+			}
+			process(body)
+			s.pending = append(s.pending, pendingMessage{mbox, uid})
+		}
+	}
+	return nil
+}
+
+// checkMessages looks at the size and date of the messages in uids before
+// any are downloaded, and returns the ones that should be. Messages over
+// MaxMessageSize are skipped for good: the UID record moves past them, and
+// drafts are flagged $MailpostSkipped.
+func (s *IMAPSource) checkMessages(ctx context.Context, mbox string, uids []uint32, drafts bool) ([]uint32, error) {
+	set, _ := imap.NewSeqSet("")
+	set.AddNum(uids...)
+	oversize, _ := imap.NewSeqSet("")
+
+	items := []string{"UID", "RFC822.SIZE", "INTERNALDATE"}
+	s.structures = make(map[uint32]*bodyPart)
+	// signatures are over the whole message, and encrypted parts look
+	// like any other attachment, so those need it all
+	if s.config.FetchParts && !s.config.VerifiesSignatures() && !s.config.Decrypt {
+		items = append(items, "BODYSTRUCTURE")
+	}
+
+	ok := make(map[uint32]bool)
+	err := s.fetch(ctx, set, func(info *imap.MessageInfo) error {
+		if structure, found := info.Attrs["BODYSTRUCTURE"]; found {
+			s.structures[info.UID] = parseBodyStructure(structure, "", s.config.AttachmentTypes)
+		}
+		switch {
+		case s.config.MaxMessageSize > 0 && Size(info.Size) > s.config.MaxMessageSize:
+			log.Printf("Message %d is %d bytes, over MaxMessageSize, skipping it.", info.UID, info.Size)
+			oversize.AddNum(info.UID)
+			if current, found := s.uids[mbox]; found && info.UID > current.LastUID {
+				current.LastUID = info.UID
+				s.uids[mbox] = current
+			}
+		case drafts && time.Since(info.InternalDate) < s.draftsDelay():
+			log.Printf("Draft %d was saved too recently, leaving it for later.", info.UID)
+		default:
+			ok[info.UID] = true
+		}
+		return nil
+	}, items...)
+	if err != nil {
+		return nil, err
+	}
+
+	if drafts && !oversize.Empty() {
+		if err := s.store(oversize, skippedDraft); err != nil {
+			return nil, err
+		}
+	}
+
+	var wanted []uint32
+	for _, uid := range uids {
+		if ok[uid] {
+			wanted = append(wanted, uid)
+		}
+	}
+	return wanted, nil
+}
+
+// spoolBodies downloads the messages in uids into files of their own,
+// see spoolReader, so no body has to be held in memory while its batch
+// comes in. Messages with parts that aren't needed are fetched a part at
+// a time instead. It returns the files by UID; if it fails, the files
+// already written are removed.
+func (s *IMAPSource) spoolBodies(ctx context.Context, uids []uint32) (map[uint32]string, error) {
+	if err := os.MkdirAll(s.spool, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create %s: %s", s.spool, err)
+	}
+
+	spool := &spoolReader{dir: s.spool}
+	set, _ := imap.NewSeqSet("")
+	files := make(map[uint32]string)
+	var err error
+	for _, uid := range uids {
+		structure := s.structures[uid]
+		if structure == nil || structure.complete() {
+			set.AddNum(uid)
+			continue
+		}
+		var body []byte
+		if body, err = s.fetchParts(ctx, uid, structure); err != nil {
+			break
+		}
+		if files[uid], err = spool.write(body); err != nil {
+			break
+		}
+	}
+
+	if err == nil && !set.Empty() {
+		prev := s.client.SetLiteralReader(spool)
+		err = s.fetch(ctx, set, func(info *imap.MessageInfo) error {
+			var err error
+			switch body := info.Attrs["BODY[]"].(type) {
+			case *spooledLiteral:
+				files[info.UID] = body.path
+			default:
+				// a body short enough to come as a quoted string
+				files[info.UID], err = spool.write(imap.AsBytes(body))
+			}
+			return err
+		}, "UID", "BODY[]")
+		s.client.SetLiteralReader(prev)
+	}
+
+	if err != nil {
+		for _, file := range spool.files {
+			os.Remove(file)
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// spoolReader is the LiteralReader the IMAP client reads literals with
+// while bodies are fetched. It copies each one from the connection
+// straight into a file of its own under dir.
+type spoolReader struct {
+	dir   string
+	files []string
+}
+
+func (r *spoolReader) ReadLiteral(in io.Reader, info imap.LiteralInfo) (imap.Literal, error) {
+	f, err := r.create()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(f, in, int64(info.Len))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't spool message: %s", err)
+	}
+	return &spooledLiteral{path: f.Name(), info: info}, nil
+}
+
+// write writes a body that is already in memory to a file of its own.
+func (r *spoolReader) write(body []byte) (string, error) {
+	f, err := r.create()
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("couldn't spool message: %s", err)
+	}
+	return f.Name(), nil
+}
+
+func (r *spoolReader) create() (*os.File, error) {
+	f, err := ioutil.TempFile(r.dir, "fetch-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't spool message: %s", err)
+	}
+	r.files = append(r.files, f.Name())
+	return f, nil
+}
+
+// spooledLiteral is a literal spoolReader wrote to the file at path.
+type spooledLiteral struct {
+	path string
+	info imap.LiteralInfo
+}
+
+func (l *spooledLiteral) WriteTo(w io.Writer) (int64, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (l *spooledLiteral) Info() imap.LiteralInfo {
+	return l.info
+}
+
+// fetch runs a UID FETCH of items for the messages in set and calls fn
+// with each message as its response comes in. It gives up when ctx is
+// done, leaving the connection to be closed.
+func (s *IMAPSource) fetch(ctx context.Context, set *imap.SeqSet, fn func(info *imap.MessageInfo) error, items ...string) error {
+	cmd, err := s.client.UIDFetch(set, items...)
+	if err != nil {
+		return fmt.Errorf("fetch failed: %s", err)
+	}
+
+	for cmd.InProgress() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("fetch failed: %s", err)
+		}
+		if err := s.client.Recv(10 * time.Second); err != nil && err != imap.ErrTimeout {
+			return fmt.Errorf("fetch failed: %s", err)
+		}
+
+		for _, rsp := range cmd.Data {
+			if err := fn(rsp.MessageInfo()); err != nil {
+				return err
+			}
+		}
+		cmd.Data = nil
+	}
+
+	if rsp, err := cmd.Result(imap.OK); err != nil {
+		if err == imap.ErrAborted {
+			return fmt.Errorf("fetch command aborted")
+		}
+		return resultError("fetch", rsp, err)
+	}
+	return nil
+}
+
+func (s *IMAPSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	defer func() { s.pending = nil }()
+
+	for _, mbox := range s.mailboxes() {
+		drafts := mbox == s.config.DraftsMailbox
+		seen, _ := imap.NewSeqSet("")
+		done, _ := imap.NewSeqSet("")
+		remove, _ := imap.NewSeqSet("")
+		skipped, _ := imap.NewSeqSet("")
+
+		for i, msg := range s.pending {
+			if msg.mbox != mbox {
+				continue
+			}
+			seen.AddNum(msg.uid)
+			if Posted(status, i) {
+				done.AddNum(msg.uid)
+			}
+			if s.config.Removable(status, i) || (drafts && Posted(status, i)) {
+				remove.AddNum(msg.uid)
+			}
+			if drafts && !Posted(status, i) {
+				skipped.AddNum(msg.uid)
+			}
+		}
+		s.saveUIDs(mbox)
+		if seen.Empty() {
+			continue
+		}
+
+		if _, err := s.client.Select(mbox, false); err != nil {
+			return fmt.Errorf("couldn't open mailbox %s: %s", mbox, err)
+		}
+
+		log.Print("Marking messages seen..\n")
+		if err := s.store(seen, `\Seen`); err != nil {
+			return err
+		}
+		if !skipped.Empty() {
+			if err := s.store(skipped, skippedDraft); err != nil {
+				return err
+			}
+		}
+
+		if s.config.ArchiveMailbox != "" && !done.Empty() {
+			if err := s.archive(done); err != nil {
+				return err
+			}
+		} else if !remove.Empty() {
+			log.Print("Deleting processed messages..\n")
+			if err := s.expunge(remove); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// searchCriteria returns the IMAP SEARCH criteria that pick the messages
+// to read: SearchQuery if it is set, otherwise unseen messages. It is sent
+// to the server as written, so quoting is up to the user.
+func (s *IMAPSource) searchCriteria() string {
+	query := strings.TrimSpace(s.config.SearchQuery)
+	if query == "" {
+		return "NOT SEEN"
+	}
+	return query
+}
+
+// stateKey identifies a mailbox in the state.
+func (s *IMAPSource) stateKey(mbox string) string {
+	return "imap:" + s.config.User + "@" + s.config.Server + "/" + mbox
+}
+
+// saveUIDs records the highest UID processed in mbox.
+func (s *IMAPSource) saveUIDs(mbox string) {
+	current, ok := s.uids[mbox]
+	if !ok {
+		return
+	}
+	for _, msg := range s.pending {
+		if msg.mbox == mbox && msg.uid > current.LastUID {
+			current.LastUID = msg.uid
+		}
+	}
+
+	err := s.state.Update(func(state *State) error {
+		known := state.UIDs[s.stateKey(mbox)]
+		if known.UIDValidity == current.UIDValidity && known.LastUID > current.LastUID {
+			return nil
+		}
+		state.UIDs[s.stateKey(mbox)] = current
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't save UIDs of %s: %s", mbox, err)
+	}
+}
+
+func (s *IMAPSource) store(set *imap.SeqSet, flag string) error {
+	cmd, err := s.client.UIDStore(set, "+FLAGS.SILENT", imap.NewFlagSet(flag))
+	if err != nil {
+		return fmt.Errorf("UIDStore failed: %s", err)
+	}
+
+	if rsp, err := cmd.Result(imap.OK); err != nil {
+		return resultError("UIDStore", rsp, err)
+	}
+	return nil
+}
+
+// archive copies the messages in set to ArchiveMailbox and expunges them
+// from the selected mailbox.
+func (s *IMAPSource) archive(set *imap.SeqSet) error {
+	log.Printf("Moving messages to %s..\n", s.config.ArchiveMailbox)
+	cmd, err := s.client.UIDCopy(set, s.config.ArchiveMailbox)
+	if err != nil {
+		return fmt.Errorf("UIDCopy failed: %s", err)
+	}
+	if rsp, err := cmd.Result(imap.OK); err != nil {
+		return resultError("UIDCopy", rsp, err)
+	}
+
+	return s.expunge(set)
+}
+
+// expunge permanently removes the messages in set from the selected
+// mailbox. Without UIDPLUS the server can only expunge every message
+// flagged \Deleted, including ones mailpost didn't touch.
+func (s *IMAPSource) expunge(set *imap.SeqSet) error {
+	if err := s.store(set, `\Deleted`); err != nil {
+		return err
+	}
+
+	if !s.client.Caps["UIDPLUS"] {
+		log.Print("Server doesn't support UIDPLUS, expunging all deleted messages.")
+		set = nil
+	}
+	cmd, err := s.client.Expunge(set)
+	if err != nil {
+		return fmt.Errorf("expunge failed: %s", err)
+	}
+	if rsp, err := cmd.Result(imap.OK); err != nil {
+		return resultError("expunge", rsp, err)
+	}
+	return nil
+}
+
+// resultError describes why a command didn't end with OK: the server's
+// answer, or if none came, the error that kept it from coming, such as a
+// dropped connection, which Retry can connect again after.
+func resultError(command string, rsp *imap.Response, err error) error {
+	if rsp == nil {
+		return fmt.Errorf("%s failed: %s", command, err)
+	}
+	return fmt.Errorf("%s error: %v", command, rsp.Info)
+}
+
+// idleTimeout is how long a single IDLE command is kept running. RFC 2177
+// says servers may drop clients that idle for more than 30 minutes, so the
+// command is re-issued a little before that.
+const idleTimeout = 29 * time.Minute
+
+// Idle waits for the server to report new mail using the IDLE extension,
+// or until.
+func (s *IMAPSource) Idle(until time.Time) bool {
+	if !s.client.Caps["IDLE"] {
+		log.Print("Server doesn't support IDLE, falling back to polling.")
+		return false
+	}
+	if len(s.mailboxes()) > 1 {
+		log.Print("IDLE can only watch one mailbox, falling back to polling.")
+		return false
+	}
+
+	for {
+		log.Print("Waiting for new mail (IDLE)..\n")
+		if _, err := s.client.Idle(); err != nil {
+			log.Printf("IDLE failed: %s", err)
+			return false
+		}
+
+		newMail := false
+		deadline := time.Now().Add(idleTimeout)
+		if !until.IsZero() && until.Before(deadline) {
+			deadline = until
+		}
+		for !newMail && time.Now().Before(deadline) {
+			err := s.client.Recv(deadline.Sub(time.Now()))
+			if err == imap.ErrTimeout {
+				break
+			} else if err != nil {
+				log.Printf("IDLE failed: %s", err)
+				return false
+			}
+
+			for _, rsp := range s.client.Data {
+				if rsp.Label == "EXISTS" || rsp.Label == "RECENT" {
+					newMail = true
+				}
+			}
+			s.client.Data = nil
+		}
+
+		if _, err := s.client.IdleTerm(); err != nil {
+			log.Printf("Couldn't end IDLE: %s", err)
+			return false
+		}
+		if newMail || (!until.IsZero() && !time.Now().Before(until)) {
+			return true
+		}
+	}
+}
+
+func (s *IMAPSource) Close() {
+	s.client.Logout(1 * time.Second)
+}
@@ -0,0 +1,189 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// slowRoundTrip is how long a NOOP may take before the server is logged
+// as slow.
+const slowRoundTrip = 2 * time.Second
+
+// maxCapChanges is how many capability changes are remembered.
+const maxCapChanges = 20
+
+// reThrottled matches the errors servers give when they are limiting a
+// client, like Gmail's "[THROTTLED]" or Exchange's "[UNAVAILABLE]".
+var reThrottled = regexp.MustCompile(`(?i)\[(THROTTLED|UNAVAILABLE|LIMIT|OVERQUOTA)\]|too many (connections|simultaneous|requests)|try again later|bandwidth limit`)
+
+// IMAPHealth is how an IMAP server has been behaving, kept in the state
+// so problems that build up over weeks, like a provider throttling the
+// account or dropping a capability, show up in the digest and in doctor
+// instead of as posts that quietly go missing.
+type IMAPHealth struct {
+	Since           time.Time
+	Connects        int
+	ConnectFailures int
+	Throttled       int
+	RoundTrips      int
+	TotalRTT        time.Duration
+	LastRTT         time.Duration
+	MaxRTT          time.Duration
+	// the capabilities the server offered last, sorted
+	Caps []string
+	// when capabilities came and went, most recent last
+	CapChanges []string
+}
+
+// AvgRTT returns the average round trip time.
+func (h IMAPHealth) AvgRTT() time.Duration {
+	if h.RoundTrips == 0 {
+		return 0
+	}
+	return h.TotalRTT / time.Duration(h.RoundTrips)
+}
+
+// Summary describes the server's health in a line.
+func (h IMAPHealth) Summary() string {
+	return fmt.Sprintf("%d connects, %d failed, %d throttled; round trip %s (avg %s, max %s)",
+		h.Connects, h.ConnectFailures, h.Throttled,
+		h.LastRTT.Round(time.Millisecond), h.AvgRTT().Round(time.Millisecond), h.MaxRTT.Round(time.Millisecond))
+}
+
+// healthKey identifies the server in the state.
+func (s *IMAPSource) healthKey() string {
+	return "imap:" + s.config.User + "@" + s.config.Server
+}
+
+// updateHealth changes the server's health in the state.
+func (s *IMAPSource) updateHealth(fn func(h *IMAPHealth)) {
+	err := s.state.Update(func(state *State) error {
+		if state.IMAPHealth == nil {
+			state.IMAPHealth = make(map[string]IMAPHealth)
+		}
+		h := state.IMAPHealth[s.healthKey()]
+		if h.Since.IsZero() {
+			h.Since = time.Now()
+		}
+		fn(&h)
+		state.IMAPHealth[s.healthKey()] = h
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't save IMAP health: %s", err)
+	}
+}
+
+// recordFailure counts a failed connection, or command if connected is
+// set, and whether the server said it was throttling the account.
+func (s *IMAPSource) recordFailure(err error, connected bool) {
+	throttled := reThrottled.MatchString(err.Error())
+	if throttled {
+		log.Printf("The IMAP server is throttling the account: %s", err)
+	}
+	if connected && !throttled {
+		return
+	}
+	s.updateHealth(func(h *IMAPHealth) {
+		if !connected {
+			h.ConnectFailures++
+		}
+		if throttled {
+			h.Throttled++
+		}
+	})
+}
+
+// recordConnect times a NOOP on a new connection and notes any change in
+// the server's capabilities.
+func (s *IMAPSource) recordConnect() {
+	start := time.Now()
+	_, err := imap.Wait(s.client.Noop())
+	rtt := time.Since(start)
+	if err != nil {
+		log.Printf("IMAP NOOP failed: %s", err)
+		rtt = 0
+	}
+
+	var caps []string
+	for c, ok := range s.client.Caps {
+		if ok {
+			caps = append(caps, c)
+		}
+	}
+	sort.Strings(caps)
+
+	s.updateHealth(func(h *IMAPHealth) {
+		h.Connects++
+		if rtt > 0 {
+			h.RoundTrips++
+			h.TotalRTT += rtt
+			h.LastRTT = rtt
+			if rtt > h.MaxRTT {
+				h.MaxRTT = rtt
+			}
+		}
+		if h.Caps != nil {
+			if change := capChange(h.Caps, caps); change != "" {
+				log.Printf("IMAP server capabilities changed: %s", change)
+				h.CapChanges = append(h.CapChanges, time.Now().Format("2006-01-02 15:04")+": "+change)
+				if len(h.CapChanges) > maxCapChanges {
+					h.CapChanges = h.CapChanges[len(h.CapChanges)-maxCapChanges:]
+				}
+			}
+		}
+		h.Caps = caps
+		log.Printf("IMAP health: %s", h.Summary())
+	})
+	if rtt > slowRoundTrip {
+		log.Printf("The IMAP server is slow: a NOOP took %s", rtt.Round(time.Millisecond))
+	}
+}
+
+// capChange describes the difference between two sorted capability
+// lists, or returns "" if there is none.
+func capChange(old, current []string) string {
+	had := make(map[string]bool)
+	for _, c := range old {
+		had[c] = true
+	}
+	var gained, lost []string
+	for _, c := range current {
+		if !had[c] {
+			gained = append(gained, c)
+		}
+		delete(had, c)
+	}
+	for _, c := range old {
+		if had[c] {
+			lost = append(lost, c)
+		}
+	}
+	var parts []string
+	if len(lost) > 0 {
+		parts = append(parts, "lost "+strings.Join(lost, " "))
+	}
+	if len(gained) > 0 {
+		parts = append(parts, "gained "+strings.Join(gained, " "))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,206 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// partialFetchTypes are the media type prefixes of the parts downloaded
+// when FetchParts is set. Everything else, like video or PDF attachments,
+// is left on the server unless it is one of the AttachmentTypes. Outlook's winmail.dat holds the images of the
+// messages it sends.
+var partialFetchTypes = []string{"text/", "image/", "message/", "application/ms-tnef", "application/vnd.ms-tnef"}
+
+// bodyPart is a node of a message's BODYSTRUCTURE.
+type bodyPart struct {
+	section   string // IMAP section number, "" for the message itself
+	mediaType string
+	parts     []*bodyPart
+	keep      bool // a leaf that is needed
+}
+
+// parseBodyStructure turns a BODYSTRUCTURE response into a tree of parts.
+// A multipart is a list that starts with its parts, followed by its
+// subtype; any other part starts with its type and subtype. Besides the
+// partialFetchTypes, the leaves matching one of keepTypes, patterns like
+// "application/pdf" or "audio/*", are needed.
+func parseBodyStructure(f imap.Field, section string, keepTypes []string) *bodyPart {
+	list := imap.AsList(f)
+	part := &bodyPart{section: section}
+	if len(list) == 0 {
+		return part
+	}
+
+	if _, multi := list[0].([]imap.Field); multi {
+		i := 0
+		for ; i < len(list); i++ {
+			if _, ok := list[i].([]imap.Field); !ok {
+				break
+			}
+			child := strconv.Itoa(i + 1)
+			if section != "" {
+				child = section + "." + child
+			}
+			part.parts = append(part.parts, parseBodyStructure(list[i], child, keepTypes))
+		}
+		subtype := "mixed"
+		if i < len(list) {
+			subtype = imap.AsString(list[i])
+		}
+		part.mediaType = "multipart/" + strings.ToLower(subtype)
+		return part
+	}
+
+	if len(list) > 1 {
+		part.mediaType = strings.ToLower(imap.AsString(list[0]) + "/" + imap.AsString(list[1]))
+	}
+	for _, prefix := range partialFetchTypes {
+		if strings.HasPrefix(part.mediaType, prefix) {
+			part.keep = true
+		}
+	}
+	for _, pattern := range keepTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), part.mediaType); ok {
+			part.keep = true
+		}
+	}
+	return part
+}
+
+// wanted reports whether any of p is needed.
+func (p *bodyPart) wanted() bool {
+	if strings.HasPrefix(p.mediaType, "multipart/") {
+		for _, child := range p.parts {
+			if child.wanted() {
+				return true
+			}
+		}
+		return false
+	}
+	return p.keep
+}
+
+// complete reports whether all of p is needed, in which case there is
+// nothing to save by fetching it in pieces.
+func (p *bodyPart) complete() bool {
+	if !p.wanted() {
+		return false
+	}
+	for _, child := range p.parts {
+		if !child.complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// sections returns the sections to fetch to rebuild the wanted parts of
+// p: the header of every part that is kept and the contents of the leaves.
+// The message's own header is always kept.
+func (p *bodyPart) sections() []string {
+	if p.section != "" && !p.wanted() {
+		return nil
+	}
+	header := "HEADER"
+	if p.section != "" {
+		header = p.section + ".MIME"
+	}
+	items := []string{header}
+	if len(p.parts) == 0 {
+		return append(items, p.section)
+	}
+	for _, child := range p.parts {
+		items = append(items, child.sections()...)
+	}
+	return items
+}
+
+// assemble rebuilds the wanted parts of p as a MIME entity from the
+// fetched sections, leaving out the parts that weren't needed.
+func (p *bodyPart) assemble(data map[string][]byte) ([]byte, error) {
+	header := "HEADER"
+	if p.section != "" {
+		header = p.section + ".MIME"
+	}
+	out := append([]byte{}, data[header]...)
+	if len(p.parts) == 0 {
+		return append(out, data[p.section]...), nil
+	}
+
+	boundary, err := partBoundary(data[header])
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range p.parts {
+		if !child.wanted() {
+			continue
+		}
+		entity, err := child.assemble(data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, "\r\n--"+boundary+"\r\n"...)
+		out = append(out, entity...)
+	}
+	return append(out, "\r\n--"+boundary+"--\r\n"...), nil
+}
+
+// partBoundary returns the multipart boundary given in a header block.
+func partBoundary(header []byte) (string, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+	fields, err := r.ReadMIMEHeader()
+	if err != nil && len(fields) == 0 {
+		return "", fmt.Errorf("couldn't read part header: %s", err)
+	}
+	_, params, err := mime.ParseMediaType(fields.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return "", fmt.Errorf("multipart without a boundary")
+	}
+	return params["boundary"], nil
+}
+
+// fetchParts downloads only the wanted parts of a message and puts them
+// back together as a message of their own.
+func (s *IMAPSource) fetchParts(ctx context.Context, uid uint32, structure *bodyPart) ([]byte, error) {
+	set, _ := imap.NewSeqSet("")
+	set.AddNum(uid)
+
+	var items []string
+	for _, section := range structure.sections() {
+		items = append(items, "BODY.PEEK["+section+"]")
+	}
+
+	data := make(map[string][]byte)
+	err := s.fetch(ctx, set, func(info *imap.MessageInfo) error {
+		for _, section := range structure.sections() {
+			data[section] = imap.AsBytes(info.Attrs["BODY["+section+"]"])
+		}
+		return nil
+	}, append([]string{"UID"}, items...)...)
+	if err != nil {
+		return nil, err
+	}
+	return structure.assemble(data)
+}
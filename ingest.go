@@ -0,0 +1,82 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// exit status for a message that couldn't be posted, EX_TEMPFAIL from
+// sysexits.h, so procmail and friends keep it and try again later
+const exitTempFail = 75
+
+// ReaderSource supplies a single message read from r.
+type ReaderSource struct {
+	r    io.Reader
+	name string
+}
+
+func (s *ReaderSource) Connect(ctx context.Context) error { return nil }
+
+func (s *ReaderSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	if s.r == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(s.r)
+	s.r = nil
+	if err != nil {
+		return fmt.Errorf("couldn't read message from %s: %s", s.name, err)
+	}
+	log.Printf("Read message from %s..\n", s.name)
+	process(body)
+	return nil
+}
+
+func (s *ReaderSource) MarkProcessed(ctx context.Context, status []MessageStatus) error { return nil }
+
+func (s *ReaderSource) Close() {}
+
+// Ingest posts one message read from the file named in args, or from
+// stdin, so mailpost can be the target of a procmail or sieve pipe. It
+// returns the exit status: non-zero if the message failed.
+func (m *Mailpost) Ingest(args []string) int {
+	source := &ReaderSource{r: os.Stdin, name: "stdin"}
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalf("Couldn't open message: %s", err)
+		}
+		defer f.Close()
+		source = &ReaderSource{r: f, name: args[0]}
+	}
+
+	m.source = source
+	m.config.Source = "ingest"
+	statuses, err := m.Run(context.Background())
+	if err != nil {
+		log.Printf("Couldn't read message: %s", err)
+		return exitTempFail
+	}
+	for _, status := range statuses {
+		if status == MessageFailed {
+			return exitTempFail
+		}
+	}
+	return 0
+}
@@ -0,0 +1,300 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const jmapMail = "urn:ietf:params:jmap:mail"
+
+// JMAPSource reads unseen messages from mailboxes on a JMAP server, such
+// as Fastmail. Processed messages get the $seen keyword and are moved to
+// ArchiveMailbox or destroyed, just like with IMAP.
+type JMAPSource struct {
+	config      *Config
+	client      *http.Client
+	apiURL      string
+	downloadURL string
+	accountID   string
+	mailboxes   map[string]string
+	pending     []jmapPending
+}
+
+type jmapPending struct {
+	id        string
+	mailboxID string
+}
+
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+type jmapMailbox struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func (s *JMAPSource) Connect(ctx context.Context) error {
+	log.Print("Connecting to JMAP server..\n")
+	client, err := s.config.HTTPClient()
+	if err != nil {
+		return err
+	}
+	s.client = client
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", s.config.JMAPSessionURL, nil)
+	var session jmapSession
+	if err := s.do(req, &session); err != nil {
+		return fmt.Errorf("connection to server failed: %s", err)
+	}
+
+	s.apiURL = session.APIURL
+	s.downloadURL = session.DownloadURL
+	s.accountID = session.PrimaryAccounts[jmapMail]
+	if s.accountID == "" {
+		return fmt.Errorf("JMAP server has no mail account")
+	}
+
+	var mailboxes struct {
+		List []jmapMailbox `json:"list"`
+	}
+	err = s.call(ctx, "Mailbox/get", map[string]interface{}{"accountId": s.accountID, "ids": nil}, &mailboxes)
+	if err != nil {
+		return err
+	}
+
+	// IMAP's INBOX is the mailbox with the inbox role in JMAP
+	s.mailboxes = make(map[string]string)
+	for _, mbox := range mailboxes.List {
+		s.mailboxes[mbox.Name] = mbox.ID
+		if mbox.Role == "inbox" {
+			s.mailboxes["INBOX"] = mbox.ID
+		}
+	}
+	return nil
+}
+
+func (s *JMAPSource) mailboxID(name string) (string, error) {
+	id, ok := s.mailboxes[name]
+	if !ok {
+		return "", fmt.Errorf("couldn't find mailbox %s", name)
+	}
+	return id, nil
+}
+
+func (s *JMAPSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.pending = nil
+
+	for _, mbox := range s.config.MailboxNames() {
+		log.Printf("Fetching unread messages in %s..\n", mbox)
+		mailboxID, err := s.mailboxID(mbox)
+		if err != nil {
+			return err
+		}
+
+		var query struct {
+			IDs []string `json:"ids"`
+		}
+		err = s.call(ctx, "Email/query", map[string]interface{}{
+			"accountId": s.accountID,
+			"filter":    map[string]interface{}{"inMailbox": mailboxID, "notKeyword": "$seen"},
+			"sort":      []interface{}{map[string]interface{}{"property": "receivedAt"}},
+		}, &query)
+		if err != nil {
+			return err
+		}
+
+		if len(query.IDs) == 0 {
+			log.Print("No unread messages found.")
+			continue
+		}
+
+		var emails struct {
+			List []struct {
+				ID     string `json:"id"`
+				BlobID string `json:"blobId"`
+			} `json:"list"`
+		}
+		err = s.call(ctx, "Email/get", map[string]interface{}{
+			"accountId":  s.accountID,
+			"ids":        query.IDs,
+			"properties": []string{"id", "blobId"},
+		}, &emails)
+		if err != nil {
+			return err
+		}
+
+		for _, email := range emails.List {
+			msgCtx, cancel := context.WithTimeout(ctx, s.config.PerMessageTimeout())
+			body, err := s.download(msgCtx, email.BlobID)
+			cancel()
+			if err != nil {
+				log.Printf("Couldn't download message %s: %s", email.ID, err)
+				continue
+			}
+			process(body)
+			s.pending = append(s.pending, jmapPending{email.ID, mailboxID})
+		}
+	}
+	return nil
+}
+
+func (s *JMAPSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	defer func() { s.pending = nil }()
+
+	var archiveID string
+	if s.config.ArchiveMailbox != "" {
+		var err error
+		if archiveID, err = s.mailboxID(s.config.ArchiveMailbox); err != nil {
+			return err
+		}
+	}
+
+	update := make(map[string]interface{})
+	var destroy []string
+	for i, msg := range s.pending {
+		patch := map[string]interface{}{"keywords/$seen": true}
+		if archiveID != "" && Posted(status, i) {
+			patch["mailboxIds/"+msg.mailboxID] = nil
+			patch["mailboxIds/"+archiveID] = true
+		} else if archiveID == "" && s.config.Removable(status, i) {
+			destroy = append(destroy, msg.id)
+			continue
+		}
+		update[msg.id] = patch
+	}
+
+	log.Print("Marking messages seen..\n")
+	args := map[string]interface{}{"accountId": s.accountID, "update": update}
+	if len(destroy) > 0 {
+		args["destroy"] = destroy
+	}
+
+	var result struct {
+		NotUpdated   map[string]interface{} `json:"notUpdated"`
+		NotDestroyed map[string]interface{} `json:"notDestroyed"`
+	}
+	if err := s.call(ctx, "Email/set", args, &result); err != nil {
+		return err
+	}
+	if len(result.NotUpdated) > 0 || len(result.NotDestroyed) > 0 {
+		return fmt.Errorf("Email/set error: %v %v", result.NotUpdated, result.NotDestroyed)
+	}
+	return nil
+}
+
+func (s *JMAPSource) Close() {}
+
+// call makes a single JMAP method call and decodes its result into v.
+func (s *JMAPSource) call(ctx context.Context, method string, args map[string]interface{}, v interface{}) error {
+	request := map[string]interface{}{
+		"using":       []string{"urn:ietf:params:jmap:core", jmapMail},
+		"methodCalls": []interface{}{[]interface{}{method, args, "0"}},
+	}
+	body, _ := json.Marshal(request)
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", s.apiURL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	var response struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := s.do(req, &response); err != nil {
+		return fmt.Errorf("%s failed: %s", method, err)
+	}
+	if len(response.MethodResponses) == 0 || len(response.MethodResponses[0]) < 2 {
+		return fmt.Errorf("%s failed: empty response", method)
+	}
+
+	var name string
+	json.Unmarshal(response.MethodResponses[0][0], &name)
+	if name == "error" {
+		return fmt.Errorf("%s error: %s", method, response.MethodResponses[0][1])
+	}
+	if err := json.Unmarshal(response.MethodResponses[0][1], v); err != nil {
+		return fmt.Errorf("%s failed: %s", method, err)
+	}
+	return nil
+}
+
+// download fetches a blob, which for an email is the raw RFC 822 message.
+func (s *JMAPSource) download(ctx context.Context, blobID string) ([]byte, error) {
+	link := strings.NewReplacer(
+		"{accountId}", url.PathEscape(s.accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{name}", "message.eml",
+		"{type}", url.QueryEscape("message/rfc822"),
+	).Replace(s.downloadURL)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", link, nil)
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &jmapError{resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// do sends an authorized request and decodes the JSON response into v.
+func (s *JMAPSource) do(req *http.Request, v interface{}) error {
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return &jmapError{resp.Status}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// authorize uses JMAPToken as a bearer token if it is set, and User and
+// Password otherwise.
+func (s *JMAPSource) authorize(req *http.Request) {
+	if s.config.JMAPToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.JMAPToken)
+	} else {
+		req.SetBasicAuth(s.config.User, s.config.Password)
+	}
+}
+
+type jmapError struct {
+	status string
+}
+
+func (e *jmapError) Error() string {
+	return "server returned " + e.status
+}
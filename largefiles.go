@@ -0,0 +1,89 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// linkRe finds the links in a post, in Markdown, HTML or plain text.
+var linkRe = regexp.MustCompile(`https?://[^\s)"'<>\]]+`)
+
+// AttachmentLink reports whether a link stands in for an attachment that
+// was too big to send, and if so returns where to download the file and
+// its name. iOS and macOS Mail replace big attachments with an iCloud Mail
+// Drop link, which carries the real download URL and the file name in its
+// query. Links to AttachmentLinkHosts are downloaded as they are, named
+// after the end of their path.
+func (c *Config) AttachmentLink(link string) (string, string, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", false
+	}
+
+	if strings.EqualFold(u.Hostname(), "www.icloud.com") && strings.HasPrefix(u.Path, "/attachment") {
+		q := u.Query()
+		download, name := q.Get("u"), q.Get("f")
+		if d, err := url.Parse(download); err != nil || d.Scheme != "https" || name == "" {
+			return "", "", false
+		}
+		return download, name, true
+	}
+
+	for _, pattern := range c.AttachmentLinkHosts {
+		if matchHost(pattern, u.Hostname()) {
+			name := path.Base(u.Path)
+			if name == "/" || name == "." {
+				return "", "", false
+			}
+			return link, name, true
+		}
+	}
+	return "", "", false
+}
+
+// RetrieveLinkedAttachments downloads the files the attachment links in a
+// post stand for, and adds the images among them to its message's
+// attachments, so they can be referred to by name or number like any
+// other attachment. Downloads go through the same checks as images.
+func (m *Mailpost) RetrieveLinkedAttachments(ctx context.Context, post Post) {
+	data, _ := MaskCode(post.Data)
+	seen := make(map[string]bool)
+	for _, link := range linkRe.FindAllString(data, -1) {
+		download, name, ok := m.config.AttachmentLink(link)
+		if !ok || seen[download] {
+			continue
+		}
+		seen[download] = true
+
+		log.Printf("   |-- Fetching linked attachment %s", name)
+		body, ok := m.FetchImage(ctx, download, post)
+		if !ok {
+			continue
+		}
+		contentType := http.DetectContentType(body)
+		if !m.HasImage(contentType) {
+			log.Printf("   |-- Skipping linked attachment %s: %s isn't an image", name, contentType)
+			continue
+		}
+
+		m.AddAttachedImage(post.Msg, Image{OrigName: name, ContentType: contentType, Data: body})
+	}
+}
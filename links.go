@@ -0,0 +1,227 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var reLink = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// trackingParams are query parameters that only exist to track clicks and
+// can be removed without changing where a link goes. Parameters starting
+// with utm_ are always removed as well.
+var trackingParams = []string{
+	"fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid",
+	"mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok", "vero_id",
+	"oly_anon_id", "oly_enc_id", "wickedid", "__s",
+}
+
+// A redirector is a link-wrapping service. decode returns the real
+// destination of one of its links, or "" if it can't.
+type redirector struct {
+	host   string
+	decode func(u *url.URL) string
+}
+
+var redirectors = []redirector{
+	{"google.com", queryParam("/url", "q", "url")},
+	{"safelinks.protection.outlook.com", queryParam("/", "url")},
+	{"safelinks.protection.office365.us", queryParam("/", "url")},
+	{"linkprotect.cudasvc.com", queryParam("/url", "a")},
+	{"urldefense.proofpoint.com", decodeProofpoint},
+	{"urldefense.com", decodeProofpoint},
+	{"urldefense.us", decodeProofpoint},
+}
+
+// queryParam returns a decoder for redirectors that pass the destination
+// in one of the given query parameters on path.
+func queryParam(path string, params ...string) func(u *url.URL) string {
+	return func(u *url.URL) string {
+		if u.Path != path && !(path == "/" && u.Path == "") {
+			return ""
+		}
+		for _, param := range params {
+			if dest := u.Query().Get(param); dest != "" {
+				return dest
+			}
+		}
+		return ""
+	}
+}
+
+var reProofpointV3 = regexp.MustCompile(`^/v3/__(.+?)__;([^!]*)!`)
+var reProofpointRun = regexp.MustCompile(`\*(\*.)?`)
+
+const proofpointRuns = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// decodeProofpoint decodes Proofpoint URL Defense links. Version 1 passes
+// the destination as a query parameter, version 2 does the same with % and
+// / replaced by - and _, and version 3 embeds the destination in the path
+// with some characters replaced by * and stored, base64 encoded, after it.
+func decodeProofpoint(u *url.URL) string {
+	switch {
+	case strings.HasPrefix(u.Path, "/v1/"):
+		return u.Query().Get("u")
+
+	case strings.HasPrefix(u.Path, "/v2/"):
+		encoded := strings.NewReplacer("-", "%", "_", "/").Replace(u.Query().Get("u"))
+		dest, err := url.QueryUnescape(encoded)
+		if err != nil {
+			return ""
+		}
+		return dest
+
+	case strings.HasPrefix(u.Path, "/v3/"):
+		path := u.EscapedPath()
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+		if u.Fragment != "" {
+			path += "#" + u.Fragment
+		}
+		matches := reProofpointV3.FindStringSubmatch(path)
+		if matches == nil {
+			return ""
+		}
+
+		bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(matches[2], "="))
+		if err != nil {
+			return ""
+		}
+		replacements := []rune(string(bytes))
+
+		failed := false
+		dest := reProofpointRun.ReplaceAllStringFunc(matches[1], func(run string) string {
+			// "*" stands for one replacement character, "**x" for a run of
+			// them whose length is encoded by x
+			n := 1
+			if len(run) > 1 {
+				n = strings.IndexByte(proofpointRuns, run[2]) + 2
+			}
+			if n < 1 || n > len(replacements) {
+				failed = true
+				return run
+			}
+			s := string(replacements[:n])
+			replacements = replacements[n:]
+			return s
+		})
+		if failed {
+			return ""
+		}
+		return dest
+	}
+	return ""
+}
+
+// CleanLinks removes tracking parameters from the links in a post and,
+// when UnwrapRedirects is set, replaces redirector links (Google, Outlook
+// Safe Links, Proofpoint URL Defense, Barracuda) with the links they point
+// to. Links inside code are left alone.
+func (m *Mailpost) CleanLinks(post string) string {
+	if !m.config.StripTracking && !m.config.UnwrapRedirects {
+		return post
+	}
+
+	data, unmask := MaskCode(post)
+	data = reLink.ReplaceAllStringFunc(data, func(link string) string {
+		// punctuation at the end of a link is usually part of the sentence
+		trimmed := strings.TrimRight(link, ".,;:!?")
+		return m.CleanLink(trimmed) + link[len(trimmed):]
+	})
+	return unmask(data)
+}
+
+// CleanLink applies the configured link transforms to a single URL.
+func (m *Mailpost) CleanLink(link string) string {
+	if m.config.UnwrapRedirects {
+		// wrappers are sometimes nested, but never very deeply
+		for i := 0; i < 5; i++ {
+			unwrapped := m.UnwrapLink(link)
+			if unwrapped == link {
+				break
+			}
+			link = unwrapped
+		}
+	}
+	if m.config.StripTracking {
+		link = m.StripTrackingParams(link)
+	}
+	return link
+}
+
+// UnwrapLink returns the destination of a redirector link, or the link
+// itself if it isn't one.
+func (m *Mailpost) UnwrapLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, r := range redirectors {
+		if host != r.host && !strings.HasSuffix(host, "."+r.host) {
+			continue
+		}
+		if dest := r.decode(u); strings.HasPrefix(dest, "http") {
+			return dest
+		}
+	}
+	return link
+}
+
+// StripTrackingParams removes tracking parameters from a URL's query,
+// keeping the remaining parameters in their original order.
+func (m *Mailpost) StripTrackingParams(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery == "" {
+		return link
+	}
+
+	var kept []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name, _ := url.QueryUnescape(strings.SplitN(param, "=", 2)[0])
+		if !m.IsTrackingParam(name) {
+			kept = append(kept, param)
+		}
+	}
+
+	if len(kept) == len(strings.Split(u.RawQuery, "&")) {
+		return link
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+func (m *Mailpost) IsTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "utm_") {
+		return true
+	}
+	for _, param := range trackingParams {
+		if name == param {
+			return true
+		}
+	}
+	for _, param := range m.config.TrackingParams {
+		if name == strings.ToLower(param) {
+			return true
+		}
+	}
+	return false
+}
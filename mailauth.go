@@ -0,0 +1,378 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Domain holds how mail claiming to be from a domain is authenticated,
+// configured in a [Domains."example.com"] table. The "*" table is used for
+// domains that don't have their own.
+type Domain struct {
+	// RequireDKIM rejects mail without a valid DKIM signature from the
+	// From address's domain, or a domain above it.
+	RequireDKIM bool
+	// RequireSPF rejects mail the receiving server, AuthServID, didn't
+	// find to pass SPF.
+	RequireSPF bool
+}
+
+// lookupTXT finds DKIM keys.
+var lookupTXT = net.LookupTXT
+
+// checkDomains checks the Domains config values.
+func (c *Config) checkDomains() error {
+	for name, domain := range c.Domains {
+		if domain.RequireSPF && c.AuthServID == "" {
+			return fmt.Errorf("Domains.%q has RequireSPF but AuthServID isn't set", name)
+		}
+	}
+	return nil
+}
+
+// Domain returns the authentication settings for mail from addr.
+func (c *Config) Domain(addr string) Domain {
+	domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+	for name, settings := range c.Domains {
+		if strings.EqualFold(name, domain) {
+			return settings
+		}
+	}
+	return c.Domains["*"]
+}
+
+// Authenticate checks that a message really is from fromAddr, as Domains
+// says for its domain, and returns why not if it isn't.
+func (m *Mailpost) Authenticate(raw []byte, fromAddr string) error {
+	settings := m.config.Domain(fromAddr)
+	if !settings.RequireDKIM && !settings.RequireSPF {
+		return nil
+	}
+	fields, body := splitRawMessage(raw)
+	domain := strings.ToLower(fromAddr[strings.LastIndex(fromAddr, "@")+1:])
+
+	if settings.RequireSPF {
+		if result := spfResult(fields, m.config.AuthServID); result != "pass" {
+			if result == "" {
+				result = "none"
+			}
+			return fmt.Errorf("SPF result from %s is %s", m.config.AuthServID, result)
+		}
+	}
+
+	if settings.RequireDKIM {
+		var reasons []string
+		for _, field := range fields {
+			if !strings.EqualFold(field.name, "DKIM-Signature") {
+				continue
+			}
+			err := verifyDKIM(field, fields, body, domain)
+			if err == nil {
+				return nil
+			}
+			reasons = append(reasons, err.Error())
+		}
+		if len(reasons) == 0 {
+			return fmt.Errorf("no DKIM signature")
+		}
+		return fmt.Errorf("no valid DKIM signature for %s: %s", domain, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// A headerField is a header field of a message as it was sent.
+type headerField struct {
+	name string
+	// raw is the whole field, name, folds and all, ending in CRLF
+	raw string
+}
+
+// splitRawMessage splits a message into its header fields, in order, and
+// its body. Line ends are made CRLF, as they were sent.
+func splitRawMessage(raw []byte) ([]headerField, []byte) {
+	raw = bytes.Replace(bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	var fields []headerField
+	rest := raw
+	for len(rest) > 0 {
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			return fields, rest[2:]
+		}
+		end := 0
+		for {
+			eol := bytes.Index(rest[end:], []byte("\r\n"))
+			if eol < 0 {
+				end = len(rest)
+				break
+			}
+			end += eol + 2
+			if end >= len(rest) || (rest[end] != ' ' && rest[end] != '\t') {
+				break
+			}
+		}
+		field := string(rest[:end])
+		if colon := strings.Index(field, ":"); colon > 0 {
+			fields = append(fields, headerField{strings.TrimSpace(field[:colon]), field})
+		}
+		rest = rest[end:]
+	}
+	return fields, nil
+}
+
+// spfResult returns the SPF result the receiving server authservID put in
+// the message's first Authentication-Results field from it. Fields from
+// other servers are ignored since anyone can add them.
+func spfResult(fields []headerField, authservID string) string {
+	reSPF := regexp.MustCompile(`(?i)(?:^|;)\s*spf\s*=\s*([a-z]+)`)
+	for _, field := range fields {
+		if !strings.EqualFold(field.name, "Authentication-Results") {
+			continue
+		}
+		value := unfold(field.raw[strings.Index(field.raw, ":")+1:])
+		id := strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+		if i := strings.IndexAny(id, " \t"); i >= 0 {
+			id = id[:i]
+		}
+		if !strings.EqualFold(id, authservID) {
+			continue
+		}
+		if match := reSPF.FindStringSubmatch(value); match != nil {
+			return strings.ToLower(match[1])
+		}
+		return ""
+	}
+	return ""
+}
+
+// unfold joins the lines of a folded header field.
+func unfold(s string) string {
+	return strings.TrimSpace(strings.Replace(strings.Replace(s, "\r\n", "", -1), "\n", "", -1))
+}
+
+var reWSP = regexp.MustCompile(`[ \t]+`)
+
+// parseTags parses a DKIM tag list like "v=1; a=rsa-sha256; d=example.com".
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		eq := strings.Index(tag, "=")
+		if eq < 0 {
+			continue
+		}
+		name := strings.TrimSpace(tag[:eq])
+		tags[name] = strings.TrimSpace(tag[eq+1:])
+	}
+	return tags
+}
+
+// verifyDKIM checks one DKIM-Signature field (RFC 6376). The signing
+// domain must be the From domain or one above it, and the signature must
+// cover the From field and the whole body. SHA-1 signatures aren't
+// accepted (RFC 8301).
+func verifyDKIM(sig headerField, fields []headerField, body []byte, fromDomain string) error {
+	tags := parseTags(unfold(sig.raw[strings.Index(sig.raw, ":")+1:]))
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return fmt.Errorf("signature has no %s= tag", required)
+		}
+	}
+	if tags["v"] != "1" {
+		return fmt.Errorf("unknown DKIM version %s", tags["v"])
+	}
+	d := strings.ToLower(tags["d"])
+	if fromDomain != d && !strings.HasSuffix(fromDomain, "."+d) {
+		return fmt.Errorf("signed by %s", d)
+	}
+
+	// a signature that leaves out From vouches for nothing about the
+	// sender, and with a second From field it isn't clear which one was
+	// signed
+	signsFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		if strings.EqualFold(strings.TrimSpace(name), "from") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return fmt.Errorf("signature doesn't cover the From field")
+	}
+	froms := 0
+	for _, field := range fields {
+		if strings.EqualFold(field.name, "From") {
+			froms++
+		}
+	}
+	if froms != 1 {
+		return fmt.Errorf("message has %d From fields", froms)
+	}
+
+	// anything could be added after the part of the body l= covers
+	if tags["l"] != "" {
+		return fmt.Errorf("signature only covers part of the body")
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	var keyType string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		newHash, cryptoHash, keyType = sha256.New, crypto.SHA256, "rsa"
+	case "rsa-sha1":
+		return fmt.Errorf("rsa-sha1 signatures aren't accepted")
+	case "ed25519-sha256":
+		newHash, cryptoHash, keyType = sha256.New, crypto.SHA256, "ed25519"
+	default:
+		return fmt.Errorf("unknown algorithm %s", tags["a"])
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := strings.ToLower(tags["c"]); c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return fmt.Errorf("unknown canonicalization %s", tags["c"])
+	}
+
+	// the body hash
+	bh := newHash()
+	bh.Write(canonicalBody(body, bodyCanon))
+	if base64.StdEncoding.EncodeToString(bh.Sum(nil)) != reWSP.ReplaceAllString(unfold(tags["bh"]), "") {
+		return fmt.Errorf("body hash doesn't match, the message was changed")
+	}
+
+	// the signed header fields, each taken from the bottom up, then the
+	// signature itself with its b= tag emptied
+	h := newHash()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].name, name) {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonicalHeader(fields[i].raw, headerCanon)))
+			break
+		}
+	}
+	reB := regexp.MustCompile(`((?:^|;)[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+	colon := strings.Index(sig.raw, ":")
+	unsigned := sig.raw[:colon+1] + reB.ReplaceAllString(sig.raw[colon+1:], "$1")
+	if !strings.HasSuffix(unsigned, "\r\n") {
+		unsigned += "\r\n"
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(unsigned, headerCanon), "\r\n")))
+	digest := h.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(reWSP.ReplaceAllString(unfold(tags["b"]), ""))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	key, err := dkimKey(tags["s"], d, keyType)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, cryptoHash, digest, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, signature) {
+			err = fmt.Errorf("bad signature")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("signature by %s doesn't verify", d)
+	}
+	return nil
+}
+
+// dkimKey looks up the public key of a DKIM selector.
+func dkimKey(selector, domain, keyType string) (crypto.PublicKey, error) {
+	records, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't look up key %s for %s: %s", selector, domain, err)
+	}
+	tags := parseTags(strings.Join(records, ""))
+	if k := strings.ToLower(tags["k"]); (k == "" && keyType != "rsa") || (k != "" && k != keyType) {
+		return nil, fmt.Errorf("key %s for %s isn't an %s key", selector, domain, keyType)
+	}
+	data, err := base64.StdEncoding.DecodeString(reWSP.ReplaceAllString(tags["p"], ""))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("key %s for %s is revoked or invalid", selector, domain)
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s for %s is invalid", selector, domain)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %s for %s is invalid", selector, domain)
+}
+
+// canonicalHeader canonicalizes a header field for DKIM.
+func canonicalHeader(raw string, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	colon := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimSpace(raw[:colon]))
+	value := strings.Replace(raw[colon+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(reWSP.ReplaceAllString(value, " "))
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes a message body for DKIM.
+func canonicalBody(body []byte, canon string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canon == "relaxed" {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(reWSP.ReplaceAllString(line, " "), " ")
+		}
+	}
+	// the last element is what follows the final CRLF
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	if end == 0 {
+		if canon == "relaxed" {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines[:end], "\r\n") + "\r\n")
+}
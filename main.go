@@ -15,13 +15,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"flag"
+	"fmt"
     "image"
-    "image/color"
-    "image/draw"
-	"image/jpeg"
  	_ "image/png"
 	"io"
 	"io/ioutil"
@@ -36,19 +34,20 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 	
 	"github.com/BurntSushi/toml"
 	"github.com/mxk/go-imap/imap"
 	"github.com/nfnt/resize"
-	"gopkg.in/alexcesaro/quotedprintable.v2"
 	"gopkg.in/yaml.v2"
 )
 
 var wd, _ = os.Getwd()
 var conf = flag.String("conf", wd+"/mailpost.toml", "Path to config file.")
 var logfile = flag.String("log", wd+"/mailpost.log", "Path to log file.")
-var interval = flag.String("interval", "5m", "Time between each check. Examples: 10s, 5m, 1h")
+var tenant = flag.String("tenant", "", "Run the command for this tenant of a multi-tenant config.")
+var interval = flag.String("interval", "5m", "Time between each check, overrides Interval in the config. Examples: 10s, 5m, 1h")
 var debug = flag.Bool("debug", false, "Log all IMAP commands and responses.")
 var once = flag.Bool("once", true, "Only execute the fetch once and exit.")
 
@@ -56,6 +55,7 @@ type Config struct {
 	Server      string
 	User        string
 	Password    string
+	PasswordCommand	string
 	ImageDir	string
 	PostDir		string
 	DatePathFmt	string
@@ -63,7 +63,161 @@ type Config struct {
 	ImagePath	string
 	MaxImgWidth	uint
 	PostFrom	string
+	AllowedSenders	[]string
 	PostTo		string
+	ImageRefStyle	string
+	Source		string
+	SourcePath	string
+	Idle		bool
+	Mailbox		string
+	Mailboxes	[]string
+	SearchQuery	string
+	MaxInlineImgSize	Size
+	MaxMessageSize	Size
+	FetchBatchSize	int
+	FetchParts	bool
+	Compress	bool
+	ArchiveMailbox	string
+	DraftsMailbox	string
+	DraftsDelay	Duration
+	DeleteProcessed	bool
+	DeleteFailed	bool
+	SMTPServer	string
+	SMTPUser	string
+	SMTPPassword	string
+	ReplyFrom	string
+	Policies	map[string]Policy
+	TLSCAFile	string
+	TLSCertFile	string
+	TLSKeyFile	string
+	TLSMinVersion	string
+	TLSInsecureSkipVerify	bool
+	WorkDir		string
+	Senders		map[string]Sender
+	JMAPSessionURL	string
+	JMAPToken	string
+	GmailClientID	string
+	GmailClientSecret	string
+	GmailRefreshToken	string
+	GmailQuery	string
+	GmailProcessedLabel	string
+	SMTPListen	string
+	SMTPListenDomain	string
+	SMTPListenRecipients	[]string
+	SMTPListenUser	string
+	SMTPListenPassword	string
+	SMTPListenCertFile	string
+	SMTPListenKeyFile	string
+	WebhookListen	string
+	WebhookUser	string
+	WebhookPassword	string
+	MailgunSigningKey	string
+	SendGridVerificationKey	string
+	GraphTenantID	string
+	GraphClientID	string
+	GraphClientSecret	string
+	GraphUser	string
+	StateDir	string
+	DigestTo	string
+	DigestInterval	Duration
+	RetryAttempts	int
+	RetryDelay	Duration
+	RetryMaxDelay	Duration
+	ExistingPosts	string
+	KeepVersions	bool
+	UserAgent	string
+	ImageHeaders	map[string]string
+	ImageHosts	map[string]ImageHost
+	ImageAllowHosts	[]string
+	ImageDenyHosts	[]string
+	AttachmentLinkHosts	[]string
+	AttachmentTypes	[]string
+	AttachmentDir	string
+	AttachmentPath	string
+	ImageTypes	[]string
+	MaxImageDownload	Size
+	WriteWorkers	int
+	ImageWorkers	int
+	MaxOpenFiles	int
+	MaxProcs	int
+	Proxy		string
+	MessageTimeout	Duration
+	Interval	Duration
+	PreferHTML	bool
+	SkipPreflight	bool
+	Notifiers	map[string]NotifierConfig
+	AlertVia	string
+	AlertAfter	int
+	EscalateVia	string
+	EscalateAfter	int
+	StripTracking	bool
+	TrackingParams	[]string
+	UnwrapRedirects	bool
+	CleanBody	bool
+	StripPatterns	[]string
+	PublishWindows	[]string
+	PublishTimeZone	string
+	Sites		map[string]Site
+	GitCommit	bool
+	GitCommitMessage	string
+	GitSigningKey	string
+	GitSigningFormat	string
+	SignaturePolicy	string
+	PGPHome		string
+	SMIMECAFile	string
+	Decrypt		bool
+	SMIMEKeyFile	string
+	SMIMECertFile	string
+	AuthServID	string
+	OriginalsDir	string
+	AttachmentText	string
+	TextExtractors	map[string]string
+	PostToken	string
+	Domains		map[string]Domain
+	AutoFrontmatter	bool
+	DefaultType	string
+	Tenants		map[string]Tenant
+	NNTPServer	string
+	NNTPUser	string
+	NNTPPassword	string
+	Newsgroups	[]string
+	NNTPBackfill	int
+	FrontmatterFormat	string
+	PostURL		string
+	ActivityPubDir	string
+	ActivityPubURL	string
+	ActivityPubUser	string
+	ActivityPubName	string
+	ActivityPubSummary	string
+	ActivityPubInbox	string
+	ActivityPubKeyFile	string
+	Frontmatter	map[string]interface{}
+	FrontmatterOverride	map[string]interface{}
+	FilenameTemplate	string
+	SitemapFile	string
+	FeedDir		string
+	PageBundles	bool
+	Provenance	string
+	SiteGenerator	string
+	DraftByDefault	bool
+	MatchPostsBy	string
+	PostTemplate	string
+	PostTemplates	map[string]string
+	Types		map[string]PostType
+	Notes		bool
+	NoteType	string
+	PostDelimiter	string
+	PhotoPosts	bool
+	PhotoType	string
+	Gallery		string
+	ExifFrontmatter	[]string
+	StripMetadata	bool
+	KeepMetadata	[]string
+	KeepImageFormat	bool
+	ImageFormat	string
+	ExtraImageFormats	[]string
+	WebPQuality	uint
+	AVIFQuality	uint
 }
 
 type Image struct {
@@ -74,6 +228,10 @@ type Image struct {
 	URL			string
 	Data    	[]byte
 	Ordinal		uint64
+	ContentType	string
+	ContentID	string
+	Description	string
+	Msg			int
 }
 
 type Post struct {
@@ -84,52 +242,62 @@ type Post struct {
 	Path 		string
 	URL			string
 	Data		string
+	Msg			int
+	From		string
+	Header		mail.Header
+	Urgent		bool
+	Site		string
+	Fields		map[string]interface{}
 }
 
 type PathParts struct {
 	Date		string
 	Type		string
+	Fields		map[string]interface{}
 }
 
 type Mailpost struct {
 	config	Config
-	client	*imap.Client
+	source	Source
 	images	[]Image
+	attachments	[]Attachment
 	posts	[]Post
 	imgNum	uint64
-}
-
-func (m *Mailpost) Connect() {
-	var err error
-	log.Print("Connecting to server..\n")
-	m.client, err = imap.DialTLS(m.config.Server, &tls.Config{})
-
-	if err != nil {
-		log.Fatalf("Connection to server failed: %s", err)
-	}
-
-	if m.client.State() == imap.Login {
-		log.Print("Logging in..\n")
-		m.client.Login(m.config.User, m.config.Password)
-	}
-
-	log.Print("Opening INBOX..\n")
-	m.client.Select("INBOX", false)
+	status	[]MessageStatus
+	msgFrom	string
+	msgHeader	mail.Header
+	msgForwards	bool
+	tenant	*Tenant
+	msgSite	string
+	msgToken	bool
+	workspaces	[]string
+	state	*StateStore
+	history	[]HistoryEntry
+	written	int
+	runs	int
+	refTmpl	*template.Template
+	commitTmpl	*template.Template
+	nameTmpls	map[string]*template.Template
+	postTmpls	map[string]*template.Template
+	galleryTmpl	*template.Template
+	stripRes	[]*regexp.Regexp
+	windows	[]PublishWindow
+	siteTime	*time.Location
+	web	*http.Client
+	encoder	*imageEncoder
+	files	limiter
 }
 
 func (m *Mailpost) DecodeSubject(msg *mail.Message) string {
-	s, _, err := quotedprintable.DecodeHeader(msg.Header.Get("Subject"))
-
-	if err != nil {
-		return msg.Header.Get("Subject")
-	} else {
-		return s
-	}
+	return DecodeHeader(msg.Header.Get("Subject"))
 }
 
 func (m *Mailpost) MakeDatePathPart(dateInfo string) string {
-	const dateStringLayout = "2006-01-02"
-	t, _ := time.Parse(dateStringLayout, dateInfo)
+	t, ok := ParsePostDate(dateInfo, m.siteTime)
+	if !ok {
+		log.Printf("Couldn't parse date %q, using today's", dateInfo)
+		t = time.Now()
+	}
 	return t.Format(m.config.DatePathFmt)
 }
 
@@ -140,21 +308,34 @@ func (m *Mailpost) MakePathFromTemplate(pathTemplate string, pathData PathParts)
 	if pathData.Date != "" {
 		pathTemplate = strings.Replace(pathTemplate, "<date>", pathData.Date, 1)
 	}
-	return pathTemplate
+	return FillFields(pathTemplate, pathData.Fields)
 }
 
-func (m *Mailpost) MakePostPath(postInfo Post) string {
+// TemplateRoot returns the directory a path template starts with, before
+// any <date> or <type> placeholders.
+func TemplateRoot(pathTemplate string) string {
+	if i := strings.Index(pathTemplate, "<"); i >= 0 {
+		pathTemplate = filepath.Dir(pathTemplate[:i] + "x")
+	}
+	return filepath.Clean(pathTemplate)
+}
+
+func (m *Mailpost) MakePostPath(postInfo Post) (string, error) {
 	datePathPart := m.MakeDatePathPart(postInfo.Date)
 		
 	postInfo.Path = strings.Replace(postInfo.Path, "<type>", strings.ToLower(strings.Trim(postInfo.Type, " ")), 1)
 	postInfo.Path = strings.Replace(postInfo.Path, "<date>", datePathPart, 1)
+	postInfo.Path = FillFields(postInfo.Path, postInfo.Fields)
+	if !m.Confined(postInfo.Path) {
+		return "", fmt.Errorf("post path %s is outside the tenant's Root", postInfo.Path)
+	}
 		
 	err := os.MkdirAll(postInfo.Path, 0755)
 	if err != nil {
-		log.Fatal("Couldn't make path %s: %s", postInfo.Path, err)
+		return "", fmt.Errorf("couldn't make path %s: %s", postInfo.Path, err)
 	}
 	
-	return postInfo.Path
+	return postInfo.Path, nil
 }
 
 func (m *Mailpost) MakeDatePath(basePath string) (fullPath string, datePathPart string) {
@@ -177,6 +358,12 @@ func (m *Mailpost) SanitizeFilename(name string) string {
 }
 
 func (m *Mailpost) ExtractAttachment(r io.Reader, params map[string]string) {
+	m.ExtractParts(r, params, m.ExtractText)
+}
+
+// ExtractParts reads the parts of a multipart body, extracting images and
+// handing every text part to text.
+func (m *Mailpost) ExtractParts(r io.Reader, params map[string]string, text func(contentType, body string)) {
 	multipartReader := multipart.NewReader(r, params["boundary"])
 	for {
 		
@@ -186,15 +373,29 @@ func (m *Mailpost) ExtractAttachment(r io.Reader, params map[string]string) {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatalf("Error parsing part: %s", err)
+			log.Printf("Error parsing part: %s", err)
+			return
 		}
 		contentType, params, _ := mime.ParseMediaType(mimePart.Header.Get("Content-Type"))
 		
 
+		// ------------------------------------------
+		// Skip bounces and read receipts, even forwarded ones
+		if m.IsReport(contentType) {
+			log.Printf("|-- Skipping %s part", contentType)
+
 		// ------------------------------------------
 		// Check for an another multipart section
-		if m.HasMultipart(contentType) {
-			m.ExtractAttachment(mimePart, params)
+		} else if contentType == "multipart/alternative" {
+			m.ExtractAlternative(mimePart, params, text)
+
+		} else if m.HasMultipart(contentType) {
+			m.ExtractParts(mimePart, params, text)
+
+		// ------------------------------------------
+		// Check for a forwarded message
+		} else if m.HasMessage(contentType) {
+			m.ExtractMessage(DecodeTransfer(mimePart.Header.Get("Content-Transfer-Encoding"), mimePart), text)
 			
 		// ------------------------------------------
 		// Check for an image part
@@ -202,135 +403,294 @@ func (m *Mailpost) ExtractAttachment(r io.Reader, params map[string]string) {
 					  
 			var imageInfo Image
 
-			imageInfo.OrigName = mimePart.FileName()
+			imageInfo.OrigName = DecodeFileName(mimePart.FileName())
+			imageInfo.ContentType = contentType
+			imageInfo.ContentID = strings.Trim(mimePart.Header.Get("Content-Id"), "<> ")
+			imageInfo.Description = strings.TrimSpace(DecodeHeader(mimePart.Header.Get("Content-Description")))
 									
-			r := base64.NewDecoder(base64.StdEncoding, mimePart)			
+			r := DecodeTransfer(mimePart.Header.Get("Content-Transfer-Encoding"), mimePart)			
 		    imageInfo.Data, err = ioutil.ReadAll(r)
-			m.imgNum = m.imgNum + 1
-		    imageInfo.Ordinal = m.imgNum
-		    
-		    m.ExtractImageData(imageInfo)
+		    m.AddAttachedImage(len(m.status)-1, imageInfo)
+
+		// --------------------------------------------
+		// Check for Outlook's winmail.dat
+		} else if m.HasTNEF(contentType) {
+			m.ExtractTNEF(DecodeTransfer(mimePart.Header.Get("Content-Transfer-Encoding"), mimePart))
+
+		// --------------------------------------------
+		// Check for another kind of file to keep
+		} else if m.AttachmentAllowed(contentType) && mimePart.FileName() != "" {
+			var attachment Attachment
+			attachment.OrigName = DecodeFileName(mimePart.FileName())
+			attachment.ContentType = contentType
+			attachment.Data, err = ioutil.ReadAll(DecodeTransfer(mimePart.Header.Get("Content-Transfer-Encoding"), mimePart))
+			if err != nil {
+				log.Printf("Error reading attachment %s: %s", attachment.OrigName, err)
+				continue
+			}
+			m.AddAttachment(len(m.status)-1, attachment)
 		
 		// --------------------------------------------	
 		// Check for a text part	
 		} else if m.HasText(contentType) {
 			buf := new(bytes.Buffer)
-			_, err := io.Copy(buf, mimePart)
+			_, err := io.Copy(buf, DecodeTransfer(mimePart.Header.Get("Content-Transfer-Encoding"), mimePart))
 			if err != nil {
-				log.Fatalf("Error copying body of post to buffer: %s", err)
+				log.Printf("Error reading text part: %s", err)
+				continue
 			}
 			
-			m.ExtractPostData(buf.String())
+			text(contentType, ToUTF8(buf.String(), params["charset"]))
 		}
 	}
 }
 
-func (m *Mailpost) FetchMails() {
-	log.Print("Fetching unread UIDs..\n")
-	cmd, err := m.client.UIDSearch("1:* NOT SEEN")
-	cmd.Result(imap.OK)
-
-	if err != nil {
-		log.Fatalf("UIDSearch failed: %s", err)
+// AddAttachedImage numbers an image attached to message msg and adds it
+// to the images to save.
+func (m *Mailpost) AddAttachedImage(msg int, imageInfo Image) {
+	imageInfo.Msg = msg
+	m.SaveArtifact(imageInfo.Msg, "attachments/"+m.SanitizeFilename(imageInfo.OrigName), imageInfo.Data)
+	if IsHEIF(imageInfo.ContentType) {
+		// from here on it is a JPEG like any other
+		converted, err := m.ConvertHEIF(imageInfo.Data)
+		if err != nil {
+			m.Fail(Post{Msg: msg}, "Couldn't convert %s from HEIC: %s", imageInfo.OrigName, err)
+			return
+		}
+		imageInfo.Data, imageInfo.ContentType = converted, "image/jpeg"
 	}
+	m.imgNum = m.imgNum + 1
+	imageInfo.Ordinal = m.imgNum
+
+	m.ExtractImageData(imageInfo)
+}
 
-	uids := cmd.Data[0].SearchResults()
-	if len(uids) == 0 {
-		log.Print("No unread messages found.")
+// ExtractMessage reads a message that was forwarded as an attachment and
+// extracts its text and images as if it had been sent on its own. A post
+// forwarded from another mailbox comes wrapped like this, and its text is
+// the one with the frontmatter, not the note it was forwarded with.
+func (m *Mailpost) ExtractMessage(r io.Reader, text func(contentType, body string)) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		log.Printf("Error parsing forwarded message: %s", err)
 		return
 	}
+	log.Printf("|-- Forwarded: %v", m.DecodeSubject(msg))
+	m.ExtractBody(msg.Header, msg.Body, text)
+}
 
-	log.Print("Fetching mail bodies..\n")
-	set, _ := imap.NewSeqSet("")
-	set.AddNum(uids...)
-	cmd, err = m.client.UIDFetch(set, "UID", "FLAGS", "BODY[]")
-
+// ExtractBody extracts the text and images from the body of a message,
+// or of a message forwarded inside it, according to its header.
+func (m *Mailpost) ExtractBody(header mail.Header, body io.Reader, text func(contentType, body string)) {
+	// without a Content-Type, as in most news articles, it's plain text
+	value := header.Get("Content-Type")
+	if value == "" {
+		value = "text/plain"
+	}
+	contentType, params, err := mime.ParseMediaType(value)
 	if err != nil {
-		log.Fatalf("Fetch failed: %s", err)
+		log.Printf("Error parsing Content-Type: %s", err)
 	}
 
-	for cmd.InProgress() {
-		m.client.Recv(10 * time.Second)
+	if contentType == "multipart/alternative" {
+		m.ExtractAlternative(body, params, text)
 
-		for _, rsp := range cmd.Data {
-			body := imap.AsBytes(rsp.MessageInfo().Attrs["BODY[]"])
-			
-			if msg, _ := mail.ReadMessage(bytes.NewReader(body)); msg != nil {
-				contentType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
-				if err != nil {
-					log.Fatalf("Error parsing Content-Type: ", err)
-				}
-				
-				fromAddr := strings.ToLower(msg.Header.Get("From"))
-				toAddr := strings.ToLower(msg.Header.Get("To"))
-				re := regexp.MustCompile("<(.*)>")
-				fromMatches := re.FindStringSubmatch(fromAddr)
-				if len(fromMatches) > 1 {
-					fromAddr = fromMatches[1]
-				}
-				toMatches := re.FindStringSubmatch(toAddr)
-				if len(toMatches) > 1 {
-					toAddr = toMatches[1]
-				}
-				
-				log.Printf("|-- Subject: %v", msg.Header.Get("Subject"))
-				log.Printf("|-- To: %v", toAddr)
-				log.Printf("|-- From: %v", fromAddr)
-				
-				processMessage := true
-				
-				// if this email is from a valid poster
-				if m.config.PostFrom != "" &&
-					strings.ToLower(m.config.PostFrom) != fromAddr {
-					processMessage = false
-				}
-				
-				// if this email is to a valid poster
-				if m.config.PostFrom != "" &&
-					strings.ToLower(m.config.PostTo) != toAddr {
-					processMessage = false
-				}
-				
-				if processMessage == true {
-					// check mime parts for valid content
-					if m.HasMultipart(contentType) {
-						m.ExtractAttachment(msg.Body, params)
-						
-					// otherwise, save the plaintext email
-					} else if m.HasText(contentType) {
-						reader := quotedprintable.NewDecoder(msg.Body)
-						if b, err := ioutil.ReadAll(reader); err == nil {
-							m.ExtractPostData(string(b))
-						}
-					}
-				}
-			}
+	} else if m.HasMultipart(contentType) {
+		m.ExtractParts(body, params, text)
+
+	} else if m.HasMessage(contentType) {
+		m.ExtractMessage(DecodeTransfer(header.Get("Content-Transfer-Encoding"), body), text)
+
+	// otherwise, save the plaintext email
+	} else if m.HasText(contentType) {
+		reader := DecodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+		if b, err := ioutil.ReadAll(reader); err == nil {
+			text(contentType, ToUTF8(string(b), params["charset"]))
 		}
-		cmd.Data = nil
 	}
+}
 
-	if rsp, err := cmd.Result(imap.OK); err != nil {
-		if err == imap.ErrAborted {
-			log.Fatal("Fetch command aborted")
+// ExtractAlternative reads the parts of a multipart/alternative and hands
+// the text of one of them to text: the plain text version, unless there
+// is none or PreferHTML is set. Images are extracted from all of them.
+func (m *Mailpost) ExtractAlternative(r io.Reader, params map[string]string, text func(contentType, body string)) {
+	var plain, rich, richType string
+	m.ExtractParts(r, params, func(contentType, body string) {
+		if m.HasHTML(contentType) {
+			rich, richType = body, contentType
 		} else {
-			log.Fatalf("Fetch error: %v", rsp.Info)
+			plain = body
 		}
+	})
+
+	if rich != "" && (plain == "" || m.config.PreferHTML) {
+		text(richType, rich)
+	} else if plain != "" {
+		text("text/plain", plain)
 	}
+}
 
-	log.Print("Marking messages seen..\n")
-	cmd, err = m.client.UIDStore(set, "+FLAGS.SILENT",
-		imap.NewFlagSet(`\Seen`))
+// ExtractText makes a post out of a text part, converting it to Markdown
+// first if it is HTML.
+func (m *Mailpost) ExtractText(contentType, body string) {
+	if m.HasHTML(contentType) {
+		body = HTMLToMarkdown(body)
+	}
+	m.ExtractPostData(body)
+}
+
+func (m *Mailpost) FetchMails(ctx context.Context) error {
+	return m.source.Fetch(ctx, m.ProcessMessage)
+}
+
+// WaitForMail blocks until the source reports new mail, or the first held
+// post is due, so the next run publishes it. It returns false when the
+// source can't push new mail, in which case the caller falls back to
+// polling every -interval.
+func (m *Mailpost) WaitForMail() bool {
+	idler, ok := m.source.(Idler)
+	if !ok {
+		return false
+	}
+	until := m.NextHeldPost()
+	if !until.IsZero() && until.Before(time.Now()) {
+		// one that couldn't be written is tried again every Interval
+		until = time.Now().Add(m.config.CheckInterval())
+	}
+	return idler.Idle(until)
+}
+
+// MessageStatus is the outcome of processing a fetched message.
+type MessageStatus int
+
+const (
+	// MessageIgnored is a message that wasn't meant for mailpost.
+	MessageIgnored MessageStatus = iota
+	// MessagePosted is a message whose posts were all written.
+	MessagePosted
+	// MessageFailed is a message that was meant for mailpost but
+	// couldn't be fully processed.
+	MessageFailed
+)
+
+// Fail logs a problem with a post and records that the message it came
+// from wasn't fully processed.
+func (m *Mailpost) Fail(postInfo Post, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	if postInfo.Msg < len(m.status) {
+		m.status[postInfo.Msg] = MessageFailed
+	}
+	if postInfo.Msg < len(m.history) && m.history[postInfo.Msg].Error == "" {
+		m.history[postInfo.Msg].Error = fmt.Sprintf(format, v...)
+	}
+}
+
+func (m *Mailpost) ProcessMessage(body []byte) {
+	m.status = append(m.status, MessageIgnored)
+	current := len(m.status) - 1
+	m.history = append(m.history, HistoryEntry{Processed: time.Now(), Source: m.SourceName()})
+
+	msg, _ := mail.ReadMessage(bytes.NewReader(body))
+	if msg == nil {
+		return
+	}
+	m.NewWorkspace(current, msg.Header.Get("Message-Id"), body)
+
+	fromAddr := strings.ToLower(msg.Header.Get("From"))
+	toAddr := strings.ToLower(msg.Header.Get("To"))
+	re := regexp.MustCompile("<(.*)>")
+	fromMatches := re.FindStringSubmatch(fromAddr)
+	if len(fromMatches) > 1 {
+		fromAddr = fromMatches[1]
+	}
+	toMatches := re.FindStringSubmatch(toAddr)
+	if len(toMatches) > 1 {
+		toAddr = toMatches[1]
+	}
+	
+	log.Printf("|-- Subject: %v", m.DecodeSubject(msg))
+	log.Printf("|-- To: %v", toAddr)
+	log.Printf("|-- From: %v", DecodeFrom(msg))
+	
+	m.history[current].MessageID = msg.Header.Get("Message-Id")
+	m.history[current].Sender = fromAddr
+	m.history[current].Subject = m.DecodeSubject(msg)
+	m.msgFrom = fromAddr
+	m.msgHeader = msg.Header
+	processMessage := true
+
+	// never post (or reply to) auto-responders and bulk mail
+	if automated, reason := m.IsAutomated(msg, fromAddr); automated {
+		log.Printf("Skipping automated message (%s)", reason)
+		processMessage = false
+	}
+	
+	// if this email is from a valid poster
+	if !m.config.SenderAllowed(fromAddr) {
+		processMessage = false
+	}
+	
+	// a tag added to the posting address picks the site, as in
+	// blog+photos@example.com
+	toBase, toTag := splitPlusAddress(toAddr)
+	toTag, m.msgToken = m.config.SplitAddressToken(toTag)
+	if m.config.PostToken != "" && m.config.tokenMatches(msg.Header.Get(tokenHeader)) {
+		m.msgToken = true
+	}
+	m.msgSite = ""
+	if m.config.HasSite(toTag) {
+		m.msgSite = toTag
+	}
 
-	if rsp, err := cmd.Result(imap.OK); err != nil {
-		log.Fatalf("UIDStore error:%v", rsp.Info)
+	// if this email is to a valid poster; articles are posted to
+	// newsgroups, not to an address
+	if m.config.RestrictsSenders() && m.SourceName() != "nntp" &&
+		strings.ToLower(m.config.PostTo) != toAddr &&
+		strings.ToLower(m.config.PostTo) != toBase {
+		processMessage = false
 	}
+	
+	// a From address proves nothing unless the sender's domain vouches
+	// for it
+	if processMessage {
+		if err := m.Authenticate(body, fromAddr); err != nil {
+			log.Printf("Skipping unauthenticated message: %s", err)
+			m.history[current].Error = err.Error()
+			processMessage = false
+		}
+	}
+
+	if processMessage == true {
+		// failed until a post has been extracted from it
+		m.status[current] = MessageFailed
 
-	cmd.Data = nil
+		// check signatures and decrypt before looking inside
+		raw, _ := ioutil.ReadAll(msg.Body)
+		header, content, err := m.Unwrap(msg.Header, raw, fromAddr)
+		if err != nil {
+			// checking again won't change the answer
+			log.Printf("Skipping message: %s", err)
+			m.status[current] = MessageIgnored
+			m.history[current].Error = err.Error()
+			return
+		}
+
+		// check mime parts for valid content
+		m.msgForwards = m.HasForwarded(header, content)
+		m.ExtractBody(header, bytes.NewReader(content), m.ExtractText)
+		m.MakePhotoPost(current)
+		m.ApplyExifFrontmatter(current)
+	}
 }
 
 func (m *Mailpost) HasImage(contentType string) bool {
 	if strings.HasPrefix(contentType, "image/jpeg") ||
-		strings.HasPrefix(contentType, "image/png") {
+		strings.HasPrefix(contentType, "image/png") ||
+		IsHEIF(contentType) {
+		return true
+	}
+	// GIFs are only any good with all their frames
+	if strings.HasPrefix(contentType, "image/gif") && m.config.KeepImageFormat {
 		return true
 	}
 	return false
@@ -338,12 +698,23 @@ func (m *Mailpost) HasImage(contentType string) bool {
 
 func (m *Mailpost) HasText(contentType string) bool {
 	if strings.HasPrefix(contentType, "text/plain") ||
-		strings.HasPrefix(contentType, "multipart/alternative") {
+		strings.HasPrefix(contentType, "multipart/alternative") ||
+		m.HasHTML(contentType) {
 		return true
 	}
 	return false
 }
 
+func (m *Mailpost) HasHTML(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/html")
+}
+
+// HasMessage reports whether a part is a whole message, as a forwarded
+// message attached to another one is.
+func (m *Mailpost) HasMessage(contentType string) bool {
+	return contentType == "message/rfc822" || contentType == "message/global"
+}
+
 func (m *Mailpost) HasMultipart(contentType string) bool {
 	if strings.HasPrefix(contentType, "multipart/") {
 		return true
@@ -367,14 +738,52 @@ func (m *Mailpost) ReadConfig(path string) {
 	if _, err := toml.DecodeFile(path, &m.config); err != nil {
 		log.Fatalf("Error opening config file: %s", err)
 	}
+	if err := m.config.Validate(); err != nil {
+		log.Fatalf("Error in config file: %s", err)
+	}
+	m.config.ApplySiteGenerator()
+	if err := m.Configure(); err != nil {
+		log.Fatalf("Error in config file: %s", err)
+	}
+}
+
+// Configure gets everything the config asks for ready, once it has been
+// read. It returns the first setting that can't be used.
+func (m *Mailpost) Configure() error {
+	if err := m.config.ResolveSecrets(); err != nil {
+		return err
+	}
+	for _, parse := range []func() error{
+		m.ParseImageRefStyle,
+		m.ParseCommitMessage,
+		m.ParseFilenameTemplate,
+		m.ParsePostTemplates,
+		m.ParseGallery,
+		m.ParseStripPatterns,
+		m.ParsePublishWindows,
+		m.ParseExistingPosts,
+	} {
+		if err := parse(); err != nil {
+			return err
+		}
+	}
+	web, err := m.config.HTTPClient()
+	if err != nil {
+		return err
+	}
+	m.web = web
+	m.ApplyResourceLimits()
+	m.state, err = OpenStateStore(filepath.Join(m.StateDir(), "mailpost.db"))
+	return err
 }
 
 func (m *Mailpost) ExtractImageData(imageInfo Image) {
-	// sanitize orig name and replace extension (we will save it as a jpg)
+	// sanitize orig name and replace extension with the one of the format
+	// it is published in
 	imageInfo.Name = m.SanitizeFilename(imageInfo.OrigName)
     extension := filepath.Ext(imageInfo.Name)
 	imageInfo.Name = imageInfo.Name[0:len(imageInfo.Name)-len(extension)]
-	imageInfo.Name = imageInfo.Name + ".jpg"
+	imageInfo.Name = imageInfo.Name + imageExts[m.PublishedFormat(imageInfo.ContentType)]
 	
 	m.images = append(m.images, imageInfo)
 }
@@ -384,65 +793,197 @@ func (imageInfo *Image) SaveImage(m *Mailpost, relatedPost Post) {
 	// save the new path for this image				
 	var pathData PathParts
 	pathData.Date = m.MakeDatePathPart(relatedPost.Date)
-	imageInfo.Path = m.MakePathFromTemplate(m.config.ImageDir, pathData)
-		
-	err := os.MkdirAll(imageInfo.Path, 0755)
-	if err != nil {
-		log.Fatalf("Couldn't make image path: %s", err)
-	}
-	
-	imageInfo.Path = filepath.Join(imageInfo.Path, imageInfo.Name)
+	pathData.Fields = relatedPost.Fields
+	site := m.config.ForPost(relatedPost)
+	imageDir := m.MakePathFromTemplate(site.ImageDir, pathData)
+	imageInfo.Path = filepath.Join(imageDir, imageInfo.Name)
 	
 	// save the new URL for this image
-	imageInfo.URL = filepath.Join(m.config.BaseURL, m.config.ImagePath, pathData.Date, imageInfo.Name)
+	imageInfo.URL = filepath.Join(site.BaseURL, FillFields(site.ImagePath, pathData.Fields), pathData.Date, imageInfo.Name)
+	if m.config.PageBundles {
+		// images go into the post's bundle, next to index.md
+		imageDir = relatedPost.Path
+		imageInfo.Path = filepath.Join(imageDir, imageInfo.Name)
+		imageInfo.URL = imageInfo.Name
+	}
 		
-	// load the image into memory
-	imgReader := bytes.NewReader(imageInfo.Data)
-	img, _, err := image.Decode(imgReader)
+	// tiny images go into the post as a data URI instead of into ImageDir,
+	// so they have to be encoded right away to see how big they are
+	if m.config.MaxInlineImgSize > 0 {
+		m.encoder.slots.Acquire()
+		defer m.encoder.slots.Release()
+
+		img, alpha, err := m.DecodeImage(imageInfo.Data, relatedPost)
+		if err != nil {
+			m.Fail(relatedPost, "Failed to decode image: %s", err)
+			return
+		}
+		// a data URI can't wait for an external encoder, so WebP and AVIF
+		// images are inlined as JPEGs
+		format := m.PublishedFormat(imageInfo.ContentType)
+		inlineFormat := format
+		if _, ok := imageEncoders[format]; ok {
+			inlineFormat = formatJPEG
+		}
+		meta := m.KeptMetadata(imageInfo.Data, relatedPost)
+		encoded, err := encodeImageBuffer(img, alpha, inlineFormat, imageInfo.Data, meta)
+		if err != nil {
+			m.Fail(relatedPost, "Failed to encode image: %s", err)
+			return
+		}
+		defer releaseBuffer(encoded)
+
+		if encoded.Len() <= int(m.config.MaxInlineImgSize) {
+			imageInfo.Path = ""
+			imageInfo.URL = "data:image/" + inlineFormat + ";base64," + base64.StdEncoding.EncodeToString(encoded.Bytes())
+			log.Printf("   |-- Inlined image: %s", imageInfo.Name)
+			return
+		}
+
+		err = m.SaveImageFile(imageDir, imageInfo.Path, func(path string) error {
+			if format == inlineFormat && len(m.extraFormats(format)) == 0 {
+				return writeFile(path, encoded)
+			}
+			return m.writePublishedImage(path, img, alpha, format, imageInfo.Data, meta)
+		})
+		if err != nil {
+			m.Fail(relatedPost, "%s", err)
+			return
+		}
+		m.SaveOriginal(site, *imageInfo)
+		return
+	}
+
+	// the rest are saved in the background, see WaitForImages
+	m.SaveOriginal(site, *imageInfo)
+	data, path := imageInfo.Data, imageInfo.Path
+	format := m.PublishedFormat(imageInfo.ContentType)
+	m.encoder.Go(path, relatedPost, func() error {
+		img, alpha, err := m.DecodeImage(data, relatedPost)
+		if err != nil {
+			return fmt.Errorf("Failed to decode image: %s", err)
+		}
+		return m.SaveImageFile(imageDir, path, func(path string) error {
+			return m.writePublishedImage(path, img, alpha, format, data, m.KeptMetadata(data, relatedPost))
+		})
+	})
+}
+
+// DecodeImage decodes an image, converts it to 8-bit RGB if it is CMYK or
+// 16-bit, turns it upright if its EXIF orientation says it is stored
+// sideways or flipped, and scales it down to MaxImgWidth, or that of the
+// post's type, or the sender's limits if they are smaller. It also
+// reports whether the image has transparency to flatten.
+func (m *Mailpost) DecodeImage(data []byte, postInfo Post) (image.Image, bool, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		log.Printf("Failed to decode image: %s", err)
+		return nil, false, err
 	}
-				
-	// resize the image to max width specified in MaxImgWidth in the config file
+	img = toRGB8(img)
+	if info, ok := ReadExif(data); ok {
+		// before resizing, so the width limit is on the upright width
+		img = orient(img, info.Orientation)
+	}
+	alpha := hasAlpha(format, img)
+
+	privacy := m.config.ForPost(postInfo).ImagePrivacy(postInfo.From)
 	bounds := img.Bounds()
 	width := uint(bounds.Max.X - bounds.Min.X)
 			
-	if width > m.config.MaxImgWidth {
-		img = resize.Resize(m.config.MaxImgWidth, 0, img, resize.Lanczos3)
+	if privacy.MaxWidth > 0 && width > privacy.MaxWidth {
+		img = resize.Resize(privacy.MaxWidth, 0, img, resize.Lanczos3)
 	}
-			
-	// add a white background in case there was transparency
-	backgroundColor := color.RGBA{0xff, 0xff, 0xff, 0xff}
-	finalImg := image.NewRGBA(img.Bounds())
-	draw.Draw(finalImg, finalImg.Bounds(), image.NewUniform(backgroundColor), image.Point{}, draw.Src)
-	draw.Draw(finalImg, finalImg.Bounds(), img, img.Bounds().Min, draw.Over)
-						
-	// save the image as a jpg
-	outfile, err := os.Create(imageInfo.Path)
+	height := uint(img.Bounds().Dy())
+	if privacy.MaxHeight > 0 && height > privacy.MaxHeight {
+		img = resize.Resize(0, privacy.MaxHeight, img, resize.Lanczos3)
+	}
+	return img, alpha, nil
+}
+
+// SaveImageFile makes imageDir and saves an image to path with write,
+// holding one of the MaxOpenFiles while it does.
+func (m *Mailpost) SaveImageFile(imageDir, path string, write func(path string) error) error {
+	err := os.MkdirAll(imageDir, 0755)
 	if err != nil {
-		log.Fatalf("Failed to output image file: %s", err)
+		return fmt.Errorf("Couldn't make image path: %s", err)
+	}
+
+	m.files.Acquire()
+	err = write(path)
+	m.files.Release()
+	if err != nil {
+		return fmt.Errorf("Failed to write image file: %s", err)
 	}
-	defer outfile.Close()
-			
-	jpeg.Encode(outfile, finalImg, &jpeg.Options{jpeg.DefaultQuality})
 	
-	log.Printf("   |-- Saved image: %s", imageInfo.Path)
+	log.Printf("   |-- Saved image: %s", path)
+	return nil
 }
 
 func (m *Mailpost) ExtractPostData(post string) {
+	var ok bool
+	if post, ok = m.CheckAuthorSignature(post, m.msgFrom); !ok {
+		log.Printf("Couldn't verify the author's signature. Skipping...")
+		return
+	}
+
+	// without the PostToken in the address or a header, the post itself
+	// has to give it
+	if m.config.PostToken != "" {
+		var found bool
+		post, found = m.StripToken(post)
+		if !found && !m.msgToken {
+			log.Printf("Couldn't find the PostToken in the message. Skipping...")
+			return
+		}
+	}
+
+	parts := m.SplitPosts(post)
+	if len(parts) > 1 {
+		log.Printf("|-- %d posts in the message", len(parts))
+	}
+	for _, part := range parts {
+		m.ExtractPost(part)
+	}
+}
+
+// ExtractPost makes a post out of the text of one, with its frontmatter,
+// and adds it to the posts to write.
+func (m *Mailpost) ExtractPost(post string) {
 	var postInfo Post
-	
+
+	// everything after this works on YAML
+	post, err := NormalizeFrontmatter(post)
+	if err != nil {
+		log.Printf("Couldn't read frontmatter: %s. Skipping...", err)
+		return
+	}
+
+	post = m.CleanLinks(post)
+	post = m.CleanBody(post)
+	post = RepairFrontmatter(post)
+	post = m.MakeNote(post)
+	post = m.SynthesizeFrontmatter(post)
+	post = m.ApplySubject(post)
+	post = m.ApplyDraftDefault(post)
+	post = m.MergeSenderFrontmatter(post, m.msgFrom)
+	post = m.ApplyDate(post)
+	post = m.ApplyConfigFrontmatter(post)
+	post = m.ApplyGeneratorFrontmatter(post)
+	post = m.ApplyProvenance(post)
 	postInfo.Data = post
+	postInfo.Fields = ParseFields(post)
 	
 	type T struct {
 		Title string `yaml:"title"`
 		Date string `yaml:"date"`
 		Type string `yaml:"type"`
+		Urgent bool `yaml:"urgent"`
+		Site string `yaml:"site"`
 	}
 	
 	var t T
-	err := yaml.Unmarshal([]byte(post), &t)
-	if t.Title=="" || 
+	err = yaml.Unmarshal([]byte(post), &t)
+	if (t.Title=="" && !m.config.IsNote(t.Type)) || 
 		t.Date=="" ||
 		t.Type=="" || 
 		err!=nil {
@@ -455,94 +996,215 @@ func (m *Mailpost) ExtractPostData(post string) {
 	postInfo.Title = t.Title
 	postInfo.Date = t.Date
 	postInfo.Type = strings.ToLower(t.Type)
+	postInfo.Urgent = t.Urgent
 	
-	postInfo.File = m.SanitizeFilename(t.Title) + ".md"
+	postInfo.File = m.PostFilename(postInfo)
 	
-	postInfo.Path = m.config.PostDir
-	postInfo.Path = m.MakePostPath(postInfo)
+	postInfo.Site = m.msgSite
+	if t.Site != "" {
+		postInfo.Site = t.Site
+	}
+	if !m.config.HasSite(postInfo.Site) {
+		log.Printf("Unknown site %q in frontmatter. Skipping...", postInfo.Site)
+		return
+	}
+
+	postInfo.From = m.msgFrom
+	postInfo.Path = m.config.ForPost(postInfo).PostDir
+	if m.config.PageBundles {
+		postInfo.Path, postInfo.File = BundlePath(postInfo.Path, postInfo.File)
+	}
+	if existing, ok := m.FindExistingPost(postInfo); ok {
+		log.Printf("|-- Same post as %s, updating it", existing)
+		postInfo.Path, postInfo.File = filepath.Dir(existing), filepath.Base(existing)
+	} else {
+		path, err := m.MakePostPath(postInfo)
+		if err != nil {
+			m.Fail(Post{Msg: len(m.status) - 1}, "Can't write the post there: %s", err)
+			return
+		}
+		postInfo.Path = path
+	}
 	
+	postInfo.Msg = len(m.status) - 1
+	m.SaveArtifact(postInfo.Msg, "posts/"+postInfo.File, []byte(post))
+	postInfo.Header = m.msgHeader
+	m.status[postInfo.Msg] = MessagePosted
 	m.posts = append(m.posts, postInfo)
 }
 
-func (m *Mailpost) WritePostToFile(postInfo Post) {
-	path := filepath.Join(postInfo.Path, postInfo.File)
+// WritePostToFile writes a post and returns where it went, and false if
+// it was already there as it is. It only logs to logger and touches
+// nothing but the post's file, so posts can be written side by side.
+func (m *Mailpost) WritePostToFile(postInfo Post, logger *log.Logger) (string, bool, error) {
+	postInfo.Data = m.FormatFrontmatter(postInfo.Data)
+	path, changed := m.ResolveExistingPost(filepath.Join(postInfo.Path, postInfo.File), postInfo.Data, logger)
+	if !changed {
+		return path, false, nil
+	}
 		
 	dst, err := os.Create(path)
 	if err != nil {
-		log.Fatalf("Failed to create file: %s", err)
+		return path, false, fmt.Errorf("Failed to create file: %s", err)
 	}
+	defer dst.Close()
 	
 	buf := bytes.NewBufferString(postInfo.Data)
 	_, err = io.Copy(dst, buf)
 	if err != nil {
-		log.Fatalf("Failed to write post to file: %s", err)
+		return path, false, fmt.Errorf("Failed to write post to file: %s", err)
 	}
 	
-	log.Printf("   |-- Saved post: %s", path)
+	logger.Printf("   |-- Saved post: %s", path)
+	return path, true, nil
 }
 
-func (m *Mailpost) RetrieveImages() {
+// PerMessageTimeout returns how long the downloads for one message may take
+// altogether, both the message itself and the images it links to.
+func (c *Config) PerMessageTimeout() time.Duration {
+	return c.MessageTimeout.Or(5 * time.Minute)
+}
+
+// CheckInterval returns how long to wait between checks for mail: the
+// -interval flag if it was given, otherwise Interval, otherwise 5m.
+func (c *Config) CheckInterval() time.Duration {
+	var d Duration
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "interval" {
+			if err := d.UnmarshalText([]byte(f.Value.String())); err != nil || d.d <= 0 {
+				log.Fatalf("Invalid -interval: %s", f.Value)
+			}
+		}
+	})
+	return d.Or(c.Interval.Or(5 * time.Minute))
+}
+
+func (m *Mailpost) RetrieveImages(ctx context.Context) {
 	var imageInfo Image
+	
+	// every message gets MessageTimeout for all of its downloads, so one
+	// slow host can't hold up the rest
+	deadlines := make(map[int]context.Context)
+	for p:=0;p<len(m.posts);p++ {
+		if _, ok := deadlines[m.posts[p].Msg]; !ok {
+			msgCtx, cancel := context.WithTimeout(ctx, m.config.PerMessageTimeout())
+			defer cancel()
+			deadlines[m.posts[p].Msg] = msgCtx
+		}
+	}
 		
-	reMd := regexp.MustCompile(`!\[.*\]\(\s*(https{0,1}://.*?)[\s|\)]`)
-	reSc := regexp.MustCompile(`{{<\s*(?:figure|img).*src="(https{0,1}://.*?)"`)
+	reMd := regexp.MustCompile(`!\[[^\]]*\]\(\s*(https{0,1}://.*?)[\s|\)]`)
+	reSc := regexp.MustCompile(`{{<\s*(?:figure|img)\b[^>]*?src="(https{0,1}://.*?)"`)
 
 	for p:=0;p<len(m.posts);p++ {
-		mdImageURLs := reMd.FindAllStringSubmatch(m.posts[p].Data, -1)
-		scImageURLs := reSc.FindAllStringSubmatch(m.posts[p].Data, -1)
+		m.RetrieveLinkedAttachments(deadlines[m.posts[p].Msg], m.posts[p])
+
+		// images referenced inside code are examples, not content
+		data, _ := MaskCode(m.posts[p].Data)
+		mdImageURLs := reMd.FindAllStringSubmatch(data, -1)
+		scImageURLs := reSc.FindAllStringSubmatch(data, -1)
 		
 		for i:=0;i<len(mdImageURLs);i++ {
-		    reqImg, err := http.Get(mdImageURLs[i][1])
-		    if err != nil || reqImg.StatusCode != 200 {
-		        log.Printf("Error %d, Status: %d", err, reqImg.StatusCode)
-		        return
-		    }
-		    
-		    imageInfo.Data, err = ioutil.ReadAll(reqImg.Body)
-		    
-		    defer reqImg.Body.Close()
+			data, ok := m.FetchImage(deadlines[m.posts[p].Msg], mdImageURLs[i][1], m.posts[p])
+			if !ok {
+				continue
+			}
+			imageInfo.Data = data
+			imageInfo.Msg = m.posts[p].Msg
 			
 			imageInfo.OrigURL = mdImageURLs[i][1]
 			u, _ := url.Parse(imageInfo.OrigURL)
 			imageInfo.OrigName = filepath.Base(u.Path)
+			m.SaveArtifact(imageInfo.Msg, "downloads/"+m.SanitizeFilename(imageInfo.OrigName), data)
 						
 			m.ExtractImageData(imageInfo)
 		}
 		for i:=0;i<len(scImageURLs);i++ {
-		    reqImg, err := http.Get(scImageURLs[i][1])
-		    if err != nil || reqImg.StatusCode != 200 {
-		        log.Printf("Error %d, Status: %d", err, reqImg.StatusCode)
-		        return
-		    }
-		    
-		    imageInfo.Data, err = ioutil.ReadAll(reqImg.Body)
-		    
-		    defer reqImg.Body.Close()
+			data, ok := m.FetchImage(deadlines[m.posts[p].Msg], scImageURLs[i][1], m.posts[p])
+			if !ok {
+				continue
+			}
+			imageInfo.Data = data
+			imageInfo.Msg = m.posts[p].Msg
 			
 			imageInfo.OrigURL = scImageURLs[i][1]
 			u, _ := url.Parse(imageInfo.OrigURL)
 			imageInfo.OrigName = filepath.Base(u.Path)
+			m.SaveArtifact(imageInfo.Msg, "downloads/"+m.SanitizeFilename(imageInfo.OrigName), data)
 						
 			m.ExtractImageData(imageInfo)
 		}
 	}
 }
 
+// FetchImage downloads an image referenced by a post. Images turned away
+// by PreflightImage, or found to break the same rules while downloading,
+// are skipped and left as links.
+func (m *Mailpost) FetchImage(ctx context.Context, link string, relatedPost Post) ([]byte, bool) {
+	if !m.PreflightImage(ctx, link) {
+		return nil, false
+	}
+	req, err := m.NewImageRequest(ctx, link)
+	if err != nil {
+		m.Fail(relatedPost, "Failed to fetch image %s: %s", link, err)
+		return nil, false
+	}
+	reqImg, err := m.web.Do(req)
+	if err != nil {
+		m.Fail(relatedPost, "Failed to fetch image %s: %s", link, err)
+		return nil, false
+	}
+	defer reqImg.Body.Close()
+
+	if reqImg.StatusCode != 200 {
+		m.Fail(relatedPost, "Failed to fetch image %s: status %d", link, reqImg.StatusCode)
+		return nil, false
+	}
+	if err := m.config.CheckImageHeaders(reqImg.Header, reqImg.ContentLength); err != nil {
+		log.Printf("   |-- Skipping image %s: %s", link, err)
+		return nil, false
+	}
+
+	body := io.Reader(reqImg.Body)
+	if m.config.MaxImageDownload > 0 {
+		body = io.LimitReader(body, int64(m.config.MaxImageDownload)+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		m.Fail(relatedPost, "Failed to fetch image %s: %s", link, err)
+		return nil, false
+	}
+	if m.config.MaxImageDownload > 0 && len(data) > int(m.config.MaxImageDownload) {
+		log.Printf("   |-- Skipping image %s: over MaxImageDownload", link)
+		return nil, false
+	}
+	if err := m.config.CheckImageType(http.DetectContentType(data)); err != nil {
+		log.Printf("   |-- Skipping image %s: content is %s", link, err)
+		return nil, false
+	}
+	return data, true
+}
+
 func (m *Mailpost) ReplaceImageRefs() {
-	reMd := regexp.MustCompile(`!\[.*\]\(\s*((?:[[:alnum:]]|_|-)+\.[[:alpha:]]+).*?\)`)
-	reSc := regexp.MustCompile(`{{<\s*(?:figure|img).*src="((?:[[:alnum:]]|_|-)+\.[[:alpha:]]+)"`)
-	reMdOrd := regexp.MustCompile(`(!\[.*\]\(\s*)([[:digit:]]+)(.*?\))`)
-	reScOrd := regexp.MustCompile(`({{<\s*(?:figure|img).*src=")([[:digit:]]+)(".*>}})`)
-	reMdURL := regexp.MustCompile(`!\[.*\]\(\s*(https{0,1}://.*?)(?:\s|\))`)
-	reScURL := regexp.MustCompile(`{{<\s*(?:figure|img).*src="(https{0,1}://.*?)"`)
+	reMd := regexp.MustCompile(`!\[[^\]]*\]\(\s*((?:[[:alnum:]]|_|-)+\.[[:alpha:]]+).*?\)`)
+	reSc := regexp.MustCompile(`{{<\s*(?:figure|img)\b[^>]*?src="((?:[[:alnum:]]|_|-)+\.[[:alpha:]]+)"[^>]*>}}`)
+	reMdOrd := regexp.MustCompile(`(!\[[^\]]*\]\(\s*)([[:digit:]]+)(.*?\))`)
+	reScOrd := regexp.MustCompile(`({{<\s*(?:figure|img)\b[^>]*?src=")([[:digit:]]+)("[^>]*>}})`)
+	reMdURL := regexp.MustCompile(`!\[[^\]]*\]\(\s*(https{0,1}://.*?)(?:\s.*?)?\)`)
+	reScURL := regexp.MustCompile(`{{<\s*(?:figure|img)\b[^>]*?src="(https{0,1}://.*?)"[^>]*>}}`)
+	reMdCid := regexp.MustCompile(`!\[[^\]]*\]\(\s*cid:([^\s)]+).*?\)`)
 
 	for p:=0;p<len(m.posts);p++ {
+		var unmask func(string) string
+		m.posts[p].Data, unmask = MaskCode(m.posts[p].Data)
+
 		mdMatches := reMd.FindAllStringSubmatch(m.posts[p].Data, -1)
 		scMatches := reSc.FindAllStringSubmatch(m.posts[p].Data, -1)
 		mdOrdMatches := reMdOrd.FindAllStringSubmatch(m.posts[p].Data, -1)
 		scOrdMatches := reScOrd.FindAllStringSubmatch(m.posts[p].Data, -1)
 		mdURLMatches := reMdURL.FindAllStringSubmatch(m.posts[p].Data, -1)
 		scURLMatches := reScURL.FindAllStringSubmatch(m.posts[p].Data, -1)
+		mdCidMatches := reMdCid.FindAllStringSubmatch(m.posts[p].Data, -1)
 				
 		for i:=0;i<len(mdMatches);i++ {
 			for j:=0;j<len(m.images);j++ {
@@ -550,7 +1212,7 @@ func (m *Mailpost) ReplaceImageRefs() {
 					m.images[j].OrigURL==mdMatches[i][1] {		
 								
 					m.images[j].SaveImage(m, m.posts[p])
-					m.posts[p].Data = strings.Replace(m.posts[p].Data, mdMatches[i][1], m.images[j].URL, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, mdMatches[i][0], mdMatches[i][1], m.images[j].URL, m.images[j])
 				}
 			}
 		}
@@ -560,7 +1222,7 @@ func (m *Mailpost) ReplaceImageRefs() {
 					m.images[j].OrigURL==scMatches[i][1] {		
 								
 					m.images[j].SaveImage(m, m.posts[p])
-					m.posts[p].Data = strings.Replace(m.posts[p].Data, scMatches[i][1], m.images[j].URL, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, scMatches[i][0], scMatches[i][1], m.images[j].URL, m.images[j])
 				}
 			}
 		}
@@ -570,7 +1232,7 @@ func (m *Mailpost) ReplaceImageRefs() {
 				if m.images[j].Ordinal==matchedOrd {		
 					m.images[j].SaveImage(m, m.posts[p])
 					newImgStr := mdOrdMatches[i][1]+m.images[j].URL+mdOrdMatches[i][3]
- 					m.posts[p].Data = strings.Replace(m.posts[p].Data, mdOrdMatches[i][0], newImgStr, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, mdOrdMatches[i][0], mdOrdMatches[i][0], newImgStr, m.images[j])
 				}
 			}
 		}
@@ -580,7 +1242,7 @@ func (m *Mailpost) ReplaceImageRefs() {
 				if m.images[j].Ordinal==matchedOrd {							
 					m.images[j].SaveImage(m, m.posts[p])
 					newImgStr := scOrdMatches[i][1]+m.images[j].URL+scOrdMatches[i][3]
-					m.posts[p].Data = strings.Replace(m.posts[p].Data, scOrdMatches[i][0], newImgStr, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, scOrdMatches[i][0], scOrdMatches[i][0], newImgStr, m.images[j])
 				}
 			}
 		}
@@ -588,7 +1250,7 @@ func (m *Mailpost) ReplaceImageRefs() {
 			for j:=0;j<len(m.images);j++ {
 				if m.images[j].OrigURL==mdURLMatches[i][1] {
 					m.images[j].SaveImage(m,m.posts[p])
-					m.posts[p].Data = strings.Replace(m.posts[p].Data, mdURLMatches[i][1], m.images[j].URL, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, mdURLMatches[i][0], mdURLMatches[i][1], m.images[j].URL, m.images[j])
 				}
 			}
 		}
@@ -596,12 +1258,86 @@ func (m *Mailpost) ReplaceImageRefs() {
 			for j:=0;j<len(m.images);j++ {
 				if m.images[j].OrigURL==scURLMatches[i][1] {
 					m.images[j].SaveImage(m,m.posts[p])
-					m.posts[p].Data = strings.Replace(m.posts[p].Data, scURLMatches[i][1], m.images[j].URL, 1)
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, scURLMatches[i][0], scURLMatches[i][1], m.images[j].URL, m.images[j])
+				}
+			}
+		}
+		for i:=0;i<len(mdCidMatches);i++ {
+			for j:=0;j<len(m.images);j++ {
+				if m.images[j].ContentID != "" &&
+					m.images[j].ContentID==mdCidMatches[i][1] {
+					m.images[j].SaveImage(m,m.posts[p])
+					m.posts[p].Data = m.RewriteImageRef(m.posts[p].Data, mdCidMatches[i][0], "cid:"+mdCidMatches[i][1], m.images[j].URL, m.images[j])
 				}
 			}
 		}
-		m.WritePostToFile(m.posts[p])
+		m.posts[p].Data = m.AddGallery(p)
+		m.posts[p].Data = m.LinkAttachments(m.posts[p], m.posts[p].Data)
+		m.posts[p].Data = unmask(m.posts[p].Data)
+		m.posts[p].Data = m.ApplyPostTemplate(m.posts[p])
+	}
+	m.WaitForImages()
+	m.HoldPosts()
+	m.WritePosts()
+}
+
+// Run processes everything the source has waiting and returns what
+// became of each message. If the source fails while fetching, nothing is
+// posted and the messages are left for the next run.
+func (m *Mailpost) Run(ctx context.Context) ([]MessageStatus, error) {
+	m.PublishHeldPosts()
+	if reason, over := m.OverQuota(); over {
+		log.Printf("Over quota, not checking mail: %s", reason)
+		return nil, nil
+	}
+	if err := m.FetchMails(ctx); err != nil {
+		m.ResetRun()
+		return nil, err
+	}
+	m.RetrieveImages(ctx)
+	m.EnforcePolicies()
+	m.ReplaceImageRefs()
+	err := m.source.MarkProcessed(ctx, m.status)
+	if err != nil {
+		log.Printf("Couldn't mark messages processed: %s", err)
+	} else {
+		m.runs++
+		m.RecordSuccess()
+	}
+	m.RecordHistory()
+	m.RecordStats()
+	m.RecordQuota()
+	m.CleanWorkspaces()
+	
+	for i:=0;i<len(m.images);i++ {
+		log.Printf("-------------------------")
+		log.Printf("Name: %s", m.images[i].Name)
+		log.Printf("Path: %s", m.images[i].Path)
+		log.Printf("Ordinal: %d", m.images[i].Ordinal)
+	}
+	status := m.status
+	m.posts = nil
+	m.images = nil
+	m.attachments = nil
+	m.status = nil
+	m.written = 0
+	return status, err
+}
+
+// ResetRun throws away everything gathered from a fetch that failed.
+func (m *Mailpost) ResetRun() {
+	for _, dir := range m.workspaces {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
 	}
+	m.workspaces = nil
+	m.posts = nil
+	m.images = nil
+	m.attachments = nil
+	m.status = nil
+	m.history = nil
+	m.written = 0
 }
 
 func main() {
@@ -612,29 +1348,55 @@ func main() {
 		imap.DefaultLogMask = imap.LogConn | imap.LogRaw
 	}
 
-	m := Mailpost{}
+	m := &Mailpost{}
 	m.ReadConfig(*conf)
 	m.OpenLog(*logfile)
+	if *tenant != "" {
+		tm, err := m.Tenant(*tenant)
+		if err != nil {
+			log.Fatalf("Couldn't load tenant: %s", err)
+		}
+		m = tm
+	}
+
+	switch flag.Arg(0) {
+	case "gc":
+		m.GC(flag.Args()[1:])
+		os.Exit(0)
+	case "history":
+		m.HistoryCommand(flag.Args()[1:])
+		os.Exit(0)
+	case "ingest":
+		os.Exit(m.Ingest(flag.Args()[1:]))
+	case "doctor":
+		os.Exit(m.Doctor(flag.Args()[1:]))
+	case "images":
+		os.Exit(m.Images(flag.Args()[1:]))
+	case "sign":
+		os.Exit(m.Sign(flag.Args()[1:]))
+	case "":
+	default:
+		log.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
+	if len(m.config.Tenants) > 0 {
+		os.Exit(m.RunTenants())
+	}
+
 	m.imgNum = 0
+	m.source = m.NewSource()
+	m.RunPreflight()
 
 	for {
-		m.Connect()
-		m.FetchMails()
-		m.RetrieveImages()
-		m.ReplaceImageRefs()
-		m.client.Logout(1 * time.Second)
-		
-		for i:=0;i<len(m.images);i++ {
-			log.Printf("-------------------------")
-			log.Printf("Name: %s", m.images[i].Name)
-			log.Printf("Path: %s", m.images[i].Path)
-			log.Printf("Ordinal: %d", m.images[i].Ordinal)
-		}
+		err := m.Retry("Mail check", func() error { return m.Session(context.Background()) })
 
 		if *once {
+			if err != nil {
+				os.Exit(1)
+			}
 			os.Exit(0)
 		} else {
-			t, _ := time.ParseDuration(*interval)
+			t := m.config.CheckInterval()
 			log.Printf("Waiting for %v", t)
 			time.Sleep(t)
 		}
@@ -0,0 +1,128 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaskCode replaces fenced code blocks and inline code spans in a post with
+// placeholders, so that image references and shortcodes shown as code are
+// left alone by the rewriting regexes. The returned function puts the code
+// back.
+func MaskCode(data string) (string, func(string) string) {
+	var code []string
+	out := new(strings.Builder)
+
+	mask := func(s string) {
+		fmt.Fprintf(out, "\x00%d\x00", len(code))
+		code = append(code, s)
+	}
+
+	lines := strings.SplitAfter(data, "\n")
+	text := new(strings.Builder)
+	for i := 0; i < len(lines); i++ {
+		fence := codeFence(lines[i])
+		if fence == "" {
+			text.WriteString(lines[i])
+			continue
+		}
+
+		// a fence runs until a closing fence of the same kind that is at
+		// least as long, or to the end of the post
+		maskInlineCode(text.String(), out, mask)
+		text.Reset()
+
+		block := lines[i]
+		for i++; i < len(lines); i++ {
+			block += lines[i]
+			if closing := codeFence(lines[i]); closing != "" &&
+				closing[0] == fence[0] && len(closing) >= len(fence) &&
+				strings.TrimSpace(lines[i]) == closing {
+				break
+			}
+		}
+		mask(block)
+	}
+	maskInlineCode(text.String(), out, mask)
+
+	unmask := func(s string) string {
+		for i := len(code) - 1; i >= 0; i-- {
+			s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", i), code[i], 1)
+		}
+		return s
+	}
+	return out.String(), unmask
+}
+
+// codeFence returns the ``` or ~~~ run opening a fenced code block on
+// line, or "" if the line doesn't start one.
+func codeFence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return ""
+	}
+	for _, c := range []string{"`", "~"} {
+		n := len(trimmed) - len(strings.TrimLeft(trimmed, c))
+		if n < 3 {
+			continue
+		}
+		// the info string of a backtick fence can't contain backticks
+		if c == "`" && strings.Contains(trimmed[n:], "`") {
+			return ""
+		}
+		return strings.Repeat(c, n)
+	}
+	return ""
+}
+
+// maskInlineCode copies text to out, passing each inline code span (a run
+// of backticks up to the next run of the same length) to mask instead.
+func maskInlineCode(text string, out *strings.Builder, mask func(string)) {
+	for {
+		start := strings.Index(text, "`")
+		if start < 0 {
+			break
+		}
+		n := len(text[start:]) - len(strings.TrimLeft(text[start:], "`"))
+		ticks := text[start : start+n]
+
+		end := -1
+		for pos := start + n; pos < len(text); {
+			i := strings.Index(text[pos:], ticks)
+			if i < 0 {
+				break
+			}
+			i += pos
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			if run == n {
+				end = i + n
+				break
+			}
+			pos = i + run
+		}
+
+		if end < 0 {
+			// an unmatched run of backticks is just text
+			out.WriteString(text[:start+n])
+			text = text[start+n:]
+			continue
+		}
+		out.WriteString(text[:start])
+		mask(text[start:end])
+		text = text[end:]
+	}
+	out.WriteString(text)
+}
@@ -0,0 +1,207 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaskCode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// what is left once the code is masked, with each placeholder
+		// written as #
+		want string
+	}{
+		{
+			name: "no code",
+			in:   "Some text with ![a](a.jpg) in it.\n",
+			want: "Some text with ![a](a.jpg) in it.\n",
+		},
+		{
+			name: "backtick fence",
+			in:   "Before\n```go\n![a](a.jpg)\n```\nAfter ![b](b.jpg)\n",
+			want: "Before\n#After ![b](b.jpg)\n",
+		},
+		{
+			name: "tilde fence",
+			in:   "Before\n~~~\n{{< figure src=\"a.jpg\" >}}\n~~~\nAfter\n",
+			want: "Before\n#After\n",
+		},
+		{
+			name: "indented fence",
+			in:   "   ```\n![a](a.jpg)\n   ```\n",
+			want: "#",
+		},
+		{
+			name: "four spaces is not a fence",
+			in:   "    ```\n![a](a.jpg)\n",
+			want: "    ```\n![a](a.jpg)\n",
+		},
+		{
+			name: "tildes don't close a backtick fence",
+			in:   "```\n~~~\n![a](a.jpg)\n~~~\n```\ntext\n",
+			want: "#text\n",
+		},
+		{
+			name: "a shorter fence doesn't close a longer one",
+			in:   "````\n```\n![a](a.jpg)\n```\n````\ntext\n",
+			want: "#text\n",
+		},
+		{
+			name: "a closing fence can't have an info string",
+			in:   "```\n```go\n![a](a.jpg)\n```\ntext\n",
+			want: "#text\n",
+		},
+		{
+			name: "unclosed fence runs to the end",
+			in:   "Before\n```\n![a](a.jpg)\n{{< figure src=\"b.jpg\" >}}\n",
+			want: "Before\n#",
+		},
+		{
+			name: "backticks in a backtick info string",
+			in:   "``` a`b\n![a](a.jpg)\n",
+			want: "``` a`b\n![a](a.jpg)\n",
+		},
+		{
+			name: "inline code",
+			in:   "Use `![a](a.jpg)` for ![b](b.jpg).",
+			want: "Use # for ![b](b.jpg).",
+		},
+		{
+			name: "double backticks around a single one",
+			in:   "Use ``a ` b ![a](a.jpg)`` here.",
+			want: "Use # here.",
+		},
+		{
+			name: "a longer run doesn't close a span",
+			in:   "`a ``` b` c",
+			want: "# c",
+		},
+		{
+			name: "unmatched backticks are text",
+			in:   "It's ``![a](a.jpg) and `not code.",
+			want: "It's ``![a](a.jpg) and `not code.",
+		},
+		{
+			name: "several spans",
+			in:   "`a` and ``b`` and `c`",
+			want: "# and # and #",
+		},
+		{
+			name: "shortcode nested in a fenced shortcode",
+			in:   "```\n{{< gallery >}}\n{{< figure src=\"a.jpg\" >}}\n{{< /gallery >}}\n```\n{{< figure src=\"b.jpg\" >}}\n",
+			want: "#{{< figure src=\"b.jpg\" >}}\n",
+		},
+		{
+			name: "shortcode nested in inline code",
+			in:   "`{{< gallery >}}{{< figure src=\"a.jpg\" >}}{{< /gallery >}}` {{< figure src=\"b.jpg\" >}}",
+			want: "# {{< figure src=\"b.jpg\" >}}",
+		},
+		{
+			name: "inline code in a shortcode",
+			in:   "{{< figure src=\"a.jpg\" caption=\"`code`\" >}}",
+			want: "{{< figure src=\"a.jpg\" caption=\"#\" >}}",
+		},
+		{
+			name: "inline code around a fence",
+			in:   "`a`\n```\nb\n```\n`c`\n",
+			want: "#\n##\n",
+		},
+	}
+
+	for _, test := range tests {
+		masked, unmask := MaskCode(test.in)
+		var got strings.Builder
+		for i := 0; i < len(masked); i++ {
+			if masked[i] != 0 {
+				got.WriteByte(masked[i])
+				continue
+			}
+			// skip the number and the closing NUL
+			i += strings.IndexByte(masked[i+1:], 0) + 1
+			got.WriteByte('#')
+		}
+		if got.String() != test.want {
+			t.Errorf("%s: MaskCode(%q) left %q, want %q", test.name, test.in, got.String(), test.want)
+		}
+		if back := unmask(masked); back != test.in {
+			t.Errorf("%s: unmask gave %q, want %q", test.name, back, test.in)
+		}
+	}
+}
+
+func TestMaskCodeUnmaskAfterRewrite(t *testing.T) {
+	in := "![a](a.jpg)\n```\n![a](a.jpg)\n```\n`![a](a.jpg)`\n"
+	masked, unmask := MaskCode(in)
+	rewritten := strings.Replace(masked, "a.jpg", "/images/a.jpg", -1)
+	want := "![a](/images/a.jpg)\n```\n![a](a.jpg)\n```\n`![a](a.jpg)`\n"
+	if got := unmask(rewritten); got != want {
+		t.Errorf("unmask after rewriting gave %q, want %q", got, want)
+	}
+}
+
+func TestReplaceImageRefsSkipsCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailpost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Mailpost{config: Config{
+		PostDir:     filepath.Join(dir, "posts"),
+		ImageDir:    filepath.Join(dir, "images"),
+		ImagePath:   "/images",
+		DatePathFmt: "2006/01",
+	}}
+	if err := os.MkdirAll(m.config.PostDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	m.ApplyResourceLimits()
+	m.status = []MessageStatus{MessagePosted}
+	m.history = []HistoryEntry{{}}
+	for _, name := range []string{"a.png", "b.png"} {
+		m.ExtractImageData(Image{OrigName: name, ContentType: "image/png", Data: alphaPNGFixture(4, 4)})
+	}
+
+	gallery := "{{< gallery >}}{{< figure src=\"a.png\" >}}{{< /gallery >}}\n"
+	fence := "```\n![b](b.png)\n{{< figure src=\"b.png\" >}}\n```\n"
+	inline := "`![b](b.png)`"
+	m.posts = []Post{{
+		Title: "Test",
+		Date:  "2015-06-01",
+		File:  "test.md",
+		Path:  m.config.PostDir,
+		Data:  gallery + "\n" + fence + "\n" + inline + " and ![b](b.png)\n",
+	}}
+	m.ReplaceImageRefs()
+
+	got := m.posts[0].Data
+	url := "/images/2015/06/"
+	wantGallery := "{{< gallery >}}{{< figure src=\"" + url + m.images[0].Name + "\" >}}{{< /gallery >}}"
+	if !strings.Contains(got, wantGallery) {
+		t.Errorf("figure in a gallery not rewritten to %q:\n%s", wantGallery, got)
+	}
+	if !strings.Contains(got, fence) {
+		t.Errorf("image refs in a code fence rewritten:\n%s", got)
+	}
+	if !strings.Contains(got, inline+" and ![b]("+url+m.images[1].Name+")") {
+		t.Errorf("image ref in inline code rewritten, or the one after it not:\n%s", got)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// More EXIF tags, which are only ever kept.
+const (
+	tagImageDescription = 0x010e
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagArtist           = 0x013b
+	tagCopyright        = 0x8298
+	tagLensModel        = 0xa434
+)
+
+// keptTag is where a tag KeepMetadata may name is found: in the first IFD
+// or in the EXIF IFD it points to.
+type keptTag struct {
+	exifIFD bool
+	tag     uint16
+}
+
+// keepableTags are the tags KeepMetadata may name, by lower case name.
+// GPS tags can't be kept, nor the orientation, which DecodeImage has
+// already applied.
+var keepableTags = map[string]keptTag{
+	"make":               {false, tagMake},
+	"model":              {false, tagModel},
+	"imagedescription":   {false, tagImageDescription},
+	"software":           {false, tagSoftware},
+	"datetime":           {false, tagDateTime},
+	"artist":             {false, tagArtist},
+	"copyright":          {false, tagCopyright},
+	"datetimeoriginal":   {true, tagTaken},
+	"offsettimeoriginal": {true, tagTakenOffset},
+	"exposuretime":       {true, tagExposureTime},
+	"fnumber":            {true, tagFNumber},
+	"isospeedratings":    {true, tagISO},
+	"focallength":        {true, tagFocalLength},
+	"lensmodel":          {true, tagLensModel},
+}
+
+// checkKeepMetadata makes sure KeepMetadata only names tags that can be
+// kept.
+func (c *Config) checkKeepMetadata() error {
+	for _, name := range c.KeepMetadata {
+		if _, ok := keepableTags[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("invalid KeepMetadata %q: it isn't an EXIF tag mailpost can keep", name)
+		}
+	}
+	return nil
+}
+
+// KeptMetadata returns the EXIF segment to write into the published copy
+// of an image, with only the tags KeepMetadata names, or nil if there is
+// nothing to keep. A sender with StripMetadata gets nothing kept.
+func (m *Mailpost) KeptMetadata(data []byte, postInfo Post) []byte {
+	return keepMetadata(data, m.config.ForPost(postInfo).ImagePrivacy(postInfo.From).Keep)
+}
+
+// keepMetadata returns an APP1 segment with an EXIF of the tags of the
+// JPEG in data that are named, in the byte order they were in, or nil if
+// it has none of them.
+func keepMetadata(data []byte, names []string) []byte {
+	if len(names) == 0 {
+		return nil
+	}
+	r, ifd0, ok := readTIFF(data)
+	if !ok {
+		return nil
+	}
+	var exifIFD map[uint16]tiffEntry
+	if offset, ok := r.uint(ifd0[tagExifIFD]); ok {
+		exifIFD = r.ifd(offset)
+	}
+
+	top := make(map[uint16]tiffEntry)
+	sub := make(map[uint16]tiffEntry)
+	for _, name := range names {
+		kept, ok := keepableTags[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if kept.exifIFD {
+			if entry, ok := exifIFD[kept.tag]; ok {
+				sub[kept.tag] = entry
+			}
+		} else if entry, ok := ifd0[kept.tag]; ok {
+			top[kept.tag] = entry
+		}
+	}
+	if len(top) == 0 && len(sub) == 0 {
+		return nil
+	}
+
+	// the EXIF IFD goes right after the first, which has to be laid out
+	// to know where that is
+	pointer := make([]byte, 4)
+	if len(sub) > 0 {
+		top[tagExifIFD] = tiffEntry{kind: 4, count: 1, value: pointer}
+	}
+	first := r.marshalIFD(top, 8)
+	var second []byte
+	if len(sub) > 0 {
+		r.order.PutUint32(pointer, uint32(8+len(first)))
+		first = r.marshalIFD(top, 8)
+		second = r.marshalIFD(sub, uint32(8+len(first)))
+	}
+
+	tiff := make([]byte, 8)
+	if r.order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	r.order.PutUint16(tiff[2:], 42)
+	r.order.PutUint32(tiff[4:], 8)
+	tiff = append(append(tiff, first...), second...)
+
+	size := 2 + 6 + len(tiff)
+	if size > 0xffff {
+		return nil
+	}
+	segment := []byte{0xff, 0xe1, byte(size >> 8), byte(size)}
+	segment = append(segment, "Exif\x00\x00"...)
+	return append(segment, tiff...)
+}
+
+// marshalIFD lays out an IFD that starts at offset, with the values too
+// big to fit in their entries after it and no IFD after it.
+func (r tiffReader) marshalIFD(entries map[uint16]tiffEntry, offset uint32) []byte {
+	var tags []int
+	for tag := range entries {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	out := make([]byte, 2+12*len(tags)+4)
+	r.order.PutUint16(out, uint16(len(tags)))
+	var values []byte
+	valuesAt := offset + uint32(len(out))
+	for i, tag := range tags {
+		entry := entries[uint16(tag)]
+		raw := out[2+i*12:]
+		r.order.PutUint16(raw, uint16(tag))
+		r.order.PutUint16(raw[2:], entry.kind)
+		r.order.PutUint32(raw[4:], entry.count)
+		if len(entry.value) <= 4 {
+			copy(raw[8:12], entry.value)
+			continue
+		}
+		r.order.PutUint32(raw[8:], valuesAt+uint32(len(values)))
+		values = append(values, entry.value...)
+		if len(values)%2 == 1 {
+			// values start on a word boundary
+			values = append(values, 0)
+		}
+	}
+	return append(out, values...)
+}
+
+// segmentWriter writes a segment into a JPEG right after its start of
+// image marker, as the JPEG is written through it.
+type segmentWriter struct {
+	w       io.Writer
+	segment []byte
+	written int
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	if s.segment == nil {
+		return s.w.Write(p)
+	}
+	head := 2 - s.written
+	if head > len(p) {
+		head = len(p)
+	}
+	n, err := s.w.Write(p[:head])
+	s.written += n
+	if err != nil || s.written < 2 {
+		return n, err
+	}
+	if _, err := s.w.Write(s.segment); err != nil {
+		return n, err
+	}
+	s.segment = nil
+	rest, err := s.w.Write(p[head:])
+	return n + rest, err
+}
@@ -0,0 +1,48 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "strings"
+
+// SplitPosts splits the text of a message into the posts in it, which
+// are separated by lines holding only PostDelimiter, like "---===---", so
+// a week of posts can be sent in one message. Each has frontmatter of its
+// own. Parts with nothing in them are dropped. Without PostDelimiter the
+// text is a single post.
+func (m *Mailpost) SplitPosts(text string) []string {
+	delimiter := strings.TrimSpace(m.config.PostDelimiter)
+	if delimiter == "" {
+		return []string{text}
+	}
+
+	var parts []string
+	var part strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.TrimSpace(line) != delimiter {
+			part.WriteString(line)
+			continue
+		}
+		if strings.TrimSpace(part.String()) != "" {
+			parts = append(parts, strings.TrimLeft(part.String(), "\r\n"))
+		}
+		part.Reset()
+	}
+	if strings.TrimSpace(part.String()) != "" {
+		parts = append(parts, strings.TrimLeft(part.String(), "\r\n"))
+	}
+	if len(parts) == 0 {
+		return []string{text}
+	}
+	return parts
+}
@@ -0,0 +1,310 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNoArticle is returned for an article that has been cancelled or has
+// expired, which is skipped.
+var errNoArticle = errors.New("no such article")
+
+// NNTPSource reads the articles of newsgroups, from NNTPServer or, without
+// one, from a news spool at SourcePath, as INN keeps it with a directory
+// for each group and a file for each article. Articles are numbered in
+// every group, so the state keeps the last one read and only newer ones
+// are fetched. Nothing is marked or removed on the server.
+type NNTPSource struct {
+	config  *Config
+	state   *StateStore
+	netConn net.Conn
+	conn    *textproto.Conn
+	pending map[string]uint32
+}
+
+func (s *NNTPSource) Connect(ctx context.Context) error {
+	if len(s.config.Newsgroups) == 0 {
+		return fmt.Errorf("no Newsgroups to read")
+	}
+	if s.config.NNTPServer == "" {
+		log.Printf("Opening news spool %s..\n", s.config.SourcePath)
+		if info, err := os.Stat(s.config.SourcePath); err != nil || !info.IsDir() {
+			return fmt.Errorf("not a news spool: %s", s.config.SourcePath)
+		}
+		return nil
+	}
+
+	log.Print("Connecting to news server..\n")
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("connection to server failed: %s", err)
+	}
+	s.netConn = conn
+	s.conn = textproto.NewConn(conn)
+	s.netConn.SetDeadline(time.Now().Add(s.config.PerMessageTimeout()))
+	if _, _, err := s.conn.ReadCodeLine(20); err != nil {
+		s.Close()
+		return fmt.Errorf("server refused the connection: %s", err)
+	}
+
+	// servers that also take articles from peers only offer reading
+	// after MODE READER, and the others ignore it
+	s.cmd(20, "MODE READER")
+
+	if s.config.NNTPUser != "" {
+		log.Print("Logging in..\n")
+		code, _, err := s.cmd(0, "AUTHINFO USER %s", s.config.NNTPUser)
+		if err == nil && code == 381 {
+			_, _, err = s.cmd(281, "AUTHINFO PASS %s", s.config.NNTPPassword)
+		} else if err == nil && code != 281 {
+			err = fmt.Errorf("unexpected response %d", code)
+		}
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("login failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// dial connects to NNTPServer, with TLS unless it is on port 119, the
+// port for news in plain text.
+func (s *NNTPSource) dial(ctx context.Context) (net.Conn, error) {
+	addr := s.config.NNTPServer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "563"
+		addr = net.JoinHostPort(addr, port)
+	}
+	conn, err := s.config.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if port != "119" {
+		config, err := s.config.TLSConfig()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		conn = tls.Client(conn, config)
+	}
+	return conn, nil
+}
+
+// cmd sends a command and reads the status line of its response, which
+// must start with expect if it isn't 0. Like a download, a command may
+// take MessageTimeout.
+func (s *NNTPSource) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	s.netConn.SetDeadline(time.Now().Add(s.config.PerMessageTimeout()))
+	id, err := s.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	s.conn.StartResponse(id)
+	defer s.conn.EndResponse(id)
+	return s.conn.ReadCodeLine(expect)
+}
+
+func (s *NNTPSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.pending = make(map[string]uint32)
+	fetched := 0
+
+	for _, group := range s.config.Newsgroups {
+		low, high, err := s.group(group)
+		if err != nil {
+			return fmt.Errorf("couldn't select %s: %s", group, err)
+		}
+
+		// a group is known once it has been read, which the state marks
+		// with a UIDValidity of 1
+		var known MailboxState
+		if err := s.state.View(func(state *State) { known = state.UIDs[s.stateKey(group)] }); err != nil {
+			return fmt.Errorf("couldn't read state: %s", err)
+		}
+		first := known.LastUID + 1
+		switch {
+		case known.UIDValidity == 0:
+			// only articles posted from now on, and NNTPBackfill of the
+			// ones already there
+			first = high + 1
+			if backfill := uint32(s.config.NNTPBackfill); backfill > high {
+				first = low
+			} else {
+				first -= backfill
+			}
+		case known.LastUID > high:
+			log.Printf("Article numbers of %s went back, reading it again.", group)
+			first = low
+		}
+		if first < low {
+			first = low
+		}
+
+		if first <= high {
+			log.Printf("Fetching articles %d-%d of %s..\n", first, high, group)
+		}
+		for n := first; n <= high; n++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			body, err := s.article(group, n)
+			if err == errNoArticle {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("couldn't fetch article %d of %s: %s", n, group, err)
+			}
+			process(body)
+			fetched++
+		}
+		s.pending[group] = high
+	}
+
+	if fetched == 0 {
+		log.Print("No new articles found.")
+	}
+	return nil
+}
+
+// group returns the lowest and highest article numbers of a newsgroup,
+// and selects it on the server.
+func (s *NNTPSource) group(name string) (uint32, uint32, error) {
+	if s.conn == nil {
+		return s.spoolGroup(name)
+	}
+
+	// 211 count low high name
+	_, line, err := s.cmd(211, "GROUP %s", name)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, 0, fmt.Errorf("unexpected response %q", line)
+	}
+	low, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected response %q", line)
+	}
+	high, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected response %q", line)
+	}
+	return uint32(low), uint32(high), nil
+}
+
+// article returns article n of the selected group.
+func (s *NNTPSource) article(group string, n uint32) ([]byte, error) {
+	if s.conn == nil {
+		body, err := ioutil.ReadFile(filepath.Join(s.spoolDir(group), strconv.FormatUint(uint64(n), 10)))
+		if os.IsNotExist(err) {
+			return nil, errNoArticle
+		}
+		return body, err
+	}
+
+	s.netConn.SetDeadline(time.Now().Add(s.config.PerMessageTimeout()))
+	id, err := s.conn.Cmd("ARTICLE %d", n)
+	if err != nil {
+		return nil, err
+	}
+	s.conn.StartResponse(id)
+	defer s.conn.EndResponse(id)
+	if _, _, err := s.conn.ReadCodeLine(220); err != nil {
+		if e, ok := err.(*textproto.Error); ok && e.Code == 423 {
+			return nil, errNoArticle
+		}
+		return nil, err
+	}
+	return s.conn.ReadDotBytes()
+}
+
+// spoolDir returns the directory of a group in the news spool, where
+// comp.lang.go is comp/lang/go.
+func (s *NNTPSource) spoolDir(group string) string {
+	return filepath.Join(s.config.SourcePath, filepath.FromSlash(strings.Replace(group, ".", "/", -1)))
+}
+
+// spoolGroup returns the lowest and highest article numbers in the news
+// spool's directory for a group.
+func (s *NNTPSource) spoolGroup(name string) (uint32, uint32, error) {
+	entries, err := ioutil.ReadDir(s.spoolDir(name))
+	if err != nil {
+		return 0, 0, err
+	}
+	var low, high uint32
+	for _, entry := range entries {
+		n, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		if low == 0 || uint32(n) < low {
+			low = uint32(n)
+		}
+		if uint32(n) > high {
+			high = uint32(n)
+		}
+	}
+	if high == 0 {
+		low = 1
+	}
+	return low, high, nil
+}
+
+// MarkProcessed remembers the last article read in each group. Articles
+// that weren't posted aren't read again either, as with IMAP.
+func (s *NNTPSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	err := s.state.Update(func(state *State) error {
+		for group, last := range s.pending {
+			state.UIDs[s.stateKey(group)] = MailboxState{UIDValidity: 1, LastUID: last}
+		}
+		return nil
+	})
+	s.pending = nil
+	return err
+}
+
+func (s *NNTPSource) Close() {
+	if s.conn == nil {
+		return
+	}
+	s.cmd(20, "QUIT")
+	s.conn.Close()
+	s.conn = nil
+	s.netConn = nil
+}
+
+// stateKey identifies a newsgroup in the state.
+func (s *NNTPSource) stateKey(group string) string {
+	if s.config.NNTPServer == "" {
+		return "nntp:" + s.config.SourcePath + "/" + group
+	}
+	return "nntp:" + s.config.NNTPUser + "@" + s.config.NNTPServer + "/" + group
+}
@@ -0,0 +1,69 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultNoteType is the type of notes when NoteType isn't set.
+const defaultNoteType = "note"
+
+// noteSlugFormat names the file of a note, which has no title to name it,
+// after the time it was posted.
+const noteSlugFormat = "2006-01-02-150405"
+
+// noteType returns the type notes are posted as.
+func (c *Config) noteType() string {
+	if c.NoteType != "" {
+		return strings.ToLower(c.NoteType)
+	}
+	return defaultNoteType
+}
+
+// IsNote reports whether a post of the given type may go without a title.
+func (c *Config) IsNote(postType string) bool {
+	return c.Notes && strings.EqualFold(strings.TrimSpace(postType), c.noteType())
+}
+
+// MakeNote turns a message that is only text, without frontmatter, into
+// a note, when Notes is set: a post of NoteType with no title, for a
+// microblog. It is done when there is no subject to make a title from, or
+// AutoFrontmatter isn't set to make one. The date is added later, as for
+// any post without one.
+func (m *Mailpost) MakeNote(post string) string {
+	if !m.config.Notes || m.msgHeader == nil || m.msgForwards {
+		return post
+	}
+	if _, _, ok := SplitFrontmatter(post); ok || strings.HasPrefix(strings.TrimSpace(post), "---") {
+		return post
+	}
+	if title, _ := ParseSubject(DecodeHeader(m.msgHeader.Get("Subject"))); title != "" && m.config.AutoFrontmatter {
+		return post
+	}
+	if strings.TrimSpace(post) == "" {
+		return post
+	}
+
+	frontmatter, err := MarshalFrontmatter(yaml.MapSlice{{Key: "type", Value: m.config.noteType()}})
+	if err != nil {
+		log.Printf("Couldn't make frontmatter: %s", err)
+		return post
+	}
+	log.Printf("|-- No frontmatter, posting as a note")
+	return JoinFrontmatter(frontmatter, strings.TrimLeft(post, "\r\n"))
+}
@@ -0,0 +1,226 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Notifier tells whoever runs mailpost that something is wrong with it.
+type Notifier interface {
+	Notify(subject string, text string) error
+}
+
+// NotifierConfig is a channel alerts can be sent through, configured in
+// a [Notifiers.name] table. To emails the alert through SMTPServer; URL
+// posts it as JSON to a webhook, which works with Slack, Mattermost and
+// Discord incoming webhooks and with anything else that reads a "text"
+// field.
+type NotifierConfig struct {
+	To  string
+	URL string
+}
+
+// AlertState is the streak of failed mail checks alerts are based on.
+type AlertState struct {
+	Failures  int
+	Since     time.Time
+	LastError string
+	// the notifiers told about the current streak, to be told when it ends
+	Notified []string
+}
+
+// Notifier returns the notifier configured as name.
+func (m *Mailpost) Notifier(name string) (Notifier, error) {
+	config, ok := m.config.Notifiers[name]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("no notifier named %q", name)
+	case config.To != "":
+		return &mailNotifier{m, config.To}, nil
+	case config.URL != "":
+		return &webhookNotifier{m.web, config.URL}, nil
+	}
+	return nil, fmt.Errorf("notifier %q has neither To nor URL", name)
+}
+
+type mailNotifier struct {
+	m  *Mailpost
+	to string
+}
+
+func (n *mailNotifier) Notify(subject string, text string) error {
+	if n.m.config.SMTPServer == "" || n.m.config.ReplyFrom == "" {
+		return fmt.Errorf("SMTPServer and ReplyFrom must be set to send alerts by email")
+	}
+	if !n.m.SendMail(n.to, subject, text, nil) {
+		return fmt.Errorf("couldn't send alert to %s", n.to)
+	}
+	return nil
+}
+
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *webhookNotifier) Notify(subject string, text string) error {
+	message := subject + "\n\n" + text
+	body, _ := json.Marshal(map[string]string{"text": message, "content": message})
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// alertLevel is a notifier to alert after a number of failures in a row.
+type alertLevel struct {
+	via   string
+	after int
+}
+
+// alertLevels returns AlertVia to alert after AlertAfter failures (3 by
+// default), then EscalateVia after EscalateAfter (10 by default).
+func (c *Config) alertLevels() []alertLevel {
+	var levels []alertLevel
+	add := func(via string, after, def int) {
+		if via == "" {
+			return
+		}
+		if after <= 0 {
+			after = def
+		}
+		levels = append(levels, alertLevel{via, after})
+	}
+	add(c.AlertVia, c.AlertAfter, 3)
+	add(c.EscalateVia, c.EscalateAfter, 10)
+	return levels
+}
+
+// RecordFailure counts a failed attempt at checking mail and sends the
+// alerts that are due. The count is kept in the state, so it carries over
+// between runs with -once too.
+func (m *Mailpost) RecordFailure(what string, err error) {
+	var due []string
+	var state AlertState
+	update := func(s *State) error {
+		alerts := &s.Alerts
+		if alerts.Failures == 0 {
+			alerts.Since = time.Now()
+		}
+		alerts.Failures++
+		alerts.LastError = err.Error()
+		for _, level := range m.config.alertLevels() {
+			if alerts.Failures >= level.after && !contains(alerts.Notified, level.via) {
+				due = append(due, level.via)
+				alerts.Notified = append(alerts.Notified, level.via)
+			}
+		}
+		state = *alerts
+		return nil
+	}
+	if err := m.state.Update(update); err != nil {
+		log.Printf("Couldn't record failure: %s", err)
+		return
+	}
+
+	subject := fmt.Sprintf("mailpost: %s has failed %d times in a row", strings.ToLower(what), state.Failures)
+	text := fmt.Sprintf("%s has been failing since %s.\n\nThe last error was: %s\n",
+		what, state.Since.Format(time.RFC1123), state.LastError)
+	for _, via := range due {
+		m.notify(via, subject, text)
+	}
+}
+
+// RecordSuccess ends a streak of failures, telling the notifiers that
+// were alerted about it that mailpost works again.
+func (m *Mailpost) RecordSuccess() {
+	var failures int
+	m.state.View(func(s *State) { failures = s.Alerts.Failures })
+	if failures == 0 {
+		return
+	}
+
+	var state AlertState
+	err := m.state.Update(func(s *State) error {
+		state = s.Alerts
+		s.Alerts = AlertState{}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't record success: %s", err)
+		return
+	}
+
+	subject := "mailpost: checking mail works again"
+	text := fmt.Sprintf("Mail is being checked again after %d failures since %s.\n",
+		state.Failures, state.Since.Format(time.RFC1123))
+	for _, via := range state.Notified {
+		m.notify(via, subject, text)
+	}
+}
+
+func (m *Mailpost) notify(via string, subject string, text string) {
+	notifier, err := m.Notifier(via)
+	if err == nil {
+		err = notifier.Notify(subject, text)
+	}
+	if err != nil {
+		log.Printf("Couldn't send alert through %s: %s", via, err)
+		return
+	}
+	log.Printf("Sent alert through %s: %s", via, subject)
+}
+
+// checkNotifiers makes sure AlertVia and EscalateVia name notifiers that
+// are configured.
+func (c *Config) checkNotifiers() error {
+	var names []string
+	for name := range c.Notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, level := range c.alertLevels() {
+		config, ok := c.Notifiers[level.via]
+		if !ok {
+			return fmt.Errorf("no notifier named %q, configured ones are %v", level.via, names)
+		}
+		if config.To == "" && config.URL == "" {
+			return fmt.Errorf("notifier %q has neither To nor URL", level.via)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExistingPosts policies, for when a post is written where one already
+// exists with different content, as when a message is processed again.
+const (
+	// ExistingOverwrite replaces the old post.
+	ExistingOverwrite = "overwrite"
+	// ExistingVersion keeps the old post and writes the new one next to it
+	// as name-2.md, name-3.md and so on.
+	ExistingVersion = "version"
+	// ExistingConflict keeps the old post and writes the new one to
+	// name.md.conflict for someone to sort out.
+	ExistingConflict = "conflict"
+	// ExistingSkip keeps the old post and drops the new one, with a
+	// warning.
+	ExistingSkip = "skip"
+)
+
+// MatchPostsBy values, for what makes a new post the same as one already
+// written. Without one, it is being written to the same file.
+const (
+	// MatchSlug finds the post with the same file name, or bundle, anywhere
+	// under the top of PostDir, whatever date or type it was filed under.
+	MatchSlug = "slug"
+	// MatchID finds the post with the same id field in its frontmatter.
+	MatchID = "id"
+)
+
+// ParseExistingPosts checks the ExistingPosts and MatchPostsBy config
+// values.
+func (m *Mailpost) ParseExistingPosts() error {
+	switch strings.ToLower(m.config.ExistingPosts) {
+	case "", ExistingOverwrite, ExistingVersion, ExistingConflict, ExistingSkip:
+	default:
+		return fmt.Errorf("invalid ExistingPosts: %s", m.config.ExistingPosts)
+	}
+	switch strings.ToLower(m.config.MatchPostsBy) {
+	case "", "path", MatchSlug, MatchID:
+	default:
+		return fmt.Errorf("invalid MatchPostsBy: %s", m.config.MatchPostsBy)
+	}
+	return nil
+}
+
+// errFound stops the search for an existing post once it is found.
+var errFound = errors.New("found")
+
+// FindExistingPost looks under the top of PostDir for a post written
+// before that MatchPostsBy says is the same as postInfo, so that updating
+// a post by mailing it again changes it where it is, instead of adding
+// another one under a new date. Posts in .versions and other hidden
+// directories aren't looked at.
+func (m *Mailpost) FindExistingPost(postInfo Post) (string, bool) {
+	by := strings.ToLower(m.config.MatchPostsBy)
+	var id string
+	switch by {
+	case MatchSlug:
+	case MatchID:
+		if postInfo.Fields["id"] == nil {
+			return "", false
+		}
+		id = fmt.Sprint(postInfo.Fields["id"])
+	default:
+		return "", false
+	}
+
+	slug := PostSlug(postInfo)
+	ext := filepath.Ext(postInfo.File)
+	var found string
+	root := TemplateRoot(m.config.ForPost(postInfo).PostDir)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if found != "" {
+			return errFound
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ext {
+			return nil
+		}
+		candidate := Post{Path: filepath.Dir(path), File: info.Name()}
+		switch by {
+		case MatchSlug:
+			if PostSlug(candidate) == slug {
+				found = path
+			}
+		case MatchID:
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			post, err := NormalizeFrontmatter(string(data))
+			if err != nil {
+				return nil
+			}
+			if value, ok := ParseFields(post)["id"]; ok && fmt.Sprint(value) == id {
+				found = path
+			}
+		}
+		return nil
+	})
+	return found, found != ""
+}
+
+// sameFile reports whether the file at path holds exactly data.
+func sameFile(path string, data string) bool {
+	existing, err := ioutil.ReadFile(path)
+	return err == nil && string(existing) == data
+}
+
+// ResolveExistingPost returns where a post meant for path should be
+// written. It returns false if there's nothing to write because the post
+// is already on disk as it is, so running mailpost on the same message
+// twice leaves the site as it was. What it decides is logged to logger.
+func (m *Mailpost) ResolveExistingPost(path string, data string, logger *log.Logger) (string, bool) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, true
+	}
+	if sameFile(path, data) {
+		return path, false
+	}
+
+	mode := strings.ToLower(m.config.ExistingPosts)
+	if mode == ExistingVersion && m.config.PageBundles {
+		// a bundle has a single index.md, and the new version's images
+		// are already in it
+		mode = ExistingConflict
+	}
+	switch mode {
+	case ExistingSkip:
+		logger.Printf("   |-- %s already exists with different content, skipping the new post", path)
+		return path, false
+	case ExistingVersion:
+		ext := filepath.Ext(path)
+		base := strings.TrimSuffix(path, ext)
+		for n := 2; ; n++ {
+			version := base + "-" + strconv.Itoa(n) + ext
+			if _, err := os.Stat(version); os.IsNotExist(err) {
+				logger.Printf("   |-- %s already exists, writing new version", path)
+				return version, true
+			}
+			if sameFile(version, data) {
+				return version, false
+			}
+		}
+	case ExistingConflict:
+		conflict := path + ".conflict"
+		if sameFile(conflict, data) {
+			return conflict, false
+		}
+		logger.Printf("   |-- %s already exists with different content, see %s", path, conflict)
+		return conflict, true
+	}
+
+	logger.Printf("   |-- Replacing %s", path)
+	if m.config.KeepVersions {
+		m.SaveVersion(path, logger)
+	}
+	return path, true
+}
+
+// SaveVersion copies a post that is about to be replaced into .versions/
+// next to it, named after the time it was replaced, so an update that went
+// wrong can be undone. Site generators skip directories starting with a
+// dot, so the copies aren't published.
+func (m *Mailpost) SaveVersion(path string, logger *log.Logger) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Printf("Couldn't keep old version of %s: %s", path, err)
+		return
+	}
+
+	dir := filepath.Join(filepath.Dir(path), ".versions")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Printf("Couldn't keep old version of %s: %s", path, err)
+		return
+	}
+
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	version := filepath.Join(dir, name+"."+time.Now().UTC().Format("20060102T150405Z")+ext)
+	if err := ioutil.WriteFile(version, data, 0644); err != nil {
+		logger.Printf("Couldn't keep old version of %s: %s", path, err)
+		return
+	}
+	logger.Printf("   |-- Old version kept at %s", version)
+}
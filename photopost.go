@@ -0,0 +1,87 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultPhotoType is the type of photo posts when PhotoType isn't set.
+const defaultPhotoType = "photo"
+
+// MakePhotoPost makes a post out of the images attached to a message that
+// didn't give a post of its own, because it has no text or none that
+// could be posted, when PhotoPosts is set. The title is the subject, or
+// the name of the first image without one, the type is PhotoType and each
+// image gets a figure shortcode, captioned with its Content-Description,
+// in the order they were attached, unless Gallery is set to show them. The
+// post goes through the same checks as any other, so a PostToken or
+// signature the message lacks still keeps it from being posted.
+func (m *Mailpost) MakePhotoPost(msg int) {
+	if !m.config.PhotoPosts {
+		return
+	}
+	for _, postInfo := range m.posts {
+		if postInfo.Msg == msg {
+			return
+		}
+	}
+	var images []Image
+	for _, imageInfo := range m.images {
+		if imageInfo.Msg == msg {
+			images = append(images, imageInfo)
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	title, _ := ParseSubject(DecodeHeader(m.msgHeader.Get("Subject")))
+	if title == "" {
+		title = strings.TrimSuffix(images[0].OrigName, filepath.Ext(images[0].OrigName))
+	}
+	postType := m.config.PhotoType
+	if postType == "" {
+		postType = defaultPhotoType
+	}
+	frontmatter, err := MarshalFrontmatter(yaml.MapSlice{
+		{Key: "title", Value: title},
+		{Key: "type", Value: postType},
+	})
+	if err != nil {
+		log.Printf("Couldn't make frontmatter: %s", err)
+		return
+	}
+
+	// images are referred to by their number, which works whatever their
+	// names are, or left for the gallery when there is one
+	var body strings.Builder
+	for _, imageInfo := range images {
+		if m.galleryTmpl == nil {
+			caption := ""
+			if imageInfo.Description != "" {
+				caption = fmt.Sprintf(" caption=\"%s\"", html.EscapeString(imageInfo.Description))
+			}
+			fmt.Fprintf(&body, "{{< figure src=\"%d\"%s >}}\n", imageInfo.Ordinal, caption)
+		}
+	}
+	log.Printf("|-- No post in the message, making a photo post of its %d images", len(images))
+	m.ExtractPostData(JoinFrontmatter(frontmatter, body.String()))
+}
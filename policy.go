@@ -0,0 +1,103 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A Policy restricts the images a post of a given type may have. Policies
+// are configured per post type in the [Policies.<type>] tables of the
+// config file. MaxImages and MaxAttachments are pointers so that an unset
+// limit can be told apart from a limit of 0.
+type Policy struct {
+	MinImages      int
+	MaxImages      *int
+	MaxAttachments *int
+	AllowedTypes   []string
+}
+
+// EnforcePolicies checks every post against the policy for its type. Posts
+// that break their policy aren't written, and the sender is told why.
+func (m *Mailpost) EnforcePolicies() {
+	var posts []Post
+
+	for _, postInfo := range m.posts {
+		problems := m.CheckPolicy(postInfo)
+		if len(problems) == 0 {
+			posts = append(posts, postInfo)
+			continue
+		}
+
+		m.Fail(postInfo, "Post %q breaks the policy for type %s: %s",
+			postInfo.Title, postInfo.Type, strings.Join(problems, "; "))
+		m.Reply(postInfo, "Post not published: "+postInfo.Title,
+			fmt.Sprintf("Your post %q was not published because it doesn't follow the rules for %s posts:\n\n- %s\n",
+				postInfo.Title, postInfo.Type, strings.Join(problems, "\n- ")))
+	}
+
+	m.posts = posts
+}
+
+// CheckPolicy returns the ways in which a post breaks the policy for its
+// type.
+func (m *Mailpost) CheckPolicy(postInfo Post) []string {
+	policy, ok := m.config.Policies[postInfo.Type]
+	if !ok {
+		return nil
+	}
+
+	var problems []string
+	images, attachments := 0, 0
+
+	for _, imageInfo := range m.images {
+		if imageInfo.Msg != postInfo.Msg {
+			continue
+		}
+		images++
+		if imageInfo.OrigURL != "" {
+			continue
+		}
+		attachments++
+
+		if len(policy.AllowedTypes) > 0 && !m.TypeAllowed(policy.AllowedTypes, imageInfo.ContentType) {
+			problems = append(problems, fmt.Sprintf("attachments of type %s aren't allowed", imageInfo.ContentType))
+		}
+	}
+
+	if images < policy.MinImages {
+		problems = append(problems, fmt.Sprintf("at least %d image(s) are required, found %d", policy.MinImages, images))
+	}
+	if policy.MaxImages != nil && images > *policy.MaxImages {
+		problems = append(problems, fmt.Sprintf("at most %d image(s) are allowed, found %d", *policy.MaxImages, images))
+	}
+	if policy.MaxAttachments != nil && attachments > *policy.MaxAttachments {
+		problems = append(problems, fmt.Sprintf("at most %d attachment(s) are allowed, found %d", *policy.MaxAttachments, attachments))
+	}
+
+	return problems
+}
+
+// TypeAllowed reports whether contentType matches one of the patterns,
+// which may use wildcards such as "image/*".
+func (m *Mailpost) TypeAllowed(patterns []string, contentType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(contentType)); ok {
+			return true
+		}
+	}
+	return false
+}
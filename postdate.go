@@ -0,0 +1,77 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// postDateLayouts are the forms of date a post's frontmatter may use.
+var postDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParsePostDate parses the date in a post's frontmatter. Dates without a
+// time zone are taken to be in loc.
+func ParsePostDate(date string, loc *time.Location) (time.Time, bool) {
+	if loc == nil {
+		loc = time.Local
+	}
+	date = strings.TrimSpace(date)
+	for _, layout := range postDateLayouts {
+		if t, err := time.ParseInLocation(layout, date, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ApplyDate adds a date to a post whose frontmatter doesn't have one: the
+// time in the message's Date header or, if there isn't one that parses,
+// the time it is processed, in the site's time zone either way. A date
+// the post gives itself is left alone.
+func (m *Mailpost) ApplyDate(post string) string {
+	if frontmatter, _, ok := SplitFrontmatter(post); ok {
+		var t struct {
+			Date string `yaml:"date"`
+		}
+		if yaml.Unmarshal([]byte(frontmatter), &t) == nil && t.Date != "" {
+			return post
+		}
+	}
+
+	date := time.Now()
+	if m.msgHeader != nil {
+		if sent, err := mail.ParseDate(m.msgHeader.Get("Date")); err == nil {
+			date = sent
+		} else {
+			log.Printf("No date in the frontmatter or the Date header, using now")
+		}
+	}
+	if m.siteTime != nil {
+		date = date.In(m.siteTime)
+	}
+	return MergeFrontmatter(post, yaml.MapSlice{{Key: "date", Value: date.Format(time.RFC3339)}})
+}
@@ -0,0 +1,98 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// PostTemplateData is the data passed to a post template: the post's
+// Title, Type, Date and Slug, every field of its Frontmatter and its Body,
+// the text after the frontmatter with images and attachments linked.
+type PostTemplateData struct {
+	Title       string
+	Type        string
+	Date        string
+	Slug        string
+	Frontmatter map[string]interface{}
+	Body        string
+}
+
+// ParsePostTemplates reads PostTemplate, the template for every post, and
+// PostTemplates, the templates for posts of a type, like
+// { photo = "templates/photo.md" }.
+func (m *Mailpost) ParsePostTemplates() error {
+	files := make(map[string]string)
+	for postType, file := range m.config.PostTemplates {
+		files[strings.ToLower(postType)] = file
+	}
+	if m.config.PostTemplate != "" {
+		files[""] = m.config.PostTemplate
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	m.postTmpls = make(map[string]*template.Template)
+	for postType, file := range files {
+		tmpl, err := template.New(filepath.Base(file)).ParseFiles(file)
+		if err != nil {
+			return fmt.Errorf("invalid post template: %s", err)
+		}
+		m.postTmpls[postType] = tmpl
+	}
+	return nil
+}
+
+// ApplyPostTemplate runs a post's body through the template for its type,
+// or PostTemplate if its type has none, so boilerplate like an author bio
+// or a newsletter footer can be added to every post. The template makes
+// the text after the frontmatter, which is left as it is. A template that
+// fails is logged and the post kept as it was.
+func (m *Mailpost) ApplyPostTemplate(postInfo Post) string {
+	tmpl, ok := m.postTmpls[strings.ToLower(postInfo.Type)]
+	if !ok {
+		tmpl, ok = m.postTmpls[""]
+	}
+	if !ok {
+		return postInfo.Data
+	}
+
+	frontmatter, body, hasFrontmatter := SplitFrontmatter(postInfo.Data)
+	if !hasFrontmatter {
+		body = postInfo.Data
+	}
+	data := PostTemplateData{
+		Title:       postInfo.Title,
+		Type:        postInfo.Type,
+		Date:        postInfo.Date,
+		Slug:        PostSlug(postInfo),
+		Frontmatter: ParseFields(postInfo.Data),
+		Body:        body,
+	}
+	out := new(bytes.Buffer)
+	if err := tmpl.Execute(out, data); err != nil {
+		log.Printf("Couldn't apply post template %s to %s: %s", tmpl.Name(), postInfo.File, err)
+		return postInfo.Data
+	}
+	if !hasFrontmatter {
+		return out.String()
+	}
+	return JoinFrontmatter(frontmatter, out.String())
+}
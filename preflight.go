@@ -0,0 +1,158 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// preflightTimeout is how long the source gets to connect during the
+// startup checks.
+const preflightTimeout = time.Minute
+
+// Preflight checks at startup that everything mailpost will need later is
+// in place: the source can be connected to, the directories it writes to
+// are writable, the ImageRefStyle template renders and the sender
+// frontmatter files can be read. It returns every problem it finds, so
+// they can be fixed in one go instead of one failed post at a time.
+func (m *Mailpost) Preflight(ctx context.Context) []string {
+	var problems []string
+	report := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	type dir struct {
+		name string
+		path string
+	}
+	dirs := []dir{
+		{"WorkDir", m.WorkDir()},
+		{"StateDir", m.StateDir()},
+	}
+	for _, name := range m.config.SiteNames() {
+		site := m.config.ForSite(name)
+		prefix := ""
+		if name != "" {
+			prefix = "Sites." + name + "."
+		}
+		dirs = append(dirs, dir{prefix + "PostDir", TemplateRoot(site.PostDir)}, dir{prefix + "ImageDir", TemplateRoot(site.ImageDir)})
+		if site.OriginalsDir != "" {
+			dirs = append(dirs, dir{prefix + "OriginalsDir", site.OriginalsDir})
+		}
+	}
+	for _, dir := range dirs {
+		if err := checkWritable(dir.path); err != nil {
+			report("%s %s isn't writable: %s", dir.name, dir.path, err)
+		}
+	}
+
+	if m.refTmpl != nil {
+		sample := ImageRef{URL: "http://example.com/image.jpg", Alt: "alt", Title: "title", Caption: "caption", Name: "image.jpg"}
+		if err := m.refTmpl.Execute(ioutil.Discard, sample); err != nil {
+			report("ImageRefStyle can't be rendered: %s", err)
+		}
+	}
+	for _, format := range m.config.EncodedFormats() {
+		if _, err := exec.LookPath(imageEncoders[format]); err != nil {
+			report("%s isn't installed, but ImageFormat or ExtraImageFormats needs it for %s", imageEncoders[format], format)
+		}
+	}
+	if m.galleryTmpl != nil {
+		sample := Gallery{Images: []ImageRef{{URL: "http://example.com/image.jpg", Alt: "alt", Caption: "caption", Name: "image.jpg"}}}
+		if err := m.galleryTmpl.Execute(ioutil.Discard, sample); err != nil {
+			report("Gallery can't be rendered: %s", err)
+		}
+	}
+
+	var senders []string
+	for addr := range m.config.Senders {
+		senders = append(senders, addr)
+	}
+	sort.Strings(senders)
+	for _, addr := range senders {
+		file := m.config.Senders[addr].FrontmatterFile
+		if file == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(file); err != nil {
+			report("FrontmatterFile for %s can't be read: %s", addr, err)
+		}
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	if err := m.source.Connect(connectCtx); err != nil {
+		report("Can't connect to the %s source: %s", m.SourceName(), err)
+	} else {
+		m.source.Close()
+	}
+
+	return problems
+}
+
+// checkWritable checks that a file can be created in dir. A directory
+// that doesn't exist yet is fine as long as it can be made in the nearest
+// directory above it that does.
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("not a directory")
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+
+	f, err := ioutil.TempFile(dir, ".mailpost-preflight")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// RunPreflight runs Preflight and exits listing the problems if there are
+// any, unless SkipPreflight is set.
+func (m *Mailpost) RunPreflight() {
+	if m.config.SkipPreflight {
+		return
+	}
+	problems := m.Preflight(context.Background())
+	if len(problems) == 0 {
+		log.Print("Preflight checks passed.")
+		return
+	}
+	log.Printf("Preflight checks failed:")
+	for _, problem := range problems {
+		log.Printf("  - %s", problem)
+	}
+	os.Exit(1)
+}
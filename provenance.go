@@ -0,0 +1,114 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The places Provenance can put where a post came from.
+const (
+	provenanceComment     = "comment"
+	provenanceFrontmatter = "frontmatter"
+)
+
+// provenanceKey is the frontmatter field provenance is kept in.
+const provenanceKey = "mailpost"
+
+// checkProvenance checks the Provenance config value.
+func (c *Config) checkProvenance() error {
+	switch strings.ToLower(c.Provenance) {
+	case "", provenanceComment, provenanceFrontmatter:
+		return nil
+	}
+	return fmt.Errorf("invalid Provenance %q: it must be %q or %q", c.Provenance, provenanceComment, provenanceFrontmatter)
+}
+
+// ApplyProvenance records in a post which message it was made from: its
+// Message-ID, when the first server it reached received it and a hash of
+// the sender's address, which doesn't publish the address but can be
+// checked against one. Provenance "comment" puts them in an HTML comment
+// at the top of the post's text, and "frontmatter" in a mailpost field.
+func (m *Mailpost) ApplyProvenance(post string) string {
+	mode := strings.ToLower(m.config.Provenance)
+	if mode == "" || m.msgHeader == nil {
+		return post
+	}
+
+	var fields yaml.MapSlice
+	if id := strings.TrimSpace(m.msgHeader.Get("Message-Id")); id != "" {
+		fields = append(fields, yaml.MapItem{Key: "message_id", Value: id})
+	}
+	if received, ok := receivedTime(m.msgHeader); ok {
+		fields = append(fields, yaml.MapItem{Key: "received", Value: received.UTC().Format(time.RFC3339)})
+	}
+	if m.msgFrom != "" {
+		fields = append(fields, yaml.MapItem{Key: "sender", Value: SenderHash(m.msgFrom)})
+	}
+	if len(fields) == 0 {
+		return post
+	}
+
+	if mode == provenanceFrontmatter {
+		return OverrideFrontmatter(post, yaml.MapSlice{{Key: provenanceKey, Value: fields}})
+	}
+
+	var parts []string
+	for _, field := range fields {
+		// "--" would end the comment early
+		value := strings.Replace(fmt.Sprint(field.Value), "--", "-", -1)
+		parts = append(parts, fmt.Sprintf("%s=%s", field.Key, value))
+	}
+	comment := "<!-- " + provenanceKey + ": " + strings.Join(parts, " ") + " -->\n"
+	frontmatter, body, ok := SplitFrontmatter(post)
+	if !ok {
+		return comment + post
+	}
+	return JoinFrontmatter(frontmatter, comment+body)
+}
+
+// receivedTime returns when a message reached the first server that
+// took it, from the date at the end of its last Received header.
+func receivedTime(header mail.Header) (time.Time, bool) {
+	received := header["Received"]
+	if len(received) == 0 {
+		return time.Time{}, false
+	}
+	last := received[len(received)-1]
+	i := strings.LastIndex(last, ";")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := mail.ParseDate(strings.TrimSpace(last[i+1:]))
+	if err != nil {
+		log.Printf("Couldn't parse Received date %q: %s", last[i+1:], err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// SenderHash returns the start of the SHA-256 of an address, in lower
+// case, as "sha256:" and 16 hex digits.
+func SenderHash(addr string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(addr))))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
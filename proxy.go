@@ -0,0 +1,133 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyURL parses the Proxy config value. It returns nil when no proxy is
+// set.
+func (c *Config) ProxyURL() (*url.URL, error) {
+	if c.Proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Proxy: %s", c.Proxy)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported Proxy scheme %q, use http or socks5", u.Scheme)
+	}
+	return u, nil
+}
+
+// HTTPClient returns the client for web requests, going through Proxy if
+// one is set and the usual HTTPS_PROXY variables otherwise.
+func (c *Config) HTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	u, err := c.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// postForm is http.Client.PostForm with a context.
+func postForm(ctx context.Context, client *http.Client, link string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", link, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
+
+// Dial connects to addr, through Proxy if one is set.
+func (c *Config) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	direct := &net.Dialer{Timeout: 30 * time.Second}
+	u, err := c.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return direct.DialContext(ctx, "tcp", addr)
+	}
+	if u.Scheme == "http" {
+		return dialHTTPProxy(ctx, direct, u, addr)
+	}
+
+	dialer, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return nil, err
+	}
+	if dialer, ok := dialer.(proxy.ContextDialer); ok {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// dialHTTPProxy opens a tunnel to addr with an HTTP CONNECT request.
+func dialHTTPProxy(ctx context.Context, direct *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := direct.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the server doesn't speak until we do, so nothing past the response
+	// can have been buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
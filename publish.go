@@ -0,0 +1,288 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// A PublishWindow is a time of day, on some days of the week, when posts
+// may be published, written in PublishWindows as "Mon-Fri 09:00-17:00",
+// "Sat,Sun 10:00-12:00" or, for every day, "09:00-17:00".
+type PublishWindow struct {
+	days  [7]bool
+	start time.Duration
+	end   time.Duration
+}
+
+// ParsePublishWindow parses a publishing window.
+func ParsePublishWindow(s string) (PublishWindow, error) {
+	var w PublishWindow
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("%q isn't of the form \"Mon-Fri 09:00-17:00\"", s)
+	}
+
+	if len(fields) == 1 {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	} else {
+		for _, days := range strings.Split(fields[0], ",") {
+			first, last := days, days
+			if i := strings.Index(days, "-"); i >= 0 {
+				first, last = days[:i], days[i+1:]
+			}
+			from, ok1 := weekdays[strings.ToLower(first)]
+			to, ok2 := weekdays[strings.ToLower(last)]
+			if !ok1 || !ok2 {
+				return w, fmt.Errorf("%q has unknown days %q", s, days)
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("%q has no time range like 09:00-17:00", s)
+	}
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return w, fmt.Errorf("%q: %s", s, err)
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return w, fmt.Errorf("%q: %s", s, err)
+	}
+	if w.end <= w.start {
+		return w, fmt.Errorf("%q ends before it starts", s)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day like 09:00 into the time since midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParsePublishWindows parses PublishWindows and PublishTimeZone.
+func (m *Mailpost) ParsePublishWindows() error {
+	for _, s := range m.config.PublishWindows {
+		w, err := ParsePublishWindow(s)
+		if err != nil {
+			return fmt.Errorf("invalid PublishWindows: %s", err)
+		}
+		m.windows = append(m.windows, w)
+	}
+	m.siteTime = time.Local
+	if m.config.PublishTimeZone != "" {
+		loc, err := time.LoadLocation(m.config.PublishTimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid PublishTimeZone: %s", err)
+		}
+		m.siteTime = loc
+	}
+	return nil
+}
+
+// NextPublishTime returns when a post that arrives at t may be published:
+// t itself if it is inside one of the PublishWindows, or there are none,
+// and otherwise the next time one opens, in site time.
+func (m *Mailpost) NextPublishTime(t time.Time) time.Time {
+	if len(m.windows) == 0 {
+		return t
+	}
+	t = t.In(m.siteTime)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, m.siteTime)
+
+	var next time.Time
+	for day := 0; day <= 7; day++ {
+		date := midnight.AddDate(0, 0, day)
+		for _, w := range m.windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			start := date.Add(w.start)
+			end := date.Add(w.end)
+			if !t.Before(start) && t.Before(end) {
+				return t
+			}
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return t
+}
+
+// HoldPosts takes the posts that arrived outside the PublishWindows out of
+// the run and keeps them in the state until their window opens. Posts
+// with "urgent: true" in their frontmatter are published right away.
+func (m *Mailpost) HoldPosts() {
+	if len(m.windows) == 0 {
+		return
+	}
+	now := time.Now()
+	publish := m.NextPublishTime(now)
+	if !publish.After(now) {
+		return
+	}
+
+	var posts, held []Post
+	for _, postInfo := range m.posts {
+		if postInfo.Urgent {
+			log.Printf("Publishing urgent post %s outside the publishing windows", postInfo.File)
+			posts = append(posts, postInfo)
+			continue
+		}
+		held = append(held, postInfo)
+	}
+	if len(held) == 0 {
+		return
+	}
+
+	err := m.state.Update(func(state *State) error {
+		for _, postInfo := range held {
+			state.Schedule = append(state.Schedule, ScheduledPost{
+				Path:    filepath.Join(postInfo.Path, postInfo.File),
+				Publish: publish,
+				Title:   postInfo.Title,
+				Type:    postInfo.Type,
+				Date:    postInfo.Date,
+				Data:    postInfo.Data,
+				Site:    postInfo.Site,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		// better to publish early than to lose the posts
+		log.Printf("Couldn't hold posts until %s, publishing them now: %s", publish, err)
+		return
+	}
+
+	for _, postInfo := range held {
+		path := filepath.Join(postInfo.Path, postInfo.File)
+		log.Printf("   |-- Holding post %s until %s", path, publish.Format("Mon Jan 2 15:04 MST"))
+		if postInfo.Msg < len(m.history) {
+			m.history[postInfo.Msg].Posts = append(m.history[postInfo.Msg].Posts, path+" (held)")
+		}
+	}
+	m.posts = posts
+}
+
+// PublishHeldPosts writes the posts held by HoldPosts whose window has
+// opened. A post only leaves the schedule once it has been written, so
+// one that can't be is tried again on the next run.
+func (m *Mailpost) PublishHeldPosts() {
+	now := time.Now()
+	var due []ScheduledPost
+	err := m.state.View(func(state *State) {
+		for _, scheduled := range state.Schedule {
+			if !scheduled.Publish.After(now) {
+				due = append(due, scheduled)
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Couldn't read held posts: %s", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	logger := log.New(log.Writer(), log.Prefix(), log.Flags())
+	var written []Post
+	var published []ScheduledPost
+	for _, scheduled := range due {
+		dir, file := filepath.Split(scheduled.Path)
+		postInfo := Post{Title: scheduled.Title, Type: scheduled.Type, Date: scheduled.Date, Path: dir, File: file, Data: scheduled.Data, Site: scheduled.Site}
+		log.Printf("Publishing held post %s", scheduled.Path)
+		m.files.Acquire()
+		_, changed, err := m.WritePostToFile(postInfo, logger)
+		m.files.Release()
+		if err != nil {
+			log.Printf("Couldn't publish held post %s, keeping it for the next run: %s", scheduled.Path, err)
+			continue
+		}
+		published = append(published, scheduled)
+		if changed {
+			m.written++
+			written = append(written, postInfo)
+		}
+	}
+
+	err = m.state.Update(func(state *State) error {
+		var waiting []ScheduledPost
+		for _, scheduled := range state.Schedule {
+			if !scheduledIn(published, scheduled) {
+				waiting = append(waiting, scheduled)
+			}
+		}
+		state.Schedule = waiting
+		return nil
+	})
+	if err != nil {
+		// they are written, so the next run only writes them again
+		log.Printf("Couldn't take the published posts off the schedule: %s", err)
+	}
+	m.Federate(written)
+	m.UpdateSitemaps(written)
+	m.CommitPosts(written)
+}
+
+// scheduledIn reports whether post is one of posts.
+func scheduledIn(posts []ScheduledPost, post ScheduledPost) bool {
+	for _, p := range posts {
+		if p.Path == post.Path && p.Publish.Equal(post.Publish) && p.Data == post.Data {
+			return true
+		}
+	}
+	return false
+}
+
+// NextHeldPost returns when the first of the posts held by HoldPosts is
+// due, or the zero time if none are held.
+func (m *Mailpost) NextHeldPost() time.Time {
+	var next time.Time
+	m.state.View(func(state *State) {
+		for _, scheduled := range state.Schedule {
+			if next.IsZero() || scheduled.Publish.Before(next) {
+				next = scheduled.Publish
+			}
+		}
+	})
+	return next
+}
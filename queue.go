@@ -0,0 +1,79 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// how many delivered messages may wait for the pipeline
+const queueSize = 100
+
+// MessageQueue holds messages pushed to mailpost, by the SMTP listener
+// or a webhook, until the pipeline gets to them. Push may be called from
+// any goroutine; Drain and Wait only from the one running the pipeline.
+type MessageQueue struct {
+	queue   chan []byte
+	waiting [][]byte
+}
+
+func NewMessageQueue() *MessageQueue {
+	return &MessageQueue{queue: make(chan []byte, queueSize)}
+}
+
+// Push adds a message to the queue. It reports false if the queue is
+// full and the sender should try again later.
+func (q *MessageQueue) Push(body []byte) bool {
+	select {
+	case q.queue <- body:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain calls process for every message in the queue.
+func (q *MessageQueue) Drain(process func(body []byte)) {
+	for len(q.queue) > 0 {
+		q.waiting = append(q.waiting, <-q.queue)
+	}
+
+	if len(q.waiting) == 0 {
+		log.Print("No new messages received.")
+	}
+	for _, body := range q.waiting {
+		process(body)
+	}
+	q.waiting = nil
+}
+
+// Wait blocks until there is a message in the queue, or until is reached
+// if it isn't zero.
+func (q *MessageQueue) Wait(until time.Time) {
+	if len(q.waiting) > 0 {
+		return
+	}
+	if until.IsZero() {
+		q.waiting = append(q.waiting, <-q.queue)
+		return
+	}
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case body := <-q.queue:
+		q.waiting = append(q.waiting, body)
+	case <-timer.C:
+	}
+}
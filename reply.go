@@ -0,0 +1,89 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// Reply sends a plain text message to the author of a post. Nothing is
+// ever sent in reply to an automated message.
+func (m *Mailpost) Reply(postInfo Post, subject string, text string) {
+	if postInfo.From == "" {
+		return
+	}
+	if automated, _ := m.IsAutomated(&mail.Message{Header: postInfo.Header}, postInfo.From); automated {
+		return
+	}
+
+	header := make(mail.Header)
+	if id := postInfo.Header.Get("Message-Id"); id != "" {
+		header["In-Reply-To"] = []string{id}
+		header["References"] = []string{id}
+	}
+	// RFC 3834: keeps well behaved auto-responders from answering us
+	header["Auto-Submitted"] = []string{"auto-replied"}
+
+	if m.SendMail(postInfo.From, subject, text, header) {
+		log.Printf("   |-- Sent reply to %s", postInfo.From)
+	}
+}
+
+// SendMail sends a plain text message from ReplyFrom through SMTPServer.
+// Nothing is sent unless both are configured. It reports whether the
+// message was sent.
+func (m *Mailpost) SendMail(to string, subject string, text string, header mail.Header) bool {
+	if m.config.SMTPServer == "" || m.config.ReplyFrom == "" {
+		return false
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", m.config.ReplyFrom)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for name, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(msg, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(msg, "\r\n%s", text)
+
+	var auth smtp.Auth
+	if m.config.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(m.config.SMTPServer)
+		auth = smtp.PlainAuth("", m.config.SMTPUser, m.config.SMTPPassword, host)
+	}
+
+	from := m.config.ReplyFrom
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+
+	err := smtp.SendMail(m.config.SMTPServer, auth, from, []string{to}, msg.Bytes())
+	if err != nil {
+		log.Printf("Failed to send mail to %s: %s", to, err)
+		return false
+	}
+	return true
+}
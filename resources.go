@@ -0,0 +1,116 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+)
+
+// A limiter lets at most as many callers hold it at once as it has room
+// for. A nil limiter lets everyone through.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+func (l limiter) Acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l limiter) Release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// ApplyResourceLimits sets up the limits from the config: GOMAXPROCS from
+// MaxProcs, how many images are encoded at once from ImageWorkers (1 by
+// default, each one can hold several full size copies of a photo) and how
+// many files are written at once from MaxOpenFiles.
+func (m *Mailpost) ApplyResourceLimits() {
+	if m.config.MaxProcs > 0 {
+		runtime.GOMAXPROCS(m.config.MaxProcs)
+		log.Printf("Using at most %d CPUs", m.config.MaxProcs)
+	}
+
+	workers := m.config.ImageWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	m.encoder = &imageEncoder{slots: newLimiter(workers)}
+	m.files = newLimiter(m.config.MaxOpenFiles)
+}
+
+// imageEncoder encodes and saves images in the background while posts are
+// being rewritten, up to ImageWorkers at a time. Failures are kept until
+// Wait, so they are recorded on the main goroutine.
+type imageEncoder struct {
+	slots    limiter
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	saving   map[string]bool
+	failures []imageFailure
+}
+
+type imageFailure struct {
+	post Post
+	err  error
+}
+
+// Go runs save for the image going to path, unless that image is already
+// being saved.
+func (e *imageEncoder) Go(path string, post Post, save func() error) {
+	e.mu.Lock()
+	if e.saving == nil {
+		e.saving = make(map[string]bool)
+	}
+	if e.saving[path] {
+		e.mu.Unlock()
+		return
+	}
+	e.saving[path] = true
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.slots.Acquire()
+		defer e.slots.Release()
+		if err := save(); err != nil {
+			e.mu.Lock()
+			e.failures = append(e.failures, imageFailure{post, err})
+			e.mu.Unlock()
+		}
+	}()
+}
+
+// WaitForImages blocks until every image has been saved and marks the posts whose
+// images couldn't be as failed.
+func (m *Mailpost) WaitForImages() {
+	e := m.encoder
+	e.wg.Wait()
+	for _, failure := range e.failures {
+		m.Fail(failure.post, "%s", failure.err)
+	}
+	e.failures = nil
+	e.saving = nil
+}
@@ -0,0 +1,85 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Retry calls fn until it succeeds or RetryAttempts attempts in a row have
+// failed, and returns the last error. The delay between attempts starts at
+// RetryDelay and doubles each time up to RetryMaxDelay, with full jitter so
+// a fleet of mailposts doesn't hammer a recovering server in step. A run
+// that gets through in between counts as a success, so a long IDLE session
+// that drops starts over with a short delay.
+func (m *Mailpost) Retry(what string, fn func() error) error {
+	attempts := m.config.RetryAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	base := m.config.RetryDelay.Or(5 * time.Second)
+	max := m.config.RetryMaxDelay.Or(5 * time.Minute)
+
+	failed := 0
+	for {
+		runs := m.runs
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if m.runs != runs {
+			failed = 0
+		}
+		failed++
+		m.RecordFailure(what, err)
+		if failed >= attempts {
+			log.Printf("%s failed %d times, giving up: %s", what, failed, err)
+			return err
+		}
+
+		delay := base << uint(failed-1)
+		if delay > max || delay <= 0 {
+			delay = max
+		}
+		delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+		log.Printf("%s failed: %s, retrying in %v", what, err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// Session connects to the source and processes mail until there is
+// nothing more to wait for, or until the source fails.
+func (m *Mailpost) Session(ctx context.Context) error {
+	if err := m.source.Connect(ctx); err != nil {
+		return err
+	}
+	defer m.source.Close()
+
+	for {
+		if _, err := m.Run(ctx); err != nil {
+			return err
+		}
+		if !*once {
+			m.SendDigest()
+		}
+
+		// with IDLE, stay connected and go again as soon as mail arrives
+		if *once || !m.config.Idle || !m.WaitForMail() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// Secrets in the config file can be given as a reference instead of the
+// value itself, so they don't have to be kept in plain text there:
+//
+//	"env:NAME"               the environment variable NAME
+//	"file:/path"             the first line of a file
+//	"cmd:command"            the first line a command prints
+//	"keyring:service/user"   an entry in the OS keyring
+//
+// PasswordCommand is a shorthand for Password = "cmd:...".
+
+// secrets returns the config values that may be references.
+func (c *Config) secrets() map[string]*string {
+	return map[string]*string{
+		"Password":           &c.Password,
+		"SMTPPassword":       &c.SMTPPassword,
+		"SMTPListenPassword": &c.SMTPListenPassword,
+		"WebhookPassword":    &c.WebhookPassword,
+		"MailgunSigningKey":  &c.MailgunSigningKey,
+		"JMAPToken":          &c.JMAPToken,
+		"GmailClientSecret":  &c.GmailClientSecret,
+		"GmailRefreshToken":  &c.GmailRefreshToken,
+		"GraphClientSecret":  &c.GraphClientSecret,
+		"PostToken":          &c.PostToken,
+		"NNTPPassword":       &c.NNTPPassword,
+	}
+}
+
+// ResolveSecrets replaces the secret references in the config with the
+// secrets themselves. A secret that can't be read is an error, since
+// nothing would work without it.
+func (c *Config) ResolveSecrets() error {
+	if c.PasswordCommand != "" {
+		if c.Password != "" {
+			return fmt.Errorf("set either Password or PasswordCommand, not both")
+		}
+		c.Password = "cmd:" + c.PasswordCommand
+	}
+
+	for name, value := range c.secrets() {
+		secret, err := ResolveSecret(*value)
+		if err != nil {
+			return fmt.Errorf("couldn't read %s: %s", name, err)
+		}
+		*value = secret
+	}
+
+	for addr, sender := range c.Senders {
+		if sender.Secret == "" {
+			continue
+		}
+		secret, err := ResolveSecret(sender.Secret)
+		if err != nil {
+			return fmt.Errorf("couldn't read the Secret of %s: %s", addr, err)
+		}
+		sender.Secret = secret
+		c.Senders[addr] = sender
+	}
+	return nil
+}
+
+// ResolveSecret returns the secret a config value refers to, or the value
+// itself if it isn't a reference.
+func ResolveSecret(value string) (string, error) {
+	kind, ref := "", value
+	if i := strings.Index(value, ":"); i > 0 {
+		kind, ref = value[:i], value[i+1:]
+	}
+
+	switch kind {
+	case "env":
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s isn't set", ref)
+		}
+		return secret, nil
+	case "file":
+		data, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", err
+		}
+		return firstLine(data), nil
+	case "cmd":
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/C"
+		}
+		cmd := exec.Command(shell, flag, ref)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%q failed: %s", ref, err)
+		}
+		return firstLine(out), nil
+	case "keyring":
+		service, user := ref, ""
+		if i := strings.LastIndex(ref, "/"); i >= 0 {
+			service, user = ref[:i], ref[i+1:]
+		}
+		return keyring.Get(service, user)
+	}
+	return value, nil
+}
+
+// firstLine returns the first line of data, which is where password
+// managers like pass put the password.
+func firstLine(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return strings.TrimRight(string(data), "\r")
+}
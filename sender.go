@@ -0,0 +1,134 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "strings"
+
+// Sender holds the settings for one sender, configured in a
+// [Senders."address"] table of the config file.
+type Sender struct {
+	FrontmatterFile string
+	MaxImgWidth     uint
+	MaxImgHeight    uint
+	StripMetadata   bool
+	StripGPS        bool
+	// defaults for the frontmatter of the sender's posts
+	Author string
+	Type   string
+	// the key their posts are signed with, see CheckAuthorSignature
+	Secret string
+	// where the sender's posts and images go instead of the site's
+	PostDir   string
+	ImageDir  string
+	ImagePath string
+}
+
+// ImagePrivacy is how much of a sender's images mailpost may keep.
+type ImagePrivacy struct {
+	MaxWidth  uint
+	MaxHeight uint
+	// Images are re-encoded in the format they are published in, see
+	// encodeImage, which drops their metadata anyway: only a JPEG gets
+	// the kept EXIF tags back, and a GIF's frames are rescaled without
+	// the comments and application data it was sent with. These make
+	// sure nothing that keeps metadata is used for the sender.
+	StripMetadata bool
+	StripGPS      bool
+	// the EXIF tags written back into re-encoded images, see KeptMetadata
+	Keep []string
+}
+
+// ImagePrivacy returns the image settings for mail from addr. A sender's
+// settings can only make the site-wide ones stricter.
+func (c *Config) ImagePrivacy(addr string) ImagePrivacy {
+	privacy := ImagePrivacy{
+		MaxWidth:      c.MaxImgWidth,
+		StripMetadata: c.StripMetadata,
+		StripGPS:      c.StripMetadata,
+		Keep:          c.KeepMetadata,
+	}
+
+	sender, ok := c.Sender(addr)
+	if !ok {
+		return privacy
+	}
+	privacy.MaxWidth = stricter(privacy.MaxWidth, sender.MaxImgWidth)
+	privacy.MaxHeight = stricter(privacy.MaxHeight, sender.MaxImgHeight)
+	privacy.StripMetadata = privacy.StripMetadata || sender.StripMetadata
+	privacy.StripGPS = privacy.StripGPS || sender.StripGPS || sender.StripMetadata
+	if sender.StripMetadata {
+		// nothing of a sender's who asked for it, whatever the site keeps
+		privacy.Keep = nil
+	}
+	return privacy
+}
+
+// stricter returns the smaller of two limits, where 0 is no limit.
+func stricter(a, b uint) uint {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// RestrictsSenders reports whether only some senders may post.
+func (c *Config) RestrictsSenders() bool {
+	return c.PostFrom != "" || len(c.AllowedSenders) > 0
+}
+
+// SenderAllowed reports whether mail from addr may be posted: it is
+// PostFrom or one of the AllowedSenders, or neither is set.
+func (c *Config) SenderAllowed(addr string) bool {
+	if !c.RestrictsSenders() || strings.EqualFold(c.PostFrom, addr) {
+		return true
+	}
+	for _, allowed := range c.AllowedSenders {
+		if strings.EqualFold(allowed, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForPost returns the config for a post: that of its site, with the
+// settings of its type, and then the PostDir, ImageDir and ImagePath of
+// its sender, in place of the site's if they have them.
+func (c *Config) ForPost(postInfo Post) *Config {
+	site := c.ForSite(postInfo.Site).forType(postInfo.Type)
+	sender, ok := c.Sender(postInfo.From)
+	if !ok || (sender.PostDir == "" && sender.ImageDir == "" && sender.ImagePath == "") {
+		return site
+	}
+	sc := *site
+	if sender.PostDir != "" {
+		sc.PostDir = sender.PostDir
+	}
+	if sender.ImageDir != "" {
+		sc.ImageDir = sender.ImageDir
+	}
+	if sender.ImagePath != "" {
+		sc.ImagePath = sender.ImagePath
+	}
+	return &sc
+}
+
+// Sender returns the settings for an email address.
+func (c *Config) Sender(addr string) (Sender, bool) {
+	for key, sender := range c.Senders {
+		if strings.EqualFold(key, addr) {
+			return sender, true
+		}
+	}
+	return Sender{}, false
+}
@@ -0,0 +1,471 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SignaturePolicy values.
+const (
+	// SignaturesIgnored leaves signatures alone; the default.
+	SignaturesIgnored = "ignore"
+	// SignaturesVerified rejects messages whose signature doesn't check
+	// out, but lets unsigned ones through.
+	SignaturesVerified = "verify-if-present"
+	// SignaturesRequired rejects every message that isn't signed with a
+	// trusted key.
+	SignaturesRequired = "require-signed"
+)
+
+// Signatures are checked, and messages decrypted, with the gpg and
+// openssl commands. PGP/MIME signatures are trusted if they were made
+// with a key in the keyring in PGPHome (gpg's own by default), S/MIME
+// signatures if the certificate chains up to one in SMIMECAFile, which
+// has to be set for S/MIME signatures to be trusted at all. Either way,
+// the key has to have a user ID, or the certificate an email address,
+// that is the From address: a trusted key only vouches for its owner.
+// Encrypted messages are decrypted, when Decrypt is set, with the secret
+// keys in PGPHome or with SMIMEKeyFile and SMIMECertFile.
+
+// VerifiesSignatures reports whether signatures are checked.
+func (c *Config) VerifiesSignatures() bool {
+	return c.SignaturePolicy == SignaturesVerified || c.SignaturePolicy == SignaturesRequired
+}
+
+// checkSignaturePolicy checks the SignaturePolicy config value, and that
+// S/MIME signatures, if the config uses S/MIME, can be checked against
+// SMIMECAFile.
+func (c *Config) checkSignaturePolicy() error {
+	switch c.SignaturePolicy {
+	case "", SignaturesIgnored, SignaturesVerified, SignaturesRequired:
+	default:
+		return fmt.Errorf("invalid SignaturePolicy %q: it must be %q, %q or %q",
+			c.SignaturePolicy, SignaturesIgnored, SignaturesVerified, SignaturesRequired)
+	}
+	// without it openssl would trust every certificate the system does,
+	// and anyone can get one of those for their own address
+	if c.VerifiesSignatures() && c.SMIMECAFile == "" && (c.SMIMECertFile != "" || c.SMIMEKeyFile != "") {
+		return fmt.Errorf("SMIMECAFile must be set to check S/MIME signatures")
+	}
+	return nil
+}
+
+// Unwrap decrypts an encrypted message and checks the signature of a
+// signed one, as SignaturePolicy and Decrypt say, and returns the header
+// and body of what was signed or encrypted. The message's own header is
+// returned for a message that is neither. Signatures only count if they
+// were made by from, the sender's address. An error means the message
+// must not be posted.
+func (m *Mailpost) Unwrap(header mail.Header, body []byte, from string) (mail.Header, []byte, error) {
+	signed := false
+	// a message is often signed and then encrypted, rarely more
+	for depth := 0; depth < 4; depth++ {
+		contentType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		var entity []byte
+		var err error
+
+		switch {
+		case contentType == "multipart/encrypted" && strings.EqualFold(params["protocol"], "application/pgp-encrypted"):
+			if !m.config.Decrypt {
+				return nil, nil, fmt.Errorf("message is encrypted and Decrypt isn't set")
+			}
+			var valid bool
+			entity, valid, err = m.decryptPGP(body, params["boundary"], from)
+			signed = signed || valid
+
+		case (contentType == "application/pkcs7-mime" || contentType == "application/x-pkcs7-mime") &&
+			strings.EqualFold(params["smime-type"], "enveloped-data"):
+			if !m.config.Decrypt {
+				return nil, nil, fmt.Errorf("message is encrypted and Decrypt isn't set")
+			}
+			entity, err = m.decryptSMIME(header, body)
+
+		case (contentType == "application/pkcs7-mime" || contentType == "application/x-pkcs7-mime") &&
+			strings.EqualFold(params["smime-type"], "signed-data"):
+			entity, err = m.verifyOpaqueSMIME(header, body, from)
+			signed = err == nil && m.config.VerifiesSignatures()
+
+		case contentType == "multipart/signed" && m.config.VerifiesSignatures():
+			entity, err = m.verifySigned(body, params, from)
+			signed = err == nil
+
+		default:
+			if m.config.SignaturePolicy == SignaturesRequired && !signed {
+				return nil, nil, fmt.Errorf("message isn't signed and SignaturePolicy is %s", SignaturesRequired)
+			}
+			return header, body, nil
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+		if header, body, err = parseEntity(entity); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, fmt.Errorf("message is nested too deeply")
+}
+
+// parseEntity splits a MIME entity into its header and body.
+func parseEntity(entity []byte) (mail.Header, []byte, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(entity)))
+	fields, err := r.ReadMIMEHeader()
+	if err != nil && len(fields) == 0 {
+		return nil, nil, fmt.Errorf("couldn't read signed or encrypted content: %s", err)
+	}
+	body, _ := ioutil.ReadAll(r.R)
+	return mail.Header(fields), body, nil
+}
+
+// signedParts returns the two parts of a multipart/signed or
+// multipart/encrypted body: the first exactly as it was sent, header and
+// all, since that is what was signed, and the content of the second.
+func signedParts(body []byte, boundary string) ([]byte, []byte, error) {
+	if boundary == "" {
+		return nil, nil, fmt.Errorf("multipart without a boundary")
+	}
+	body = bytes.Replace(bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+
+	delimiter := []byte("--" + boundary)
+	start := bytes.Index(body, delimiter)
+	if start < 0 {
+		return nil, nil, fmt.Errorf("no parts found")
+	}
+	start += len(delimiter)
+	if eol := bytes.Index(body[start:], []byte("\r\n")); eol >= 0 {
+		start += eol + 2
+	}
+	end := bytes.Index(body[start:], append([]byte("\r\n"), delimiter...))
+	if end < 0 {
+		return nil, nil, fmt.Errorf("only one part found")
+	}
+	first := body[start : start+end]
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for i := 0; i < 2; i++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, nil, fmt.Errorf("only one part found")
+		}
+		if i == 1 {
+			second, err := ioutil.ReadAll(DecodeTransfer(part.Header.Get("Content-Transfer-Encoding"), part))
+			return first, second, err
+		}
+	}
+	return nil, nil, fmt.Errorf("only one part found")
+}
+
+// verifySigned checks the signature of a multipart/signed message, and
+// that from made it, and returns the entity that was signed.
+func (m *Mailpost) verifySigned(body []byte, params map[string]string, from string) ([]byte, error) {
+	data, signature, err := signedParts(body, params["boundary"])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read signed message: %s", err)
+	}
+
+	os.MkdirAll(m.WorkDir(), 0700)
+	dir, err := ioutil.TempDir(m.WorkDir(), "verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	dataFile, sigFile := filepath.Join(dir, "data"), filepath.Join(dir, "signature")
+	ioutil.WriteFile(dataFile, data, 0600)
+	ioutil.WriteFile(sigFile, signature, 0600)
+
+	switch protocol := strings.ToLower(params["protocol"]); protocol {
+	case "application/pgp-signature":
+		status, err := m.gpg(nil, nil, "--verify", sigFile, dataFile)
+		if err != nil || !strings.Contains(status, "[GNUPG:] VALIDSIG") {
+			return nil, fmt.Errorf("PGP signature isn't valid or not from a trusted key: %s", gpgReason(status, err))
+		}
+		if err := m.checkPGPSigner(status, from); err != nil {
+			return nil, err
+		}
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		trust, err := m.smimeTrust()
+		if err != nil {
+			return nil, err
+		}
+		signerFile := filepath.Join(dir, "signer")
+		args := append([]string{"cms", "-verify", "-binary", "-inform", "DER", "-in", sigFile,
+			"-content", dataFile, "-out", os.DevNull, "-signer", signerFile}, trust...)
+		if _, err := m.openssl(nil, args...); err != nil {
+			return nil, fmt.Errorf("S/MIME signature isn't valid or not from a trusted certificate: %s", err)
+		}
+		if err := checkSMIMESigner(signerFile, from); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown signature protocol %q", protocol)
+	}
+	return data, nil
+}
+
+// smimeTrust returns the openssl arguments that say which S/MIME
+// certificates to trust: only those that chain up to SMIMECAFile, and
+// are for signing mail. Without SMIMECAFile none are.
+func (m *Mailpost) smimeTrust() ([]string, error) {
+	if m.config.SMIMECAFile == "" {
+		return nil, fmt.Errorf("S/MIME signatures aren't trusted without SMIMECAFile")
+	}
+	return []string{"-CAfile", m.config.SMIMECAFile}, nil
+}
+
+// checkSMIMESigner makes sure one of the certificates openssl wrote to
+// file, as the ones a message was signed with, is for from.
+func checkSMIMESigner(file, from string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("couldn't read the S/MIME signer's certificate: %s", err)
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		for _, address := range certAddresses(cert) {
+			if strings.EqualFold(address, from) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("S/MIME certificate isn't for %s", from)
+}
+
+// oidEmailAddress is the emailAddress attribute older certificates put
+// in the subject instead of a subject alternative name.
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// certAddresses returns the email addresses a certificate is for.
+func certAddresses(cert *x509.Certificate) []string {
+	addresses := cert.EmailAddresses
+	for _, name := range cert.Subject.Names {
+		if address, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// verifyOpaqueSMIME checks an S/MIME message with the signed content
+// inside the signature, and that from signed it, and returns the
+// content. With SignaturePolicy "ignore" the content is taken out
+// without checking.
+func (m *Mailpost) verifyOpaqueSMIME(header mail.Header, body []byte, from string) ([]byte, error) {
+	der, err := ioutil.ReadAll(DecodeTransfer(header.Get("Content-Transfer-Encoding"), bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	if !m.config.VerifiesSignatures() {
+		out, err := m.openssl(der, "cms", "-verify", "-binary", "-inform", "DER", "-noverify")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read S/MIME message: %s", err)
+		}
+		return out, nil
+	}
+
+	trust, err := m.smimeTrust()
+	if err != nil {
+		return nil, err
+	}
+	os.MkdirAll(m.WorkDir(), 0700)
+	signer, err := ioutil.TempFile(m.WorkDir(), "signer")
+	if err != nil {
+		return nil, err
+	}
+	signer.Close()
+	defer os.Remove(signer.Name())
+
+	args := append([]string{"cms", "-verify", "-binary", "-inform", "DER", "-signer", signer.Name()}, trust...)
+	out, err := m.openssl(der, args...)
+	if err != nil {
+		return nil, fmt.Errorf("S/MIME signature isn't valid or not from a trusted certificate: %s", err)
+	}
+	if err := checkSMIMESigner(signer.Name(), from); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decryptSMIME decrypts an S/MIME message with SMIMEKeyFile.
+func (m *Mailpost) decryptSMIME(header mail.Header, body []byte) ([]byte, error) {
+	der, err := ioutil.ReadAll(DecodeTransfer(header.Get("Content-Transfer-Encoding"), bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	out, err := m.openssl(der, "cms", "-decrypt", "-binary", "-inform", "DER",
+		"-inkey", m.config.SMIMEKeyFile, "-recip", m.config.SMIMECertFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt S/MIME message: %s", err)
+	}
+	return out, nil
+}
+
+// decryptPGP decrypts a PGP/MIME message and reports whether it was also
+// signed by from with a trusted key. When signatures are checked, one by
+// anyone else is an error.
+func (m *Mailpost) decryptPGP(body []byte, boundary, from string) ([]byte, bool, error) {
+	_, encrypted, err := signedParts(body, boundary)
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't read encrypted message: %s", err)
+	}
+	var out bytes.Buffer
+	status, err := m.gpg(encrypted, &out, "--decrypt")
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decrypt PGP message: %s", gpgReason(status, err))
+	}
+	if !strings.Contains(status, "[GNUPG:] VALIDSIG") {
+		return out.Bytes(), false, nil
+	}
+	if err := m.checkPGPSigner(status, from); err != nil {
+		if m.config.VerifiesSignatures() {
+			return nil, false, err
+		}
+		return out.Bytes(), false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// checkPGPSigner makes sure the key that made a valid signature, as gpg's
+// status lines name it, has a user ID for from that isn't revoked or
+// expired.
+func (m *Mailpost) checkPGPSigner(status, from string) error {
+	key := ""
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		// the primary key comes last, when a subkey made the signature
+		key = fields[2]
+		if len(fields) >= 12 {
+			key = fields[11]
+		}
+	}
+	if key == "" {
+		return fmt.Errorf("PGP signature isn't valid")
+	}
+
+	var out bytes.Buffer
+	if status, err := m.gpg(nil, &out, "--with-colons", "--list-keys", key); err != nil {
+		return fmt.Errorf("couldn't look up PGP key %s: %s", key, gpgReason(status, err))
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 10 || fields[0] != "uid" || fields[1] == "r" || fields[1] == "e" {
+			continue
+		}
+		if strings.EqualFold(uidAddress(fields[9]), from) {
+			return nil
+		}
+	}
+	return fmt.Errorf("PGP key %s has no user ID for %s", key, from)
+}
+
+// uidAddress returns the address in a PGP user ID as gpg lists it, like
+// "Jane Doe <jane@example.com>", or the user ID if it is just an address.
+func uidAddress(uid string) string {
+	uid = strings.Replace(uid, `\x3a`, ":", -1)
+	if start := strings.LastIndex(uid, "<"); start >= 0 {
+		if end := strings.Index(uid[start:], ">"); end >= 0 {
+			return strings.TrimSpace(uid[start+1 : start+end])
+		}
+	}
+	return strings.TrimSpace(uid)
+}
+
+// gpg runs gpg with PGPHome and input on stdin, writing its output to out
+// if it isn't nil, and returns its status lines.
+func (m *Mailpost) gpg(input []byte, out *bytes.Buffer, args ...string) (string, error) {
+	base := []string{"--batch", "--no-tty", "--status-fd", "2"}
+	if m.config.PGPHome != "" {
+		base = append(base, "--homedir", m.config.PGPHome)
+	}
+	cmd := exec.Command("gpg", append(base, args...)...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var status bytes.Buffer
+	cmd.Stderr = &status
+	if out != nil {
+		cmd.Stdout = out
+	}
+	err := cmd.Run()
+	return status.String(), err
+}
+
+// openssl runs openssl with input on stdin and returns what it prints.
+func (m *Mailpost) openssl(input []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("openssl", args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, firstOutputLine(stderr.String()))
+	}
+	return out, nil
+}
+
+// gpgReason picks the status line that says why gpg didn't verify or
+// decrypt a message.
+func gpgReason(status string, err error) string {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "BADSIG", "ERRSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG", "NO_PUBKEY", "NO_SECKEY", "DECRYPTION_FAILED", "NODATA":
+			return strings.Join(fields[1:], " ")
+		}
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "no valid signature"
+}
+
+// firstOutputLine returns the first line of a command's output, which says why
+// it failed.
+func firstOutputLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return "no reason given"
+}
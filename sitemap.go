@@ -0,0 +1,215 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxFeedItems is how many posts a section's feed keeps, newest first.
+const maxFeedItems = 20
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// sitemapURL is a page in a sitemap.
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemap is a sitemap.xml document.
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// rssItem is a post in a feed.
+type rssItem struct {
+	Title       string `xml:"title,omitempty"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description,omitempty"`
+}
+
+// rssChannel is what a feed is about, and its posts.
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+// rss is an RSS 2.0 feed.
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// UpdateSitemaps adds the posts written by a run to the SitemapFile and
+// to the feed of their section, by type, in FeedDir, of the site each
+// went to, for sites whose generator doesn't make them. Entries for a
+// post that is written again are replaced. Nothing is done for a site
+// without SitemapFile or FeedDir.
+func (m *Mailpost) UpdateSitemaps(posts []Post) {
+	bySite := make(map[string][]Post)
+	for _, postInfo := range posts {
+		bySite[postInfo.Site] = append(bySite[postInfo.Site], postInfo)
+	}
+	for _, name := range m.config.SiteNames() {
+		if len(bySite[name]) == 0 {
+			continue
+		}
+		site := m.config.ForSite(name)
+		if site.SitemapFile != "" {
+			if err := m.updateSitemap(site.SitemapFile, bySite[name]); err != nil {
+				log.Printf("Couldn't update sitemap %s: %s", site.SitemapFile, err)
+			}
+		}
+		if site.FeedDir != "" {
+			m.updateFeeds(site, bySite[name])
+		}
+	}
+}
+
+// updateSitemap adds posts to a sitemap, or makes one.
+func (m *Mailpost) updateSitemap(path string, posts []Post) error {
+	doc := sitemap{XMLNS: sitemapNamespace}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			log.Printf("Couldn't read sitemap %s, starting a new one: %s", path, err)
+			doc = sitemap{}
+		}
+		doc.XMLNS = sitemapNamespace
+	}
+
+	now := time.Now().In(m.siteTime).Format(time.RFC3339)
+	index := make(map[string]int)
+	for i, u := range doc.URLs {
+		index[u.Loc] = i
+	}
+	for _, postInfo := range posts {
+		u := sitemapURL{Loc: m.PostURL(postInfo), LastMod: now}
+		if i, ok := index[u.Loc]; ok {
+			doc.URLs[i] = u
+			continue
+		}
+		index[u.Loc] = len(doc.URLs)
+		doc.URLs = append(doc.URLs, u)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeXML(path, doc); err != nil {
+		return err
+	}
+	log.Printf("   |-- Added %d posts to %s", len(posts), path)
+	return nil
+}
+
+// updateFeeds adds posts to the feed of their section, FeedDir/type.xml.
+func (m *Mailpost) updateFeeds(site *Config, posts []Post) {
+	if err := os.MkdirAll(site.FeedDir, 0755); err != nil {
+		log.Printf("Couldn't make FeedDir: %s", err)
+		return
+	}
+	bySection := make(map[string][]Post)
+	for _, postInfo := range posts {
+		section := Slugify(postInfo.Type)
+		bySection[section] = append(bySection[section], postInfo)
+	}
+	for section, sectionPosts := range bySection {
+		path := filepath.Join(site.FeedDir, section+".xml")
+		if err := m.updateFeed(path, site, section, sectionPosts); err != nil {
+			log.Printf("Couldn't update feed %s: %s", path, err)
+		}
+	}
+}
+
+// updateFeed adds posts to a feed, or makes one, keeping the newest
+// maxFeedItems.
+func (m *Mailpost) updateFeed(path string, site *Config, section string, posts []Post) error {
+	doc := rss{Version: "2.0", Channel: rssChannel{
+		Title:       section,
+		Link:        site.BaseURL,
+		Description: "Latest " + section + " posts",
+	}}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			log.Printf("Couldn't read feed %s, starting a new one: %s", path, err)
+		}
+	}
+
+	items := make(map[string]rssItem)
+	for _, item := range doc.Channel.Items {
+		items[item.GUID] = item
+	}
+	for _, postInfo := range posts {
+		published := time.Now()
+		if t, ok := ParsePostDate(postInfo.Date, m.siteTime); ok {
+			published = t
+		}
+		link := m.PostURL(postInfo)
+		items[link] = rssItem{
+			Title:       postInfo.Title,
+			Link:        link,
+			GUID:        link,
+			PubDate:     published.Format(time.RFC1123Z),
+			Description: postSummary(postInfo.Data),
+		}
+	}
+
+	doc.Channel.Items = doc.Channel.Items[:0]
+	for _, item := range items {
+		doc.Channel.Items = append(doc.Channel.Items, item)
+	}
+	sort.Slice(doc.Channel.Items, func(i, j int) bool {
+		a, _ := time.Parse(time.RFC1123Z, doc.Channel.Items[i].PubDate)
+		b, _ := time.Parse(time.RFC1123Z, doc.Channel.Items[j].PubDate)
+		if a.Equal(b) {
+			return doc.Channel.Items[i].GUID < doc.Channel.Items[j].GUID
+		}
+		return a.After(b)
+	})
+	if len(doc.Channel.Items) > maxFeedItems {
+		doc.Channel.Items = doc.Channel.Items[:maxFeedItems]
+	}
+	doc.Version = "2.0"
+
+	if err := writeXML(path, doc); err != nil {
+		return err
+	}
+	log.Printf("   |-- Added %d posts to %s", len(posts), path)
+	return nil
+}
+
+// writeXML writes v to path as indented XML, through a temporary file like
+// writeJSON.
+func writeXML(path string, v interface{}) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, []byte(xml.Header+strings.TrimSpace(string(data))+"\n"))
+}
@@ -0,0 +1,129 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Site is another site posts can be sent to, configured in a
+// [Sites.name] table. A post goes to it when its frontmatter says
+// "site: name", or when it was sent to the posting address with "+name"
+// added, like blog+photos@example.com. Settings left out are the same as
+// for the main site.
+type Site struct {
+	PostDir        string
+	ImageDir       string
+	BaseURL        string
+	ImagePath      string
+	AttachmentDir  string
+	AttachmentPath string
+	OriginalsDir   string
+	PostURL        string
+	SitemapFile    string
+	FeedDir        string
+}
+
+// ForSite returns the config for posts going to the named site: c with
+// the site's settings in place of the main site's. The main site, "",
+// gets c itself.
+func (c *Config) ForSite(name string) *Config {
+	site, ok := c.Sites[name]
+	if name == "" || !ok {
+		return c
+	}
+	sc := *c
+	for _, s := range []struct {
+		value   string
+		setting *string
+	}{
+		{site.PostDir, &sc.PostDir},
+		{site.ImageDir, &sc.ImageDir},
+		{site.BaseURL, &sc.BaseURL},
+		{site.ImagePath, &sc.ImagePath},
+		{site.AttachmentDir, &sc.AttachmentDir},
+		{site.AttachmentPath, &sc.AttachmentPath},
+		{site.OriginalsDir, &sc.OriginalsDir},
+		{site.PostURL, &sc.PostURL},
+		{site.SitemapFile, &sc.SitemapFile},
+		{site.FeedDir, &sc.FeedDir},
+	} {
+		if s.value != "" {
+			*s.setting = s.value
+		}
+	}
+	return &sc
+}
+
+// SiteNames returns the names of the configured sites, sorted, after the
+// main site "".
+func (c *Config) SiteNames() []string {
+	names := []string{""}
+	var others []string
+	for name := range c.Sites {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// HasSite reports whether name is the main site or a configured one.
+func (c *Config) HasSite(name string) bool {
+	_, ok := c.Sites[name]
+	return name == "" || ok
+}
+
+// splitPlusAddress splits the tag off an address like
+// blog+photos@example.com, returning blog@example.com and photos.
+func splitPlusAddress(addr string) (string, string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	local := addr[:at]
+	plus := strings.Index(local, "+")
+	if plus < 0 {
+		return addr, ""
+	}
+	return local[:plus] + addr[at:], local[plus+1:]
+}
+
+// PostURL returns the address a post is published at. PostURL is a
+// template for its path, like "/<type>/<date>/<slug>/", where <date> is
+// formatted with DatePathFmt; without it, the path is where the post's
+// file is under the top of PostDir, as Hugo does it.
+func (m *Mailpost) PostURL(postInfo Post) string {
+	site := m.config.ForPost(postInfo)
+	slug := PostSlug(postInfo)
+	urlPath := site.PostURL
+	if urlPath == "" {
+		page := filepath.Join(postInfo.Path, slug)
+		if InBundle(postInfo) {
+			page = postInfo.Path
+		}
+		rel, err := filepath.Rel(TemplateRoot(site.PostDir), page)
+		if err != nil {
+			rel = slug
+		}
+		urlPath = filepath.ToSlash(rel) + "/"
+	} else {
+		urlPath = strings.Replace(urlPath, "<type>", strings.ToLower(strings.TrimSpace(postInfo.Type)), -1)
+		urlPath = strings.Replace(urlPath, "<date>", m.MakeDatePathPart(postInfo.Date), -1)
+		urlPath = strings.Replace(urlPath, "<slug>", slug, -1)
+		urlPath = FillFields(urlPath, postInfo.Fields)
+	}
+	return strings.TrimRight(site.BaseURL, "/") + "/" + strings.TrimLeft(urlPath, "/")
+}
@@ -0,0 +1,148 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// reNotSlug matches what a slug can't have.
+var reNotSlug = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// transliterations are the letters that don't come apart into a plain
+// letter and accents, and what a slug has for them instead.
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d",
+	'ð': "d", 'þ': "th", 'ı': "i", 'ħ': "h", 'ŋ': "n",
+}
+
+// Slugify makes text into a slug: lower case letters and digits with
+// dashes between words, so "Crème Brûlée, again!" becomes
+// "creme-brulee-again". Accents are taken off letters, apostrophes are
+// dropped instead of splitting a word, and letters of scripts without an
+// ASCII form are kept as they are.
+func Slugify(text string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(text)) {
+		switch {
+		case unicode.Is(unicode.Mn, r), r == '\'', r == '’':
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.Trim(reNotSlug.ReplaceAllString(norm.NFC.String(b.String()), "-"), "-")
+}
+
+// FilenameInfo is the data passed to the FilenameTemplate: the post's
+// Title, its Slug, its Date as 2006-01-02, its Type and every field of its
+// Frontmatter.
+type FilenameInfo struct {
+	Title       string
+	Slug        string
+	Date        string
+	Type        string
+	Frontmatter map[string]interface{}
+}
+
+// ParseFilenameTemplate compiles the FilenameTemplate config value, and
+// those of the Types.
+func (m *Mailpost) ParseFilenameTemplate() error {
+	texts := make(map[string]string)
+	for name, postType := range m.config.Types {
+		if postType.FilenameTemplate != "" {
+			texts[strings.ToLower(name)] = postType.FilenameTemplate
+		}
+	}
+	if m.config.FilenameTemplate != "" {
+		texts[""] = m.config.FilenameTemplate
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+
+	m.nameTmpls = make(map[string]*template.Template)
+	for name, text := range texts {
+		tmpl, err := template.New("filename").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid FilenameTemplate: %s", err)
+		}
+		m.nameTmpls[name] = tmpl
+	}
+	return nil
+}
+
+// PostFilename returns the name of a post's file. Without a
+// FilenameTemplate, for its type or the site, it is the title, sanitized,
+// with .md added, or for a note without one, the time it was posted. A name from the template gets .md if it has no
+// extension, and can't have directories in it.
+func (m *Mailpost) PostFilename(postInfo Post) string {
+	name := m.SanitizeFilename(postInfo.Title) + ".md"
+	slug := Slugify(postInfo.Title)
+	if postInfo.Title == "" {
+		// a note is named after when it was posted
+		t, ok := ParsePostDate(postInfo.Date, m.siteTime)
+		if !ok {
+			t = time.Now().In(m.siteTime)
+		}
+		slug = t.Format(noteSlugFormat)
+		name = slug + ".md"
+	}
+	tmpl, ok := m.nameTmpls[strings.ToLower(strings.TrimSpace(postInfo.Type))]
+	if !ok {
+		tmpl, ok = m.nameTmpls[""]
+	}
+	if !ok {
+		return name
+	}
+
+	info := FilenameInfo{
+		Title:       postInfo.Title,
+		Slug:        slug,
+		Type:        postInfo.Type,
+		Frontmatter: postInfo.Fields,
+	}
+	if slug, ok := postInfo.Fields["slug"].(string); ok && slug != "" {
+		info.Slug = Slugify(slug)
+	}
+	if t, ok := ParsePostDate(postInfo.Date, m.siteTime); ok {
+		info.Date = t.Format("2006-01-02")
+	}
+
+	out := new(bytes.Buffer)
+	if err := tmpl.Execute(out, info); err != nil {
+		log.Printf("Couldn't render FilenameTemplate, using %s: %s", name, err)
+		return name
+	}
+	rendered := strings.Trim(strings.NewReplacer("/", "-", "\\", "-").Replace(strings.TrimSpace(out.String())), ".-")
+	if rendered == "" {
+		log.Printf("FilenameTemplate gave an empty name, using %s", name)
+		return name
+	}
+	if filepath.Ext(rendered) == "" {
+		rendered += ".md"
+	}
+	return rendered
+}
@@ -0,0 +1,188 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// largest message the listener accepts
+const smtpMaxMessageBytes = 32 << 20
+
+// SMTPListenerSource runs an SMTP server and posts the mail delivered to
+// it, so no mailbox is needed at all. Messages are queued as they are
+// accepted and picked up by the next Fetch.
+type SMTPListenerSource struct {
+	config *Config
+	server *smtp.Server
+	queue  *MessageQueue
+}
+
+func (s *SMTPListenerSource) Connect(ctx context.Context) error {
+	if s.server != nil {
+		return nil
+	}
+	s.queue = NewMessageQueue()
+
+	server := smtp.NewServer(&smtpBackend{s})
+	s.server = server
+	s.server.Addr = s.config.SMTPListen
+	if s.server.Addr == "" {
+		s.server.Addr = ":2525"
+	}
+	s.server.Domain = s.config.SMTPListenDomain
+	if s.server.Domain == "" {
+		s.server.Domain = "localhost"
+	}
+	s.server.MaxMessageBytes = smtpMaxMessageBytes
+	s.server.MaxRecipients = 50
+	s.server.ReadTimeout = 5 * time.Minute
+	s.server.WriteTimeout = 5 * time.Minute
+
+	if s.config.SMTPListenCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.SMTPListenCertFile, s.config.SMTPListenKeyFile)
+		if err != nil {
+			s.server = nil
+			return fmt.Errorf("couldn't load SMTP listener certificate: %s", err)
+		}
+		s.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		s.server.AllowInsecureAuth = true
+	}
+
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.server = nil
+		return fmt.Errorf("couldn't listen for mail: %s", err)
+	}
+	log.Printf("Listening for mail on %s..\n", server.Addr)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Fatalf("SMTP listener failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *SMTPListenerSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.queue.Drain(process)
+	return nil
+}
+
+// Idle waits for the next message to be delivered, or until.
+func (s *SMTPListenerSource) Idle(until time.Time) bool {
+	s.queue.Wait(until)
+	return true
+}
+
+// MarkProcessed has nothing to do, delivered mail only exists in memory
+// until it has been processed.
+func (s *SMTPListenerSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	return nil
+}
+
+// Close keeps the server running between checks, so mail can still be
+// accepted while mailpost waits.
+func (s *SMTPListenerSource) Close() {}
+
+type smtpBackend struct {
+	source *SMTPListenerSource
+}
+
+func (b *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smtpSession{source: b.source, remote: c.Conn().RemoteAddr().String()}, nil
+}
+
+type smtpSession struct {
+	source *SMTPListenerSource
+	remote string
+	authed bool
+}
+
+func (s *smtpSession) AuthMechanisms() []string {
+	if s.source.config.SMTPListenUser == "" {
+		return nil
+	}
+	return []string{sasl.Plain}
+}
+
+func (s *smtpSession) Auth(mech string) (sasl.Server, error) {
+	config := s.source.config
+	if config.SMTPListenUser == "" || mech != sasl.Plain {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(config.SMTPListenUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(config.SMTPListenPassword)) == 1
+		if !userOK || !passOK {
+			log.Printf("SMTP login failed for %s from %s", username, s.remote)
+			return &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Invalid credentials"}
+		}
+		s.authed = true
+		return nil
+	}), nil
+}
+
+// Mail turns away senders who haven't logged in, if SMTPListenUser is
+// set.
+func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.source.config.SMTPListenUser != "" && !s.authed {
+		return smtp.ErrAuthRequired
+	}
+	return nil
+}
+
+// Rcpt turns away mail for anyone but SMTPListenRecipients, if set.
+func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	recipients := s.source.config.SMTPListenRecipients
+	if len(recipients) == 0 {
+		return nil
+	}
+	for _, addr := range recipients {
+		if strings.EqualFold(addr, to) {
+			return nil
+		}
+	}
+	return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such recipient"}
+}
+
+func (s *smtpSession) Data(r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if !s.source.queue.Push(body) {
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 1}, Message: "Too many messages waiting, try again later"}
+	}
+	return nil
+}
+
+func (s *smtpSession) Reset() {}
+
+func (s *smtpSession) Logout() error {
+	return nil
+}
@@ -0,0 +1,400 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Source supplies raw RFC 822 messages to the pipeline. Fetch calls
+// process once for every message that hasn't been handled yet.
+// MarkProcessed is called once the resulting posts have been written and
+// marks the messages from the last Fetch so they aren't returned again.
+// status holds the outcome of each message, in the order the messages
+// were passed to process; only posted messages may be archived or deleted.
+//
+// Errors returned by Connect, Fetch and MarkProcessed are taken to be
+// temporary: the source is closed and connected again after a while. The
+// context passed to them ends when mailpost stops waiting on the source;
+// downloads of single messages should also give up after MessageTimeout.
+type Source interface {
+	Connect(ctx context.Context) error
+	Fetch(ctx context.Context, process func(body []byte)) error
+	MarkProcessed(ctx context.Context, status []MessageStatus) error
+	Close()
+}
+
+// SourceName returns the kind of source mail is read from.
+func (m *Mailpost) SourceName() string {
+	if m.config.Source == "" {
+		return "imap"
+	}
+	return strings.ToLower(m.config.Source)
+}
+
+// Posted reports whether the i'th message of a fetch was posted.
+func Posted(status []MessageStatus, i int) bool {
+	return i < len(status) && status[i] == MessagePosted
+}
+
+// Removable reports whether the i'th message of a fetch should be deleted.
+func (c *Config) Removable(status []MessageStatus, i int) bool {
+	if !c.DeleteProcessed || i >= len(status) {
+		return false
+	}
+	return status[i] == MessagePosted ||
+		(c.DeleteFailed && status[i] == MessageFailed)
+}
+
+// An Idler is a Source that can wait for new messages to arrive. Idle
+// blocks until there is new mail, or until is reached if it isn't zero,
+// and returns false if the source can't wait, for example because the
+// server doesn't support it.
+type Idler interface {
+	Idle(until time.Time) bool
+}
+
+// MailboxNames returns the mailboxes to read from: Mailboxes if it is set,
+// otherwise Mailbox, otherwise INBOX.
+func (c *Config) MailboxNames() []string {
+	if len(c.Mailboxes) > 0 {
+		return c.Mailboxes
+	}
+	if c.Mailbox != "" {
+		return []string{c.Mailbox}
+	}
+	return []string{"INBOX"}
+}
+
+// NewSource returns the Source selected by the Source config option.
+func (m *Mailpost) NewSource() Source {
+	switch strings.ToLower(m.config.Source) {
+	case "", "imap":
+		return &IMAPSource{config: &m.config, state: m.state, spool: m.WorkDir()}
+	case "gmail":
+		return &GmailSource{config: &m.config}
+	case "webhook":
+		return &WebhookSource{config: &m.config}
+	case "smtp":
+		return &SMTPListenerSource{config: &m.config}
+	case "graph":
+		return &GraphSource{config: &m.config, state: m.StateDir()}
+	case "jmap":
+		return &JMAPSource{config: &m.config}
+	case "maildir":
+		return &MaildirSource{config: &m.config, path: m.config.SourcePath}
+	case "mbox":
+		return &MboxSource{config: &m.config, path: m.config.SourcePath}
+	case "nntp":
+		return &NNTPSource{config: &m.config, state: m.state}
+	}
+	log.Fatalf("Unknown Source in config: %s", m.config.Source)
+	return nil
+}
+
+// MaildirSource reads messages from a local Maildir. Messages in new/ and
+// messages in cur/ without the Seen flag are processed, then moved to cur/
+// with the Seen flag set, or deleted when DeleteProcessed is set.
+type MaildirSource struct {
+	config  *Config
+	path    string
+	pending []string
+}
+
+func (s *MaildirSource) Connect(ctx context.Context) error {
+	log.Printf("Opening Maildir %s..\n", s.path)
+	for _, dir := range []string{"new", "cur", "tmp"} {
+		if info, err := os.Stat(filepath.Join(s.path, dir)); err != nil || !info.IsDir() {
+			return fmt.Errorf("not a Maildir: %s", s.path)
+		}
+	}
+	return nil
+}
+
+func (s *MaildirSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	var files []string
+	s.pending = nil
+
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(s.path, dir))
+		if err != nil {
+			return fmt.Errorf("couldn't read Maildir: %s", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if dir == "cur" && strings.Contains(s.flags(entry.Name()), "S") {
+				continue
+			}
+			files = append(files, filepath.Join(s.path, dir, entry.Name()))
+		}
+	}
+
+	if len(files) == 0 {
+		log.Print("No unread messages found.")
+		return nil
+	}
+
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("Couldn't read message %s: %s", file, err)
+			continue
+		}
+		process(body)
+		s.pending = append(s.pending, file)
+	}
+	return nil
+}
+
+func (s *MaildirSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	for i, file := range s.pending {
+		if s.config.Removable(status, i) {
+			if err := os.Remove(file); err != nil {
+				log.Printf("Couldn't delete message: %s", err)
+			}
+			continue
+		}
+		s.markSeen(file)
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *MaildirSource) Close() {}
+
+// flags returns the flags from the info part of a Maildir file name.
+func (s *MaildirSource) flags(name string) string {
+	if i := strings.LastIndex(name, ":2,"); i >= 0 {
+		return name[i+3:]
+	}
+	return ""
+}
+
+func (s *MaildirSource) markSeen(file string) {
+	name := filepath.Base(file)
+	flags := s.flags(name)
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+
+	// flags must be kept in ASCII order
+	chars := strings.Split(flags+"S", "")
+	sort.Strings(chars)
+	name = name + ":2," + strings.Join(chars, "")
+
+	if err := os.Rename(file, filepath.Join(s.path, "cur", name)); err != nil {
+		log.Printf("Couldn't mark message seen: %s", err)
+	}
+}
+
+// MboxSource reads messages from a local mbox file. Messages whose Status
+// header doesn't contain R are processed and are then rewritten with
+// "Status: RO", or removed from the file when DeleteProcessed is set.
+type MboxSource struct {
+	config  *Config
+	path    string
+	pending map[string]bool
+	order   []string
+}
+
+var reMboxFrom = regexp.MustCompile(`(?m)^>(>*From )`)
+var reMboxStatus = regexp.MustCompile(`(?im)^Status:([^\r\n]*)`)
+
+func (s *MboxSource) Connect(ctx context.Context) error {
+	log.Printf("Opening mbox %s..\n", s.path)
+	if _, err := os.Stat(s.path); err != nil {
+		return fmt.Errorf("file doesn't exist: %v", err)
+	}
+	return nil
+}
+
+func (s *MboxSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("couldn't read mbox: %s", err)
+	}
+
+	s.pending = make(map[string]bool)
+	s.order = nil
+
+	for _, raw := range s.split(data) {
+		header, _ := s.header(raw)
+		if status := reMboxStatus.FindSubmatch(header); status != nil &&
+			bytes.Contains(status[1], []byte("R")) {
+			continue
+		}
+
+		// drop the envelope line and undo ">From " quoting
+		body := raw[bytes.IndexByte(raw, '\n')+1:]
+		process(reMboxFrom.ReplaceAll(body, []byte("$1")))
+		s.pending[string(raw)] = true
+		s.order = append(s.order, string(raw))
+	}
+
+	if len(s.pending) == 0 {
+		log.Print("No unread messages found.")
+	}
+	return nil
+}
+
+// MarkProcessed rewrites the mbox with the processed messages marked read.
+// The file is read again first so mail delivered since Fetch isn't lost.
+func (s *MboxSource) MarkProcessed(ctx context.Context, status []MessageStatus) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	remove := make(map[string]bool)
+	for i, raw := range s.order {
+		if s.config.Removable(status, i) {
+			remove[raw] = true
+		}
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't lock mbox: %s", err)
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("couldn't read mbox: %s", err)
+	}
+
+	var messages [][]byte
+	for _, raw := range s.split(data) {
+		if remove[string(raw)] {
+			continue
+		}
+		if s.pending[string(raw)] {
+			raw = s.markSeen(raw)
+		}
+		messages = append(messages, raw)
+	}
+	s.pending = nil
+	s.order = nil
+
+	info, _ := os.Stat(s.path)
+	tmp := s.path + ".mailpost"
+	if err := ioutil.WriteFile(tmp, bytes.Join(messages, nil), info.Mode()); err != nil {
+		return fmt.Errorf("couldn't update mbox: %s", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("couldn't update mbox: %s", err)
+	}
+	return nil
+}
+
+func (s *MboxSource) Close() {}
+
+// mboxLockStale is how old a dotlock has to be before it is taken to be
+// left over from a crashed process, as procmail and mutt do.
+const mboxLockStale = 5 * time.Minute
+
+// lock takes the dotlock delivery agents take before appending to the
+// mbox, so no mail is delivered between reading the file and renaming
+// the rewritten one over it. A lock file is used rather than flock since
+// the rename replaces the file a flock would be held on.
+func (s *MboxSource) lock(ctx context.Context) (func(), error) {
+	path := s.path + ".lock"
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > mboxLockStale {
+			log.Printf("Removing stale lock %s", path)
+			os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// split breaks an mbox into its messages, each starting with its
+// "From " envelope line.
+func (s *MboxSource) split(data []byte) [][]byte {
+	var messages [][]byte
+	start := -1
+
+	for pos := 0; pos < len(data); {
+		end := bytes.IndexByte(data[pos:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end = pos + end + 1
+		}
+		if bytes.HasPrefix(data[pos:], []byte("From ")) {
+			if start >= 0 {
+				messages = append(messages, data[start:pos])
+			}
+			start = pos
+		}
+		pos = end
+	}
+	if start >= 0 {
+		messages = append(messages, data[start:])
+	}
+	return messages
+}
+
+// header returns the header block of a raw message and the offset at which
+// the blank line separating it from the body begins.
+func (s *MboxSource) header(raw []byte) ([]byte, int) {
+	end := bytes.Index(raw, []byte("\n\n"))
+	if crlf := bytes.Index(raw, []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+		end = crlf
+	}
+	if end < 0 {
+		end = len(raw)
+	}
+	return raw[:end], end
+}
+
+func (s *MboxSource) markSeen(raw []byte) []byte {
+	header, end := s.header(raw)
+	if reMboxStatus.Match(header) {
+		header = reMboxStatus.ReplaceAll(header, []byte("Status: RO"))
+		return append(append([]byte{}, header...), raw[end:]...)
+	}
+
+	newline := "\n"
+	if bytes.Contains(header, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	out := append([]byte{}, header...)
+	out = append(out, []byte(newline+"Status: RO")...)
+	return append(out, raw[end:]...)
+}
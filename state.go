@@ -0,0 +1,224 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// State is everything mailpost remembers between runs.
+type State struct {
+	// last UID seen in each mailbox, keyed by source and mailbox name
+	UIDs map[string]MailboxState
+	// posts waiting to be published
+	Schedule []ScheduledPost
+	Stats    Stats
+	Alerts   AlertState
+	// how each IMAP server has been behaving
+	IMAPHealth map[string]IMAPHealth
+	// a tenant's posts today, see Tenant
+	Quota QuotaState
+}
+
+type MailboxState struct {
+	UIDValidity uint32
+	LastUID     uint32
+}
+
+// ScheduledPost is a post held until it may be published, see HoldPosts.
+type ScheduledPost struct {
+	Path    string
+	Publish time.Time
+	Title   string
+	Type    string
+	Date    string
+	Data    string
+	Site    string
+}
+
+const stateSchema = `
+CREATE TABLE IF NOT EXISTS state (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS history (
+	id         INTEGER PRIMARY KEY,
+	processed  TIMESTAMP NOT NULL,
+	source     TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	sender     TEXT NOT NULL,
+	subject    TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	posts      TEXT NOT NULL,
+	error      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS history_sender ON history (sender, processed);
+CREATE INDEX IF NOT EXISTS history_processed ON history (processed);
+`
+
+// StateStore keeps State and the history of processed messages in a
+// SQLite database. Every change to the state goes through Update, which
+// runs in a write transaction, so several sources in one process and
+// another mailpost run at the same time all see each other's changes and
+// never write over them.
+type StateStore struct {
+	path string
+	db   *sql.DB
+	mu   sync.RWMutex
+}
+
+var stores = struct {
+	sync.Mutex
+	m map[string]*StateStore
+}{m: make(map[string]*StateStore)}
+
+// OpenStateStore returns the store for the database at path, creating it
+// if needed. Everything in the process that opens the same database
+// shares one store.
+func OpenStateStore(path string) (*StateStore, error) {
+	path, _ = filepath.Abs(path)
+
+	stores.Lock()
+	defer stores.Unlock()
+	if s, ok := stores.m[path]; ok {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't make state directory: %s", err)
+	}
+	// _txlock=immediate takes the write lock when a transaction begins,
+	// so two processes can't both read the old state and then update it
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=30000&_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open state database: %s", err)
+	}
+	if _, err := db.Exec(stateSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't open state database: %s", err)
+	}
+
+	s := &StateStore{path: path, db: db}
+	s.importJSON(filepath.Join(filepath.Dir(path), "state.json"))
+	stores.m[path] = s
+	return s, nil
+}
+
+// importJSON brings in the state file earlier versions kept.
+func (s *StateStore) importJSON(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = s.Update(func(state *State) error {
+		return json.Unmarshal(data, state)
+	})
+	if err != nil {
+		log.Printf("Couldn't import %s: %s", path, err)
+		return
+	}
+	os.Rename(path, path+".imported")
+}
+
+// View calls fn with the current state. fn must not keep the state or
+// change it.
+func (s *StateStore) View(fn func(state *State)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state, err := s.read(s.db)
+	if err != nil {
+		return err
+	}
+	fn(state)
+	return nil
+}
+
+// Update calls fn with the current state and saves the changes it makes
+// unless it returns an error.
+func (s *StateStore) Update(fn func(state *State) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	state, err := s.read(tx)
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO state (id, data) VALUES (1, ?)`, string(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Check runs SQLite's integrity check on the database and makes sure the
+// state in it can be read.
+func (s *StateStore) Check() error {
+	var result string
+	if err := s.db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s", result)
+	}
+	_, err := s.read(s.db)
+	return err
+}
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *StateStore) read(q querier) (*State, error) {
+	state := &State{}
+
+	var data string
+	err := q.QueryRow(`SELECT data FROM state WHERE id = 1`).Scan(&data)
+	if err == nil {
+		err = json.Unmarshal([]byte(data), state)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if state.UIDs == nil {
+		state.UIDs = make(map[string]MailboxState)
+	}
+	return state, nil
+}
@@ -0,0 +1,154 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stats counts what happened since the last digest was sent. They are
+// kept in the state so a restart doesn't lose them.
+type Stats struct {
+	Since       time.Time
+	Runs        int
+	Posts       int
+	Failures    int
+	Quarantined int
+}
+
+func (m *Mailpost) StateDir() string {
+	if m.config.StateDir != "" {
+		return m.config.StateDir
+	}
+	return wd
+}
+
+// RecordStats adds the outcome of the current run to the stats. It must
+// be called before the run's status is reset.
+func (m *Mailpost) RecordStats() {
+	if m.config.DigestTo == "" {
+		return
+	}
+
+	err := m.state.Update(func(state *State) error {
+		stats := &state.Stats
+		if stats.Since.IsZero() {
+			stats.Since = time.Now()
+		}
+		stats.Runs++
+		stats.Posts += m.written
+		for i, status := range m.status {
+			if status != MessageFailed {
+				continue
+			}
+			stats.Failures++
+			if i < len(m.workspaces) && m.workspaces[i] != "" {
+				stats.Quarantined++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't save stats: %s", err)
+	}
+}
+
+// SendDigest emails the stats to DigestTo once DigestInterval has passed
+// since the last digest, and starts counting again.
+func (m *Mailpost) SendDigest() {
+	if m.config.DigestTo == "" {
+		return
+	}
+
+	interval := m.config.DigestInterval.Or(7 * 24 * time.Hour)
+
+	var stats Stats
+	if err := m.state.View(func(state *State) { stats = state.Stats }); err != nil {
+		log.Printf("Couldn't read stats: %s", err)
+		return
+	}
+	if stats.Since.IsZero() || time.Since(stats.Since) < interval {
+		return
+	}
+
+	text := new(strings.Builder)
+	fmt.Fprintf(text, "mailpost summary for %s to %s\n\n",
+		stats.Since.Format("Jan 2, 2006"), time.Now().Format("Jan 2, 2006"))
+	fmt.Fprintf(text, "Runs:                %d\n", stats.Runs)
+	fmt.Fprintf(text, "Posts published:     %d\n", stats.Posts)
+	fmt.Fprintf(text, "Failed messages:     %d\n", stats.Failures)
+	fmt.Fprintf(text, "Quarantined (kept):  %d\n", stats.Quarantined)
+	fmt.Fprintf(text, "Workspaces on disk:  %d (%s)\n", m.countDir(m.WorkDir()), m.WorkDir())
+	fmt.Fprintf(text, "ImageDir disk usage: %s (%s)\n", formatBytes(m.diskUsage(m.ImageRoot())), m.ImageRoot())
+
+	var health map[string]IMAPHealth
+	m.state.View(func(state *State) { health = state.IMAPHealth })
+	for server, h := range health {
+		fmt.Fprintf(text, "\n%s since %s:\n  %s\n", server, h.Since.Format("Jan 2, 2006"), h.Summary())
+		for _, change := range h.CapChanges {
+			fmt.Fprintf(text, "  capabilities %s\n", change)
+		}
+	}
+
+	if m.SendMail(m.config.DigestTo, "mailpost summary", text.String(), nil) {
+		log.Printf("Sent digest to %s", m.config.DigestTo)
+		err := m.state.Update(func(state *State) error {
+			state.Stats = Stats{Since: time.Now()}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Couldn't reset stats: %s", err)
+		}
+	}
+}
+
+// ImageRoot returns the part of ImageDir before any placeholders.
+func (m *Mailpost) ImageRoot() string {
+	return TemplateRoot(m.config.ImageDir)
+}
+
+func (m *Mailpost) diskUsage(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func (m *Mailpost) countDir(dir string) int {
+	entries, _ := ioutil.ReadDir(dir)
+	return len(entries)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for i := n / unit; i >= unit; i /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,92 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// reSubjectDirective matches a directive in a subject, like [draft] or
+// [tags:travel,food].
+var reSubjectDirective = regexp.MustCompile(`\[\s*([A-Za-z][\w-]*)\s*(?::\s*([^\]]*?))?\s*\]`)
+
+// subjectFlags are the directives without a value, and the frontmatter
+// they stand for.
+var subjectFlags = map[string]yaml.MapItem{
+	"draft":   {Key: "draft", Value: true},
+	"urgent":  {Key: "urgent", Value: true},
+	"page":    {Key: "type", Value: "page"},
+	"publish": {Key: "publish", Value: true},
+}
+
+// subjectLists are the directives whose value is a comma separated list.
+var subjectLists = map[string]bool{"tags": true, "categories": true, "keywords": true, "series": true}
+
+// ParseSubject takes the directives out of a subject, so a post can be
+// controlled from a phone without writing frontmatter: [draft], [urgent]
+// and [page], and [key:value] for any frontmatter field, like
+// [type:photo], with a comma separated list for [tags:travel,food] and
+// the other taxonomies. It returns the subject without them, for the
+// title, and the frontmatter they make. Anything else in brackets, like
+// [blog], is left in the subject.
+func ParseSubject(subject string) (string, yaml.MapSlice) {
+	var fields yaml.MapSlice
+	title := reSubjectDirective.ReplaceAllStringFunc(subject, func(directive string) string {
+		match := reSubjectDirective.FindStringSubmatch(directive)
+		name := strings.ToLower(match[1])
+		if !strings.Contains(directive, ":") {
+			flag, ok := subjectFlags[name]
+			if !ok {
+				return directive
+			}
+			fields = append(fields, flag)
+			return ""
+		}
+
+		value := strings.TrimSpace(match[2])
+		if subjectLists[name] {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			fields = append(fields, yaml.MapItem{Key: name, Value: list})
+		} else {
+			fields = append(fields, yaml.MapItem{Key: name, Value: value})
+		}
+		return ""
+	})
+	return strings.Join(strings.Fields(title), " "), fields
+}
+
+// ApplySubject adds the frontmatter the subject's directives make to a
+// post, and the rest of the subject as its title. Frontmatter the post
+// has itself wins. Subjects without directives are left alone.
+func (m *Mailpost) ApplySubject(post string) string {
+	if m.msgHeader == nil {
+		return post
+	}
+	title, fields := ParseSubject(DecodeHeader(m.msgHeader.Get("Subject")))
+	if len(fields) == 0 {
+		return post
+	}
+	if title != "" {
+		fields = append(yaml.MapSlice{{Key: "title", Value: title}}, fields...)
+	}
+	return MergeFrontmatter(post, fields)
+}
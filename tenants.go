@@ -0,0 +1,420 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tenantDir is the directory under a tenant's Root that its state and
+// workspaces go in, unless its config puts them elsewhere under Root.
+const tenantDir = ".mailpost"
+
+// Tenant is one of the users a shared mailpost posts for. Each has a
+// config file of its own, like any mailpost config, but everything it
+// reads or writes has to be under Root, and it can't run commands.
+type Tenant struct {
+	Config         string
+	Root           string
+	MaxPostsPerDay int
+	MaxDiskUsage   Size
+
+	name string
+}
+
+// QuotaState counts a tenant's posts for MaxPostsPerDay.
+type QuotaState struct {
+	Day   string
+	Posts int
+}
+
+// LoadTenants reads the config of every tenant, in name order. A tenant
+// whose config is broken or reaches outside its Root is left out, so it
+// can't stop the others, and the reason is logged.
+func (m *Mailpost) LoadTenants() []*Mailpost {
+	var names []string
+	for name := range m.config.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tenants []*Mailpost
+	for _, name := range names {
+		t := m.config.Tenants[name]
+		t.name = name
+		if err := m.checkTenantRoot(t); err != nil {
+			log.Printf("Skipping tenant %s: %s", name, err)
+			continue
+		}
+		tm, err := LoadTenant(t)
+		if err != nil {
+			log.Printf("Skipping tenant %s: %s", name, err)
+			continue
+		}
+		tenants = append(tenants, tm)
+	}
+	return tenants
+}
+
+// Tenant returns the named tenant, for running a command like history for
+// it alone.
+func (m *Mailpost) Tenant(name string) (*Mailpost, error) {
+	t, ok := m.config.Tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("no tenant %q", name)
+	}
+	t.name = name
+	if err := m.checkTenantRoot(t); err != nil {
+		return nil, err
+	}
+	return LoadTenant(t)
+}
+
+// checkTenantRoot makes sure a tenant's Root exists and doesn't overlap
+// another tenant's.
+func (m *Mailpost) checkTenantRoot(t Tenant) error {
+	if t.Config == "" || t.Root == "" {
+		return fmt.Errorf("Config and Root must be set")
+	}
+	root, err := realPath(t.Root)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("Root %s isn't a directory", t.Root)
+	}
+	for name, other := range m.config.Tenants {
+		if name == t.name {
+			continue
+		}
+		otherRoot, err := realPath(other.Root)
+		if err != nil {
+			continue
+		}
+		if within(root, otherRoot) || within(otherRoot, root) {
+			return fmt.Errorf("Root overlaps the Root of tenant %s", name)
+		}
+	}
+	return nil
+}
+
+// LoadTenant reads a tenant's config and sets it up. Relative paths in it
+// are taken from Root. Anything in the config that can't be used is
+// returned as an error, never fatal, so the other tenants go on.
+func LoadTenant(t Tenant) (*Mailpost, error) {
+	root, err := realPath(t.Root)
+	if err != nil {
+		return nil, err
+	}
+	t.Root = root
+
+	tm := &Mailpost{tenant: &t}
+	if _, err := toml.DecodeFile(t.Config, &tm.config); err != nil {
+		return nil, fmt.Errorf("error opening config file: %s", err)
+	}
+	if err := tm.config.Validate(); err != nil {
+		return nil, fmt.Errorf("error in config file: %s", err)
+	}
+	tm.config.ApplySiteGenerator()
+	if err := tm.config.confine(root); err != nil {
+		return nil, err
+	}
+	if tm.config.Idle {
+		log.Printf("Tenant %s: Idle can't be used by tenants, checking every Interval instead", t.name)
+		tm.config.Idle = false
+	}
+	if err := tm.Configure(); err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// confine checks that a tenant's config only reads and writes under root
+// and runs no commands, and makes its relative paths relative to root.
+func (c *Config) confine(root string) error {
+	if len(c.Tenants) > 0 {
+		return fmt.Errorf("Tenants can't have tenants")
+	}
+	switch strings.ToLower(c.Source) {
+	case "smtp", "webhook":
+		return fmt.Errorf("Source %q listens on the network, which tenants can't do", c.Source)
+	case "", "imap", "gmail", "graph", "jmap", "maildir", "mbox", "nntp":
+	default:
+		// NewSource would stop every tenant over it
+		return fmt.Errorf("Unknown Source %q", c.Source)
+	}
+	if c.PasswordCommand != "" || len(c.TextExtractors) > 0 {
+		return fmt.Errorf("PasswordCommand and TextExtractors run commands, which tenants can't do")
+	}
+	// git runs the hooks and config of the repository, which the tenant
+	// controls, and would sign with the server's keys
+	if c.GitCommit || c.GitSigningKey != "" {
+		return fmt.Errorf("GitCommit and GitSigningKey run git, which tenants can't do")
+	}
+
+	if c.PostDir == "" || c.ImageDir == "" {
+		return fmt.Errorf("PostDir and ImageDir must be set")
+	}
+	if c.StateDir == "" {
+		c.StateDir = filepath.Join(tenantDir, "state")
+	}
+	if c.WorkDir == "" {
+		c.WorkDir = filepath.Join(tenantDir, "work")
+	}
+	// never the server's own keyring
+	if c.PGPHome == "" {
+		c.PGPHome = filepath.Join(tenantDir, "gnupg")
+	}
+	paths := map[string]*string{
+		"PostDir":            &c.PostDir,
+		"ImageDir":           &c.ImageDir,
+		"AttachmentDir":      &c.AttachmentDir,
+		"OriginalsDir":       &c.OriginalsDir,
+		"StateDir":           &c.StateDir,
+		"WorkDir":            &c.WorkDir,
+		"SourcePath":         &c.SourcePath,
+		"PGPHome":            &c.PGPHome,
+		"SMIMECAFile":        &c.SMIMECAFile,
+		"SMIMEKeyFile":       &c.SMIMEKeyFile,
+		"SMIMECertFile":      &c.SMIMECertFile,
+		"TLSCAFile":          &c.TLSCAFile,
+		"TLSCertFile":        &c.TLSCertFile,
+		"TLSKeyFile":         &c.TLSKeyFile,
+		"ActivityPubDir":     &c.ActivityPubDir,
+		"ActivityPubKeyFile": &c.ActivityPubKeyFile,
+		"SitemapFile":        &c.SitemapFile,
+		"FeedDir":            &c.FeedDir,
+		"PostTemplate":       &c.PostTemplate,
+	}
+	for name, value := range c.secrets() {
+		if *value == "" {
+			continue
+		}
+		if err := confineSecret(root, name, value); err != nil {
+			return err
+		}
+	}
+	for name, site := range c.Sites {
+		for setting, value := range map[string]*string{"PostDir": &site.PostDir, "ImageDir": &site.ImageDir, "AttachmentDir": &site.AttachmentDir, "OriginalsDir": &site.OriginalsDir, "SitemapFile": &site.SitemapFile, "FeedDir": &site.FeedDir} {
+			if err := confinePath(root, "Sites."+name+"."+setting, value); err != nil {
+				return err
+			}
+		}
+		c.Sites[name] = site
+	}
+	for addr, sender := range c.Senders {
+		for setting, value := range map[string]*string{"PostDir": &sender.PostDir, "ImageDir": &sender.ImageDir, "FrontmatterFile": &sender.FrontmatterFile} {
+			if err := confinePath(root, "Senders."+addr+"."+setting, value); err != nil {
+				return err
+			}
+		}
+		if sender.Secret != "" {
+			if err := confineSecret(root, "Senders."+addr+".Secret", &sender.Secret); err != nil {
+				return err
+			}
+		}
+		c.Senders[addr] = sender
+	}
+	for name, value := range paths {
+		if err := confinePath(root, name, value); err != nil {
+			return err
+		}
+	}
+	for name, postType := range c.Types {
+		for setting, value := range map[string]*string{"PostDir": &postType.PostDir, "ImageDir": &postType.ImageDir} {
+			if err := confinePath(root, "Types."+name+"."+setting, value); err != nil {
+				return err
+			}
+		}
+		c.Types[name] = postType
+	}
+	for postType, file := range c.PostTemplates {
+		if err := confinePath(root, "PostTemplates."+postType, &file); err != nil {
+			return err
+		}
+		c.PostTemplates[postType] = file
+	}
+	return nil
+}
+
+// confinePath makes a path setting absolute, from root if it's relative,
+// and checks that it is under root, symlinks and all.
+func confinePath(root, name string, value *string) error {
+	if *value == "" {
+		return nil
+	}
+	path := *value
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	real, err := realPath(TemplateRoot(path))
+	if err != nil || !within(root, real) {
+		return fmt.Errorf("%s %s is outside Root", name, *value)
+	}
+	*value = path
+	return nil
+}
+
+// confineSecret lets a tenant's secret be a value or a file under root,
+// but not an environment variable, command or keyring entry of the
+// machine mailpost runs on.
+func confineSecret(root, name string, value *string) error {
+	kind, ref := "", *value
+	if i := strings.Index(*value, ":"); i > 0 {
+		kind, ref = (*value)[:i], (*value)[i+1:]
+	}
+	switch kind {
+	case "file":
+		if err := confinePath(root, name, &ref); err != nil {
+			return err
+		}
+		*value = "file:" + ref
+	case "env", "cmd", "keyring":
+		return fmt.Errorf("%s can't be read from %s by a tenant", name, kind)
+	}
+	return nil
+}
+
+// realPath returns the absolute path with symlinks resolved as far as it
+// exists, so a path can't get out of a directory through a link.
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// within reports whether path is dir or under it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Confined reports whether a path mailpost is about to write is where it
+// may write, which for a tenant is under its Root.
+func (m *Mailpost) Confined(path string) bool {
+	if m.tenant == nil {
+		return true
+	}
+	real, err := realPath(path)
+	return err == nil && within(m.tenant.Root, real)
+}
+
+// OverQuota reports whether a tenant has used up MaxPostsPerDay or
+// MaxDiskUsage, and which, so no more mail is fetched for it until it
+// hasn't.
+func (m *Mailpost) OverQuota() (string, bool) {
+	if m.tenant == nil {
+		return "", false
+	}
+	if max := m.tenant.MaxPostsPerDay; max > 0 {
+		var quota QuotaState
+		m.state.View(func(state *State) { quota = state.Quota })
+		if quota.Day == time.Now().Format("2006-01-02") && quota.Posts >= max {
+			return fmt.Sprintf("%d posts today, MaxPostsPerDay is %d", quota.Posts, max), true
+		}
+	}
+	if max := m.tenant.MaxDiskUsage; max > 0 {
+		if used := m.diskUsage(m.tenant.Root); used >= int64(max) {
+			return fmt.Sprintf("%s used, MaxDiskUsage is %s", formatBytes(used), formatBytes(int64(max))), true
+		}
+	}
+	return "", false
+}
+
+// RecordQuota counts the posts written by the current run against a
+// tenant's MaxPostsPerDay.
+func (m *Mailpost) RecordQuota() {
+	if m.tenant == nil || m.tenant.MaxPostsPerDay <= 0 || m.written == 0 {
+		return
+	}
+	err := m.state.Update(func(state *State) error {
+		today := time.Now().Format("2006-01-02")
+		if state.Quota.Day != today {
+			state.Quota = QuotaState{Day: today}
+		}
+		state.Quota.Posts += m.written
+		return nil
+	})
+	if err != nil {
+		log.Printf("Couldn't save quota: %s", err)
+	}
+}
+
+// RunTenants checks the mail of every tenant in turn, once or every
+// Interval of the main config, with each tenant's log lines starting
+// with its name. It returns the exit code.
+func (m *Mailpost) RunTenants() int {
+	var tenants []*Mailpost
+	for _, tm := range m.LoadTenants() {
+		tm.source = tm.NewSource()
+		if !tm.config.SkipPreflight {
+			if problems := tm.Preflight(context.Background()); len(problems) > 0 {
+				log.Printf("Skipping tenant %s, preflight checks failed:", tm.tenant.name)
+				for _, problem := range problems {
+					log.Printf("  - %s", problem)
+				}
+				continue
+			}
+		}
+		tenants = append(tenants, tm)
+	}
+	if len(tenants) == 0 {
+		log.Printf("No tenants to check mail for")
+		return 1
+	}
+
+	for {
+		failed := false
+		for _, tm := range tenants {
+			log.SetPrefix("[" + tm.tenant.name + "] ")
+			err := tm.Retry("Mail check", func() error { return tm.Session(context.Background()) })
+			if err != nil {
+				failed = true
+			}
+		}
+		log.SetPrefix("")
+
+		if *once {
+			if failed {
+				return 1
+			}
+			return 0
+		}
+		t := m.config.CheckInterval()
+		log.Printf("Waiting for %v", t)
+		time.Sleep(t)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Where AttachmentText puts the text of attachments.
+const (
+	textInFrontmatter = "frontmatter"
+	textInSidecar     = "sidecar"
+)
+
+// maxAttachmentText is how much text of an attachment is kept, so a long
+// document doesn't make for a huge post.
+const maxAttachmentText = 64 << 10
+
+// officeParts are the parts of Office Open XML and OpenDocument files
+// that hold their text.
+var officeParts = []string{"word/document.xml", "ppt/slides/slide*.xml", "xl/sharedStrings.xml", "content.xml"}
+
+// checkAttachmentText checks the AttachmentText config value.
+func (c *Config) checkAttachmentText() error {
+	switch c.AttachmentText {
+	case "", textInFrontmatter, textInSidecar:
+		return nil
+	}
+	return fmt.Errorf("invalid AttachmentText %q: it must be %q or %q", c.AttachmentText, textInFrontmatter, textInSidecar)
+}
+
+// ExtractAttachmentText returns the text of an attachment, so the site's
+// search can find what is in it. Plain text is taken as it is and Word,
+// PowerPoint, Excel and OpenDocument files are read by mailpost itself.
+// Anything else, like PDFs, needs a command in TextExtractors for its
+// type, which is given the file on stdin and prints its text, e.g.
+// "pdftotext -q - -". It returns false if there's no way to get the text.
+func (m *Mailpost) ExtractAttachmentText(a Attachment) (string, bool) {
+	var text string
+	var err error
+	if command, ok := m.textExtractor(a.ContentType); ok {
+		text, err = runExtractor(command, a.Data)
+	} else if strings.HasPrefix(a.ContentType, "text/") {
+		text = string(a.Data)
+	} else if bytes.HasPrefix(a.Data, []byte("PK\x03\x04")) {
+		text, err = officeText(a.Data)
+	} else {
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Couldn't extract text from %s: %s", a.OrigName, err)
+		return "", false
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxAttachmentText {
+		text = text[:maxAttachmentText]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text, text != ""
+}
+
+// textExtractor returns the TextExtractors command for a content type.
+// The most specific pattern wins.
+func (m *Mailpost) textExtractor(contentType string) (string, bool) {
+	var patterns []string
+	for pattern := range m.config.TextExtractors {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool { return len(patterns[i]) > len(patterns[j]) })
+	for _, pattern := range patterns {
+		if m.TypeAllowed([]string{pattern}, contentType) {
+			return m.config.TextExtractors[pattern], true
+		}
+	}
+	return "", false
+}
+
+// runExtractor runs a TextExtractors command with data on stdin.
+func runExtractor(command string, data []byte) (string, error) {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.Command(shell, flag, command)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%q failed: %s %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// officeText returns the text of an Office Open XML or OpenDocument file.
+func officeText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		for _, pattern := range officeParts {
+			if ok, _ := path.Match(pattern, f.Name); ok {
+				names = append(names, f.Name)
+				files[f.Name] = f
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("not a document mailpost can read")
+	}
+	sort.Strings(names)
+
+	var text strings.Builder
+	for _, name := range names {
+		rc, err := files[name].Open()
+		if err != nil {
+			return "", err
+		}
+		err = xmlText(&text, io.LimitReader(rc, 32<<20))
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return text.String(), nil
+}
+
+// xmlText writes the character data of an XML document to w, with a
+// space after every paragraph so words don't run together.
+func xmlText(w *strings.Builder, r io.Reader) error {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			w.Write(tok)
+		case xml.EndElement:
+			switch tok.Name.Local {
+			case "p", "tab", "br", "si", "h":
+				w.WriteByte(' ')
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Outlook sometimes sends its attachments wrapped up in a single
+// application/ms-tnef part, winmail.dat. It is a signature followed by a
+// list of attributes, each one a level byte, an ID, a length, the data
+// and a checksum. The attributes of an attachment start with its
+// rendering information, then come its file name and contents.
+const (
+	tnefSignature = 0x223e9f78
+
+	tnefLevelAttachment = 0x02
+
+	tnefAttachRendData = 0x00069002
+	tnefAttachTitle    = 0x00018010
+	tnefAttachData     = 0x0006800f
+)
+
+// A tnefAttachment is a file found in a TNEF part.
+type tnefAttachment struct {
+	Name string
+	Data []byte
+}
+
+// decodeTNEF returns the attachments in a TNEF part.
+func decodeTNEF(data []byte) ([]tnefAttachment, error) {
+	r := bytes.NewReader(data)
+	var header struct {
+		Signature uint32
+		Key       uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil || header.Signature != tnefSignature {
+		return nil, fmt.Errorf("not a TNEF part")
+	}
+
+	var attachments []tnefAttachment
+	for r.Len() > 0 {
+		var attr struct {
+			Level  uint8
+			ID     uint32
+			Length uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &attr); err != nil {
+			return attachments, fmt.Errorf("truncated attribute: %s", err)
+		}
+		if int64(attr.Length) > int64(r.Len()) {
+			return attachments, fmt.Errorf("attribute %#x is longer than the part", attr.ID)
+		}
+		value := make([]byte, attr.Length)
+		io.ReadFull(r, value)
+		var checksum uint16
+		binary.Read(r, binary.LittleEndian, &checksum)
+
+		if attr.Level != tnefLevelAttachment {
+			continue
+		}
+		switch attr.ID {
+		case tnefAttachRendData:
+			attachments = append(attachments, tnefAttachment{})
+		case tnefAttachTitle:
+			if len(attachments) > 0 {
+				attachments[len(attachments)-1].Name = strings.TrimRight(string(value), "\x00")
+			}
+		case tnefAttachData:
+			if len(attachments) > 0 {
+				attachments[len(attachments)-1].Data = value
+			}
+		}
+	}
+	return attachments, nil
+}
+
+// HasTNEF reports whether a part is an Outlook winmail.dat.
+func (m *Mailpost) HasTNEF(contentType string) bool {
+	return contentType == "application/ms-tnef" || contentType == "application/vnd.ms-tnef"
+}
+
+// ExtractTNEF extracts the images in a winmail.dat as if they had been
+// attached to the message on their own. Outlook doesn't say what type its
+// attachments are, so that is worked out from their contents.
+func (m *Mailpost) ExtractTNEF(r io.Reader) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Printf("Error reading winmail.dat: %s", err)
+		return
+	}
+	attachments, err := decodeTNEF(data)
+	if err != nil {
+		log.Printf("Error decoding winmail.dat: %s", err)
+	}
+	for _, a := range attachments {
+		contentType := http.DetectContentType(a.Data)
+		if a.Name == "" || !m.HasImage(contentType) {
+			continue
+		}
+		log.Printf("|-- Found %s in winmail.dat", a.Name)
+		m.AddAttachedImage(len(m.status)-1, Image{OrigName: a.Name, ContentType: contentType, Data: a.Data})
+	}
+}
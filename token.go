@@ -0,0 +1,66 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"regexp"
+	"strings"
+)
+
+// tokenHeader is the header a PostToken can be sent in.
+const tokenHeader = "X-Mailpost-Token"
+
+// reTokenLine matches a line of a post that gives the PostToken.
+var reTokenLine = regexp.MustCompile(`(?im)^[ \t]*token:[ \t]*(\S+)[ \t]*(\r?\n|$)`)
+
+// tokenMatches compares a token with PostToken in constant time.
+func (c *Config) tokenMatches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.PostToken)) == 1
+}
+
+// SplitAddressToken takes the PostToken out of the tag of a posting
+// address, so blog+s3cr3t@example.com and blog+photos+s3cr3t@example.com
+// both carry it, and returns what is left of the tag and whether the token
+// was there.
+func (c *Config) SplitAddressToken(tag string) (string, bool) {
+	if c.PostToken == "" || tag == "" {
+		return tag, false
+	}
+	var rest []string
+	found := false
+	for _, part := range strings.Split(tag, "+") {
+		if !found && c.tokenMatches(part) {
+			found = true
+			continue
+		}
+		rest = append(rest, part)
+	}
+	return strings.Join(rest, "+"), found
+}
+
+// StripToken removes the lines giving the PostToken, "token: s3cr3t", from
+// a post and reports whether there were any, so the token never ends up
+// on the site.
+func (m *Mailpost) StripToken(post string) (string, bool) {
+	found := false
+	post = reTokenLine.ReplaceAllStringFunc(post, func(line string) string {
+		if m.config.tokenMatches(reTokenLine.FindStringSubmatch(line)[1]) {
+			found = true
+			return ""
+		}
+		return line
+	})
+	return post, found
+}
@@ -0,0 +1,42 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// DecodeTransfer returns a reader for the content of a part sent with the
+// given Content-Transfer-Encoding. 7bit, 8bit and binary content, and
+// content without an encoding, is read as it is, as is content in an
+// encoding that isn't known, after logging it.
+//
+// The parts of a multipart.Reader come with quoted-printable already
+// decoded and the header removed, so for them this only decodes base64.
+func DecodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "", "7bit", "8bit", "binary":
+		return r
+	}
+	log.Printf("Unknown Content-Transfer-Encoding %q, reading the part as it is", encoding)
+	return r
+}
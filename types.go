@@ -0,0 +1,65 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "strings"
+
+// PostType holds the settings for posts of one type, configured in a
+// [Types.photo] table of the config file. Settings left out are the same
+// as for the site.
+type PostType struct {
+	PostDir          string
+	ImageDir         string
+	ImagePath        string
+	FilenameTemplate string
+	MaxImgWidth      uint
+	// defaults for the frontmatter of posts of the type, which win over
+	// the config's Frontmatter
+	Frontmatter map[string]interface{}
+}
+
+// PostType returns the settings for posts of a type.
+func (c *Config) PostType(name string) (PostType, bool) {
+	for key, postType := range c.Types {
+		if strings.EqualFold(key, strings.TrimSpace(name)) {
+			return postType, true
+		}
+	}
+	return PostType{}, false
+}
+
+// forType returns c with the settings of the type in place of its own.
+func (c *Config) forType(name string) *Config {
+	postType, ok := c.PostType(name)
+	if !ok {
+		return c
+	}
+	tc := *c
+	for _, s := range []struct {
+		value   string
+		setting *string
+	}{
+		{postType.PostDir, &tc.PostDir},
+		{postType.ImageDir, &tc.ImageDir},
+		{postType.ImagePath, &tc.ImagePath},
+	} {
+		if s.value != "" {
+			*s.setting = s.value
+		}
+	}
+	if postType.MaxImgWidth != 0 {
+		tc.MaxImgWidth = postType.MaxImgWidth
+	}
+	return &tc
+}
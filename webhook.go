@@ -0,0 +1,407 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how far a signed webhook's timestamp may be from now
+const webhookMaxSkew = 15 * time.Minute
+
+// WebhookSource runs an HTTP server that takes the inbound mail webhooks
+// of Mailgun (/mailgun), SendGrid's Inbound Parse (/sendgrid) and Postmark
+// (/postmark). Each endpoint only works once the means of checking its
+// requests is configured. Messages are queued as they are received and
+// picked up by the next Fetch.
+type WebhookSource struct {
+	config *Config
+	server *http.Server
+	queue  *MessageQueue
+}
+
+func (s *WebhookSource) Connect(ctx context.Context) error {
+	if s.server != nil {
+		return nil
+	}
+	s.queue = NewMessageQueue()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mailgun", s.mailgun)
+	mux.HandleFunc("/sendgrid", s.sendgrid)
+	mux.HandleFunc("/postmark", s.postmark)
+
+	s.server = &http.Server{
+		Addr:         s.config.WebhookListen,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Minute,
+		WriteTimeout: time.Minute,
+	}
+	if s.server.Addr == "" {
+		s.server.Addr = ":8080"
+	}
+
+	server := s.server
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		s.server = nil
+		return fmt.Errorf("couldn't listen for webhooks: %s", err)
+	}
+	log.Printf("Listening for webhooks on %s..\n", server.Addr)
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Fatalf("Webhook listener failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *WebhookSource) Fetch(ctx context.Context, process func(body []byte)) error {
+	s.queue.Drain(process)
+	return nil
+}
+
+// Idle waits for the next message to be delivered, or until.
+func (s *WebhookSource) Idle(until time.Time) bool {
+	s.queue.Wait(until)
+	return true
+}
+
+// MarkProcessed has nothing to do, delivered mail only exists in memory
+// until it has been processed.
+func (s *WebhookSource) MarkProcessed(ctx context.Context, status []MessageStatus) error { return nil }
+
+// Close keeps the server running between checks, so mail can still be
+// accepted while mailpost waits.
+func (s *WebhookSource) Close() {}
+
+// accept queues a message and answers the webhook. Providers retry when
+// they get an error, so a full queue is reported as one.
+func (s *WebhookSource) accept(w http.ResponseWriter, provider string, body []byte, err error) {
+	if err != nil {
+		log.Printf("Bad %s webhook: %s", provider, err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.queue.Push(body) {
+		http.Error(w, "Too many messages waiting, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// readBody reads a webhook request, refusing anything but a POST.
+func (s *WebhookSource) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, smtpMaxMessageBytes))
+	if err != nil {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (s *WebhookSource) mailgun(w http.ResponseWriter, r *http.Request) {
+	if s.config.MailgunSigningKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := s.readBody(w, r); !ok {
+		return
+	}
+	if err := r.ParseMultipartForm(smtpMaxMessageBytes); err != nil && err != http.ErrNotMultipart {
+		s.accept(w, "Mailgun", nil, err)
+		return
+	}
+
+	// the signature is the HMAC of the timestamp and token
+	timestamp := r.FormValue("timestamp")
+	mac := hmac.New(sha256.New, []byte(s.config.MailgunSigningKey))
+	mac.Write([]byte(timestamp + r.FormValue("token")))
+	signature, _ := hex.DecodeString(r.FormValue("signature"))
+	if !hmac.Equal(signature, mac.Sum(nil)) || !recent(timestamp) {
+		log.Printf("Rejected Mailgun webhook with a bad signature from %s", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// routes to a URL ending in "mime" get the raw message
+	if raw := r.FormValue("body-mime"); raw != "" {
+		s.accept(w, "Mailgun", []byte(raw), nil)
+		return
+	}
+
+	var header [][2]string
+	var headers [][]string
+	json.Unmarshal([]byte(r.FormValue("message-headers")), &headers)
+	for _, h := range headers {
+		if len(h) == 2 {
+			header = append(header, [2]string{h[0], h[1]})
+		}
+	}
+	body, err := buildMessage(header, r.FormValue("body-plain"), formFiles(r))
+	s.accept(w, "Mailgun", body, err)
+}
+
+func (s *WebhookSource) sendgrid(w http.ResponseWriter, r *http.Request) {
+	if s.config.SendGridVerificationKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	payload, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// the signature is an ECDSA signature of the timestamp and the body
+	timestamp := r.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp")
+	signature, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Email-Event-Webhook-Signature"))
+	der, _ := base64.StdEncoding.DecodeString(s.config.SendGridVerificationKey)
+	key, err := x509.ParsePKIXPublicKey(der)
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if err != nil || !ok {
+		log.Printf("Invalid SendGridVerificationKey: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), payload...))
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) || !recent(timestamp) {
+		log.Printf("Rejected SendGrid webhook with a bad signature from %s", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseMultipartForm(smtpMaxMessageBytes); err != nil {
+		s.accept(w, "SendGrid", nil, err)
+		return
+	}
+
+	// with "POST the raw, full MIME message" the message is all there
+	if raw := r.FormValue("email"); raw != "" {
+		s.accept(w, "SendGrid", []byte(raw), nil)
+		return
+	}
+
+	var header [][2]string
+	parsed, err := textproto.NewReader(bufio.NewReader(strings.NewReader(r.FormValue("headers") + "\r\n"))).ReadMIMEHeader()
+	if err != nil && len(parsed) == 0 {
+		s.accept(w, "SendGrid", nil, fmt.Errorf("couldn't read headers: %s", err))
+		return
+	}
+	for name, values := range parsed {
+		for _, value := range values {
+			header = append(header, [2]string{name, value})
+		}
+	}
+	body, err := buildMessage(header, r.FormValue("text"), formFiles(r))
+	s.accept(w, "SendGrid", body, err)
+}
+
+func (s *WebhookSource) postmark(w http.ResponseWriter, r *http.Request) {
+	if s.config.WebhookUser == "" {
+		http.NotFound(w, r)
+		return
+	}
+	// Postmark doesn't sign its webhooks, it logs in with the
+	// credentials in the webhook URL instead
+	user, pass, _ := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.WebhookUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.WebhookPassword)) == 1
+	if !userOK || !passOK {
+		log.Printf("Rejected Postmark webhook with bad credentials from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="mailpost"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payload, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var msg struct {
+		From        string
+		To          string
+		Subject     string
+		Date        string
+		MessageID   string
+		TextBody    string
+		RawEmail    string
+		Headers     []struct{ Name, Value string }
+		Attachments []struct{ Name, Content, ContentType string }
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		s.accept(w, "Postmark", nil, err)
+		return
+	}
+
+	// with "Include raw email content" the message is all there
+	if msg.RawEmail != "" {
+		s.accept(w, "Postmark", []byte(msg.RawEmail), nil)
+		return
+	}
+
+	header := [][2]string{
+		{"From", msg.From},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", msg.Date},
+		{"Message-Id", "<" + msg.MessageID + ">"},
+	}
+	for _, h := range msg.Headers {
+		header = append(header, [2]string{h.Name, h.Value})
+	}
+
+	var files []webhookFile
+	for _, a := range msg.Attachments {
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			s.accept(w, "Postmark", nil, fmt.Errorf("couldn't decode %s: %s", a.Name, err))
+			return
+		}
+		files = append(files, webhookFile{a.Name, a.ContentType, data})
+	}
+	body, err := buildMessage(header, msg.TextBody, files)
+	s.accept(w, "Postmark", body, err)
+}
+
+// recent reports whether a Unix timestamp is close enough to now to
+// accept, so old webhooks can't be replayed.
+func recent(timestamp string) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	return skew < webhookMaxSkew && skew > -webhookMaxSkew
+}
+
+type webhookFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// formFiles returns the files uploaded with a webhook, in the order the
+// provider numbered them.
+func formFiles(r *http.Request) []webhookFile {
+	if r.MultipartForm == nil {
+		return nil
+	}
+
+	var files []webhookFile
+	for i := 1; ; i++ {
+		var headers []*multipart.FileHeader
+		for _, field := range []string{"attachment-" + strconv.Itoa(i), "attachment" + strconv.Itoa(i)} {
+			headers = append(headers, r.MultipartForm.File[field]...)
+		}
+		if len(headers) == 0 {
+			return files
+		}
+		for _, fh := range headers {
+			f, err := fh.Open()
+			if err != nil {
+				continue
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err == nil {
+				files = append(files, webhookFile{fh.Filename, fh.Header.Get("Content-Type"), data})
+			}
+		}
+	}
+}
+
+// buildMessage puts a message the provider has taken apart back together
+// as a multipart message the pipeline can read.
+func buildMessage(header [][2]string, text string, files []webhookFile) ([]byte, error) {
+	msg := new(bytes.Buffer)
+	parts := multipart.NewWriter(msg)
+
+	for _, h := range header {
+		switch strings.ToLower(h[0]) {
+		// these describe the original body, not the one we're building
+		case "content-type", "content-transfer-encoding", "mime-version":
+			continue
+		}
+		if h[1] != "" && h[1] != "<>" {
+			fmt.Fprintf(msg, "%s: %s\r\n", h[0], h[1])
+		}
+	}
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+
+	part, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(text))
+	qp.Close()
+
+	for _, f := range files {
+		contentType := f.contentType
+		if contentType == "" || contentType == "application/octet-stream" {
+			contentType = http.DetectContentType(f.data)
+		}
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": f.name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(f.data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
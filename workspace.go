@@ -0,0 +1,93 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every message gets its own workspace directory under WorkDir holding the
+// raw message and everything extracted or downloaded for it. Workspaces
+// are removed once the message has been handled and kept when it failed,
+// so the failure can be looked into afterwards.
+
+func (m *Mailpost) WorkDir() string {
+	if m.config.WorkDir != "" {
+		return m.config.WorkDir
+	}
+	return filepath.Join(os.TempDir(), "mailpost")
+}
+
+// NewWorkspace creates the workspace for the message being processed and
+// saves the raw message in it. The directory name combines the current
+// time in nanoseconds with the Message-ID, so it is unique even when the
+// same message is processed twice.
+func (m *Mailpost) NewWorkspace(msgNum int, messageID string, body []byte) {
+	id := m.SanitizeFilename(messageID)
+	if len(id) > 64 {
+		id = id[:64]
+	}
+	dir := filepath.Join(m.WorkDir(), fmt.Sprintf("%d-%s", time.Now().UnixNano(), id))
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Couldn't create workspace: %s", err)
+		return
+	}
+	for len(m.workspaces) <= msgNum {
+		m.workspaces = append(m.workspaces, "")
+	}
+	m.workspaces[msgNum] = dir
+
+	log.Printf("|-- Workspace: %v", dir)
+	m.SaveArtifact(msgNum, "message.eml", body)
+}
+
+// SaveArtifact writes an intermediate file to a message's workspace.
+func (m *Mailpost) SaveArtifact(msgNum int, name string, data []byte) {
+	if msgNum < 0 || msgNum >= len(m.workspaces) || m.workspaces[msgNum] == "" {
+		return
+	}
+
+	path := filepath.Join(m.workspaces[msgNum], filepath.Clean("/" + name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Couldn't save %s to workspace: %s", name, err)
+		return
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		log.Printf("Couldn't save %s to workspace: %s", name, err)
+	}
+}
+
+// CleanWorkspaces removes the workspaces of messages that didn't fail and
+// logs where the others were left.
+func (m *Mailpost) CleanWorkspaces() {
+	for i, dir := range m.workspaces {
+		if dir == "" {
+			continue
+		}
+		if i < len(m.status) && m.status[i] == MessageFailed {
+			log.Printf("Message failed, workspace kept at %s", dir)
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Couldn't remove workspace %s: %s", dir, err)
+		}
+	}
+	m.workspaces = nil
+}
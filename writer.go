@@ -0,0 +1,95 @@
+// Copyright © 2015 Del Putnam <del@putnams.net>.
+//
+// Licensed under the Simple Public License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://opensource.org/licenses/Simple-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// postResult is what became of writing one post.
+type postResult struct {
+	path    string
+	changed bool
+	err     error
+	log     bytes.Buffer
+}
+
+// WritePosts writes the posts of a run, up to WriteWorkers (4 by default)
+// at a time. Posts going to the same file are written one after another
+// by the same worker, in order. Each post's log lines are held back and
+// the results are handled in the order of the posts, so the log, the
+// history and the counts come out the same as when writing one by one.
+func (m *Mailpost) WritePosts() {
+	workers := m.config.WriteWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	var files []string
+	byFile := make(map[string][]int)
+	for i, postInfo := range m.posts {
+		file := filepath.Join(postInfo.Path, postInfo.File)
+		if _, ok := byFile[file]; !ok {
+			files = append(files, file)
+		}
+		byFile[file] = append(byFile[file], i)
+	}
+
+	results := make([]postResult, len(m.posts))
+	jobs := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for posts := range jobs {
+				for _, i := range posts {
+					result := &results[i]
+					logger := log.New(&result.log, log.Prefix(), log.Flags())
+					m.files.Acquire()
+					result.path, result.changed, result.err = m.WritePostToFile(m.posts[i], logger)
+					m.files.Release()
+				}
+			}
+		}()
+	}
+	for _, file := range files {
+		jobs <- byFile[file]
+	}
+	close(jobs)
+	wg.Wait()
+
+	var changed []Post
+	for i, postInfo := range m.posts {
+		result := &results[i]
+		log.Writer().Write(result.log.Bytes())
+		if result.err != nil {
+			m.Fail(postInfo, "%s", result.err)
+			continue
+		}
+		if result.changed {
+			m.written++
+			changed = append(changed, postInfo)
+		}
+		if postInfo.Msg < len(m.history) {
+			m.history[postInfo.Msg].Posts = append(m.history[postInfo.Msg].Posts, result.path)
+		}
+	}
+	m.Federate(changed)
+	m.UpdateSitemaps(changed)
+	m.CommitPosts(changed)
+}